@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+type amplificationCounts struct {
+	host           string
+	anyQueries     int
+	largeEdns      int
+	largeResponses int
+	responseBytes  int
+}
+
+// AmplificationProcessor flags the queries and responses that are typical of
+// reflection abuse: qtype ANY, a large EDNS buffer size or a large response. The
+// flagged messages are counted per source and written every interval, so open
+// forwarders that are being used for amplification stand out.
+type AmplificationProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	maxEdnsSize uint16
+	maxResponse int
+	interval    time.Duration
+	mutex       sync.Mutex
+	counts      map[string]*amplificationCounts
+}
+
+func NewAmplificationProcessor(writeApi *api.WriteApi, measurement string, maxEdnsSize uint16, maxResponse int, interval time.Duration, bufferSize uint) *AmplificationProcessor {
+	return &AmplificationProcessor{
+		baseProcessor: newBaseProcessor("amplification", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		maxEdnsSize:   maxEdnsSize,
+		maxResponse:   maxResponse,
+		interval:      interval,
+		counts:        make(map[string]*amplificationCounts),
+	}
+}
+
+func (proc *AmplificationProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *AmplificationProcessor) run() {
+	proc.consume(proc.check)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *AmplificationProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *AmplificationProcessor) check(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	anyQuery, largeEdns, largeResponse := false, false, false
+	responseBytes := 0
+	switch *message.dnstapMessage.Type {
+	case dnstap.Message_CLIENT_QUERY:
+		anyQuery = len(message.dnsMessage.Question) > 0 && message.dnsMessage.Question[0].Qtype == dns.TypeANY
+		if opt := message.dnsMessage.IsEdns0(); opt != nil {
+			largeEdns = opt.UDPSize() > proc.maxEdnsSize
+		}
+	case dnstap.Message_CLIENT_RESPONSE:
+		responseBytes = len(message.dnstapMessage.ResponseMessage)
+		largeResponse = responseBytes > proc.maxResponse
+	}
+	if !anyQuery && !largeEdns && !largeResponse {
+		return
+	}
+
+	client := net.IP(message.dnstapMessage.QueryAddress).String()
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	counts := proc.counts[client]
+	if counts == nil {
+		counts = &amplificationCounts{}
+		proc.counts[client] = counts
+	}
+	if len(message.host) > 0 {
+		counts.host = message.host
+	}
+	if anyQuery {
+		counts.anyQueries++
+	}
+	if largeEdns {
+		counts.largeEdns++
+	}
+	if largeResponse {
+		counts.largeResponses++
+		counts.responseBytes += responseBytes
+	}
+}
+
+// Flush writes the flagged counts of every source since the last flush.
+func (proc *AmplificationProcessor) Flush() {
+	proc.mutex.Lock()
+	counts := proc.counts
+	proc.counts = make(map[string]*amplificationCounts)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for client, clientCounts := range counts {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("qaddress", client).
+			AddField("any_queries", clientCounts.anyQueries).
+			AddField("large_edns", clientCounts.largeEdns).
+			AddField("large_responses", clientCounts.largeResponses).
+			AddField("large_response_bytes", clientCounts.responseBytes).
+			SetTime(now)
+		if len(clientCounts.host) > 0 {
+			point.AddTag("qhost", clientCounts.host)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// annotations records the operational events that explain changes in traffic. It is
+// nil when annotations are disabled.
+var annotations *Annotator
+
+type annotation struct {
+	time  time.Time
+	event string
+	text  string
+}
+
+// Annotator writes operational events, such as list updates, config reloads and
+// enforcer reconnects, as points to a measurement and optionally to the Grafana
+// annotations API, so dashboards can show them on their graphs. Grafana is called by a
+// single goroutine and events are dropped when it falls behind.
+type Annotator struct {
+	writeApi     *api.WriteApi
+	measurement  string
+	grafanaUrl   string
+	grafanaToken string
+	client       *http.Client
+	queue        chan annotation
+}
+
+func NewAnnotator(writeApi *api.WriteApi, measurement, grafanaUrl, grafanaToken string) *Annotator {
+	annotator := &Annotator{
+		writeApi:     writeApi,
+		measurement:  measurement,
+		grafanaUrl:   strings.TrimSuffix(grafanaUrl, "/"),
+		grafanaToken: grafanaToken,
+	}
+	if len(grafanaUrl) > 0 {
+		annotator.client = &http.Client{Timeout: 10 * time.Second}
+		annotator.queue = make(chan annotation, 100)
+		go annotator.run()
+	}
+	return annotator
+}
+
+// Annotate records an event. It is safe to call on a nil annotator, which does
+// nothing.
+func (annotator *Annotator) Annotate(event, format string, args ...interface{}) {
+	if annotator == nil {
+		return
+	}
+	note := annotation{time: time.Now(), event: event, text: fmt.Sprintf(format, args...)}
+	point := influxdb2.NewPointWithMeasurement(annotator.measurement).
+		AddTag("event", note.event).
+		AddField("text", note.text).
+		SetTime(note.time)
+	(*annotator.writeApi).WritePoint(point)
+
+	if annotator.queue != nil {
+		select {
+		case annotator.queue <- note:
+		default:
+		}
+	}
+}
+
+func (annotator *Annotator) run() {
+	for note := range annotator.queue {
+		if err := annotator.sendGrafana(note); err != nil && errorLog.Allow("grafana annotations") {
+			log.WithError(err).Errorf("Failed to annotate %s", annotator.grafanaUrl)
+		}
+	}
+}
+
+func (annotator *Annotator) sendGrafana(note annotation) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"time": note.time.UnixNano() / int64(time.Millisecond),
+		"tags": []string{"dnstap", note.event},
+		"text": note.text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, annotator.grafanaUrl+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(annotator.grafanaToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+annotator.grafanaToken)
+	}
+	resp, err := annotator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"net"
+	"sync"
+	"time"
+)
+
+type AnonymizeMode int
+
+const (
+	AnonymizeTruncate AnonymizeMode = iota
+	AnonymizeHash
+	AnonymizeDrop
+)
+
+func ParseAnonymizeMode(mode string) (AnonymizeMode, error) {
+	switch mode {
+	case "truncate":
+		return AnonymizeTruncate, nil
+	case "hash":
+		return AnonymizeHash, nil
+	case "drop":
+		return AnonymizeDrop, nil
+	default:
+		return 0, fmt.Errorf("invalid anonymize mode \"%s\"", mode)
+	}
+}
+
+// Anonymizer replaces the client addresses of messages before they are enriched or
+// written. Truncate keeps the /24 or /64 network, hash replaces the address with an
+// HMAC of it under a random key that is replaced every rotation, so that clients can
+// only be followed within a rotation, and drop removes the address and port.
+type Anonymizer struct {
+	mode     AnonymizeMode
+	rotation time.Duration
+	mutex    sync.Mutex
+	key      []byte
+	rotated  time.Time
+}
+
+func NewAnonymizer(mode AnonymizeMode, rotation time.Duration) *Anonymizer {
+	return &Anonymizer{mode: mode, rotation: rotation}
+}
+
+// Anonymize replaces the client address of client and auth server messages, where
+// the query address is the client.
+func (anon *Anonymizer) Anonymize(message *Message) {
+	switch *message.dnstapMessage.Type {
+	case dnstap.Message_CLIENT_QUERY,
+		dnstap.Message_CLIENT_RESPONSE,
+		dnstap.Message_AUTH_QUERY,
+		dnstap.Message_AUTH_RESPONSE:
+	default:
+		return
+	}
+	address := message.dnstapMessage.QueryAddress
+	if address == nil {
+		return
+	}
+
+	switch anon.mode {
+	case AnonymizeTruncate:
+		ip := net.IP(address)
+		if ip4 := ip.To4(); ip4 != nil {
+			message.dnstapMessage.QueryAddress = ip4.Mask(net.CIDRMask(24, 32))
+		} else {
+			message.dnstapMessage.QueryAddress = ip.Mask(net.CIDRMask(64, 128))
+		}
+	case AnonymizeHash:
+		mac := hmac.New(sha256.New, anon.currentKey())
+		_, _ = mac.Write(address)
+		message.dnstapMessage.QueryAddress = mac.Sum(nil)[:len(address)]
+	case AnonymizeDrop:
+		message.dnstapMessage.QueryAddress = nil
+		message.dnstapMessage.QueryPort = nil
+	}
+}
+
+func (anon *Anonymizer) currentKey() []byte {
+	anon.mutex.Lock()
+	defer anon.mutex.Unlock()
+	if anon.key == nil || (anon.rotation > 0 && time.Since(anon.rotated) > anon.rotation) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		anon.key = key
+		anon.rotated = time.Now()
+	}
+	return anon.key
+}
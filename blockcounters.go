@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"sync"
+	"time"
+)
+
+// blockingList returns the list that blocked a client response, or an empty string
+// if it wasn't blocked. A policy in the dnstap message is exact; otherwise a response
+// that looks blocked is attributed to the list blockedList finds for its name, as for
+// the block_list tag of the query points.
+func blockingList(message *Message, blockedList func(qname string) string) string {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		*message.dnstapMessage.Type != dnstap.Message_CLIENT_RESPONSE {
+		return ""
+	}
+	if policy := parsePolicy(message.dnstapMessage); policy != nil {
+		if !policy.blocks() {
+			return ""
+		}
+		if len(policy.rule) > 0 {
+			return policy.rule
+		}
+		return "policy"
+	}
+	if blockedList != nil && looksBlocked(message.dnsMessage) {
+		return blockedList(message.dnsMessage.Question[0].Name)
+	}
+	return ""
+}
+
+type blockedCounterKey struct {
+	list     string
+	category string
+}
+
+// BlockedCountersProcessor counts the blocked client responses by list and category
+// and writes the counts every interval, so blocked totals don't have to be counted
+// from the query points.
+type BlockedCountersProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	interval    time.Duration
+	categories  map[string]string
+	blockedList func(qname string) string
+	mutex       sync.Mutex
+	counts      map[blockedCounterKey]int
+}
+
+func NewBlockedCountersProcessor(writeApi *api.WriteApi, measurement string, categories map[string]string, blockedList func(qname string) string, interval time.Duration, bufferSize uint) *BlockedCountersProcessor {
+	return &BlockedCountersProcessor{
+		baseProcessor: newBaseProcessor("blocked_counters", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		interval:      interval,
+		categories:    categories,
+		blockedList:   blockedList,
+		counts:        make(map[blockedCounterKey]int),
+	}
+}
+
+func (proc *BlockedCountersProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *BlockedCountersProcessor) run() {
+	proc.consume(proc.count)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *BlockedCountersProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *BlockedCountersProcessor) count(message *Message) {
+	if message.duplicate {
+		return
+	}
+	list := blockingList(message, proc.blockedList)
+	if len(list) == 0 {
+		return
+	}
+	key := blockedCounterKey{list: list}
+	if proc.categories != nil {
+		key.category = category(proc.categories, message.dnsMessage.Question[0].Name)
+	}
+	proc.mutex.Lock()
+	proc.counts[key]++
+	proc.mutex.Unlock()
+}
+
+// Flush writes the counts since the last flush.
+func (proc *BlockedCountersProcessor) Flush() {
+	proc.mutex.Lock()
+	counts := proc.counts
+	proc.counts = make(map[blockedCounterKey]int)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for key, count := range counts {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("block_list", key.list).
+			AddField("blocked", count).
+			SetTime(now)
+		if len(key.category) > 0 {
+			point.AddTag("category", key.category)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
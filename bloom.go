@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var bloomMagic = [4]byte{'D', 'T', 'B', 'F'}
+
+// BloomFilter is a fixed size set that may report false positives but never false
+// negatives. The k bit positions of a key are derived from two FNV hashes.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// NewBloomFilter sizes a filter for capacity keys at the given false positive rate.
+func NewBloomFilter(capacity uint, falsePositiveRate float64) *BloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (filter *BloomFilter) hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	h1 := h.Sum64()
+	h = fnv.New64()
+	_, _ = h.Write([]byte(key))
+	return h1, h.Sum64() | 1
+}
+
+// Add adds key and reports whether it was already (probably) in the set.
+func (filter *BloomFilter) Add(key string) bool {
+	h1, h2 := filter.hashes(key)
+	present := true
+	for i := uint64(0); i < filter.k; i++ {
+		bit := (h1 + i*h2) % filter.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if filter.bits[word]&mask == 0 {
+			present = false
+			filter.bits[word] |= mask
+		}
+	}
+	return present
+}
+
+// Save writes the filter, along with header, to path atomically.
+func (filter *BloomFilter) Save(path string, header uint64) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = binary.Write(writer, binary.LittleEndian, bloomMagic)
+	for _, value := range []uint64{filter.m, filter.k, header} {
+		if err == nil {
+			err = binary.Write(writer, binary.LittleEndian, value)
+		}
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.LittleEndian, filter.bits)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Clean(path))
+}
+
+// LoadBloomFilter reads a filter written by Save, returning it with its header.
+func LoadBloomFilter(path string) (*BloomFilter, uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var magic [4]byte
+	var m, k, header uint64
+	for _, value := range []interface{}{&magic, &m, &k, &header} {
+		if err := binary.Read(reader, binary.LittleEndian, value); err != nil {
+			return nil, 0, err
+		}
+	}
+	if magic != bloomMagic || m == 0 || k == 0 {
+		return nil, 0, errors.New("not a bloom filter file")
+	}
+	filter := &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+	if err := binary.Read(reader, binary.LittleEndian, filter.bits); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return filter, header, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/domain"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errWriteDenied is returned by CheckWrite when InfluxDB rejects the token or bucket.
+var errWriteDenied = errors.New("write denied")
+
+// EnsureBucket creates the bucket in the org if it doesn't exist yet. The data in a
+// new bucket expires after retention, or never if retention is 0. The retention of an
+// existing bucket is left alone.
+func (influx *InfluxProcessor) EnsureBucket(ctx context.Context, retention time.Duration) error {
+	buckets := influx.client.BucketsApi()
+	if bucket, err := buckets.FindBucketByName(ctx, influx.bucket); err == nil && bucket != nil {
+		return nil
+	}
+
+	org, err := influx.client.OrganizationsApi().FindOrganizationByName(ctx, influx.org)
+	if err != nil {
+		return fmt.Errorf("failed to find org %s: %w", influx.org, err)
+	}
+	var rules []domain.RetentionRule
+	if retention > 0 {
+		rules = append(rules, domain.RetentionRule{
+			EverySeconds: int(retention / time.Second),
+			Type:         domain.RetentionRuleTypeExpire,
+		})
+	}
+	if _, err := buckets.CreateBucketWithName(ctx, org, influx.bucket, rules...); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", influx.bucket, err)
+	}
+	log.Infof("Created bucket %s in org %s with retention %s", influx.bucket, influx.org, retention)
+	return nil
+}
+
+// CheckWrite verifies that the token may write to the bucket by writing an empty
+// batch, which InfluxDB authorizes like any other write but doesn't store.
+func (influx *InfluxProcessor) CheckWrite(ctx context.Context) error {
+	query := url.Values{}
+	query.Set("org", influx.org)
+	query.Set("bucket", influx.bucket)
+	req, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(influx.client.ServerUrl(), "/")+"/api/v2/write?"+query.Encode(), strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+influx.authToken)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: the token may not write to bucket %s: %s", errWriteDenied, influx.bucket, resp.Status)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: bucket %s doesn't exist in org %s", errWriteDenied, influx.bucket, influx.org)
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
+
+// setupBucket creates the bucket if asked to and checks the write permission, exiting
+// if either fails. InfluxDB being unreachable is only logged, since the writes are
+// retried until it is back.
+func setupBucket(influx *InfluxProcessor, create bool, retention time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if create {
+		if err := influx.EnsureBucket(ctx, retention); err != nil {
+			log.WithError(err).Fatal("Failed to set up the bucket")
+		}
+	}
+	if err := influx.CheckWrite(ctx); errors.Is(err, errWriteDenied) {
+		log.WithError(err).Fatalf("Can't write to bucket %s", influx.bucket)
+	} else if err != nil {
+		log.WithError(err).Warnf("Failed to check the write permission on bucket %s", influx.bucket)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureStats counts the messages captured and those that couldn't be.
+var captureStats = expvar.NewMap("captures")
+
+type CaptureFormat int
+
+const (
+	CaptureDnstap CaptureFormat = iota
+	CaptureJson
+	CaptureLine
+)
+
+func ParseCaptureFormat(format string) (CaptureFormat, error) {
+	switch format {
+	case "dnstap":
+		return CaptureDnstap, nil
+	case "json":
+		return CaptureJson, nil
+	case "line":
+		return CaptureLine, nil
+	default:
+		return CaptureDnstap, fmt.Errorf("invalid capture format \"%s\"", format)
+	}
+}
+
+// captureRecord is the JSON form of a captured message: the decoded message along
+// with its wire format.
+type captureRecord struct {
+	QueryRecord
+	Wire  string `json:"wire"`
+	Error string `json:"error,omitempty"`
+}
+
+// CaptureProcessor keeps the raw wire format of the messages matching its filter,
+// e.g. malformed payloads, names with a high DGA score or a domain under
+// investigation, so they can be examined later without capturing everything. The
+// messages are written to a sidecar file if one is set and otherwise as base64 to a
+// measurement. The file has the raw dnstap frames, which tools like dnstap-read and
+// replay can read, one JSON object per line or InfluxDB line protocol, so downstream
+// consumers can pick the encoding they understand.
+type CaptureProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	format      CaptureFormat
+	output      *dnstap.FrameStreamOutput
+	outputDone  chan bool
+	file        *os.File
+	mutex       sync.Mutex
+	writer      *bufio.Writer
+}
+
+func NewCaptureProcessor(writeApi *api.WriteApi, measurement string, file string, format CaptureFormat, bufferSize uint) (*CaptureProcessor, error) {
+	proc := &CaptureProcessor{
+		baseProcessor: newBaseProcessor("capture", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		format:        format,
+	}
+	if len(file) == 0 {
+		return proc, nil
+	}
+	if format == CaptureDnstap {
+		output, err := dnstap.NewFrameStreamOutputFromFilename(file)
+		if err != nil {
+			return nil, err
+		}
+		proc.output = output
+		proc.outputDone = make(chan bool)
+		return proc, nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	proc.file = f
+	proc.writer = bufio.NewWriter(f)
+	return proc, nil
+}
+
+func (proc *CaptureProcessor) Start(ctx context.Context) error {
+	if proc.output != nil {
+		go func() {
+			proc.output.RunOutputLoop()
+			close(proc.outputDone)
+		}()
+	}
+	if proc.writer != nil {
+		go proc.flushLoop(ctx)
+	}
+	go proc.run()
+	return nil
+}
+
+func (proc *CaptureProcessor) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *CaptureProcessor) run() {
+	proc.consume(proc.capture)
+	if proc.output != nil {
+		proc.output.Close()
+		<-proc.outputDone
+	}
+	if proc.file != nil {
+		proc.Flush()
+		_ = proc.file.Close()
+	}
+	proc.finish()
+}
+
+// Flush writes the buffered lines of a JSON or line protocol file.
+func (proc *CaptureProcessor) Flush() {
+	if proc.writer == nil {
+		return
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	if err := proc.writer.Flush(); err != nil {
+		captureStats.Add("errors", 1)
+		log.WithError(err).Errorf("Failed to write %s", proc.file.Name())
+	}
+}
+
+func (proc *CaptureProcessor) capture(message *Message) {
+	if proc.output != nil {
+		frame, err := proto.Marshal(message.dnstap)
+		if err != nil {
+			captureStats.Add("errors", 1)
+			log.WithError(err).Debug("Failed to marshal a captured message")
+			return
+		}
+		proc.output.GetOutputChannel() <- frame
+		captureStats.Add("captured", 1)
+		return
+	}
+
+	payload := capturePayload(message)
+	if payload == nil {
+		return
+	}
+	if proc.writer != nil {
+		proc.writeLine(message, payload)
+		return
+	}
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("tap_type", message.dnstapMessage.Type.String()).
+		AddField("size", len(payload)).
+		AddField("wire", base64.StdEncoding.EncodeToString(payload)).
+		SetTime(message.timestamp)
+	if message.dnstapMessage.QueryAddress != nil {
+		point.AddTag("qaddress", net.IP(message.dnstapMessage.QueryAddress).String())
+	}
+	if len(message.host) > 0 {
+		point.AddTag("qhost", message.host)
+	}
+	if message.unpackErr != nil {
+		point.AddField("error", message.unpackErr.Error())
+	}
+	(*proc.writeApi).WritePoint(point)
+	captureStats.Add("captured", 1)
+}
+
+// capturePayload returns the wire format of the response of a message, or of the query
+// if it has no response.
+func capturePayload(message *Message) []byte {
+	if message.dnstapMessage.ResponseMessage != nil {
+		return message.dnstapMessage.ResponseMessage
+	}
+	return message.dnstapMessage.QueryMessage
+}
+
+func newCaptureRecord(message *Message, payload []byte) captureRecord {
+	record := captureRecord{
+		QueryRecord: newQueryRecord(message),
+		Wire:        base64.StdEncoding.EncodeToString(payload),
+	}
+	if message.unpackErr != nil {
+		record.Error = message.unpackErr.Error()
+	}
+	return record
+}
+
+func (proc *CaptureProcessor) writeLine(message *Message, payload []byte) {
+	record := newCaptureRecord(message, payload)
+	var line []byte
+	if proc.format == CaptureJson {
+		var err error
+		if line, err = json.Marshal(record); err != nil {
+			captureStats.Add("errors", 1)
+			return
+		}
+	} else {
+		line = []byte(lineProtocol(proc.measurement, record, len(payload)))
+	}
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	_, _ = proc.writer.Write(line)
+	_ = proc.writer.WriteByte('\n')
+	captureStats.Add("captured", 1)
+}
+
+var (
+	lineKeyEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	lineStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// lineProtocol encodes a captured message in InfluxDB line protocol with the tags and
+// fields the captures measurement has.
+func lineProtocol(measurement string, record captureRecord, size int) string {
+	var line strings.Builder
+	line.WriteString(lineKeyEscaper.Replace(measurement))
+	tags := []struct{ key, value string }{
+		{"qaddress", record.Client},
+		{"qhost", record.Host},
+		{"qname", record.Qname},
+		{"qtype", record.Qtype},
+		{"status", record.Rcode},
+		{"tap_type", record.Type},
+	}
+	for _, tag := range tags {
+		if len(tag.value) > 0 {
+			line.WriteString("," + tag.key + "=" + lineKeyEscaper.Replace(tag.value))
+		}
+	}
+	line.WriteString(" size=" + strconv.Itoa(size) + "i")
+	line.WriteString(`,wire="` + record.Wire + `"`)
+	if len(record.Error) > 0 {
+		line.WriteString(`,error="` + lineStringEscaper.Replace(record.Error) + `"`)
+	}
+	line.WriteString(" " + strconv.FormatInt(record.Time.UnixNano(), 10))
+	return line.String()
+}
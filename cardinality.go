@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"net"
+	"sync"
+	"time"
+)
+
+type cardinalitySketches struct {
+	host    string
+	qnames  *HyperLogLog
+	domains *HyperLogLog
+}
+
+func newCardinalitySketches(precision uint8) *cardinalitySketches {
+	return &cardinalitySketches{
+		qnames:  NewHyperLogLog(precision),
+		domains: NewHyperLogLog(precision),
+	}
+}
+
+// CardinalityProcessor estimates the number of distinct query names and registered
+// domains per interval, both overall and per client, with HyperLogLog sketches. Exact
+// distinct counts over the raw queries are too expensive to run in Flux.
+type CardinalityProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	interval    time.Duration
+	mutex       sync.Mutex
+	global      *cardinalitySketches
+	clients     map[string]*cardinalitySketches
+}
+
+func NewCardinalityProcessor(writeApi *api.WriteApi, measurement string, interval time.Duration, bufferSize uint) *CardinalityProcessor {
+	return &CardinalityProcessor{
+		baseProcessor: newBaseProcessor("cardinality", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		interval:      interval,
+		global:        newCardinalitySketches(14),
+		clients:       make(map[string]*cardinalitySketches),
+	}
+}
+
+func (proc *CardinalityProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *CardinalityProcessor) run() {
+	proc.consume(proc.add)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *CardinalityProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *CardinalityProcessor) add(message *Message) {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return
+	}
+	qname := message.dnsMessage.Question[0].Name
+	domain := registeredDomain(qname)
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	sketches := []*cardinalitySketches{proc.global}
+	if message.dnstapMessage.QueryAddress != nil {
+		client := net.IP(message.dnstapMessage.QueryAddress).String()
+		clientSketches := proc.clients[client]
+		if clientSketches == nil {
+			// per-client sketches are smaller, with a standard error of about 3%
+			clientSketches = newCardinalitySketches(10)
+			proc.clients[client] = clientSketches
+		}
+		clientSketches.host = message.host
+		sketches = append(sketches, clientSketches)
+	}
+	for _, sketch := range sketches {
+		sketch.qnames.Add(qname)
+		if len(domain) > 0 {
+			sketch.domains.Add(domain)
+		}
+	}
+}
+
+// Flush writes the estimates for the interval so far and starts a new interval.
+func (proc *CardinalityProcessor) Flush() {
+	proc.mutex.Lock()
+	global := proc.global
+	clients := proc.clients
+	proc.global = newCardinalitySketches(14)
+	proc.clients = make(map[string]*cardinalitySketches)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	proc.write(global, "", now)
+	for client, sketches := range clients {
+		proc.write(sketches, client, now)
+	}
+}
+
+func (proc *CardinalityProcessor) write(sketches *cardinalitySketches, client string, now time.Time) {
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddField("qnames", int64(sketches.qnames.Estimate())).
+		AddField("domains", int64(sketches.domains.Estimate())).
+		SetTime(now)
+	if len(client) > 0 {
+		point.AddTag("qaddress", client)
+		if len(sketches.host) > 0 {
+			point.AddTag("qhost", sketches.host)
+		}
+	} else {
+		point.AddTag("scope", "global")
+	}
+	(*proc.writeApi).WritePoint(point)
+}
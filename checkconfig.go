@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkConfig validates the settings, list files, InfluxDB endpoint and enforcement
+// backend without starting anything, printing a summary of what would run. It
+// returns the number of problems found.
+func checkConfig(influxdbUrl, input string) int {
+	problems := 0
+	check := func(what string, err error) {
+		if err != nil {
+			problems++
+			fmt.Printf("FAIL  %s: %s\n", what, err)
+		} else {
+			fmt.Printf("ok    %s\n", what)
+		}
+	}
+
+	if flagFile {
+		_, err := os.Stat(input)
+		check(fmt.Sprintf("input file %s", input), err)
+	} else {
+		_, err := os.Stat(filepath.Dir(input))
+		check(fmt.Sprintf("input socket %s", input), err)
+	}
+
+	blockedDomains, err := getBlockedDomains(flagBlockFile, flagWhitelistFile, flagBlacklistFile, flagGravityDb)
+	if err == nil {
+		check(fmt.Sprintf("lists (%d blocked domains)", blockedDomains.Len()), nil)
+	} else {
+		check("lists", err)
+	}
+
+	_, err = ParseFilter(flagInfluxFilter)
+	check(fmt.Sprintf("influx filter \"%s\"", flagInfluxFilter), err)
+	_, err = ParseFilter(flagCnameFilter)
+	check(fmt.Sprintf("cname filter \"%s\"", flagCnameFilter), err)
+	_, err = ParseOverflowPolicy(flagInfluxOverflow)
+	check(fmt.Sprintf("influx overflow policy %s", flagInfluxOverflow), err)
+	_, err = ParseOverflowPolicy(flagCnameOverflow)
+	check(fmt.Sprintf("cname overflow policy %s", flagCnameOverflow), err)
+	_, err = ParseHostFormat(flagHostFormat)
+	check(fmt.Sprintf("qhost format %s", flagHostFormat), err)
+	if flagDns64 {
+		_, err = parseDns64Prefixes(flagDns64Prefixes)
+		check(fmt.Sprintf("%d DNS64 prefixes", len(flagDns64Prefixes)), err)
+	}
+
+	_, err = NewHostSources(flagHostSources, flagHostSourceInterval)
+	check(fmt.Sprintf("%d host sources", len(flagHostSources)), err)
+	_, err = NewClientGroups(flagClientGroups, flagClientGroupsFile)
+	check("client groups", err)
+	for _, file := range []string{flagGeoIPFile, flagAsnFile, flagOuiFile} {
+		if len(file) > 0 {
+			_, err = os.Stat(file)
+			check(file, err)
+		}
+	}
+
+	blockAction, blockTarget, err := ParseBlockAction(flagBlockAction, flagBlockTarget)
+	check(fmt.Sprintf("block action %s", flagBlockAction), err)
+	if err == nil {
+		enforcer, err := NewEnforcer(flagEnforcer, blockAction, blockTarget, flagRpzFile, flagKnotSocket)
+		if err == nil {
+			err = enforcer.Probe()
+		}
+		check(fmt.Sprintf("%s enforcer", flagEnforcer), err)
+	}
+
+	client := influxdb2.NewClient(influxdbUrl, flagAuthToken)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ready, err := client.Ready(ctx)
+	cancel()
+	client.Close()
+	if err == nil && !ready {
+		err = errors.New("influxdb is not ready")
+	}
+	check(fmt.Sprintf("influxdb %s (bucket %s, org %s)", influxdbUrl, flagBucket, flagOrg), err)
+
+	fmt.Printf("%d problems\n", problems)
+	return problems
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+type clientGroup struct {
+	network *net.IPNet
+	label   string
+}
+
+// ClientGroups maps client addresses to group labels. When networks overlap, the most
+// specific network wins.
+type ClientGroups struct {
+	mutex  sync.RWMutex
+	groups []clientGroup
+}
+
+// NewClientGroups parses "cidr=label" mappings, followed by the "cidr label" lines of
+// file if it is set.
+func NewClientGroups(mappings []string, file string) (*ClientGroups, error) {
+	groups := &ClientGroups{}
+	for _, mapping := range mappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid client group \"%s\"", mapping)
+		}
+		if err := groups.add(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		//noinspection GoUnhandledErrorResult
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid client group line \"%s\" in %s", scanner.Text(), file)
+			}
+			if err := groups.add(fields[0], fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (groups *ClientGroups) add(cidr, label string) error {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return err
+	}
+	label = strings.TrimSpace(label)
+	if len(label) == 0 {
+		return fmt.Errorf("missing label for client group %s", cidr)
+	}
+	groups.groups = append(groups.groups, clientGroup{network: network, label: label})
+	return nil
+}
+
+func (groups *ClientGroups) Lookup(addr []byte) string {
+	if groups == nil || addr == nil {
+		return ""
+	}
+	groups.mutex.RLock()
+	defer groups.mutex.RUnlock()
+	ip := net.IP(addr)
+	label := ""
+	bestSize := -1
+	for _, group := range groups.groups {
+		if group.network.Contains(ip) {
+			if size, _ := group.network.Mask.Size(); size > bestSize {
+				label = group.label
+				bestSize = size
+			}
+		}
+	}
+	return label
+}
+
+// Replace swaps in the mappings of other, e.g. after the config is reloaded.
+func (groups *ClientGroups) Replace(other *ClientGroups) {
+	groups.mutex.Lock()
+	defer groups.mutex.Unlock()
+	groups.groups = other.groups
+}
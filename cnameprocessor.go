@@ -3,14 +3,19 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
 	"github.com/influxdata/influxdb-client-go/api"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,119 +37,315 @@ const (
 	UpdateBlackCommand               = 3
 )
 
+// cnameStats has the size of the block lists and the number of learned blocks.
+var cnameStats = expvar.NewMap("cnames")
+
 type Command struct {
 	command        CnameCommand
 	message        *Message
-	blockedDomains *map[string]bool
+	blockedDomains *SuffixSet
+}
+
+// LearnedBlock is a block learned from a blocked cname, as served on /blocks.
+type LearnedBlock struct {
+	Time   time.Time `json:"time"`
+	Qname  string    `json:"qname"`
+	Cname  string    `json:"cname"`
+	List   string    `json:"list,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Host   string    `json:"host,omitempty"`
 }
 
+// maxRecentBlocks is the number of learned blocks served on /blocks.
+const maxRecentBlocks = 50
+
 type CnameProcessor struct {
-	messages          chan *Message
+	baseProcessor
 	commands          chan *Command
 	blockedFile       string
 	whitelistFile     string
 	blacklistFile     string
+	gravityDb         string
+	disabledLists     map[string]bool
 	blockedCnames     *map[string]string
-	blockedDomains    *map[string]bool
-	unbound           *Unbound
-	httpServer        *http.Server
+	learnedLists      map[string]string
+	blockedDomains    *SuffixSet
+	blockedMutex      sync.RWMutex
+	enforcer          Enforcer
+	maxLearned        uint
+	wildcardThreshold uint
+	recentMutex       sync.Mutex
+	recentBlocks      []LearnedBlock
+	lastDiff          *ListDiff
 	httpMutex         sync.Mutex
 	influxMeasurement string
 	influxWriteApi    *api.WriteApi
 }
 
-func addKeys(destMap *map[string]bool, keysMap *map[string]bool) {
+func addKeys(destSet *SuffixSet, keysMap *map[string]bool, list string) {
 	for key := range *keysMap {
-		(*destMap)[key] = true
+		destSet.Set(key, list)
 	}
 }
 
-func removeKeys(destMap *map[string]bool, keysMap *map[string]bool) {
+func removeKeys(destSet *SuffixSet, keysMap *map[string]bool) {
 	for key := range *keysMap {
-		delete(*destMap, key)
+		destSet.Delete(key)
 	}
 }
 
-func NewCnameProcessor(influxWriteApi *api.WriteApi, influxMeasurement string, blockedFile, whitelistFile, blacklistFile string, bufferSize, port uint) *CnameProcessor {
-	blockedDomains, err := getBlockedDomains(blockedFile, whitelistFile, blacklistFile)
+func NewCnameProcessor(influxWriteApi *api.WriteApi, enforcer Enforcer, influxMeasurement string, blockedFile, whitelistFile, blacklistFile, gravityDb string, bufferSize uint, maxLearned uint) *CnameProcessor {
+	blockedDomains, err := getBlockedDomains(blockedFile, whitelistFile, blacklistFile, gravityDb)
 	if err != nil {
 		log.WithError(err).Fatal("Failed to get blocked domains")
 	}
 	blockedCnames := make(map[string]string)
+	setListStats(blockedDomains, &blockedCnames)
 
 	return &CnameProcessor{
-		messages:          make(chan *Message, bufferSize),
+		baseProcessor:     newBaseProcessor("cnames", bufferSize),
 		commands:          make(chan *Command, bufferSize),
 		blockedFile:       blockedFile,
 		blacklistFile:     blacklistFile,
 		whitelistFile:     whitelistFile,
+		gravityDb:         gravityDb,
 		blockedCnames:     &blockedCnames,
+		learnedLists:      make(map[string]string),
 		blockedDomains:    blockedDomains,
-		unbound:           NewUnbound(),
-		httpServer:        &http.Server{Addr: fmt.Sprintf(":%d", port)},
+		enforcer:          enforcer,
+		maxLearned:        maxLearned,
 		influxMeasurement: influxMeasurement,
 		influxWriteApi:    influxWriteApi,
 	}
 }
 
-func getBlockedDomains(blockedFile, whitelistFile, blacklistFile string) (*map[string]bool, error) {
-	whitelistDomains, err := loadRpzFile(whitelistFile)
-	if err != nil {
-		return whitelistDomains, err
+func setListStats(blockedDomains *SuffixSet, blockedCnames *map[string]string) {
+	blocked := new(expvar.Int)
+	blocked.Set(int64(blockedDomains.Len()))
+	cnameStats.Set("blocked_domains", blocked)
+	learned := new(expvar.Int)
+	learned.Set(int64(len(*blockedCnames)))
+	cnameStats.Set("learned_blocks", learned)
+}
+
+// getBlockedDomains merges the lists into a set of the blocked domains and the name of
+// the list that blocks them. The domains of a Pi-hole gravity database, if one is
+// set, are merged in as the gravity list, with its deny and allow entries added to
+// the black and white lists. A list without a file is empty. The lists are loaded in
+// parallel, since the large ones take seconds each.
+func getBlockedDomains(blockedFile, whitelistFile, blacklistFile, gravityDb string) (*SuffixSet, error) {
+	var whitelistDomains, blacklistDomains, blockDomains *map[string]bool
+	var gravity *gravityLists
+	var errs [4]error
+	wg := sync.WaitGroup{}
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		whitelistDomains, errs[0] = loadListFile(whitelistFile)
+	}()
+	go func() {
+		defer wg.Done()
+		blacklistDomains, errs[1] = loadListFile(blacklistFile)
+	}()
+	go func() {
+		defer wg.Done()
+		blockDomains, errs[2] = loadListFile(blockedFile)
+	}()
+	go func() {
+		defer wg.Done()
+		if len(gravityDb) > 0 {
+			gravity, errs[3] = loadGravityDb(gravityDb)
+		}
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return NewSuffixSet(0), err
+		}
 	}
-	blacklistDomains, err := loadRpzFile(blacklistFile)
-	if err != nil {
-		return blacklistDomains, err
+
+	// size the set up front, growing it for millions of domains doubles the memory
+	// needed while it is rehashed
+	size := len(*blockDomains) + len(*blacklistDomains)
+	if gravity != nil {
+		size += len(*gravity.gravity) + len(*gravity.deny)
 	}
-	blockedDomains, err := loadRpzFile(blockedFile)
-	if err != nil {
-		return blockedDomains, err
+	blockedDomains := NewSuffixSet(size)
+	addKeys(blockedDomains, blockDomains, "block")
+	if gravity != nil {
+		addKeys(blockedDomains, gravity.gravity, "gravity")
+		addKeys(blockedDomains, gravity.deny, "black")
+		removeKeys(blockedDomains, gravity.allow)
 	}
-	addKeys(blockedDomains, blacklistDomains)
+	addKeys(blockedDomains, blacklistDomains, "black")
 	removeKeys(blockedDomains, whitelistDomains)
 	return blockedDomains, nil
 }
 
-func (proc *CnameProcessor) GetChannel() chan *Message {
-	return proc.messages
+func (proc *CnameProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
 }
 
-func (proc *CnameProcessor) Run(wg *sync.WaitGroup) {
+func (proc *CnameProcessor) run() {
 	childrenWg := sync.WaitGroup{}
-	childrenWg.Add(3)
+	childrenWg.Add(2)
 
 	go proc.processCommands(&childrenWg)
-	go proc.runUpdateListener(&childrenWg)
-	go proc.unbound.Run(&childrenWg)
+	go proc.enforcer.Run(&childrenWg)
 
 	for message := range proc.messages {
 		proc.processMessage(message)
 	}
 
-	_ = proc.httpServer.Shutdown(context.TODO())
 	close(proc.commands)
-	close(proc.unbound.GetChannel())
+	close(proc.enforcer.GetChannel())
 	childrenWg.Wait()
-	wg.Done()
+	proc.finish()
 }
 
-func (proc *CnameProcessor) runUpdateListener(wg *sync.WaitGroup) {
-	http.HandleFunc("/updateAll", func(w http.ResponseWriter, req *http.Request) {
+func (proc *CnameProcessor) Flush() {
+}
+
+func (proc *CnameProcessor) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/updateAll", func(w http.ResponseWriter, req *http.Request) {
 		proc.updateHandler(w, req, UpdateAllCommand)
 	})
-	http.HandleFunc("/updateBlock", func(w http.ResponseWriter, req *http.Request) {
+	server.HandleFunc("/updateBlock", func(w http.ResponseWriter, req *http.Request) {
 		proc.updateHandler(w, req, UpdateBlockCommand)
 	})
-	http.HandleFunc("/updateWhite", func(w http.ResponseWriter, req *http.Request) {
+	server.HandleFunc("/updateWhite", func(w http.ResponseWriter, req *http.Request) {
 		proc.updateHandler(w, req, UpdateWhiteCommand)
 	})
-	http.HandleFunc("/updateBlack", func(w http.ResponseWriter, req *http.Request) {
+	server.HandleFunc("/updateBlack", func(w http.ResponseWriter, req *http.Request) {
 		proc.updateHandler(w, req, UpdateBlackCommand)
 	})
-	if err := proc.httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		log.WithError(err).Fatal("ListenAndServe() failed")
+	server.HandleFunc("/blocks", proc.blocksHandler)
+	server.HandleFunc("/learned", proc.learnedHandler)
+	server.HandleFunc("/lists", proc.listsHandler)
+	server.HandleFunc("/listDiff", proc.listDiffHandler)
+	server.HandleFunc("/listState", proc.listStateHandler)
+}
+
+// learnedHandler serves all learned blocks as a map of the blocked name to the blocked
+// cname it was learned from, or only those learned from one list with
+// /learned?list=gravity.
+func (proc *CnameProcessor) learnedHandler(w http.ResponseWriter, req *http.Request) {
+	learned := proc.Learned()
+	if list := req.URL.Query().Get("list"); len(list) > 0 {
+		lists := proc.LearnedLists()
+		for qname := range learned {
+			if lists[qname] != list {
+				delete(learned, qname)
+			}
+		}
 	}
-	wg.Done()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(learned)
+}
+
+// listsHandler adds a domain to or removes it from the white or black list file and
+// reloads the lists, e.g. POST /lists?list=white&action=add&domain=example.com.
+func (proc *CnameProcessor) listsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := req.URL.Query()
+	domain := dns.Fqdn(strings.ToLower(strings.TrimSpace(params.Get("domain"))))
+	if !domainRegex.MatchString(domain) {
+		http.Error(w, fmt.Sprintf("invalid domain \"%s\"", params.Get("domain")), http.StatusBadRequest)
+		return
+	}
+	action := params.Get("action")
+	if action != "add" && action != "remove" {
+		http.Error(w, "action must be add or remove", http.StatusBadRequest)
+		return
+	}
+
+	proc.httpMutex.Lock()
+	defer proc.httpMutex.Unlock()
+	var path string
+	switch params.Get("list") {
+	case "white":
+		path = proc.whitelistFile
+	case "black":
+		path = proc.blacklistFile
+	default:
+		http.Error(w, "list must be white or black", http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Updating %s: %s %s", path, action, domain)
+	if err := editListFile(path, domain, action == "add"); err != nil {
+		http.Error(w, fmt.Sprintf("something went wrong: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if err := proc.updateLists(); err != nil {
+		http.Error(w, fmt.Sprintf("something went wrong: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Learned returns a copy of the learned blocks, a map of the blocked name to the
+// blocked cname it was learned from.
+func (proc *CnameProcessor) Learned() map[string]string {
+	proc.blockedMutex.RLock()
+	defer proc.blockedMutex.RUnlock()
+	learned := make(map[string]string, len(*proc.blockedCnames))
+	for qname, cname := range *proc.blockedCnames {
+		learned[qname] = cname
+	}
+	return learned
+}
+
+// LearnedLists returns a copy of the source lists of the learned blocks, a map of the
+// blocked name to the list that blocks the cname it was learned from.
+func (proc *CnameProcessor) LearnedLists() map[string]string {
+	proc.blockedMutex.RLock()
+	defer proc.blockedMutex.RUnlock()
+	lists := make(map[string]string, len(proc.learnedLists))
+	for qname, list := range proc.learnedLists {
+		lists[qname] = list
+	}
+	return lists
+}
+
+// sourceList returns the list that blocks cname in blockedDomains, following learned
+// blocks back to the list they were learned from.
+func (proc *CnameProcessor) sourceList(blockedDomains *SuffixSet, cname string) string {
+	list := blockedDomains.Get(cname)
+	if list == "learned" {
+		return proc.learnedLists[cname]
+	}
+	return list
+}
+
+// blocksHandler serves the most recently learned blocks, newest first.
+//noinspection GoUnusedParameter
+func (proc *CnameProcessor) blocksHandler(w http.ResponseWriter, req *http.Request) {
+	proc.recentMutex.Lock()
+	blocks := make([]LearnedBlock, len(proc.recentBlocks))
+	for i, block := range proc.recentBlocks {
+		blocks[len(blocks)-1-i] = block
+	}
+	proc.recentMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(blocks)
+}
+
+func (proc *CnameProcessor) addRecentBlock(message *Message, qname, cname, list string) {
+	block := LearnedBlock{Time: message.timestamp, Qname: qname, Cname: cname, List: list, Host: message.host}
+	if message.dnstapMessage.QueryAddress != nil {
+		block.Client = net.IP(message.dnstapMessage.QueryAddress).String()
+	}
+	proc.recentMutex.Lock()
+	defer proc.recentMutex.Unlock()
+	if len(proc.recentBlocks) == maxRecentBlocks {
+		proc.recentBlocks = append(proc.recentBlocks[:0], proc.recentBlocks[1:]...)
+	}
+	proc.recentBlocks = append(proc.recentBlocks, block)
 }
 
 //noinspection GoUnusedParameter
@@ -155,12 +356,9 @@ func (proc *CnameProcessor) updateHandler(w http.ResponseWriter, req *http.Reque
 
 		log.Infof("CNAME handler got update command: %d", command)
 
-		blockedDomains, err := getBlockedDomains(proc.blockedFile, proc.whitelistFile, proc.blacklistFile)
-		if err != nil {
+		if err := proc.updateLists(); err != nil {
 			http.Error(w, fmt.Sprintf("something went wrong: %s", err), http.StatusInternalServerError)
 		} else {
-			cmdObj := Command{UpdateListsCommand, nil, blockedDomains}
-			proc.commands <- &cmdObj
 			w.WriteHeader(http.StatusOK)
 		}
 
@@ -170,6 +368,179 @@ func (proc *CnameProcessor) updateHandler(w http.ResponseWriter, req *http.Reque
 	}
 }
 
+// updateLists reloads the list files and injects the result into the pipeline. The
+// caller must hold httpMutex.
+func (proc *CnameProcessor) updateLists() error {
+	enabled := func(list string, path string) string {
+		if proc.disabledLists[list] {
+			return ""
+		}
+		return path
+	}
+	blockedDomains, err := getBlockedDomains(enabled("block", proc.blockedFile), enabled("white", proc.whitelistFile),
+		enabled("black", proc.blacklistFile), enabled("gravity", proc.gravityDb))
+	if err != nil {
+		return err
+	}
+	proc.commands <- &Command{UpdateListsCommand, nil, blockedDomains}
+	return nil
+}
+
+// ReloadLists reloads the list files.
+func (proc *CnameProcessor) ReloadLists() error {
+	proc.httpMutex.Lock()
+	defer proc.httpMutex.Unlock()
+	return proc.updateLists()
+}
+
+// listNames are the lists that can be disabled.
+var listNames = []string{"block", "white", "black", "gravity"}
+
+// SetDisabledLists sets the lists that are left out of the blocked domains from the
+// next update on, e.g. after the config is reloaded.
+func (proc *CnameProcessor) SetDisabledLists(lists []string) error {
+	disabled := make(map[string]bool)
+	for _, list := range lists {
+		if !containsString(listNames, list) {
+			return fmt.Errorf("invalid list \"%s\"", list)
+		}
+		disabled[list] = true
+	}
+	proc.httpMutex.Lock()
+	defer proc.httpMutex.Unlock()
+	proc.disabledLists = disabled
+	return nil
+}
+
+// invalidListEdit is the error returned for list edits with a bad list or domain.
+type invalidListEdit string
+
+func (err invalidListEdit) Error() string {
+	return string(err)
+}
+
+// EnableList enables or disables a list without touching its file and reloads the
+// lists, e.g. to lift a list while troubleshooting.
+func (proc *CnameProcessor) EnableList(list string, enabled bool) error {
+	if !containsString(listNames, list) {
+		return invalidListEdit(fmt.Sprintf("invalid list \"%s\"", list))
+	}
+	proc.httpMutex.Lock()
+	defer proc.httpMutex.Unlock()
+	if proc.disabledLists[list] == !enabled {
+		return nil
+	}
+	disabled := make(map[string]bool)
+	for name := range proc.disabledLists {
+		disabled[name] = true
+	}
+	if enabled {
+		delete(disabled, list)
+		log.Infof("Enabling the %s list", list)
+	} else {
+		disabled[list] = true
+		log.Infof("Disabling the %s list", list)
+	}
+	proc.disabledLists = disabled
+	return proc.updateLists()
+}
+
+// listStateHandler serves whether each list is enabled, and enables or disables one
+// on POST /listState?list=block&enabled=false.
+func (proc *CnameProcessor) listStateHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := proc.EnableList(req.URL.Query().Get("list"), enabled); err != nil {
+			if _, invalid := err.(invalidListEdit); invalid {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, fmt.Sprintf("something went wrong: %s", err), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	proc.httpMutex.Lock()
+	state := make(map[string]bool, len(listNames))
+	for _, list := range listNames {
+		state[list] = !proc.disabledLists[list]
+	}
+	proc.httpMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+// SetLists switches to a new set of list files, e.g. after the config is reloaded,
+// and reloads them.
+func (proc *CnameProcessor) SetLists(blockedFile, whitelistFile, blacklistFile, gravityDb string) error {
+	proc.httpMutex.Lock()
+	defer proc.httpMutex.Unlock()
+	proc.blockedFile = blockedFile
+	proc.whitelistFile = whitelistFile
+	proc.blacklistFile = blacklistFile
+	proc.gravityDb = gravityDb
+	return proc.updateLists()
+}
+
+// rpzLineRegex matches the lines of a list file, either bare domains or unbound
+// local-zone statements.
+var rpzLineRegex = regexp.MustCompile(`^(local-zone:\s*")?(([a-z0-9]+([-a-z0-9]+)*\.)+[a-z]{2,}\.?)`)
+
+var domainRegex = regexp.MustCompile(`^([a-z0-9]+([-a-z0-9]+)*\.)+[a-z]{2,}\.$`)
+
+// editListFile adds a domain to or removes it from a list file. Added domains use the
+// local-zone format, with the same zone type, when the file already does.
+func editListFile(path string, domain string, add bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	localZone := ""
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	kept := lines[:0]
+	for _, line := range lines {
+		match := rpzLineRegex.FindStringSubmatch(line)
+		if match != nil {
+			if len(localZone) == 0 && len(match[1]) > 0 {
+				if i := strings.Index(line[len(match[0]):], "\""); i >= 0 {
+					localZone = line[len(match[0])+i+1:]
+				}
+			}
+			if dns.Fqdn(match[2]) == domain {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	if add {
+		if len(localZone) > 0 {
+			kept = append(kept, fmt.Sprintf("local-zone: \"%s\"%s", domain, localZone))
+		} else {
+			kept = append(kept, domain)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(kept, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadListFile(path string) (*map[string]bool, error) {
+	if len(path) == 0 {
+		return &map[string]bool{}, nil
+	}
+	return loadRpzFile(path)
+}
+
 func loadRpzFile(path string) (*map[string]bool, error) {
 	domains := make(map[string]bool)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -185,14 +556,13 @@ func loadRpzFile(path string) (*map[string]bool, error) {
 	//noinspection GoUnhandledErrorResult
 	defer file.Close()
 
-	re := regexp.MustCompile(`^(local-zone:\s*")?(([a-z0-9]+([-a-z0-9]+)*\.)+[a-z]{2,}\.?)`)
-
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		match := re.FindStringSubmatch(line)
+		match := rpzLineRegex.FindStringSubmatch(line)
 		if match != nil {
-			domain := match[2]
+			// copy the domain, a substring would keep the whole line in memory
+			domain := string([]byte(match[2]))
 			if !strings.HasSuffix(domain, ".") {
 				domain += "."
 			}
@@ -216,46 +586,88 @@ func (proc *CnameProcessor) processMessage(message *Message) {
 }
 
 func (proc *CnameProcessor) processCommands(wg *sync.WaitGroup) {
-	for command := range proc.commands {
-		switch command.command {
-		case DnsTapCommand:
-			proc.processDnstapMessage(command.message)
-		case UpdateListsCommand:
-			proc.processUpdateLists(command.blockedDomains)
-		default:
-			log.Warnf("Got invalid command: %s", command.command)
+	proc.supervise(func() {
+		for command := range proc.commands {
+			switch command.command {
+			case DnsTapCommand:
+				span := childSpan(command.message.span, proc.name)
+				proc.processDnstapMessage(command.message)
+				span.End()
+				command.message.Release()
+			case UpdateListsCommand:
+				proc.processUpdateLists(command.blockedDomains)
+			default:
+				log.Warnf("Got invalid command: %d", command.command)
+			}
 		}
-	}
+	}, func() {
+		for command := range proc.commands {
+			if command.message != nil {
+				command.message.Release()
+			}
+		}
+	})
 	wg.Done()
 }
 
-func (proc *CnameProcessor) processUpdateLists(blockedDomains *map[string]bool) {
-	// Remove cnames that are no longer blocked
+func (proc *CnameProcessor) processUpdateLists(blockedDomains *SuffixSet) {
+	// Remove cnames that are no longer blocked. A cname that is still blocked by
+	// another list keeps its block, which is attributed to that list from now on.
 	for qname, cname := range *proc.blockedCnames {
-		if !(*blockedDomains)[cname] {
-			log.Infof("Removing block of \"%s\" because cname \"%s\" is no longer blocked", qname, cname)
-			proc.unbound.GetChannel() <- &UnboundCommandMessage{
+		list := proc.learnedLists[qname]
+		if len(blockedDomains.Get(cname)) == 0 {
+			log.WithFields(blockFields(nil, qname, cname, list)).
+				Infof("Removing block of \"%s\" because cname \"%s\" is no longer blocked", qname, cname)
+			proc.enforcer.GetChannel() <- &EnforcerCommandMessage{
 				cmd:    ZoneRemove,
 				domain: qname,
 			}
+			proc.blockedMutex.Lock()
 			delete(*proc.blockedCnames, qname)
+			delete(proc.learnedLists, qname)
+			proc.blockedMutex.Unlock()
 
 			point := influxdb2.NewPointWithMeasurement(proc.influxMeasurement).
 				AddTag("qname", qname).
 				AddTag("cname", cname).
 				AddField("blocked", false).
 				SetTime(time.Now())
+			if len(list) > 0 {
+				point.AddTag("list", list)
+			}
 			(*proc.influxWriteApi).WritePoint(point)
+			continue
+		}
+		if source := proc.sourceList(blockedDomains, cname); source != list && source != "" {
+			log.WithFields(blockFields(nil, qname, cname, source)).
+				Infof("Block of \"%s\" moved from the %s list to the %s list", qname, list, source)
+			proc.blockedMutex.Lock()
+			proc.learnedLists[qname] = source
+			proc.blockedMutex.Unlock()
+		}
+		if len(blockedDomains.Get(qname)) == 0 {
+			// keep the learned blocks that are still valid
+			blockedDomains.Set(qname, "learned")
 		}
 	}
 
+	diff := diffLists(proc.blockedDomains, blockedDomains)
+	proc.blockedMutex.Lock()
 	proc.blockedDomains = blockedDomains
+	proc.blockedMutex.Unlock()
+	proc.recentMutex.Lock()
+	proc.lastDiff = diff
+	proc.recentMutex.Unlock()
+	setListStats(proc.blockedDomains, proc.blockedCnames)
+	cnameStats.Add("list_updates", 1)
+	log.Infof("Block lists updated, %d blocked domains: %s", blockedDomains.Len(), diff)
+	annotations.Annotate("list_update", "Block lists updated, %d blocked domains: %s", blockedDomains.Len(), diff)
 }
 
 func (proc *CnameProcessor) processDnstapMessage(message *Message) {
 	if message.dnsMessage != nil && len(message.dnsMessage.Answer) > 0 {
 		qname := message.dnsMessage.Question[0].Name
-		if (*proc.blockedDomains)[qname] {
+		if len(proc.blockedDomains.Get(qname)) > 0 {
 			return
 		}
 
@@ -282,13 +694,27 @@ func (proc *CnameProcessor) processDnstapMessage(message *Message) {
 			if len(cname) == 0 {
 				break
 			}
-			if (*proc.blockedDomains)[cname] {
-				log.Infof("Blocking \"%s\" because of blocked cname \"%s\"", qname, cname)
+			if len(proc.blockedDomains.Get(cname)) > 0 {
+				if proc.maxLearned > 0 && uint(len(*proc.blockedCnames)) >= proc.maxLearned {
+					cnameStats.Add("learned_dropped", 1)
+					if errorLog.Allow("learned block limit") {
+						log.Warnf("Not blocking \"%s\", the limit of %d learned blocks was reached", qname, proc.maxLearned)
+					}
+					break
+				}
+				list := proc.sourceList(proc.blockedDomains, cname)
+				log.WithFields(blockFields(message, qname, cname, list)).
+					Infof("Blocking \"%s\" because of blocked cname \"%s\"", qname, cname)
 
+				proc.blockedMutex.Lock()
 				(*proc.blockedCnames)[qname] = cname
-				(*proc.blockedDomains)[qname] = true
+				proc.learnedLists[qname] = list
+				proc.blockedDomains.Set(qname, "learned")
+				proc.blockedMutex.Unlock()
+				setListStats(proc.blockedDomains, proc.blockedCnames)
+				proc.addRecentBlock(message, qname, cname, list)
 
-				proc.unbound.GetChannel() <- &UnboundCommandMessage{
+				proc.enforcer.GetChannel() <- &EnforcerCommandMessage{
 					cmd:    ZoneAdd,
 					domain: qname,
 				}
@@ -298,7 +724,11 @@ func (proc *CnameProcessor) processDnstapMessage(message *Message) {
 					AddTag("cname", cname).
 					AddField("blocked", true).
 					SetTime(time.Now())
+				if len(list) > 0 {
+					point.AddTag("list", list)
+				}
 				(*proc.influxWriteApi).WritePoint(point)
+				proc.escalateWildcard(qname, cname, list)
 
 				break
 			} else {
@@ -307,3 +737,106 @@ func (proc *CnameProcessor) processDnstapMessage(message *Message) {
 		}
 	}
 }
+
+// SetWildcardThreshold sets the number of learned blocks of subdomains of the same
+// registered domain, through the same cname, at which the whole registered domain is
+// blocked instead. Zero disables wildcard blocks.
+func (proc *CnameProcessor) SetWildcardThreshold(threshold uint) {
+	proc.wildcardThreshold = threshold
+}
+
+// escalateWildcard replaces the learned blocks of the siblings of qname that were
+// learned through cname with a single block of their registered domain once there
+// are enough of them. Domains that cloak a tracker behind a new subdomain for every
+// site otherwise cause a steady churn of local zones.
+func (proc *CnameProcessor) escalateWildcard(qname, cname, list string) {
+	if proc.wildcardThreshold == 0 {
+		return
+	}
+	domain := registeredDomain(strings.ToLower(qname))
+	if len(domain) == 0 {
+		return
+	}
+	domain = dns.Fqdn(domain)
+	if domain == strings.ToLower(qname) || len(proc.blockedDomains.Get(domain)) > 0 {
+		return
+	}
+	var siblings []string
+	for learned, learnedCname := range *proc.blockedCnames {
+		if learnedCname == cname && dns.IsSubDomain(domain, strings.ToLower(learned)) {
+			siblings = append(siblings, learned)
+		}
+	}
+	if uint(len(siblings)) < proc.wildcardThreshold {
+		return
+	}
+
+	log.WithFields(blockFields(nil, domain, cname, list)).
+		Infof("Blocking all of \"%s\" because %d of its subdomains were blocked because of cname \"%s\"", domain, len(siblings), cname)
+	proc.blockedMutex.Lock()
+	for _, sibling := range siblings {
+		delete(*proc.blockedCnames, sibling)
+		delete(proc.learnedLists, sibling)
+		proc.blockedDomains.Delete(sibling)
+	}
+	(*proc.blockedCnames)[domain] = cname
+	proc.learnedLists[domain] = list
+	proc.blockedDomains.Set(domain, "learned")
+	proc.blockedMutex.Unlock()
+	setListStats(proc.blockedDomains, proc.blockedCnames)
+	cnameStats.Add("wildcard_blocks", 1)
+
+	// block the domain before unblocking the siblings, so they are never unblocked
+	proc.enforcer.GetChannel() <- &EnforcerCommandMessage{
+		cmd:    ZoneAdd,
+		domain: domain,
+	}
+	for _, sibling := range siblings {
+		proc.enforcer.GetChannel() <- &EnforcerCommandMessage{
+			cmd:    ZoneRemove,
+			domain: sibling,
+		}
+	}
+
+	point := influxdb2.NewPointWithMeasurement(proc.influxMeasurement).
+		AddTag("qname", domain).
+		AddTag("cname", cname).
+		AddTag("wildcard", "true").
+		AddField("blocked", true).
+		AddField("siblings", len(siblings)).
+		SetTime(time.Now())
+	if len(list) > 0 {
+		point.AddTag("list", list)
+	}
+	(*proc.influxWriteApi).WritePoint(point)
+}
+
+// BlockedList returns the name of the list that blocks qname, or an empty string if it
+// isn't blocked. Like the blocking itself, only qname is looked up and not its parent
+// domains. It is safe to call from other goroutines.
+func (proc *CnameProcessor) BlockedList(qname string) string {
+	qname = strings.ToLower(qname)
+	proc.blockedMutex.RLock()
+	defer proc.blockedMutex.RUnlock()
+	return proc.blockedDomains.Get(qname)
+}
+
+// blockFields returns the structured log fields of a block event. The client
+// is only known when the block was learned from a message.
+func blockFields(message *Message, qname, cname, sourceList string) log.Fields {
+	fields := log.Fields{
+		"qname": qname,
+		"cname": cname,
+		"list":  "learned",
+	}
+	if len(sourceList) > 0 {
+		fields["source_list"] = sourceList
+	}
+	if message != nil && message.dnstapMessage.QueryAddress != nil {
+		fields["client"] = net.IP(message.dnstapMessage.QueryAddress).String()
+		if len(message.host) > 0 {
+			fields["client_host"] = message.host
+		}
+	}
+	return fields
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+// newTestCnameProcessor returns a processor blocking domains, with an enforcer and a
+// write API that drop everything.
+func newTestCnameProcessor(domains map[string]string) *CnameProcessor {
+	blockedDomains := NewSuffixSet(len(domains))
+	for domain, list := range domains {
+		blockedDomains.Set(domain, list)
+	}
+	var writeApi api.WriteApi = &mirrorWriteApi{}
+	return &CnameProcessor{
+		baseProcessor:     newBaseProcessor("cnames", 1),
+		blockedCnames:     &map[string]string{},
+		learnedLists:      map[string]string{},
+		blockedDomains:    blockedDomains,
+		enforcer:          NewNoopEnforcer(),
+		influxMeasurement: "cnames",
+		influxWriteApi:    &writeApi,
+	}
+}
+
+// cnameMessage returns a response for qname that answers with a chain of cnames.
+func cnameMessage(t *testing.T, qname string, chain ...string) *Message {
+	msg := new(dns.Msg)
+	msg.SetQuestion(qname, dns.TypeA)
+	name := qname
+	for _, cname := range chain {
+		rr, err := dns.NewRR(name + " 60 IN CNAME " + cname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+		name = cname
+	}
+	rr, err := dns.NewRR(name + " 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, rr)
+	return &Message{dnstapMessage: &dnstap.Message{}, dnsMessage: msg}
+}
+
+// Blocking only looks up the names themselves, never their parent domains, both when
+// learning blocks and when looking up the list that blocks a response.
+func TestCnameBlockingIsExact(t *testing.T) {
+	blocked := map[string]string{
+		"tracker.net.": "block",
+		"blocked.com.": "black",
+	}
+	tests := []struct {
+		name    string
+		qname   string
+		chain   []string
+		learned string
+	}{
+		{"blocked cname", "www.site.com.", []string{"tracker.net."}, "tracker.net."},
+		{"blocked cname further down the chain", "www.site.com.", []string{"cdn.site.com.", "tracker.net."}, "tracker.net."},
+		{"subdomain of a blocked cname", "www.site.com.", []string{"x.tracker.net."}, ""},
+		{"unblocked cname", "www.site.com.", []string{"cdn.site.com."}, ""},
+		{"blocked qname", "blocked.com.", []string{"tracker.net."}, ""},
+		{"subdomain of a blocked qname", "www.blocked.com.", []string{"tracker.net."}, "tracker.net."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proc := newTestCnameProcessor(blocked)
+			proc.processDnstapMessage(cnameMessage(t, test.qname, test.chain...))
+			if cname := (*proc.blockedCnames)[test.qname]; cname != test.learned {
+				t.Errorf("learned block of %s through %q, want %q", test.qname, cname, test.learned)
+			}
+			wantList := blocked[test.qname]
+			if len(test.learned) > 0 {
+				wantList = "learned"
+			}
+			if list := proc.BlockedList(test.qname); list != wantList {
+				t.Errorf("BlockedList(%s) = %q, want %q", test.qname, list, wantList)
+			}
+		})
+	}
+
+	proc := newTestCnameProcessor(blocked)
+	for qname, list := range map[string]string{
+		"tracker.net.":     "block",
+		"TRACKER.net.":     "block",
+		"x.tracker.net.":   "",
+		"www.blocked.com.": "",
+		"net.":             "",
+	} {
+		if got := proc.BlockedList(qname); got != list {
+			t.Errorf("BlockedList(%s) = %q, want %q", qname, got, list)
+		}
+	}
+}
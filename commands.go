@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type command struct {
+	args    string
+	summary string
+	run     func(name string, args []string)
+}
+
+// commands returns the subcommands by name. Without a subcommand, run is assumed so
+// that existing command lines keep working.
+func commands() map[string]*command {
+	return map[string]*command{
+		"run":      {"<influxdb_url> <sock_or_file>", "collect dnstap messages (the default)", runCmd},
+		"validate": {"<influxdb_url> <sock_or_file>", "validate the config, list files, influxdb and enforcer", validateCmd},
+		"replay":   {"<influxdb_url> <file>", "write a captured dnstap file to influxdb and exit", replayCmd},
+		"bench":    {"<influxdb_url> [file]", "measure pipeline throughput with generated traffic or by replaying a dnstap file", benchCmd},
+		"lists":    {"", "inspect and merge the block, white and black lists", listsCmd},
+		"migrate":  {"<influxdb_url>", "copy the queries written with an older schema into the current one", migrateCmd},
+		"tasks":    {"<influxdb_url>", "install tasks that downsample the queries into hourly and daily rollups", tasksCmd},
+		"help":     {"", "list the commands", helpCmd},
+	}
+}
+
+func runCommand(args []string) {
+	name := "run"
+	if len(args) > 0 {
+		if _, ok := commands()[args[0]]; ok {
+			name, args = args[0], args[1:]
+		}
+	}
+	commands()[name].run(name, args)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintf(os.Stderr, "%s %s [flags] %s\n", os.Args[0], name, commands()[name].args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+//noinspection GoUnusedParameter
+func helpCmd(name string, args []string) {
+	names := make([]string, 0)
+	for name := range commands() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	//noinspection GoUnhandledErrorResult
+	fmt.Fprintf(os.Stderr, "%s <command> [flags] [args]\n\n", os.Args[0])
+	for _, name := range names {
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands()[name].summary)
+	}
+}
+
+func runCmd(name string, args []string) {
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	influxdb, input, commandLine := parsePipelineFlags(flags, args, false)
+	if flagCheckConfig {
+		exitCheckConfig(influxdb, input)
+	}
+	runPipeline(flags, influxdb, commandLine, func() (dnstap.Input, error) {
+		return openInput(input)
+	})
+	os.Exit(0)
+}
+
+func validateCmd(name string, args []string) {
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	influxdb, input, _ := parsePipelineFlags(flags, args, false)
+	exitCheckConfig(influxdb, input)
+}
+
+func exitCheckConfig(influxdb, input string) {
+	if checkConfig(influxdb, input) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func replayCmd(name string, args []string) {
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	influxdb, file, commandLine := parsePipelineFlags(flags, args, false)
+	flagDontExit = false
+	runPipeline(flags, influxdb, commandLine, func() (dnstap.Input, error) {
+		return dnstap.NewFrameStreamInputFromFilename(file)
+	})
+	os.Exit(0)
+}
+
+func benchCmd(name string, args []string) {
+	var repeat uint
+	var options GeneratorOptions
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	flags.UintVar(&repeat, "repeat", 1, "the number of times the file is replayed")
+	flags.UintVar(&options.Qps, "qps", 0, "the generated queries per second (0 is as fast as possible)")
+	flags.UintVar(&options.Clients, "clients", 100, "the number of generated clients")
+	flags.UintVar(&options.Domains, "domains", 10000, "the number of generated domains")
+	flags.Float64Var(&options.Skew, "skew", 1.1, "the Zipf skew of the generated domain popularity (> 1)")
+	flags.Float64Var(&options.NxdomainRatio, "nxdomain-ratio", 0.05, "the fraction of generated responses that are NXDOMAIN")
+	flags.DurationVar(&options.Duration, "duration", time.Minute, "how long traffic is generated (0 for no limit)")
+	flags.UintVar(&options.Count, "count", 0, "the number of queries generated (0 for no limit)")
+	influxdb, file, commandLine := parsePipelineFlags(flags, args, true)
+	flagDontExit = false
+
+	start := time.Now()
+	runPipeline(flags, influxdb, commandLine, func() (dnstap.Input, error) {
+		if len(file) > 0 {
+			return newRepeatInput(file, repeat), nil
+		}
+		return newGeneratorInput(options)
+	})
+	reportBench(time.Since(start))
+	os.Exit(0)
+}
+
+// reportBench prints the throughput and drop rate of a bench run.
+func reportBench(elapsed time.Duration) {
+	frames := decodedFrames.Value()
+	fmt.Printf("%d frames in %s (%.0f frames/s)\n", frames, elapsed.Round(time.Millisecond), float64(frames)/elapsed.Seconds())
+	droppedMessages.Do(func(kv expvar.KeyValue) {
+		dropped := kv.Value.(*expvar.Int).Value()
+		rate := 0.0
+		if frames > 0 {
+			rate = 100 * float64(dropped) / float64(frames)
+		}
+		fmt.Printf("%s: %d dropped (%.2f%%)\n", kv.Key, dropped, rate)
+	})
+	fmt.Printf("influx: %s points, %s write errors\n", expvarValue(influxStats.Get("points")), expvarValue(influxStats.Get("write_errors")))
+}
+
+func expvarValue(value expvar.Var) string {
+	if value == nil {
+		return "0"
+	}
+	return value.String()
+}
+
+// repeatInput reads a dnstap file the given number of times.
+type repeatInput struct {
+	path   string
+	repeat uint
+	wait   chan bool
+}
+
+func newRepeatInput(path string, repeat uint) *repeatInput {
+	return &repeatInput{path: path, repeat: repeat, wait: make(chan bool)}
+}
+
+func (input *repeatInput) ReadInto(output chan []byte) {
+	defer close(input.wait)
+	for i := uint(0); i < input.repeat; i++ {
+		file, err := dnstap.NewFrameStreamInputFromFilename(input.path)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to open %s", input.path)
+			return
+		}
+		file.ReadInto(output)
+	}
+}
+
+func (input *repeatInput) Wait() {
+	<-input.wait
+}
+
+func listsCmd(name string, args []string) {
+	var lookups []string
+	var mergeFile string
+	flags := newFlagSet(name)
+	flags.StringVar(&flagBlockFile, "block", "/web/hblock.rpz", "the hblock rpz file")
+	flags.StringVar(&flagWhitelistFile, "white", "/web/whitelist.rpz", "the whitelist rpz file")
+	flags.StringVar(&flagBlacklistFile, "black", "/web/blacklist.rpz", "the blacklist rpz file")
+	flags.StringVar(&flagGravityDb, "gravity-db", "", "also use the lists of this Pi-hole gravity.db")
+	flags.StringArrayVar(&lookups, "lookup", nil, "show which lists contain this domain")
+	flags.StringVar(&mergeFile, "merge", "", "write the merged blocked domains, one per line, to this file (- for stdout)")
+	_ = flags.Parse(args)
+
+	lists := []struct {
+		name string
+		path string
+	}{{"block", flagBlockFile}, {"white", flagWhitelistFile}, {"black", flagBlacklistFile}}
+	for _, list := range lists {
+		domains, err := loadRpzFile(list.path)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to load the %s list", list.name)
+		}
+		fmt.Printf("%-6s %8d domains  %s\n", list.name, len(*domains), list.path)
+		for _, lookup := range lookups {
+			if (*domains)[dns.Fqdn(strings.ToLower(lookup))] {
+				fmt.Printf("       %s is in the %s list\n", dns.Fqdn(strings.ToLower(lookup)), list.name)
+			}
+		}
+	}
+
+	blockedDomains, err := getBlockedDomains(flagBlockFile, flagWhitelistFile, flagBlacklistFile, flagGravityDb)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load the lists")
+	}
+	fmt.Printf("%-6s %8d domains\n", "merged", blockedDomains.Len())
+	for _, lookup := range lookups {
+		list := blockedDomains.Get(dns.Fqdn(strings.ToLower(lookup)))
+		fmt.Printf("%s blocked: %t %s\n", dns.Fqdn(strings.ToLower(lookup)), len(list) > 0, list)
+	}
+
+	if len(mergeFile) > 0 {
+		if err := writeDomains(mergeFile, blockedDomains); err != nil {
+			log.WithError(err).Fatalf("Failed to write %s", mergeFile)
+		}
+	}
+}
+
+func writeDomains(path string, domains *SuffixSet) error {
+	sorted := make([]string, 0, domains.Len())
+	domains.Range(func(domain, list string) {
+		sorted = append(sorted, domain)
+	})
+	sort.Strings(sorted)
+
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+		//noinspection GoUnhandledErrorResult
+		defer file.Close()
+	}
+	writer := bufio.NewWriter(file)
+	for _, domain := range sorted {
+		if _, err := fmt.Fprintln(writer, domain); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
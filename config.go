@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The positional arguments can also be given in the config file or environment.
+const (
+	configInfluxdb = "influxdb"
+	configInput    = "input"
+)
+
+// envPrefix is prepended to the upper-cased flag name (with dashes replaced by
+// underscores) to get the environment variable that overrides it, e.g. DNSTAP_TOKEN.
+const envPrefix = "DNSTAP_"
+
+// configSections maps the keys of the structured config sections to the flag they
+// set. Any other top-level key must be a flag name.
+var configSections = map[string]string{
+	"input.path":                 configInput,
+	"input.file":                 "file",
+	"outputs.influx.url":         configInfluxdb,
+	"outputs.influx.bucket":      "bucket",
+	"outputs.influx.org":         "org",
+	"outputs.influx.token":       "token",
+	"outputs.influx.measurement": "queries-measurement",
+	"outputs.influx.batch":       "batch",
+	"outputs.influx.flush":       "flush",
+	"outputs.influx.buffer":      "influx-buffer",
+	"outputs.influx.overflow":    "influx-overflow",
+	"outputs.cnames.measurement": "cnames-measurement",
+	"outputs.cnames.buffer":      "cname-buffer",
+	"outputs.cnames.overflow":    "cname-overflow",
+	"lists.block":                "block",
+	"lists.white":                "white",
+	"lists.black":                "black",
+	"filters.influx":             "influx-filter",
+	"filters.cnames":             "cname-filter",
+}
+
+// Config is a parsed config file, flattened into values keyed by flag name.
+type Config struct {
+	values map[string][]string
+}
+
+// LoadConfig reads a YAML config file for the given flags. An empty path gives an
+// empty config, so that environment overrides still apply.
+func LoadConfig(path string, flags *flag.FlagSet) (*Config, error) {
+	config := &Config{values: make(map[string][]string)}
+	if len(path) == 0 {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, value := range raw {
+		if err := config.add(flags, key, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return config, nil
+}
+
+func (config *Config) add(flags *flag.FlagSet, key string, value interface{}) error {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		for child, childValue := range value {
+			if err := config.add(flags, fmt.Sprintf("%s.%v", key, child), childValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	name, ok := configSections[key]
+	if !ok {
+		if strings.Contains(key, ".") || flags.Lookup(key) == nil {
+			return fmt.Errorf("unknown config key \"%s\"", key)
+		}
+		name = key
+	}
+
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			config.values[name] = append(config.values[name], fmt.Sprint(item))
+		}
+	case nil:
+	default:
+		config.values[name] = append(config.values[name], fmt.Sprint(value))
+	}
+	return nil
+}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Get returns the value of a setting that isn't a flag, giving the environment
+// precedence over the config file.
+func (config *Config) Get(name string) string {
+	if value, ok := os.LookupEnv(envName(name)); ok {
+		return value
+	}
+	if values := config.values[name]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+// CommandLineFlags returns the names of the flags given on the command line. It must be
+// called before the first Apply.
+func CommandLineFlags(flags *flag.FlagSet) map[string]bool {
+	names := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// Apply sets every flag that wasn't given on the command line from the environment
+// or, failing that, the config file. Flags set by neither are reset to their default,
+// so that applying a reloaded config drops settings removed from the file.
+func (config *Config) Apply(flags *flag.FlagSet, commandLine map[string]bool) error {
+	var errs []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if commandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		if slice, ok := f.Value.(flag.SliceValue); ok {
+			_ = slice.Replace(nil)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+		values := config.values[f.Name]
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values = []string{value}
+		}
+		for _, value := range values {
+			if err := flags.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
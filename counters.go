@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+type counterKey struct {
+	rcode string
+	qtype string
+	group string
+}
+
+// CountersProcessor counts the responses by rcode, qtype and client group and writes
+// the counts every interval. Together with --counters-only it is a metrics only mode
+// for those who don't want any per query data stored. Duplicates are not counted.
+type CountersProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	interval    time.Duration
+	mutex       sync.Mutex
+	counts      map[counterKey]int
+}
+
+func NewCountersProcessor(writeApi *api.WriteApi, measurement string, interval time.Duration, bufferSize uint) *CountersProcessor {
+	return &CountersProcessor{
+		baseProcessor: newBaseProcessor("counters", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		interval:      interval,
+		counts:        make(map[counterKey]int),
+	}
+}
+
+func (proc *CountersProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *CountersProcessor) run() {
+	proc.consume(proc.count)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *CountersProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *CountersProcessor) count(message *Message) {
+	if message.duplicate || message.dnsMessage == nil {
+		return
+	}
+	key := counterKey{
+		rcode: dns.RcodeToString[message.dnsMessage.Rcode],
+		group: message.clientGroup,
+	}
+	if len(message.dnsMessage.Question) > 0 {
+		key.qtype = dns.Type(message.dnsMessage.Question[0].Qtype).String()
+	}
+	proc.mutex.Lock()
+	proc.counts[key]++
+	proc.mutex.Unlock()
+}
+
+// Flush writes the counts since the last flush.
+func (proc *CountersProcessor) Flush() {
+	proc.mutex.Lock()
+	counts := proc.counts
+	proc.counts = make(map[counterKey]int)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for key, count := range counts {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("status", key.rcode).
+			AddField("count", count).
+			SetTime(now)
+		if len(key.qtype) > 0 {
+			point.AddTag("qtype", key.qtype)
+		}
+		if len(key.group) > 0 {
+			point.AddTag("client_group", key.group)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"net"
+	"sync"
+	"time"
+)
+
+type clientUsage struct {
+	host       string
+	queries    int
+	blocked    int
+	domains    *HyperLogLog
+	categories map[string]int
+}
+
+// parseTimeOfDay parses a time of day of the form "15:04" into the offset from
+// midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day \"%s\", expected hh:mm", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// nextTimeOfDay returns the first time after now that is offset past a local midnight.
+func nextTimeOfDay(now time.Time, offset time.Duration) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(offset)
+	for !next.After(now) {
+		midnight = midnight.AddDate(0, 0, 1)
+		next = midnight.Add(offset)
+	}
+	return next
+}
+
+// DailyUsageProcessor writes one point per client per day, at a configurable time of
+// day, with its total queries, blocked queries, distinct domains and top category, so
+// long term per device reports don't need the raw queries. Each point covers the time
+// since the previous one, so the partial day written at shutdown and the rest of the
+// day written after a restart add up.
+type DailyUsageProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	at          time.Duration
+	categories  map[string]string
+	blockedList func(qname string) string
+	mutex       sync.Mutex
+	usage       map[string]*clientUsage
+}
+
+func NewDailyUsageProcessor(writeApi *api.WriteApi, measurement string, categories map[string]string, at time.Duration, bufferSize uint) *DailyUsageProcessor {
+	return &DailyUsageProcessor{
+		baseProcessor: newBaseProcessor("daily_usage", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		at:            at,
+		categories:    categories,
+		usage:         make(map[string]*clientUsage),
+	}
+}
+
+// SetBlockedLookup sets the function that returns the list blocking a name, used to
+// tell blocked responses from genuine ones, as for the query points.
+func (proc *DailyUsageProcessor) SetBlockedLookup(blockedList func(qname string) string) {
+	proc.blockedList = blockedList
+}
+
+func (proc *DailyUsageProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *DailyUsageProcessor) run() {
+	proc.consume(proc.add)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *DailyUsageProcessor) writeLoop(ctx context.Context) {
+	for {
+		timer := time.NewTimer(time.Until(nextTimeOfDay(time.Now(), proc.at)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *DailyUsageProcessor) clientUsage(client string) *clientUsage {
+	usage := proc.usage[client]
+	if usage == nil {
+		usage = &clientUsage{
+			domains:    NewHyperLogLog(10),
+			categories: make(map[string]int),
+		}
+		proc.usage[client] = usage
+	}
+	return usage
+}
+
+func (proc *DailyUsageProcessor) add(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	question := message.dnsMessage.Question[0]
+	client := net.IP(message.dnstapMessage.QueryAddress).String()
+
+	if *message.dnstapMessage.Type == dnstap.Message_CLIENT_RESPONSE {
+		if len(blockingList(message, proc.blockedList)) > 0 {
+			proc.mutex.Lock()
+			proc.clientUsage(client).blocked++
+			proc.mutex.Unlock()
+		}
+		return
+	}
+
+	domain := registeredDomain(question.Name)
+	qcategory := ""
+	if proc.categories != nil {
+		qcategory = category(proc.categories, question.Name)
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	usage := proc.clientUsage(client)
+	if len(message.host) > 0 {
+		usage.host = message.host
+	}
+	usage.queries++
+	if len(domain) > 0 {
+		usage.domains.Add(domain)
+	}
+	if len(qcategory) > 0 {
+		usage.categories[qcategory]++
+	}
+}
+
+// Flush writes the usage of every client since the last flush.
+func (proc *DailyUsageProcessor) Flush() {
+	proc.mutex.Lock()
+	usage := proc.usage
+	proc.usage = make(map[string]*clientUsage)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for client, clientUsage := range usage {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("qaddress", client).
+			AddField("queries", clientUsage.queries).
+			AddField("blocked", clientUsage.blocked).
+			AddField("distinct_domains", int64(clientUsage.domains.Estimate())).
+			SetTime(now)
+		if len(clientUsage.host) > 0 {
+			point.AddTag("qhost", clientUsage.host)
+		}
+		topCategory, topCount := "", 0
+		for name, count := range clientUsage.categories {
+			if count > topCount || (count == topCount && name < topCategory) {
+				topCategory, topCount = name, count
+			}
+		}
+		if topCount > 0 {
+			point.AddField("top_category", topCategory)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
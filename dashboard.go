@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+)
+
+// dashboardHandler serves a single page that polls the management API: the message
+// rate and list sizes from /debug/vars, the top talkers from /top (with --talkers)
+// and the learned blocks from /blocks and /learned. It also has forms to edit the
+// white and black lists through /lists and to reload the lists. The page is a string
+// rather than an embedded file because go:embed needs Go 1.16.
+//noinspection GoUnusedParameter
+func dashboardHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(dashboardHtml))
+}
+
+const dashboardHtml = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>dnstap-to-influxdb</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; color: #222; background: #fafafa; }
+h1 { font-size: 1.3em; }
+h2 { font-size: 1.05em; margin: 0 0 .5em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fit, minmax(320px, 1fr)); gap: 1em; }
+.card { background: #fff; border: 1px solid #ddd; border-radius: 6px; padding: 1em; }
+.big { font-size: 2em; font-weight: bold; }
+table { width: 100%; border-collapse: collapse; font-size: .9em; }
+td, th { text-align: left; padding: 2px 4px; border-bottom: 1px solid #eee; }
+td.n { text-align: right; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>dnstap-to-influxdb <span id="version" class="muted"></span></h1>
+<div class="grid">
+  <div class="card"><h2>Messages per second</h2><div id="qps" class="big">-</div></div>
+  <div class="card"><h2>Lists</h2><table id="lists"></table></div>
+  <div class="card"><h2>Top domains (5m)</h2><table id="domains"><tr><td class="muted">-</td></tr></table></div>
+  <div class="card"><h2>Top clients (5m)</h2><table id="clients"><tr><td class="muted">-</td></tr></table></div>
+  <div class="card"><h2>Recently learned blocks</h2><table id="blocks"></table></div>
+  <div class="card">
+    <h2>Lists</h2>
+    <form id="edit">
+      <input id="domain" placeholder="example.com" required>
+      <select id="list"><option value="white">whitelist</option><option value="black">blacklist</option></select>
+      <button type="submit" data-action="add">Add</button>
+      <button type="submit" data-action="remove">Remove</button>
+    </form>
+    <p><button id="reload">Reload all lists</button> <span id="status" class="muted"></span></p>
+  </div>
+  <div class="card"><h2>All learned blocks</h2><table id="learned"></table></div>
+</div>
+<script>
+let lastFrames = null, lastTime = null;
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function fill(id, rows) {
+  const table = document.getElementById(id);
+  table.replaceChildren();
+  if (rows.length === 0) {
+    const tr = document.createElement("tr");
+    tr.appendChild(cell("none", "muted"));
+    table.appendChild(tr);
+  }
+  for (const row of rows) {
+    const tr = document.createElement("tr");
+    row.forEach((value, i) => tr.appendChild(cell(value, i > 0 && typeof value === "number" ? "n" : "")));
+    table.appendChild(tr);
+  }
+}
+
+async function getJson(path) {
+  const resp = await fetch(path);
+  if (!resp.ok) throw new Error(resp.status + " " + path);
+  return resp.json();
+}
+
+async function refreshVars() {
+  const vars = await getJson("/debug/vars");
+  const frames = (vars.pipeline || {}).decoder_frames || 0;
+  const now = Date.now();
+  if (lastFrames !== null && now > lastTime) {
+    document.getElementById("qps").textContent = ((frames - lastFrames) * 1000 / (now - lastTime)).toFixed(1);
+  }
+  lastFrames = frames;
+  lastTime = now;
+  const cnames = vars.cnames || {};
+  fill("lists", [
+    ["blocked domains", cnames.blocked_domains || 0],
+    ["learned blocks", cnames.learned_blocks || 0],
+    ["list updates", cnames.list_updates || 0],
+  ]);
+}
+
+async function refreshTop() {
+  try {
+    const top = await getJson("/top?window=5m&n=10");
+    fill("domains", top.domains.map(d => [d.key, d.count]));
+    fill("clients", top.clients.map(c => [c.key, c.count]));
+  } catch (e) {
+    fill("domains", [["start with --talkers to see the top domains"]]);
+    fill("clients", [["start with --talkers to see the top clients"]]);
+  }
+}
+
+async function refreshBlocks() {
+  const blocks = await getJson("/blocks");
+  fill("blocks", blocks.map(b => [new Date(b.time).toLocaleTimeString(), b.qname, b.host || b.client || ""]));
+}
+
+async function refreshLearned() {
+  const learned = await getJson("/learned");
+  fill("learned", Object.keys(learned).sort().map(qname => [qname, learned[qname]]));
+}
+
+async function post(path) {
+  const status = document.getElementById("status");
+  status.textContent = "working...";
+  const resp = await fetch(path, {method: "POST"});
+  status.textContent = resp.ok ? "done" : "failed: " + (await resp.text());
+  refresh();
+}
+
+document.getElementById("edit").addEventListener("submit", e => {
+  e.preventDefault();
+  const params = new URLSearchParams({
+    list: document.getElementById("list").value,
+    action: e.submitter.dataset.action,
+    domain: document.getElementById("domain").value,
+  });
+  post("/lists?" + params);
+});
+document.getElementById("reload").addEventListener("click", () => post("/updateAll"));
+
+function refresh() {
+  refreshVars().catch(() => {});
+  refreshTop();
+  refreshBlocks().catch(() => {});
+  refreshLearned().catch(() => {});
+}
+
+getJson("/version").then(v => document.getElementById("version").textContent = v.version).catch(() => {});
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
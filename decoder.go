@@ -1,12 +1,11 @@
 package main
 
 import (
-	"context"
+	"expvar"
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/golang/protobuf/proto"
 	"github.com/miekg/dns"
-	"log"
-	"net"
+	log "github.com/sirupsen/logrus"
 	"sync"
 	"time"
 )
@@ -14,37 +13,46 @@ import (
 //noinspection GoUnusedExportedType
 type Decoder interface {
 	GetChannel() chan []byte
-	AddProcessor(proc Processor)
+	AddProcessor(name string, proc Processor, overflow OverflowPolicy, filter *Filter)
 	Run(wg *sync.WaitGroup)
 }
 
-type hostItem struct {
-	host      string
-	timestamp time.Time
-}
-
 type DnsTapDecoder struct {
 	channel    chan []byte
-	processors []Processor
-	ipToHost   map[string]*hostItem
-	resolver   net.Resolver
+	processors []*processorOutput
+	matching   []*processorOutput
+	dedup      *Deduplicator
+	enricher   *Enricher
+	anonymizer *Anonymizer
+	election   *LeaderElection
+	lowercase  bool
 }
 
-func NewDnsTapDecoder(resolver string, bufferSize uint) *DnsTapDecoder {
+// malformedFrames counts frames that couldn't be decoded and were skipped.
+var malformedFrames = expvar.NewInt("malformed_frames")
+
+// malformedMessages counts the DNS payloads that couldn't be unpacked.
+var malformedMessages = expvar.NewInt("malformed_messages")
+
+var decodedFrames = new(expvar.Int)
+
+func NewDnsTapDecoder(enricher *Enricher, dedup *Deduplicator, anonymizer *Anonymizer, election *LeaderElection, lowercase bool, bufferSize uint) *DnsTapDecoder {
+	channel := make(chan []byte, bufferSize)
+	pipelineStats.Set("decoder_frames", decodedFrames)
+	pipelineStats.Set("decoder_queue_depth", expvar.Func(func() interface{} {
+		return len(channel)
+	}))
+	pipelineStats.Set("decoder_queue_capacity", expvar.Func(func() interface{} {
+		return cap(channel)
+	}))
 	return &DnsTapDecoder{
-		channel:    make(chan []byte, bufferSize),
-		processors: make([]Processor, 0),
-		ipToHost:   make(map[string]*hostItem),
-		resolver: net.Resolver{
-			PreferGo:     true,
-			StrictErrors: false,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Millisecond * 1000,
-				}
-				return d.DialContext(ctx, "udp", resolver)
-			},
-		},
+		channel:    channel,
+		processors: make([]*processorOutput, 0),
+		enricher:   enricher,
+		anonymizer: anonymizer,
+		election:   election,
+		dedup:      dedup,
+		lowercase:  lowercase,
 	}
 }
 
@@ -52,8 +60,8 @@ func (dec *DnsTapDecoder) GetChannel() chan []byte {
 	return dec.channel
 }
 
-func (dec *DnsTapDecoder) AddProcessor(proc Processor) {
-	dec.processors = append(dec.processors, proc)
+func (dec *DnsTapDecoder) AddProcessor(name string, proc Processor, overflow OverflowPolicy, filter *Filter) {
+	dec.processors = append(dec.processors, newProcessorOutput(name, proc, overflow, filter))
 }
 
 func getTime(sec *uint64, nsec *uint32) time.Time {
@@ -64,49 +72,48 @@ func getTime(sec *uint64, nsec *uint32) time.Time {
 	}
 }
 
-func getDnsMsg(msg []byte) *dns.Msg {
+func getDnsMsg(msg []byte) (*dns.Msg, error) {
 	if msg != nil {
-		m := new(dns.Msg)
+		m := dnsMsgPool.Get().(*dns.Msg)
 		err := m.Unpack(msg)
 		if err == nil {
-			return m
-		}
-	}
-	return nil
-}
-
-func (dec *DnsTapDecoder) getHost(addr []byte) string {
-	if addr != nil {
-		now := time.Now()
-		ip := net.IP(addr).String()
-		host, exists := dec.ipToHost[ip]
-		if !exists || host.timestamp.Add(time.Duration(time.Hour)).Before(now) {
-			hosts, err := dec.resolver.LookupAddr(context.Background(), ip)
-			if err == nil && len(hosts) > 0 && hosts[0] != "" {
-				host = &hostItem{hosts[0], now}
-			} else if host == nil {
-				host = &hostItem{ip, now}
-			}
-			dec.ipToHost[ip] = host
+			return m, nil
 		}
-		return host.host
+		dnsMsgPool.Put(m)
+		return nil, err
 	}
-	return ""
+	return nil, nil
 }
 
 func (dec *DnsTapDecoder) Run(wg *sync.WaitGroup) {
 	for frame := range dec.channel {
-		dt := &dnstap.Dnstap{}
+		decodedFrames.Add(1)
+		dt := dnstapPool.Get().(*dnstap.Dnstap)
+		span := startTrace("frame")
+		decodeSpan := span.Child("decode")
 
-		// decode the protobuf
+		// decode the protobuf, skipping anything that isn't a valid message
 		if err := proto.Unmarshal(frame, dt); err != nil {
-			log.Fatalf("proto.Unmarshal() failed: %s\n", err)
+			malformedFrames.Add(1)
+			log.WithError(err).Debugf("Skipping malformed frame of %d bytes", len(frame))
+			dnstapPool.Put(dt)
+			decodeSpan.End()
+			span.End()
+			continue
+		}
+		if dt.Type == nil || (*dt.Type == dnstap.Dnstap_MESSAGE && (dt.Message == nil || dt.Message.Type == nil)) {
+			malformedFrames.Add(1)
+			log.Debug("Skipping frame without a message type")
+			dnstapPool.Put(dt)
+			decodeSpan.End()
+			span.End()
+			continue
 		}
 
 		if *dt.Type == dnstap.Dnstap_MESSAGE {
 			dnstapMessage := dt.Message
 			var timestamp time.Time
-			var dnsMsg *dns.Msg
+			var payload []byte
 
 			// decode the dns info
 			switch *dnstapMessage.Type {
@@ -117,7 +124,7 @@ func (dec *DnsTapDecoder) Run(wg *sync.WaitGroup) {
 				dnstap.Message_STUB_QUERY,
 				dnstap.Message_TOOL_QUERY:
 				timestamp = getTime(dnstapMessage.QueryTimeSec, dnstapMessage.QueryTimeNsec)
-				dnsMsg = getDnsMsg(dnstapMessage.QueryMessage)
+				payload = dnstapMessage.QueryMessage
 
 			case dnstap.Message_AUTH_RESPONSE,
 				dnstap.Message_CLIENT_RESPONSE,
@@ -126,27 +133,63 @@ func (dec *DnsTapDecoder) Run(wg *sync.WaitGroup) {
 				dnstap.Message_STUB_RESPONSE,
 				dnstap.Message_TOOL_RESPONSE:
 				timestamp = getTime(dnstapMessage.ResponseTimeSec, dnstapMessage.ResponseTimeNsec)
-				dnsMsg = getDnsMsg(dnstapMessage.ResponseMessage)
+				payload = dnstapMessage.ResponseMessage
 
 			default:
 				timestamp = getTime(nil, nil)
-				dnsMsg = getDnsMsg(nil)
+			}
+			dnsMsg, unpackErr := getDnsMsg(payload)
+			if unpackErr != nil {
+				malformedMessages.Add(1)
 			}
 
-			host := dec.getHost(dnstapMessage.QueryAddress)
+			if dnsMsg != nil && dec.lowercase {
+				normalizeNames(dnsMsg)
+			}
+			decodeSpan.End()
 
 			// create a processor message
-			message := &Message{timestamp: timestamp, dnstapMessage: dnstapMessage, dnsMessage: dnsMsg, host: host}
-
-			// send the message to all configured processors
-			for _, proc := range dec.processors {
-				proc.GetChannel() <- message
+			message := newMessage()
+			message.timestamp = timestamp
+			message.dnstapMessage = dnstapMessage
+			message.dnsMessage = dnsMsg
+			if unpackErr != nil {
+				message.malformed = payload
+				message.unpackErr = unpackErr
+			}
+			message.dnstap = dt
+			message.span = span
+			if dec.anonymizer != nil {
+				dec.anonymizer.Anonymize(message)
 			}
+			enrichSpan := span.Child("enrich")
+			dec.enricher.Enrich(message)
+			enrichSpan.End()
+
+			// send the message to all processors whose filter it matches, each of which
+			// releases it. A standby sends nothing, so that only the leader writes and
+			// enforces.
+			dec.matching = dec.matching[:0]
+			keep := dec.election.IsLeader() && (dec.dedup == nil || dec.dedup.Check(message))
+			for _, output := range dec.processors {
+				if keep && output.getFilter().Match(message) {
+					dec.matching = append(dec.matching, output)
+				}
+			}
+			message.refs = int32(len(dec.matching))
+			if message.refs == 0 {
+				message.refs = 1
+				message.Release()
+			}
+			for _, output := range dec.matching {
+				output.send(message)
+			}
+		} else {
+			dnstapPool.Put(dt)
+			decodeSpan.End()
+			span.End()
 		}
 	}
 
-	for _, proc := range dec.processors {
-		close(proc.GetChannel())
-	}
 	wg.Done()
 }
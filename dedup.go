@@ -0,0 +1,107 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var duplicateMessages = expvar.NewInt("duplicate_messages")
+
+type dedupKey struct {
+	id       uint16
+	qaddress string
+	qport    uint32
+	raddress string
+	rport    uint32
+	protocol int32
+	qname    string
+	response bool
+}
+
+// Deduplicator detects the same transaction being reported more than once within a
+// short window, which happens when the resolver logs several dnstap message types.
+// It is only used by the decoder goroutine, so it needs no locking; other goroutines
+// can only ask for it to be cleared with Clear.
+type Deduplicator struct {
+	window     time.Duration
+	drop       bool
+	maxEntries int
+	seen       map[dedupKey]time.Time
+	lastPrune  time.Time
+	clear      int32
+}
+
+func NewDeduplicator(window time.Duration, drop bool, maxEntries uint) *Deduplicator {
+	return &Deduplicator{
+		window:     window,
+		drop:       drop,
+		maxEntries: int(maxEntries),
+		seen:       make(map[dedupKey]time.Time),
+		lastPrune:  time.Now(),
+	}
+}
+
+// Clear forgets every transaction the next time a message is checked.
+func (dedup *Deduplicator) Clear() {
+	atomic.StoreInt32(&dedup.clear, 1)
+}
+
+func (dedup *Deduplicator) prune(now time.Time) {
+	for key, seen := range dedup.seen {
+		if now.Sub(seen) > dedup.window {
+			delete(dedup.seen, key)
+		}
+	}
+	dedup.lastPrune = now
+}
+
+// Check marks duplicate messages and returns false if the message should be dropped.
+func (dedup *Deduplicator) Check(message *Message) bool {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	if atomic.CompareAndSwapInt32(&dedup.clear, 1, 0) {
+		dedup.seen = make(map[dedupKey]time.Time)
+	}
+	if now.Sub(dedup.lastPrune) > dedup.window {
+		dedup.prune(now)
+	}
+
+	dm := message.dnstapMessage
+	key := dedupKey{
+		id:       message.dnsMessage.Id,
+		qaddress: string(dm.QueryAddress),
+		raddress: string(dm.ResponseAddress),
+		qname:    strings.ToLower(message.dnsMessage.Question[0].Name),
+		response: message.dnsMessage.Response,
+	}
+	if dm.QueryPort != nil {
+		key.qport = *dm.QueryPort
+	}
+	if dm.ResponsePort != nil {
+		key.rport = *dm.ResponsePort
+	}
+	if dm.SocketProtocol != nil {
+		key.protocol = int32(*dm.SocketProtocol)
+	}
+
+	if seen, exists := dedup.seen[key]; exists && now.Sub(seen) <= dedup.window {
+		duplicateMessages.Add(1)
+		message.duplicate = true
+		return !dedup.drop
+	}
+	if dedup.maxEntries > 0 && len(dedup.seen) >= dedup.maxEntries {
+		// prune early, and if the window still holds too many transactions, stop
+		// tracking new ones until it has moved on
+		dedup.prune(now)
+		if len(dedup.seen) >= dedup.maxEntries {
+			return true
+		}
+	}
+	dedup.seen[key] = now
+	return true
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dgaStats counts the names scored and the clients flagged.
+var dgaStats = expvar.NewMap("dga")
+
+// commonBigrams are the most frequent letter pairs in English text and in the names of
+// popular domains. Machine generated labels contain few of them.
+var commonBigrams = func() map[string]bool {
+	bigrams := make(map[string]bool)
+	for _, bigram := range strings.Fields(`
+		th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng se ha as ou
+		io le ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la ns di
+		fo ho pe ec pr no ct us ac ot il tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em
+		ad ol rt po we na ul ni ts mo ow pa im mi ai sh ir su id os iv ia am fi ci vi pl ig
+		tu ev ld ry mp fe bl ab gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo sp rd do
+		uc bu ei ov by rm ep tt oc fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va
+		um pp ua up lu go ht ru ug ds lt pi rc rr eg au ck ew mu br bi pt ak pu ui rg ib tl
+		ny ki rk ys ob mm fu ph og ms ye ud mb ip ub oi rl gu dr hr cc tw ft wn nu af hu nn
+		eo vo rv nf xp gn sm fl iz ok nl my gl aw ju oa eq sy sl ps jo lf nv je nk kn gs dy
+		hy ze ks xt bs ik dd cy rp sk xi oe oy ws lv dl rf eu dg wr xa yi nm eb rb tm xc eh
+		tc gy ja hn yp za gg ym sw bj lm cs ii ix xe oh lk dv lp ax ox uf dm iu sf bt ka yt
+		ek pm ya gt wl rh yl hs ah yc yn rw hm lw hl ae zi az lc py aj iq nj bb nh uo kl lb
+		tn gm sn nr fs py
+	`) {
+		bigrams[bigram] = true
+	}
+	return bigrams
+}()
+
+// dgaScore rates how machine generated a domain label looks, from 0 (a dictionary
+// word) to 1 (random). It combines the character entropy, the share of uncommon
+// bigrams, the share of digits and the longest run of consonants.
+func dgaScore(label string) float64 {
+	label = strings.ToLower(label)
+	if len(label) < 6 {
+		return 0
+	}
+
+	counts := make(map[rune]int)
+	digits := 0
+	consonants, longestConsonants := 0, 0
+	for _, c := range label {
+		counts[c]++
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			consonants = 0
+		case strings.ContainsRune("aeiouy-", c):
+			consonants = 0
+		default:
+			consonants++
+			if consonants > longestConsonants {
+				longestConsonants = consonants
+			}
+		}
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(label))
+		entropy -= p * math.Log2(p)
+	}
+	// the entropy of a label of random letters and digits approaches log2(36)
+	entropyScore := entropy / math.Log2(math.Min(float64(len(label)), 36))
+
+	bigrams, uncommon := 0, 0
+	for i := 0; i+2 <= len(label); i++ {
+		bigram := label[i : i+2]
+		if strings.ContainsAny(bigram, "-0123456789") {
+			continue
+		}
+		bigrams++
+		if !commonBigrams[bigram] {
+			uncommon++
+		}
+	}
+	bigramScore := 0.0
+	if bigrams > 0 {
+		bigramScore = float64(uncommon) / float64(bigrams)
+	}
+
+	digitScore := float64(digits) / float64(len(label))
+	consonantScore := math.Min(float64(longestConsonants)/6, 1)
+	return 0.35*entropyScore + 0.35*bigramScore + 0.15*digitScore + 0.15*consonantScore
+}
+
+// dgaLabel returns the label of a query name that identifies the domain, i.e. the one
+// left of the public suffix.
+func dgaLabel(qname string) string {
+	domain := registeredDomain(qname)
+	if i := strings.IndexByte(domain, '.'); i > 0 {
+		return domain[:i]
+	}
+	return ""
+}
+
+type dgaClient struct {
+	host       string
+	names      int
+	totalScore float64
+	suspicious int
+}
+
+// DgaProcessor scores the names of NXDOMAIN responses for how machine generated they
+// look and writes a per-client summary every interval. Malware using a domain
+// generation algorithm looks up many random names that don't exist, so clients with
+// many high scoring NXDOMAINs are flagged.
+type DgaProcessor struct {
+	baseProcessor
+	writeApi      *api.WriteApi
+	measurement   string
+	threshold     float64
+	minSuspicious int
+	interval      time.Duration
+	mutex         sync.Mutex
+	clients       map[string]*dgaClient
+}
+
+func NewDgaProcessor(writeApi *api.WriteApi, measurement string, threshold float64, minSuspicious uint, interval time.Duration, bufferSize uint) *DgaProcessor {
+	return &DgaProcessor{
+		baseProcessor: newBaseProcessor("dga", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		threshold:     threshold,
+		minSuspicious: int(minSuspicious),
+		interval:      interval,
+		clients:       make(map[string]*dgaClient),
+	}
+}
+
+func (proc *DgaProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *DgaProcessor) run() {
+	proc.consume(proc.score)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *DgaProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *DgaProcessor) score(message *Message) {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 || message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	label := dgaLabel(message.dnsMessage.Question[0].Name)
+	if len(label) == 0 {
+		return
+	}
+	score := dgaScore(label)
+	dgaStats.Add("scored", 1)
+
+	client := net.IP(message.dnstapMessage.QueryAddress).String()
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	entry := proc.clients[client]
+	if entry == nil {
+		entry = &dgaClient{}
+		proc.clients[client] = entry
+	}
+	entry.host = message.host
+	entry.names++
+	entry.totalScore += score
+	if score >= proc.threshold {
+		entry.suspicious++
+	}
+}
+
+// Flush writes the per-client summaries since the last flush.
+func (proc *DgaProcessor) Flush() {
+	proc.mutex.Lock()
+	clients := proc.clients
+	proc.clients = make(map[string]*dgaClient)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for client, entry := range clients {
+		flagged := entry.suspicious >= proc.minSuspicious
+		if flagged {
+			dgaStats.Add("flagged_clients", 1)
+		}
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("qaddress", client).
+			AddField("nxdomains", entry.names).
+			AddField("mean_score", entry.totalScore/float64(entry.names)).
+			AddField("suspicious", entry.suspicious).
+			AddField("flagged", flagged).
+			SetTime(now)
+		if len(entry.host) > 0 {
+			point.AddTag("qhost", entry.host)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
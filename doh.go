@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// dohClient looks up PTR records with DNS-over-HTTPS (RFC 8484).
+type dohClient struct {
+	url    string
+	client *http.Client
+}
+
+func newDohClient(url string) *dohClient {
+	return &dohClient{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (doh *dohClient) LookupAddr(ctx context.Context, ip string) ([]string, error) {
+	arpa, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(arpa, dns.TypePTR)
+	// the id is 0 so that responses can be cached by HTTP caches
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, doh.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := doh.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("got rcode %s", dns.RcodeToString[response.Rcode])
+	}
+
+	var hosts []string
+	for _, rr := range response.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			hosts = append(hosts, ptr.Ptr)
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EnforcerCommand int
+
+const (
+	ZoneAdd    EnforcerCommand = 1
+	ZoneRemove                 = 2
+	DataAdd                    = 3
+	DataRemove                 = 4
+)
+
+func (cmd EnforcerCommand) String() string {
+	switch cmd {
+	case ZoneAdd:
+		return "zone add"
+	case ZoneRemove:
+		return "zone remove"
+	case DataAdd:
+		return "data add"
+	case DataRemove:
+		return "data remove"
+	default:
+		return fmt.Sprintf("EnforcerCommand(%d)", int(cmd))
+	}
+}
+
+type EnforcerCommandMessage struct {
+	cmd    EnforcerCommand
+	domain string
+	data   string
+}
+
+// Enforcer is a backend that pushes learned blocks and custom local data into the
+// resolver. Commands are sent on its channel and applied by Run until it is closed.
+// Probe checks that the backend can be reached without changing anything.
+type Enforcer interface {
+	GetChannel() chan *EnforcerCommandMessage
+	Run(wg *sync.WaitGroup)
+	Probe() error
+}
+
+type BlockAction int
+
+const (
+	BlockNxdomain BlockAction = iota
+	BlockNodata
+	BlockSinkhole
+	BlockCname
+)
+
+// ParseBlockAction validates the --block-action/--block-target flag pair. The sinkhole
+// action needs an IP address as the target and the cname action needs a host name.
+func ParseBlockAction(action, target string) (BlockAction, string, error) {
+	switch action {
+	case "nxdomain":
+		return BlockNxdomain, "", nil
+	case "nodata":
+		return BlockNodata, "", nil
+	case "sinkhole":
+		if net.ParseIP(target) == nil {
+			return BlockSinkhole, "", fmt.Errorf("block action \"%s\" needs an IP address target, got \"%s\"", action, target)
+		}
+		return BlockSinkhole, target, nil
+	case "cname":
+		if len(target) == 0 {
+			return BlockCname, "", fmt.Errorf("block action \"%s\" needs a host name target", action)
+		}
+		if !strings.HasSuffix(target, ".") {
+			target += "."
+		}
+		return BlockCname, target, nil
+	default:
+		return BlockNxdomain, "", fmt.Errorf("invalid block action \"%s\"", action)
+	}
+}
+
+func NewEnforcer(kind string, blockAction BlockAction, blockTarget, rpzFile, knotSocket string) (Enforcer, error) {
+	switch kind {
+	case "unbound":
+		return NewUnbound(blockAction, blockTarget)
+	case "knot":
+		return NewKnotResolver(knotSocket, blockAction, blockTarget)
+	case "rpz":
+		return NewRpzEnforcer(rpzFile, blockAction, blockTarget)
+	case "none":
+		return NewNoopEnforcer(), nil
+	default:
+		return nil, fmt.Errorf("invalid enforcer \"%s\"", kind)
+	}
+}
+
+// EnforcerHealth probes an enforcer every interval, so that /readyz reports a
+// resolver that can't be reached before a learned block fails to be pushed into it.
+type EnforcerHealth struct {
+	enforcer Enforcer
+	interval time.Duration
+	mutex    sync.Mutex
+	err      error
+}
+
+func NewEnforcerHealth(enforcer Enforcer, interval time.Duration) *EnforcerHealth {
+	return &EnforcerHealth{enforcer: enforcer, interval: interval}
+}
+
+// Run probes the enforcer right away and then every interval until ctx is done.
+func (health *EnforcerHealth) Run(ctx context.Context) {
+	health.probe()
+	ticker := time.NewTicker(health.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			health.probe()
+		}
+	}
+}
+
+func (health *EnforcerHealth) probe() {
+	err := health.enforcer.Probe()
+	health.mutex.Lock()
+	failed := health.err != nil
+	health.err = err
+	health.mutex.Unlock()
+	if err != nil && !failed {
+		log.WithError(err).Warn("Enforcer probe failed")
+	} else if err == nil && failed {
+		log.Info("Enforcer probe succeeded again")
+		annotations.Annotate("enforcer_reconnect", "enforcer probe succeeded again")
+	}
+}
+
+// Ready returns the error of the last probe.
+func (health *EnforcerHealth) Ready() error {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.err
+}
+
+func RegisterEnforcerHandlers(enforcer Enforcer, server *ManagementServer) {
+	server.HandleFunc("/dataAdd", func(w http.ResponseWriter, req *http.Request) {
+		enforcerDataHandler(enforcer, w, req, DataAdd)
+	})
+	server.HandleFunc("/dataRemove", func(w http.ResponseWriter, req *http.Request) {
+		enforcerDataHandler(enforcer, w, req, DataRemove)
+	})
+}
+
+// enforcerDataHandler reads one record (for DataAdd) or one name (for DataRemove) per
+// line of the request body. Every line is validated before any command is sent.
+func enforcerDataHandler(enforcer Enforcer, w http.ResponseWriter, req *http.Request, command EnforcerCommand) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var messages []*EnforcerCommandMessage
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if command == DataAdd {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				http.Error(w, fmt.Sprintf("invalid record \"%s\": %v", line, err), http.StatusBadRequest)
+				return
+			}
+			messages = append(messages, &EnforcerCommandMessage{cmd: DataAdd, domain: rr.Header().Name, data: rr.String()})
+		} else {
+			if _, ok := dns.IsDomainName(line); !ok {
+				http.Error(w, fmt.Sprintf("invalid name \"%s\"", line), http.StatusBadRequest)
+				return
+			}
+			messages = append(messages, &EnforcerCommandMessage{cmd: DataRemove, domain: dns.Fqdn(line)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("something went wrong: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	for _, message := range messages {
+		log.Infof("Local data command %d for \"%s\"", message.cmd, message.domain)
+		enforcer.GetChannel() <- message
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// NoopEnforcer only logs the commands it receives. It is used when there is no resolver
+// to push blocks into, e.g. when built with the nounbound tag.
+type NoopEnforcer struct {
+	messages chan *EnforcerCommandMessage
+}
+
+func NewNoopEnforcer() *NoopEnforcer {
+	return &NoopEnforcer{
+		messages: make(chan *EnforcerCommandMessage, 1000),
+	}
+}
+
+func (noop *NoopEnforcer) GetChannel() chan *EnforcerCommandMessage {
+	return noop.messages
+}
+
+func (noop *NoopEnforcer) Probe() error {
+	return nil
+}
+
+func (noop *NoopEnforcer) Run(wg *sync.WaitGroup) {
+	for message := range noop.messages {
+		log.Debugf("Ignoring enforcer command %s for \"%s\"", message.cmd, message.domain)
+	}
+	wg.Done()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// probedEnforcer is an enforcer whose probe returns the next of its errors.
+type probedEnforcer struct {
+	NoopEnforcer
+	errors []error
+}
+
+func (probed *probedEnforcer) Probe() error {
+	err := probed.errors[0]
+	probed.errors = probed.errors[1:]
+	return err
+}
+
+func TestEnforcerHealth(t *testing.T) {
+	unreachable := errors.New("unreachable")
+	enforcer := &probedEnforcer{errors: []error{nil, unreachable, unreachable, nil}}
+	health := NewEnforcerHealth(enforcer, 0)
+	for i, want := range []error{nil, unreachable, unreachable, nil} {
+		health.probe()
+		if err := health.Ready(); err != want {
+			t.Errorf("Ready() after probe %d = %v, want %v", i+1, err, want)
+		}
+	}
+}
+
+func TestEnforcerCommandString(t *testing.T) {
+	tests := []struct {
+		cmd  EnforcerCommand
+		want string
+	}{
+		{ZoneAdd, "zone add"},
+		{ZoneRemove, "zone remove"},
+		{DataAdd, "data add"},
+		{DataRemove, "data remove"},
+		{7, "EnforcerCommand(7)"},
+	}
+	for _, test := range tests {
+		if s := test.cmd.String(); s != test.want {
+			t.Errorf("String() = %q, want %q", s, test.want)
+		}
+	}
+}
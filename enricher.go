@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"net"
+	"strings"
+)
+
+// HostFormat is how host names are rendered in the qhost tag and elsewhere.
+type HostFormat struct {
+	style string
+	lower bool
+}
+
+// ParseHostFormat parses a comma separated host format: one of raw (as looked up, with
+// the trailing dot), fqdn (without the trailing dot), short (the first label) or
+// combined ("host (ip)"), optionally with lower to lower case the name, e.g.
+// "short,lower".
+func ParseHostFormat(value string) (HostFormat, error) {
+	format := HostFormat{style: "raw"}
+	for _, option := range strings.Split(value, ",") {
+		switch option = strings.TrimSpace(option); option {
+		case "raw", "fqdn", "short", "combined":
+			format.style = option
+		case "lower":
+			format.lower = true
+		case "":
+		default:
+			return format, fmt.Errorf("invalid host format \"%s\"", option)
+		}
+	}
+	return format, nil
+}
+
+// Format renders the host name of ip. A host that is just the IP, because no name is
+// known yet, is returned as is.
+func (format HostFormat) Format(host, ip string) string {
+	if host == ip || len(host) == 0 {
+		return host
+	}
+	if format.lower {
+		host = strings.ToLower(host)
+	}
+	switch format.style {
+	case "fqdn":
+		return strings.TrimSuffix(host, ".")
+	case "short":
+		if i := strings.Index(host, "."); i > 0 {
+			return host[:i]
+		}
+		return host
+	case "combined":
+		return fmt.Sprintf("%s (%s)", strings.TrimSuffix(host, "."), ip)
+	}
+	return host
+}
+
+// Enricher adds the client and address information to messages that isn't part of
+// the dnstap data: host names, MAC addresses, locations and client groups. Any of
+// its sources may be nil.
+type Enricher struct {
+	reverse   *ReverseResolver
+	hosts     *HostSources
+	neighbors *NeighborTable
+	geoIP     *GeoIP
+	groups    *ClientGroups
+	unicode   bool
+	format    HostFormat
+	rhosts    bool
+}
+
+func NewEnricher(reverse *ReverseResolver, hosts *HostSources, neighbors *NeighborTable, geoIP *GeoIP, groups *ClientGroups, unicode bool) *Enricher {
+	return &Enricher{
+		reverse:   reverse,
+		hosts:     hosts,
+		neighbors: neighbors,
+		geoIP:     geoIP,
+		groups:    groups,
+		unicode:   unicode,
+		format:    HostFormat{style: "raw"},
+	}
+}
+
+// ResolveResponders enables the host names of the servers that resolver and
+// forwarder messages were sent to.
+func (enricher *Enricher) ResolveResponders(enabled bool) {
+	enricher.rhosts = enabled
+}
+
+// SetHostFormat sets how host names are rendered.
+func (enricher *Enricher) SetHostFormat(format HostFormat) {
+	enricher.format = format
+}
+
+// GetHost returns the host name for addr in the host format, preferring the host
+// sources over reverse lookups. The IP is returned until a host name is known.
+func (enricher *Enricher) GetHost(addr []byte) string {
+	if addr == nil {
+		return ""
+	}
+	ip := net.IP(addr).String()
+	if enricher.hosts != nil {
+		if host, exists := enricher.hosts.Lookup(ip); exists {
+			return enricher.format.Format(host, ip)
+		}
+	}
+	if enricher.reverse != nil {
+		return enricher.format.Format(enricher.reverse.GetHost(ip), ip)
+	}
+	return ip
+}
+
+func (enricher *Enricher) Enrich(message *Message) {
+	dnstapMessage := message.dnstapMessage
+	message.host = enricher.GetHost(dnstapMessage.QueryAddress)
+	message.clientGroup = enricher.groups.Lookup(dnstapMessage.QueryAddress)
+	if enricher.rhosts {
+		switch *dnstapMessage.Type {
+		case dnstap.Message_RESOLVER_QUERY,
+			dnstap.Message_RESOLVER_RESPONSE,
+			dnstap.Message_FORWARDER_QUERY,
+			dnstap.Message_FORWARDER_RESPONSE:
+			message.rhost = enricher.GetHost(dnstapMessage.ResponseAddress)
+		}
+	}
+	if enricher.unicode && message.dnsMessage != nil && len(message.dnsMessage.Question) > 0 {
+		message.qnameUnicode, _ = unicodeName(message.dnsMessage.Question[0].Name)
+	}
+	if enricher.neighbors != nil && dnstapMessage.QueryAddress != nil {
+		message.mac, message.vendor = enricher.neighbors.Lookup(net.IP(dnstapMessage.QueryAddress).String())
+	}
+	if enricher.geoIP != nil {
+		message.qgeo = enricher.geoIP.Lookup(dnstapMessage.QueryAddress)
+		message.rgeo = enricher.geoIP.Lookup(dnstapMessage.ResponseAddress)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+type errorClass struct {
+	count  int
+	logged int
+}
+
+// ErrorLogLimiter limits how many errors of each class are logged per window, so that
+// an outage doesn't flood the log with one line per failure. At the end of every
+// window a summary line is logged for each class that had errors.
+type ErrorLogLimiter struct {
+	mutex   sync.Mutex
+	burst   int
+	window  time.Duration
+	classes map[string]*errorClass
+}
+
+var errorLog = NewErrorLogLimiter(5, time.Minute)
+
+func NewErrorLogLimiter(burst uint, window time.Duration) *ErrorLogLimiter {
+	return &ErrorLogLimiter{
+		burst:   int(burst),
+		window:  window,
+		classes: make(map[string]*errorClass),
+	}
+}
+
+func SetErrorLogLimit(burst uint, window time.Duration) {
+	errorLog = NewErrorLogLimiter(burst, window)
+}
+
+// Allow counts an error of the class and reports whether it should be logged. Every
+// error is logged when the window is 0.
+func (limiter *ErrorLogLimiter) Allow(class string) bool {
+	if limiter.window <= 0 {
+		return true
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	entry := limiter.classes[class]
+	if entry == nil {
+		entry = &errorClass{}
+		limiter.classes[class] = entry
+	}
+	entry.count++
+	if entry.logged >= limiter.burst {
+		return false
+	}
+	entry.logged++
+	return true
+}
+
+// Run logs the summaries at the end of every window until ctx is cancelled.
+func (limiter *ErrorLogLimiter) Run(ctx context.Context) {
+	if limiter.window <= 0 {
+		return
+	}
+	ticker := time.NewTicker(limiter.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			limiter.summarize()
+		}
+	}
+}
+
+func (limiter *ErrorLogLimiter) summarize() {
+	limiter.mutex.Lock()
+	classes := limiter.classes
+	limiter.classes = make(map[string]*errorClass)
+	limiter.mutex.Unlock()
+
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := classes[name]
+		if suppressed := entry.count - entry.logged; suppressed > 0 {
+			log.Warnf("%d %s errors in the last %s (%d not logged)", entry.count, name, limiter.window, suppressed)
+		} else {
+			log.Infof("%d %s errors in the last %s", entry.count, name, limiter.window)
+		}
+	}
+}
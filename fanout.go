@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowDropOldest
+	OverflowDropNewest
+)
+
+// droppedMessages counts the messages dropped per processor because its channel was full.
+var droppedMessages = expvar.NewMap("dropped_messages")
+
+// pipelineStats has the throughput, queue depth and backpressure of every stage.
+var pipelineStats = expvar.NewMap("pipeline")
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch policy {
+	case "block":
+		return OverflowBlock, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	default:
+		return OverflowBlock, fmt.Errorf("invalid overflow policy \"%s\"", policy)
+	}
+}
+
+// processorOutput is a processor registered with the decoder, along with the messages
+// it wants and what to do when it can't keep up.
+type processorOutput struct {
+	name      string
+	processor Processor
+	overflow  OverflowPolicy
+	filter    atomic.Value
+	dropped   *expvar.Int
+	sent      *expvar.Int
+	blockedNs *expvar.Int
+	highWater *expvar.Int
+}
+
+func newProcessorOutput(name string, proc Processor, overflow OverflowPolicy, filter *Filter) *processorOutput {
+	output := &processorOutput{
+		name:      name,
+		processor: proc,
+		overflow:  overflow,
+		dropped:   new(expvar.Int),
+		sent:      new(expvar.Int),
+		blockedNs: new(expvar.Int),
+		highWater: new(expvar.Int),
+	}
+	output.setFilter(filter)
+	droppedMessages.Set(name, output.dropped)
+	pipelineStats.Set(name+"_sent", output.sent)
+	pipelineStats.Set(name+"_blocked_ns", output.blockedNs)
+	pipelineStats.Set(name+"_queue_high_watermark", output.highWater)
+	pipelineStats.Set(name+"_queue_depth", expvar.Func(func() interface{} {
+		return len(proc.GetChannel())
+	}))
+	pipelineStats.Set(name+"_queue_capacity", expvar.Func(func() interface{} {
+		return cap(proc.GetChannel())
+	}))
+	return output
+}
+
+func (output *processorOutput) getFilter() *Filter {
+	return output.filter.Load().(*Filter)
+}
+
+// setFilter replaces the filter. It is safe to call while the decoder is running.
+func (output *processorOutput) setFilter(filter *Filter) {
+	output.filter.Store(filter)
+}
+
+func (output *processorOutput) send(message *Message) {
+	channel := output.processor.GetChannel()
+	if depth := int64(len(channel)) + 1; depth > output.highWater.Value() {
+		output.highWater.Set(depth)
+	}
+	switch output.overflow {
+	case OverflowDropNewest:
+		select {
+		case channel <- message:
+			output.sent.Add(1)
+		default:
+			output.dropped.Add(1)
+			message.Release()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case channel <- message:
+				output.sent.Add(1)
+				return
+			default:
+				// make room by discarding the oldest queued message
+				select {
+				case oldest := <-channel:
+					output.dropped.Add(1)
+					oldest.Release()
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case channel <- message:
+		default:
+			start := time.Now()
+			channel <- message
+			output.blockedNs.Add(int64(time.Since(start)))
+		}
+		output.sent.Add(1)
+	}
+}
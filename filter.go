@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Filter is a conjunction of terms that a message must match to be sent to a
+// processor. Terms are separated by commas and have the form key=value, key!=value or
+// a bare key for boolean terms; a leading ! negates a term. A value may list several
+// alternatives separated by |. Supported keys:
+//
+//	type     dnstap message type (CLIENT_RESPONSE, FORWARDER_QUERY, ...)
+//	qtype    question type (A, AAAA, PTR, ...)
+//	rcode    response code (NOERROR, NXDOMAIN, ...)
+//	opcode   DNS opcode (QUERY, NOTIFY, UPDATE, ...)
+//	qname    question name, matching the name and all of its subdomains
+//	client   query address network in CIDR notation
+//	group    client group label
+//	answers  the message has at least one answer record
+//	rrtype   the answer section has a record of the type (A, TXT, ...)
+//	identity dnstap identity of the server that sent the message
+//	zone     dnstap query zone (the view or zone the resolver answered from)
+//	malformed the DNS payload couldn't be unpacked
+//	dga      the DGA score (0 to 1) of the question name is at least the value
+type Filter struct {
+	terms []filterTerm
+}
+
+// filterTerm matches messages, and the query records kept by --recent if the record
+// has what the term looks at.
+type filterTerm struct {
+	term   string
+	negate bool
+	match  func(message *Message) bool
+	record func(record *QueryRecord) bool
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+	filter := &Filter{}
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+		parsed, err := parseFilterTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		filter.terms = append(filter.terms, parsed)
+	}
+	return filter, nil
+}
+
+func parseFilterTerm(term string) (filterTerm, error) {
+	negate := false
+	if strings.HasPrefix(term, "!") {
+		negate = true
+		term = term[1:]
+	}
+
+	var key, value string
+	if i := strings.Index(term, "!="); i >= 0 {
+		key, value = term[:i], term[i+2:]
+		negate = !negate
+	} else if i := strings.IndexByte(term, '='); i >= 0 {
+		key, value = term[:i], term[i+1:]
+	} else {
+		key = term
+	}
+	values := strings.Split(value, "|")
+
+	var match func(message *Message) bool
+	var record func(record *QueryRecord) bool
+	switch key {
+	case "type":
+		match = func(message *Message) bool {
+			return containsString(values, message.dnstapMessage.Type.String())
+		}
+		record = func(record *QueryRecord) bool {
+			return containsString(values, record.Type)
+		}
+	case "qtype":
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && len(message.dnsMessage.Question) > 0 &&
+				containsString(values, dns.Type(message.dnsMessage.Question[0].Qtype).String())
+		}
+		record = func(record *QueryRecord) bool {
+			return containsString(values, record.Qtype)
+		}
+	case "rcode":
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && containsString(values, dns.RcodeToString[message.dnsMessage.Rcode])
+		}
+		record = func(record *QueryRecord) bool {
+			return containsString(values, record.Rcode)
+		}
+	case "opcode":
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && containsString(values, dns.OpcodeToString[message.dnsMessage.Opcode])
+		}
+	case "qname":
+		for i := range values {
+			values[i] = dns.Fqdn(strings.ToLower(values[i]))
+		}
+		inDomains := func(qname string) bool {
+			qname = strings.ToLower(qname)
+			for _, value := range values {
+				if dns.IsSubDomain(value, qname) {
+					return true
+				}
+			}
+			return false
+		}
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && len(message.dnsMessage.Question) > 0 &&
+				inDomains(message.dnsMessage.Question[0].Name)
+		}
+		record = func(record *QueryRecord) bool {
+			return len(record.Qname) > 0 && inDomains(record.Qname)
+		}
+	case "client":
+		networks := make([]*net.IPNet, 0, len(values))
+		for _, value := range values {
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return filterTerm{}, err
+			}
+			networks = append(networks, network)
+		}
+		inNetworks := func(ip net.IP) bool {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+		match = func(message *Message) bool {
+			return inNetworks(net.IP(message.dnstapMessage.QueryAddress))
+		}
+		record = func(record *QueryRecord) bool {
+			return inNetworks(net.ParseIP(record.Client))
+		}
+	case "group":
+		match = func(message *Message) bool {
+			return containsString(values, message.clientGroup)
+		}
+		record = func(record *QueryRecord) bool {
+			return containsString(values, record.Group)
+		}
+	case "answers":
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && len(message.dnsMessage.Answer) > 0
+		}
+		record = func(record *QueryRecord) bool {
+			return len(record.Answers) > 0
+		}
+	case "rrtype":
+		match = func(message *Message) bool {
+			if message.dnsMessage == nil {
+				return false
+			}
+			for _, rr := range message.dnsMessage.Answer {
+				if containsString(values, dns.Type(rr.Header().Rrtype).String()) {
+					return true
+				}
+			}
+			return false
+		}
+		record = func(record *QueryRecord) bool {
+			// the answers are in presentation format: name, ttl, class, type, data
+			for _, answer := range record.Answers {
+				if fields := strings.Fields(answer); len(fields) > 3 && containsString(values, fields[3]) {
+					return true
+				}
+			}
+			return false
+		}
+	case "identity":
+		match = func(message *Message) bool {
+			return containsString(values, string(message.dnstap.Identity))
+		}
+	case "zone":
+		for i := range values {
+			values[i] = dns.Fqdn(strings.ToLower(values[i]))
+		}
+		match = func(message *Message) bool {
+			return containsString(values, queryZone(message))
+		}
+	case "malformed":
+		match = func(message *Message) bool {
+			return message.unpackErr != nil
+		}
+	case "dga":
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filterTerm{}, fmt.Errorf("invalid dga score in filter term \"%s\"", term)
+		}
+		isDga := func(qname string) bool {
+			label := dgaLabel(qname)
+			return len(label) > 0 && dgaScore(label) >= threshold
+		}
+		match = func(message *Message) bool {
+			return message.dnsMessage != nil && len(message.dnsMessage.Question) > 0 &&
+				isDga(message.dnsMessage.Question[0].Name)
+		}
+		record = func(record *QueryRecord) bool {
+			return len(record.Qname) > 0 && isDga(record.Qname)
+		}
+	default:
+		return filterTerm{}, fmt.Errorf("invalid filter term \"%s\"", term)
+	}
+	if key != "answers" && key != "malformed" && len(value) == 0 {
+		return filterTerm{}, fmt.Errorf("filter term \"%s\" needs a value", term)
+	}
+	return filterTerm{term: term, negate: negate, match: match, record: record}, nil
+}
+
+// queryZone returns the lower case dnstap query zone of a message, or an empty string
+// if it has none.
+func queryZone(message *Message) string {
+	if message.dnstapMessage.QueryZone == nil {
+		return ""
+	}
+	name, _, err := dns.UnpackDomainName(message.dnstapMessage.QueryZone, 0)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(name)
+}
+
+// And returns a filter that matches the messages matching both filters. Either filter
+// may be nil.
+func (filter *Filter) And(other *Filter) *Filter {
+	if filter == nil {
+		return other
+	}
+	if other == nil {
+		return filter
+	}
+	combined := &Filter{terms: make([]filterTerm, 0, len(filter.terms)+len(other.terms))}
+	combined.terms = append(combined.terms, filter.terms...)
+	combined.terms = append(combined.terms, other.terms...)
+	return combined
+}
+
+// Match returns true when the message matches every term. A nil filter matches all
+// messages.
+func (filter *Filter) Match(message *Message) bool {
+	if filter == nil {
+		return true
+	}
+	for _, term := range filter.terms {
+		if term.match(message) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRecordFilter parses a filter for the query records kept by --recent. The records
+// don't keep the opcode, identity, zone or payload of their message, so those terms
+// are rejected.
+func ParseRecordFilter(expr string) (*Filter, error) {
+	filter, err := ParseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, term := range filter.terms {
+		if term.record == nil {
+			return nil, fmt.Errorf("filter term \"%s\" can't be applied to records", term.term)
+		}
+	}
+	return filter, nil
+}
+
+// MatchRecord returns true when the record matches every term. A nil filter matches
+// all records. The filter must have been parsed with ParseRecordFilter.
+func (filter *Filter) MatchRecord(record *QueryRecord) bool {
+	if filter == nil {
+		return true
+	}
+	for _, term := range filter.terms {
+		if term.record(record) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+// filterMessage returns a client response from 192.168.1.20 for www.example.com that
+// answers with an A record.
+func filterMessage(t *testing.T) *Message {
+	msg := new(dns.Msg)
+	msg.SetQuestion("WWW.Example.com.", dns.TypeA)
+	msg.Response = true
+	rr, err := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, rr)
+	return &Message{
+		dnstapMessage: &dnstap.Message{
+			Type:         dnstap.Message_CLIENT_RESPONSE.Enum(),
+			QueryAddress: net.ParseIP("192.168.1.20").To4(),
+		},
+		dnsMessage:  msg,
+		dnstap:      &dnstap.Dnstap{Identity: []byte("resolver")},
+		clientGroup: "kids",
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	message := filterMessage(t)
+	record := newQueryRecord(message)
+	tests := []struct {
+		expr  string
+		match bool
+		// the records can't be matched on terms they don't keep
+		noRecord bool
+	}{
+		{expr: "", match: true},
+		{expr: " , ", match: true},
+		{expr: "type=CLIENT_RESPONSE", match: true},
+		{expr: "type=CLIENT_QUERY", match: false},
+		{expr: "type=CLIENT_QUERY|CLIENT_RESPONSE", match: true},
+		{expr: "type!=CLIENT_RESPONSE", match: false},
+		{expr: "!type=CLIENT_RESPONSE", match: false},
+		{expr: "!type!=CLIENT_RESPONSE", match: true},
+		{expr: "qtype=A", match: true},
+		{expr: "qtype!=PTR", match: true},
+		{expr: "rcode=NOERROR", match: true},
+		{expr: "rcode=NXDOMAIN|SERVFAIL", match: false},
+		{expr: "qname=example.com", match: true},
+		{expr: "qname=www.example.com.", match: true},
+		{expr: "qname=a.www.example.com", match: false},
+		{expr: "qname=example.net|example.com", match: true},
+		{expr: "client=192.168.1.0/24", match: true},
+		{expr: "client=10.0.0.0/8|192.168.1.20/32", match: true},
+		{expr: "client=10.0.0.0/8", match: false},
+		{expr: "group=kids", match: true},
+		{expr: "group!=kids", match: false},
+		{expr: "answers", match: true},
+		{expr: "!answers", match: false},
+		{expr: "rrtype=A", match: true},
+		{expr: "rrtype=CNAME|AAAA", match: false},
+		{expr: "dga=0", match: true},
+		{expr: "type=CLIENT_RESPONSE,qtype=A,client=192.168.1.0/24", match: true},
+		{expr: "type=CLIENT_RESPONSE,qtype=AAAA", match: false},
+		{expr: "opcode=QUERY", match: true, noRecord: true},
+		{expr: "identity=resolver", match: true, noRecord: true},
+		{expr: "identity=other", match: false, noRecord: true},
+		{expr: "zone=example.com", match: false, noRecord: true},
+		{expr: "malformed", match: false, noRecord: true},
+		{expr: "!malformed", match: true, noRecord: true},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %s", test.expr, err)
+			continue
+		}
+		if match := filter.Match(message); match != test.match {
+			t.Errorf("%q: Match() = %t, want %t", test.expr, match, test.match)
+		}
+
+		recordFilter, err := ParseRecordFilter(test.expr)
+		if test.noRecord {
+			if err == nil {
+				t.Errorf("ParseRecordFilter(%q) didn't fail", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecordFilter(%q) failed: %s", test.expr, err)
+			continue
+		}
+		if match := recordFilter.MatchRecord(&record); match != test.match {
+			t.Errorf("%q: MatchRecord() = %t, want %t", test.expr, match, test.match)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"bogus=1",
+		"qtype",
+		"qtype=",
+		"client=192.168.1.20",
+		"dga=high",
+		"type=CLIENT_QUERY,nope",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) didn't fail", expr)
+		}
+	}
+}
+
+func TestFilterAnd(t *testing.T) {
+	message := filterMessage(t)
+	qtypeA, _ := ParseFilter("qtype=A")
+	qtypePtr, _ := ParseFilter("qtype=PTR")
+	tests := []struct {
+		name   string
+		filter *Filter
+		match  bool
+	}{
+		{"nil", (*Filter)(nil).And(nil), true},
+		{"nil and filter", (*Filter)(nil).And(qtypeA), true},
+		{"filter and nil", qtypePtr.And(nil), false},
+		{"both match", qtypeA.And(qtypeA), true},
+		{"one doesn't match", qtypeA.And(qtypePtr), false},
+	}
+	for _, test := range tests {
+		if match := test.filter.Match(message); match != test.match {
+			t.Errorf("%s: Match() = %t, want %t", test.name, match, test.match)
+		}
+	}
+}
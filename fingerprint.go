@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadCategories reads the "domain category" lines of a file. A domain also covers all
+// of its subdomains.
+func loadCategories(file string) (map[string]string, error) {
+	categories := make(map[string]string)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid category line \"%s\" in %s", scanner.Text(), file)
+		}
+		categories[dns.Fqdn(strings.ToLower(fields[0]))] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// category returns the category of the closest enclosing domain of qname.
+func category(categories map[string]string, qname string) string {
+	qname = strings.ToLower(qname)
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(qname, offset) {
+		if category, exists := categories[qname[offset:]]; exists {
+			return category
+		}
+	}
+	return ""
+}
+
+type clientProfile struct {
+	host       string
+	queries    int
+	a          int
+	aaaa       int
+	ptr        int
+	txt        int
+	domains    *HyperLogLog
+	categories map[string]int
+}
+
+// FingerprintProcessor writes a profile of every client each interval: the mix of
+// query types, the number of distinct domains and the category it queries most. The
+// profile of a device is fairly stable, so it helps to tell device types apart and to
+// spot a device that suddenly behaves differently.
+type FingerprintProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	interval    time.Duration
+	categories  map[string]string
+	mutex       sync.Mutex
+	profiles    map[string]*clientProfile
+}
+
+func NewFingerprintProcessor(writeApi *api.WriteApi, measurement string, categories map[string]string, interval time.Duration, bufferSize uint) *FingerprintProcessor {
+	return &FingerprintProcessor{
+		baseProcessor: newBaseProcessor("fingerprints", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		interval:      interval,
+		categories:    categories,
+		profiles:      make(map[string]*clientProfile),
+	}
+}
+
+func (proc *FingerprintProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *FingerprintProcessor) run() {
+	proc.consume(proc.add)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *FingerprintProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *FingerprintProcessor) add(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	question := message.dnsMessage.Question[0]
+	client := net.IP(message.dnstapMessage.QueryAddress).String()
+	domain := registeredDomain(question.Name)
+	qcategory := ""
+	if proc.categories != nil {
+		qcategory = category(proc.categories, question.Name)
+	}
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	profile := proc.profiles[client]
+	if profile == nil {
+		profile = &clientProfile{
+			domains:    NewHyperLogLog(10),
+			categories: make(map[string]int),
+		}
+		proc.profiles[client] = profile
+	}
+	if len(message.host) > 0 {
+		profile.host = message.host
+	}
+	profile.queries++
+	switch question.Qtype {
+	case dns.TypeA:
+		profile.a++
+	case dns.TypeAAAA:
+		profile.aaaa++
+	case dns.TypePTR:
+		profile.ptr++
+	case dns.TypeTXT:
+		profile.txt++
+	}
+	if len(domain) > 0 {
+		profile.domains.Add(domain)
+	}
+	if len(qcategory) > 0 {
+		profile.categories[qcategory]++
+	}
+}
+
+// Flush writes the profiles of the interval so far and starts a new interval.
+func (proc *FingerprintProcessor) Flush() {
+	proc.mutex.Lock()
+	profiles := proc.profiles
+	proc.profiles = make(map[string]*clientProfile)
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	for client, profile := range profiles {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("qaddress", client).
+			AddField("queries", profile.queries).
+			AddField("ptr", profile.ptr).
+			AddField("txt", profile.txt).
+			AddField("distinct_domains", int64(profile.domains.Estimate())).
+			SetTime(now)
+		if len(profile.host) > 0 {
+			point.AddTag("qhost", profile.host)
+		}
+		if profile.a+profile.aaaa > 0 {
+			point.AddField("aaaa_ratio", float64(profile.aaaa)/float64(profile.a+profile.aaaa))
+		}
+		topCategory, topCount := "", 0
+		for name, count := range profile.categories {
+			if count > topCount || (count == topCount && name < topCategory) {
+				topCategory, topCount = name, count
+			}
+		}
+		if topCount > 0 {
+			point.AddField("top_category", topCategory)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// GeneratorOptions describes the synthetic traffic made by the bench command.
+type GeneratorOptions struct {
+	Qps           uint
+	Clients       uint
+	Domains       uint
+	Skew          float64
+	NxdomainRatio float64
+	Duration      time.Duration
+	Count         uint
+}
+
+// generatorInput is a dnstap input that makes client query and response frames for
+// random clients and domains. Domain popularity follows a Zipf distribution, so a few
+// domains get most of the queries like in real traffic.
+type generatorInput struct {
+	options GeneratorOptions
+	random  *rand.Rand
+	zipf    *rand.Zipf
+	wait    chan bool
+}
+
+func newGeneratorInput(options GeneratorOptions) (*generatorInput, error) {
+	if options.Clients == 0 || options.Domains == 0 {
+		return nil, fmt.Errorf("the generator needs at least one client and domain")
+	}
+	if options.Skew <= 1 {
+		return nil, fmt.Errorf("the domain skew must be greater than 1, got %g", options.Skew)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &generatorInput{
+		options: options,
+		random:  random,
+		zipf:    rand.NewZipf(random, options.Skew, 1, uint64(options.Domains-1)),
+		wait:    make(chan bool),
+	}, nil
+}
+
+// ReadInto sends frames until the duration or count is reached. When a QPS is set,
+// queries are sent in batches of about 1% of the QPS.
+func (gen *generatorInput) ReadInto(output chan []byte) {
+	defer close(gen.wait)
+
+	var ticker *time.Ticker
+	perTick := uint(0)
+	if gen.options.Qps > 0 {
+		perTick = gen.options.Qps / 100
+		if perTick == 0 {
+			perTick = 1
+		}
+		ticker = time.NewTicker(time.Duration(perTick) * time.Second / time.Duration(gen.options.Qps))
+		defer ticker.Stop()
+	}
+
+	start := time.Now()
+	sent := uint(0)
+	for {
+		if gen.options.Duration > 0 && time.Since(start) >= gen.options.Duration {
+			break
+		}
+		if gen.options.Count > 0 && sent >= gen.options.Count {
+			break
+		}
+		if ticker != nil && sent%perTick == 0 {
+			<-ticker.C
+		}
+		query, response, err := gen.frames()
+		if err != nil {
+			log.WithError(err).Error("Failed to generate a frame")
+			return
+		}
+		output <- query
+		output <- response
+		sent++
+	}
+	log.Infof("Generated %d queries in %s", sent, time.Since(start).Round(time.Millisecond))
+}
+
+func (gen *generatorInput) Wait() {
+	<-gen.wait
+}
+
+// frames returns a client query frame and its response.
+func (gen *generatorInput) frames() ([]byte, []byte, error) {
+	client := uint32(gen.random.Intn(int(gen.options.Clients)))
+	clientIP := net.IPv4(10, byte(client>>16), byte(client>>8), byte(client)).To4()
+	domain := gen.zipf.Uint64()
+	qname := fmt.Sprintf("host%d.example%d.com.", domain%10, domain)
+	qtype := dns.TypeA
+	if gen.random.Intn(5) == 0 {
+		qtype = dns.TypeAAAA
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(qname, qtype)
+	query.Id = uint16(gen.random.Intn(65536))
+	response := new(dns.Msg)
+	response.SetReply(query)
+	if gen.random.Float64() < gen.options.NxdomainRatio {
+		response.Rcode = dns.RcodeNameError
+	} else if qtype == dns.TypeA {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", qname, domain%254+1))
+		response.Answer = append(response.Answer, rr)
+	} else {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN AAAA 2001:db8::%x", qname, domain%65535+1))
+		response.Answer = append(response.Answer, rr)
+	}
+
+	now := time.Now()
+	queryTime := now.Add(-time.Duration(1+gen.random.Intn(50)) * time.Millisecond)
+	queryFrame, err := gen.frame(dnstap.Message_CLIENT_QUERY, clientIP, query, queryTime, queryTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	responseFrame, err := gen.frame(dnstap.Message_CLIENT_RESPONSE, clientIP, response, queryTime, now)
+	return queryFrame, responseFrame, err
+}
+
+func (gen *generatorInput) frame(messageType dnstap.Message_Type, clientIP net.IP, msg *dns.Msg, queryTime, responseTime time.Time) ([]byte, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	message := &dnstap.Message{
+		Type:           messageType.Enum(),
+		SocketFamily:   dnstap.SocketFamily_INET.Enum(),
+		SocketProtocol: dnstap.SocketProtocol_UDP.Enum(),
+		QueryAddress:   clientIP,
+		QueryPort:      proto.Uint32(uint32(1024 + gen.random.Intn(64000))),
+		QueryTimeSec:   proto.Uint64(uint64(queryTime.Unix())),
+		QueryTimeNsec:  proto.Uint32(uint32(queryTime.Nanosecond())),
+	}
+	if messageType == dnstap.Message_CLIENT_QUERY {
+		message.QueryMessage = packed
+	} else {
+		message.ResponseTimeSec = proto.Uint64(uint64(responseTime.Unix()))
+		message.ResponseTimeNsec = proto.Uint32(uint32(responseTime.Nanosecond()))
+		message.ResponseMessage = packed
+	}
+	return proto.Marshal(&dnstap.Dnstap{
+		Type:    dnstap.Dnstap_MESSAGE.Enum(),
+		Message: message,
+	})
+}
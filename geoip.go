@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type GeoInfo struct {
+	country string
+	city    string
+	asn     string
+	asOrg   string
+}
+
+type geoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// mmdbFile is a MaxMind database that is reopened when the file on disk changes.
+type mmdbFile struct {
+	path    string
+	mutex   sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+func (db *mmdbFile) reload() {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to stat %s", db.path)
+		return
+	}
+	if !info.ModTime().After(db.modTime) {
+		return
+	}
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to open %s", db.path)
+		return
+	}
+
+	db.mutex.Lock()
+	old := db.reader
+	db.reader = reader
+	db.modTime = info.ModTime()
+	db.mutex.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+	log.Infof("Loaded MaxMind database %s", db.path)
+}
+
+func (db *mmdbFile) lookup(ip net.IP, result interface{}) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.reader == nil {
+		return false
+	}
+	return db.reader.Lookup(ip, result) == nil
+}
+
+// GeoIP looks up country, city and ASN information from local MaxMind databases. Either
+// database may be omitted.
+type GeoIP struct {
+	geo      *mmdbFile
+	asn      *mmdbFile
+	interval time.Duration
+}
+
+func NewGeoIP(geoFile, asnFile string, interval time.Duration) *GeoIP {
+	geoIP := &GeoIP{interval: interval}
+	if len(geoFile) > 0 {
+		geoIP.geo = &mmdbFile{path: geoFile}
+		geoIP.geo.reload()
+	}
+	if len(asnFile) > 0 {
+		geoIP.asn = &mmdbFile{path: asnFile}
+		geoIP.asn.reload()
+	}
+	return geoIP
+}
+
+func (geoIP *GeoIP) Lookup(addr []byte) GeoInfo {
+	info := GeoInfo{}
+	ip := net.IP(addr)
+	if addr == nil || isPrivateIP(ip) || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return info
+	}
+	if geoIP.geo != nil {
+		var record geoRecord
+		if geoIP.geo.lookup(ip, &record) {
+			info.country = record.Country.IsoCode
+			info.city = record.City.Names["en"]
+		}
+	}
+	if geoIP.asn != nil {
+		var record asnRecord
+		if geoIP.asn.lookup(ip, &record) && record.Number > 0 {
+			info.asn = strconv.FormatUint(uint64(record.Number), 10)
+			info.asOrg = record.Organization
+		}
+	}
+	return info
+}
+
+var privateNetworks = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reloads the databases whenever their files are updated.
+func (geoIP *GeoIP) Run(ctx context.Context) {
+	ticker := time.NewTicker(geoIP.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if geoIP.geo != nil {
+				geoIP.geo.reload()
+			}
+			if geoIP.asn != nil {
+				geoIP.asn.reload()
+			}
+		}
+	}
+}
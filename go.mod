@@ -8,6 +8,14 @@ require (
 	github.com/golang/protobuf v1.4.2
 	github.com/influxdata/influxdb-client-go v1.2.0
 	github.com/miekg/dns v1.1.29
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/pflag v1.0.5
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.4.0
 )
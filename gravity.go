@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os/exec"
+	"strings"
+)
+
+// gravityLists are the domains of a Pi-hole gravity database: the domains of the
+// enabled adlists, and the exact deny and allow entries of the domainlist.
+type gravityLists struct {
+	gravity *map[string]bool
+	deny    *map[string]bool
+	allow   *map[string]bool
+}
+
+// loadGravityDb reads a Pi-hole gravity database with the sqlite3 command, which
+// avoids linking a SQLite driver for the few users migrating from Pi-hole. The views
+// only contain the entries of enabled lists and groups. Regex entries can't be
+// expressed as domains and are skipped.
+func loadGravityDb(path string) (*gravityLists, error) {
+	lists := &gravityLists{}
+	var err error
+	if lists.gravity, err = gravityQuery(path, "SELECT DISTINCT domain FROM vw_gravity"); err != nil {
+		return nil, err
+	}
+	if lists.deny, err = gravityQuery(path, "SELECT DISTINCT domain FROM vw_blacklist"); err != nil {
+		return nil, err
+	}
+	if lists.allow, err = gravityQuery(path, "SELECT DISTINCT domain FROM vw_whitelist"); err != nil {
+		return nil, err
+	}
+	if regexes, err := gravityQuery(path, "SELECT DISTINCT domain FROM vw_regex_blacklist"); err == nil && len(*regexes) > 0 {
+		log.Warnf("Skipping %d regex deny entries of %s", len(*regexes), path)
+	}
+	log.Infof("Loaded %d gravity, %d deny and %d allow domains from %s",
+		len(*lists.gravity), len(*lists.deny), len(*lists.allow), path)
+	return lists, nil
+}
+
+func gravityQuery(path string, query string) (*map[string]bool, error) {
+	cmd := exec.Command("sqlite3", "-readonly", "-batch", "-noheader", path, query)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 %s: %s: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		domain := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(domain) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(domain, ".") {
+			domain += "."
+		}
+		domains[domain] = true
+	}
+	return &domains, scanner.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReadinessChecks is the set of named checks that must all pass for /readyz to report
+// the collector as ready.
+type ReadinessChecks struct {
+	mutex  sync.Mutex
+	checks map[string]func() error
+}
+
+func NewReadinessChecks() *ReadinessChecks {
+	return &ReadinessChecks{checks: make(map[string]func() error)}
+}
+
+func (readiness *ReadinessChecks) Add(name string, check func() error) {
+	readiness.mutex.Lock()
+	defer readiness.mutex.Unlock()
+	readiness.checks[name] = check
+}
+
+// Check runs every check, returning the failures keyed by check name.
+func (readiness *ReadinessChecks) Check() map[string]error {
+	readiness.mutex.Lock()
+	checks := make(map[string]func() error, len(readiness.checks))
+	for name, check := range readiness.checks {
+		checks[name] = check
+	}
+	readiness.mutex.Unlock()
+
+	failures := make(map[string]error)
+	for name, check := range checks {
+		if err := check(); err != nil {
+			failures[name] = err
+		}
+	}
+	return failures
+}
+
+func (readiness *ReadinessChecks) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	server.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		failures := readiness.Check()
+		if len(failures) == 0 {
+			_, _ = fmt.Fprintln(w, "ok")
+			return
+		}
+		names := make([]string, 0, len(failures))
+		for name := range failures {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, failures[name]))
+		}
+		http.Error(w, strings.Join(lines, "\n"), http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct keys added to it using 2^precision
+// one byte registers, with a standard error of about 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// hllHash hashes key with FNV-1a followed by the splitmix64 finalizer, since the high
+// bits of FNV alone aren't well distributed.
+func hllHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (hll *HyperLogLog) Add(key string) {
+	hash := hllHash(key)
+	index := hash >> (64 - hll.precision)
+	rank := uint8(bits.LeadingZeros64(hash<<hll.precision|1<<(hll.precision-1))) + 1
+	if rank > hll.registers[index] {
+		hll.registers[index] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct keys, using linear counting for
+// small cardinalities.
+func (hll *HyperLogLog) Estimate() uint64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeros := 0
+	for _, register := range hll.registers {
+		sum += 1 / float64(uint64(1)<<register)
+		if register == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogError(t *testing.T) {
+	for _, precision := range []uint8{10, 14} {
+		stdError := 1.04 / math.Sqrt(float64(uint64(1)<<precision))
+		for _, n := range []int{10, 100, 1000, 10000, 100000} {
+			hll := NewHyperLogLog(precision)
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("client%d.lan.", i)
+				hll.Add(key)
+				// adding a key again doesn't change the estimate
+				hll.Add(key)
+			}
+			estimate := float64(hll.Estimate())
+			if relError := math.Abs(estimate-float64(n)) / float64(n); relError > 3*stdError {
+				t.Errorf("precision %d: Estimate() of %d keys = %.0f, an error of %.2f%%, want at most %.2f%%",
+					precision, n, estimate, 100*relError, 300*stdError)
+			}
+		}
+	}
+
+	if estimate := NewHyperLogLog(14).Estimate(); estimate != 0 {
+		t.Errorf("Estimate() of an empty HyperLogLog = %d, want 0", estimate)
+	}
+}
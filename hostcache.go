@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var hostCacheStats = expvar.NewMap("host_cache")
+
+type hostItem struct {
+	ip       string
+	host     string
+	expires  time.Time
+	failures uint
+}
+
+// HostCache is a size bounded LRU cache of reverse lookup results. Expired entries are
+// still returned, flagged as expired, so callers can keep using the last known host
+// name when a refresh fails. Failed lookups are cached with their own TTL that doubles
+// with every consecutive failure.
+type HostCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	items      map[string]*list.Element
+	lru        *list.List
+}
+
+func NewHostCache(maxEntries uint, ttl time.Duration) *HostCache {
+	cache := &HostCache{
+		maxEntries: int(maxEntries),
+		ttl:        ttl,
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	hostCacheStats.Set("size", expvar.Func(func() interface{} {
+		return cache.Len()
+	}))
+	return cache
+}
+
+// Get returns the cached host for ip, whether it exists and whether it has expired.
+func (cache *HostCache) Get(ip string) (string, bool, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, exists := cache.items[ip]
+	if !exists {
+		hostCacheStats.Add("misses", 1)
+		return "", false, false
+	}
+	cache.lru.MoveToFront(element)
+	item := element.Value.(*hostItem)
+	if item.expires.Before(time.Now()) {
+		hostCacheStats.Add("expired", 1)
+		return item.host, true, true
+	}
+	hostCacheStats.Add("hits", 1)
+	return item.host, true, false
+}
+
+// SetTtl changes the TTL of the host names looked up from now on.
+func (cache *HostCache) SetTtl(ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.ttl = ttl
+}
+
+func (cache *HostCache) Put(ip, host string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, exists := cache.items[ip]; exists {
+		item := element.Value.(*hostItem)
+		item.host = host
+		item.expires = time.Now().Add(cache.ttl)
+		item.failures = 0
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.insert(&hostItem{ip: ip, host: host, expires: time.Now().Add(cache.ttl)})
+}
+
+// PutFailure records a failed lookup for ip. A previously resolved host name is kept,
+// otherwise fallback is cached. The entry expires after ttl, doubled for each earlier
+// consecutive failure, up to maxTtl.
+func (cache *HostCache) PutFailure(ip, fallback string, ttl, maxTtl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	hostCacheStats.Add("negative", 1)
+	if element, exists := cache.items[ip]; exists {
+		item := element.Value.(*hostItem)
+		item.failures++
+		item.expires = time.Now().Add(backoff(ttl, maxTtl, item.failures))
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.insert(&hostItem{ip: ip, host: fallback, expires: time.Now().Add(ttl), failures: 1})
+}
+
+func backoff(ttl, maxTtl time.Duration, failures uint) time.Duration {
+	for i := uint(1); i < failures && ttl < maxTtl; i++ {
+		ttl *= 2
+	}
+	if ttl > maxTtl {
+		return maxTtl
+	}
+	return ttl
+}
+
+func (cache *HostCache) insert(item *hostItem) {
+	cache.items[item.ip] = cache.lru.PushFront(item)
+	for cache.maxEntries > 0 && cache.lru.Len() > cache.maxEntries {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.items, oldest.Value.(*hostItem).ip)
+		hostCacheStats.Add("evictions", 1)
+	}
+}
+
+// Shrink evicts the least recently used entries until only the given fraction of them
+// is left.
+func (cache *HostCache) Shrink(keep float64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	target := int(float64(cache.lru.Len()) * keep)
+	for cache.lru.Len() > target {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.items, oldest.Value.(*hostItem).ip)
+		hostCacheStats.Add("evictions", 1)
+	}
+}
+
+func (cache *HostCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.lru.Len()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostCacheTtl(t *testing.T) {
+	cache := NewHostCache(10, time.Hour)
+	if _, exists, _ := cache.Get("192.168.1.20"); exists {
+		t.Fatal("Get() found a host in an empty cache")
+	}
+	cache.Put("192.168.1.20", "laptop")
+	if host, exists, expired := cache.Get("192.168.1.20"); host != "laptop" || !exists || expired {
+		t.Errorf("Get() = %q, %t, %t, want laptop, true, false", host, exists, expired)
+	}
+
+	// expired entries are still returned, flagged as expired
+	cache.SetTtl(-time.Second)
+	cache.Put("192.168.1.20", "laptop")
+	if host, exists, expired := cache.Get("192.168.1.20"); host != "laptop" || !exists || !expired {
+		t.Errorf("Get() after the TTL = %q, %t, %t, want laptop, true, true", host, exists, expired)
+	}
+}
+
+func TestHostCachePutFailure(t *testing.T) {
+	cache := NewHostCache(10, time.Hour)
+	cache.PutFailure("192.168.1.20", "192.168.1.20", time.Minute, time.Hour)
+	if host, exists, expired := cache.Get("192.168.1.20"); host != "192.168.1.20" || !exists || expired {
+		t.Errorf("Get() after a failure = %q, %t, %t, want the fallback", host, exists, expired)
+	}
+
+	// a failed refresh keeps the host name that was resolved before
+	cache.Put("192.168.1.21", "laptop")
+	cache.PutFailure("192.168.1.21", "192.168.1.21", time.Minute, time.Hour)
+	if host, _, _ := cache.Get("192.168.1.21"); host != "laptop" {
+		t.Errorf("Get() after a failed refresh = %q, want laptop", host)
+	}
+
+	// a successful lookup resets the failures
+	cache.Put("192.168.1.20", "workstation")
+	cache.PutFailure("192.168.1.20", "192.168.1.20", time.Minute, time.Hour)
+	element := cache.items["192.168.1.20"]
+	if item := element.Value.(*hostItem); item.failures != 1 || item.host != "workstation" {
+		t.Errorf("failures = %d, host = %q after a successful lookup, want 1, workstation", item.failures, item.host)
+	}
+	if expires := time.Until(element.Value.(*hostItem).expires); expires > time.Minute {
+		t.Errorf("entry expires in %s, want at most 1m", expires)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures uint
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if ttl := backoff(time.Minute, 30*time.Minute, test.failures); ttl != test.want {
+			t.Errorf("backoff() after %d failures = %s, want %s", test.failures, ttl, test.want)
+		}
+	}
+}
+
+func TestHostCacheEviction(t *testing.T) {
+	cache := NewHostCache(2, time.Hour)
+	cache.Put("192.168.1.20", "a")
+	cache.Put("192.168.1.21", "b")
+	// using .20 makes .21 the least recently used
+	cache.Get("192.168.1.20")
+	cache.Put("192.168.1.22", "c")
+	if cache.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", cache.Len())
+	}
+	for ip, want := range map[string]bool{"192.168.1.20": true, "192.168.1.21": false, "192.168.1.22": true} {
+		if _, exists, _ := cache.Get(ip); exists != want {
+			t.Errorf("Get(%s) exists = %t, want %t", ip, exists, want)
+		}
+	}
+
+	cache.Shrink(0.5)
+	if cache.Len() != 1 {
+		t.Errorf("Len() after Shrink(0.5) = %d, want 1", cache.Len())
+	}
+}
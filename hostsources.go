@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type hostSource struct {
+	kind string
+	path string
+}
+
+// HostSources maps client IPs to host names using DHCP lease files and static host
+// maps. All sources are reloaded periodically; when an IP appears in more than one
+// source, the source listed last wins.
+type HostSources struct {
+	sources  []hostSource
+	interval time.Duration
+	mutex    sync.RWMutex
+	hosts    map[string]string
+}
+
+var hostSourceParsers = map[string]func(io.Reader, map[string]string) error{
+	"dnsmasq": parseDnsmasqLeases,
+	"isc":     parseIscLeases,
+	"kea":     parseKeaLeases,
+	"csv":     parseCsvHosts,
+	"yaml":    parseYamlHosts,
+	"hosts":   parseHostsFile,
+}
+
+// NewHostSources parses sources of the form "kind:path", where kind is one of dnsmasq,
+// isc, kea, csv, yaml or hosts.
+func NewHostSources(specs []string, interval time.Duration) (*HostSources, error) {
+	sources := make([]hostSource, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || hostSourceParsers[parts[0]] == nil {
+			return nil, fmt.Errorf("invalid host source \"%s\"", spec)
+		}
+		sources = append(sources, hostSource{kind: parts[0], path: parts[1]})
+	}
+	hostSources := &HostSources{
+		sources:  sources,
+		interval: interval,
+		hosts:    make(map[string]string),
+	}
+	hostSources.load()
+	return hostSources, nil
+}
+
+// Replace switches to the sources of other and takes over its hosts.
+func (hs *HostSources) Replace(other *HostSources) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	hs.sources = other.sources
+	hs.hosts = other.hosts
+}
+
+func (hs *HostSources) Lookup(ip string) (string, bool) {
+	hs.mutex.RLock()
+	defer hs.mutex.RUnlock()
+	host, exists := hs.hosts[ip]
+	return host, exists
+}
+
+// Run reloads the sources every interval until ctx is done. With an interval of 0
+// the sources are only loaded when they are created.
+func (hs *HostSources) Run(ctx context.Context) {
+	if hs.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hs.load()
+		}
+	}
+}
+
+func (hs *HostSources) load() {
+	hs.mutex.RLock()
+	sources := hs.sources
+	hs.mutex.RUnlock()
+	if len(sources) == 0 {
+		return
+	}
+
+	hosts := make(map[string]string)
+	for _, source := range sources {
+		file, err := os.Open(source.path)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to open host source %s", source.path)
+			continue
+		}
+		err = hostSourceParsers[source.kind](file, hosts)
+		_ = file.Close()
+		if err != nil {
+			log.WithError(err).Warnf("Failed to read host source %s", source.path)
+		}
+	}
+
+	hs.mutex.Lock()
+	hs.hosts = hosts
+	hs.mutex.Unlock()
+	log.Debugf("Loaded %d hosts from host sources", len(hosts))
+}
+
+func addHost(hosts map[string]string, ip, host string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || len(host) == 0 || host == "*" {
+		return
+	}
+	hosts[parsed.String()] = host
+}
+
+// parseDnsmasqLeases reads "expiry mac ip hostname client-id" lines.
+func parseDnsmasqLeases(reader io.Reader, hosts map[string]string) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 {
+			addHost(hosts, fields[2], fields[3])
+		}
+	}
+	return scanner.Err()
+}
+
+// parseIscLeases reads ISC dhcpd lease blocks. Later blocks for the same IP replace
+// earlier ones, and leases that are no longer active are removed.
+func parseIscLeases(reader io.Reader, hosts map[string]string) error {
+	var ip, host string
+	active := true
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) >= 2 && fields[0] == "lease":
+			ip, host, active = fields[1], "", true
+		case len(fields) >= 2 && fields[0] == "client-hostname":
+			host = strings.Trim(fields[1], "\"")
+		case len(fields) >= 3 && fields[0] == "binding" && fields[1] == "state":
+			active = fields[2] == "active"
+		case line == "}" && len(ip) > 0:
+			if active {
+				addHost(hosts, ip, host)
+			} else {
+				delete(hosts, ip)
+			}
+			ip = ""
+		}
+	}
+	return scanner.Err()
+}
+
+// parseKeaLeases reads a Kea memfile lease CSV, using its header to find the columns.
+func parseKeaLeases(reader io.Reader, hosts map[string]string) error {
+	records := csv.NewReader(reader)
+	records.FieldsPerRecord = -1
+	header, err := records.Read()
+	if err != nil {
+		return err
+	}
+	addressCol, hostnameCol, stateCol := -1, -1, -1
+	for i, column := range header {
+		switch column {
+		case "address":
+			addressCol = i
+		case "hostname":
+			hostnameCol = i
+		case "state":
+			stateCol = i
+		}
+	}
+	if addressCol < 0 || hostnameCol < 0 {
+		return fmt.Errorf("missing address or hostname column")
+	}
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) <= addressCol || len(record) <= hostnameCol {
+			continue
+		}
+		if stateCol >= 0 && len(record) > stateCol && record[stateCol] != "0" {
+			delete(hosts, record[addressCol])
+			continue
+		}
+		addHost(hosts, record[addressCol], strings.TrimSuffix(record[hostnameCol], "."))
+	}
+}
+
+// parseCsvHosts reads "ip,name" records.
+func parseCsvHosts(reader io.Reader, hosts map[string]string) error {
+	records := csv.NewReader(reader)
+	records.Comment = '#'
+	records.FieldsPerRecord = -1
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) >= 2 {
+			addHost(hosts, strings.TrimSpace(record[0]), strings.TrimSpace(record[1]))
+		}
+	}
+}
+
+// parseYamlHosts reads a mapping of ip to name.
+func parseYamlHosts(reader io.Reader, hosts map[string]string) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	mapping := make(map[string]string)
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return err
+	}
+	for ip, host := range mapping {
+		addHost(hosts, ip, host)
+	}
+	return nil
+}
+
+// parseHostsFile reads /etc/hosts style "ip name [aliases...]" lines.
+func parseHostsFile(reader io.Reader, hosts map[string]string) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			addHost(hosts, fields[0], fields[1])
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostSourceParsers(t *testing.T) {
+	tests := []struct {
+		kind  string
+		input string
+		hosts map[string]string
+	}{
+		{"dnsmasq", `1600000000 aa:bb:cc:dd:ee:01 192.168.1.20 laptop 01:aa:bb:cc:dd:ee:01
+1600000000 aa:bb:cc:dd:ee:02 192.168.1.21 * *
+1600000000 aa:bb:cc:dd:ee:03 fd00::3 phone *
+short line
+`, map[string]string{"192.168.1.20": "laptop", "fd00::3": "phone"}},
+		{"isc", `lease 192.168.1.20 {
+  binding state active;
+  client-hostname "laptop";
+}
+lease 192.168.1.21 {
+  binding state active;
+  client-hostname "old";
+}
+lease 192.168.1.21 {
+  binding state free;
+}
+lease 192.168.1.22 {
+  binding state active;
+}
+`, map[string]string{"192.168.1.20": "laptop"}},
+		{"kea", `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state
+192.168.1.20,aa:bb:cc:dd:ee:01,,3600,1600000000,1,0,0,laptop.lan.,0
+192.168.1.21,aa:bb:cc:dd:ee:02,,3600,1600000000,1,0,0,gone.lan.,2
+192.168.1.22,aa:bb:cc:dd:ee:03,,3600,1600000000,1,0,0,,0
+`, map[string]string{"192.168.1.20": "laptop.lan"}},
+		{"csv", `# ip,name
+192.168.1.20, laptop
+192.168.1.21
+not-an-ip,printer
+`, map[string]string{"192.168.1.20": "laptop"}},
+		{"yaml", `192.168.1.20: laptop
+"fd00::3": phone
+bogus: printer
+`, map[string]string{"192.168.1.20": "laptop", "fd00::3": "phone"}},
+		{"hosts", `127.0.0.1 localhost
+# 192.168.1.30 commented
+192.168.1.20 laptop laptop.lan # trailing comment
+fd00:0:0::3 phone
+`, map[string]string{"127.0.0.1": "localhost", "192.168.1.20": "laptop", "fd00::3": "phone"}},
+	}
+	for _, test := range tests {
+		hosts := make(map[string]string)
+		if err := hostSourceParsers[test.kind](strings.NewReader(test.input), hosts); err != nil {
+			t.Errorf("%s: %s", test.kind, err)
+			continue
+		}
+		if len(hosts) != len(test.hosts) {
+			t.Errorf("%s: got %v, want %v", test.kind, hosts, test.hosts)
+			continue
+		}
+		for ip, host := range test.hosts {
+			if hosts[ip] != host {
+				t.Errorf("%s: got %v, want %v", test.kind, hosts, test.hosts)
+				break
+			}
+		}
+	}
+}
+
+func TestKeaLeasesWithoutColumns(t *testing.T) {
+	hosts := make(map[string]string)
+	if err := parseKeaLeases(strings.NewReader("address,hwaddr\n192.168.1.20,aa:bb:cc:dd:ee:01\n"), hosts); err == nil {
+		t.Errorf("parseKeaLeases() accepted a file without a hostname column")
+	}
+}
+
+func TestNewHostSources(t *testing.T) {
+	for _, spec := range []string{"laptop.csv", "bogus:laptop.csv"} {
+		if _, err := NewHostSources([]string{spec}, 0); err == nil {
+			t.Errorf("NewHostSources(%q) didn't fail", spec)
+		}
+	}
+}
+
+// With an interval of 0 the sources are loaded once, when they are created, and Run
+// returns right away.
+func TestHostSourcesWithoutInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dnsmasq := filepath.Join(dir, "dnsmasq.leases")
+	hostsFile := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(dnsmasq, []byte("1600000000 aa:bb:cc:dd:ee:01 192.168.1.20 laptop *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hostsFile, []byte("192.168.1.20 workstation\n192.168.1.21 printer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, err := NewHostSources([]string{"dnsmasq:" + dnsmasq, "hosts:" + hostsFile}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the source listed last wins
+	for ip, want := range map[string]string{"192.168.1.20": "workstation", "192.168.1.21": "printer"} {
+		if host, exists := hs.Lookup(ip); !exists || host != want {
+			t.Errorf("Lookup(%s) = %q, %t, want %q", ip, host, exists, want)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		hs.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't return with an interval of 0")
+	}
+}
@@ -1,34 +1,57 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
 	dnstap "github.com/dnstap/golang-dnstap"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
 	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/influxdata/influxdb-client-go/api/write"
 	"github.com/miekg/dns"
-	log "github.com/sirupsen/logrus"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// influxStats counts the points written and the write errors reported by the client.
+var influxStats = expvar.NewMap("influx")
+
 type InfluxProcessor struct {
+	baseProcessor
 	client      influxdb2.Client
+	mirrors     []influxdb2.Client
+	org         string
+	bucket      string
+	authToken   string
 	writeApi    api.WriteApi
-	messages    chan *Message
-	wait        chan bool
-	ipToHost    map[string]string
 	measurement string
+	malformed   string
+	blockedList func(qname string) string
+	redactor    *Redactor
+	noQueries   bool
+	truncation  *truncationTracker
+	dns64       []*net.IPNet
+	readyMutex  sync.Mutex
+	readyTime   time.Time
+	readyErr    error
 }
 
-func NewInfluxProcessor(serverUrl string, authToken string, org string, bucket string, measurement string, bufferSize uint, options *influxdb2.Options) *InfluxProcessor {
+func NewInfluxProcessor(serverUrl string, authToken string, org string, bucket string, measurement string, malformed string, bufferSize uint, options *influxdb2.Options) *InfluxProcessor {
 	client := influxdb2.NewClientWithOptions(serverUrl, authToken, options)
 	return &InfluxProcessor{
-		client:      client,
-		writeApi:    client.WriteApi(org, bucket),
-		messages:    make(chan *Message, bufferSize),
-		wait:        make(chan bool),
-		ipToHost:    make(map[string]string),
-		measurement: measurement,
+		baseProcessor: newBaseProcessor("influx", bufferSize),
+		client:        client,
+		org:           org,
+		bucket:        bucket,
+		authToken:     authToken,
+		writeApi:      client.WriteApi(org, bucket),
+		measurement:   measurement,
+		malformed:     malformed,
 	}
 }
 
@@ -36,27 +59,88 @@ func (influx *InfluxProcessor) GetWriteApi() *api.WriteApi {
 	return &influx.writeApi
 }
 
-func (influx *InfluxProcessor) GetChannel() chan *Message {
-	return influx.messages
+func (influx *InfluxProcessor) QueryApi() api.QueryApi {
+	return influx.client.QueryApi(influx.org)
 }
 
-func (influx *InfluxProcessor) Run(wg *sync.WaitGroup) {
-	for message := range influx.messages {
-		influx.writePoints(message)
-	}
+// SetBlockedLookup sets the function used to tag client responses that were answered
+// from a block list with the name of the list.
+func (influx *InfluxProcessor) SetBlockedLookup(blockedList func(qname string) string) {
+	influx.blockedList = blockedList
+}
+
+// SetRedactor sets the policy used to redact the names that are written.
+func (influx *InfluxProcessor) SetRedactor(redactor *Redactor) {
+	influx.redactor = redactor
+}
+
+// DisableQueries stops the processor from writing the messages it receives, while its
+// write API keeps serving the other processors.
+func (influx *InfluxProcessor) DisableQueries() {
+	influx.noQueries = true
+}
+
+// TrackTruncation links truncated UDP responses to the TCP queries retrying them
+// within the window.
+func (influx *InfluxProcessor) TrackTruncation(window time.Duration) {
+	influx.truncation = newTruncationTracker(window)
+}
+
+// SetDns64Prefixes sets the DNS64 prefixes (RFC 6147) that AAAA answers are checked
+// against, to tell synthesized answers from native ones.
+func (influx *InfluxProcessor) SetDns64Prefixes(prefixes []*net.IPNet) {
+	influx.dns64 = prefixes
+}
+
+func (influx *InfluxProcessor) Start(ctx context.Context) error {
+	go influx.forwardErrors()
+	go influx.run()
+	return nil
+}
+
+func (influx *InfluxProcessor) run() {
+	influx.consume(influx.writePoints)
 	influx.writeApi.Flush()
 	influx.client.Close()
-	wg.Done()
+	for _, mirror := range influx.mirrors {
+		mirror.Close()
+	}
+	influx.finish()
+}
+
+func (influx *InfluxProcessor) Flush() {
+	span := startTrace("influx flush")
+	defer span.End()
+	influx.writeApi.Flush()
 }
 
 func (influx *InfluxProcessor) writePoints(msg *Message) {
-	point := influxdb2.NewPointWithMeasurement(influx.measurement).AddTag("tap_type", msg.dnstapMessage.Type.String())
+	if influx.noQueries {
+		return
+	}
+	point := influxdb2.NewPointWithMeasurement(influx.measurement).
+		AddTag("tap_type", msg.dnstapMessage.Type.String()).
+		AddTag("schema_version", schemaVersion)
 	if msg.dnstapMessage.QueryAddress != nil {
 		point.AddTag("qaddress", net.IP(msg.dnstapMessage.QueryAddress).String())
 	}
 	if len(msg.host) > 0 {
 		point.AddTag("qhost", msg.host)
 	}
+	if len(msg.mac) > 0 {
+		point.AddTag("mac", msg.mac)
+	}
+	if len(msg.vendor) > 0 {
+		point.AddTag("vendor", msg.vendor)
+	}
+	if len(msg.clientGroup) > 0 {
+		point.AddTag("client_group", msg.clientGroup)
+	}
+	if msg.duplicate {
+		point.AddTag("duplicate", "true")
+	}
+	addGeoTags(point, "q", msg.qgeo)
+	addGeoTags(point, "r", msg.rgeo)
 
 	point.SetTime(msg.timestamp)
 
@@ -70,20 +154,69 @@ func (influx *InfluxProcessor) writePoints(msg *Message) {
 		if msg.dnstapMessage.ResponseAddress != nil {
 			point.AddTag("raddress", net.IP(msg.dnstapMessage.ResponseAddress).String())
 		}
+		if len(msg.rhost) > 0 {
+			point.AddTag("rhost", msg.rhost)
+		}
 		if msg.dnsMessage != nil {
 			if msg.dnsMessage.Question != nil && len(msg.dnsMessage.Question) > 0 &&
 				(msg.dnsMessage.Question[0].Qtype == dns.TypeA || msg.dnsMessage.Question[0].Qtype == dns.TypeAAAA) &&
 				msg.dnsMessage.Rcode == dns.RcodeSuccess && len(msg.dnsMessage.Answer) == 0 {
 				point.AddField("nodata", true)
 			}
+			policy := parsePolicy(msg.dnstapMessage)
+			if policy != nil {
+				addPolicyTags(point, policy)
+			} else if *msg.dnstapMessage.Type == dnstap.Message_CLIENT_RESPONSE && influx.blockedList != nil &&
+				len(msg.dnsMessage.Question) > 0 && looksBlocked(msg.dnsMessage) {
+				if list := influx.blockedList(msg.dnsMessage.Question[0].Name); len(list) > 0 {
+					point.AddTag("blocked", "true").
+						AddTag("block_list", list)
+				}
+			}
+			if id := nsid(msg.dnsMessage); len(id) > 0 {
+				point.AddTag("nsid", id)
+			}
+			if length, target := cnameChain(msg.dnsMessage); length > 0 {
+				target, _ = influx.redactor.Redact(target)
+				point.AddField("cname_chain", length).
+					AddField("cname_target", target)
+			}
+			if svcb := parseSvcbAnswers(msg.dnsMessage.Answer); svcb != nil {
+				point.AddField("alpn", strings.Join(svcb.alpn, ",")).
+					AddField("h2", svcb.hasAlpn("h2")).
+					AddField("h3", svcb.hasAlpn("h3")).
+					AddField("ech", svcb.ech)
+			}
+			addAnswerTypeFields(point, msg.dnsMessage.Answer)
+			if len(influx.dns64) > 0 {
+				if synthesized, hasAaaa := dns64Answer(msg.dnsMessage.Answer, influx.dns64); hasAaaa {
+					point.AddTag("dns64", strconv.FormatBool(synthesized))
+				}
+			}
 		}
 	}
 
 	if msg.dnsMessage != nil {
 		point.AddField("id", int(msg.dnsMessage.MsgHdr.Id))
-		point.AddTag("status", dns.RcodeToString[msg.dnsMessage.MsgHdr.Rcode])
+		if cookie := cookieState(msg.dnsMessage); len(cookie) > 0 {
+			point.AddField("cookie", cookie)
+		}
+		point.AddTag("status", dns.RcodeToString[msg.dnsMessage.MsgHdr.Rcode]).
+			AddTag("opcode", dns.OpcodeToString[msg.dnsMessage.Opcode]).
+			AddTag("rd", strconv.FormatBool(msg.dnsMessage.RecursionDesired)).
+			AddTag("cd", strconv.FormatBool(msg.dnsMessage.CheckingDisabled))
+		if msg.dnsMessage.Response {
+			point.AddTag("ra", strconv.FormatBool(msg.dnsMessage.RecursionAvailable))
+		}
+		if opt := msg.dnsMessage.IsEdns0(); opt != nil {
+			point.AddField("edns_size", int(opt.UDPSize()))
+		}
 		if msg.dnsMessage.Question != nil && len(msg.dnsMessage.Question) > 0 {
-			point.AddTag("qname", msg.dnsMessage.Question[0].Name)
+			qname, redacted := influx.redactor.Redact(msg.dnsMessage.Question[0].Name)
+			point.AddTag("qname", qname)
+			if len(msg.qnameUnicode) > 0 && !redacted {
+				point.AddTag("qname_unicode", msg.qnameUnicode)
+			}
 			point.AddTag("qtype", dns.Type(msg.dnsMessage.Question[0].Qtype).String())
 		}
 	}
@@ -92,6 +225,15 @@ func (influx *InfluxProcessor) writePoints(msg *Message) {
 		point.AddTag("protocol", msg.dnstapMessage.SocketProtocol.String())
 	}
 
+	if influx.truncation != nil {
+		if id, delay := influx.truncation.track(msg); len(id) > 0 {
+			point.AddField("tc_id", id)
+			if delay > 0 {
+				point.AddField("tc_retry_delay_ms", float64(delay)/float64(time.Millisecond))
+			}
+		}
+	}
+
 	if msg.dnstapMessage.QueryZone != nil {
 		name, _, err := dns.UnpackDomainName(msg.dnstapMessage.QueryZone, 0)
 		if err == nil {
@@ -108,13 +250,255 @@ func (influx *InfluxProcessor) writePoints(msg *Message) {
 	}
 
 	influx.writeApi.WritePoint(point)
+	influxStats.Add("points", 1)
+
+	if msg.unpackErr != nil {
+		influx.writeMalformed(msg)
+	}
+}
+
+// writeMalformed writes a point for a DNS payload that couldn't be unpacked, with the
+// start of the payload so that broken clients and attack traffic can be looked into.
+func (influx *InfluxProcessor) writeMalformed(msg *Message) {
+	head := msg.malformed
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	point := influxdb2.NewPointWithMeasurement(influx.malformed).
+		AddTag("tap_type", msg.dnstapMessage.Type.String()).
+		AddField("size", len(msg.malformed)).
+		AddField("head", hex.EncodeToString(head)).
+		AddField("error", msg.unpackErr.Error()).
+		SetTime(msg.timestamp)
+	if msg.dnstapMessage.QueryAddress != nil {
+		point.AddTag("qaddress", net.IP(msg.dnstapMessage.QueryAddress).String())
+	}
+	if msg.dnstapMessage.ResponseAddress != nil {
+		point.AddTag("raddress", net.IP(msg.dnstapMessage.ResponseAddress).String())
+	}
+	if len(msg.host) > 0 {
+		point.AddTag("qhost", msg.host)
+	}
+	influx.writeApi.WritePoint(point)
+	influxStats.Add("malformed_points", 1)
 }
 
-func (influx *InfluxProcessor) LogErrors() {
-	errorsCh := influx.writeApi.Errors()
-	go func() {
-		for err := range errorsCh {
-			log.WithError(err).Error("write error")
+// looksBlocked returns true for the responses a resolver gives for blocked names:
+// NXDOMAIN, REFUSED, no answers or only unspecified addresses.
+func looksBlocked(msg *dns.Msg) bool {
+	switch msg.Rcode {
+	case dns.RcodeNameError, dns.RcodeRefused:
+		return true
+	case dns.RcodeSuccess:
+		for _, rr := range msg.Answer {
+			switch answer := rr.(type) {
+			case *dns.A:
+				if !answer.A.IsUnspecified() {
+					return false
+				}
+			case *dns.AAAA:
+				if !answer.AAAA.IsUnspecified() {
+					return false
+				}
+			default:
+				return false
+			}
 		}
-	}()
+		return true
+	}
+	return false
+}
+
+// cnameChain follows the CNAMEs of the answers from the query name and returns the
+// number of CNAMEs followed and the final canonical name. Loops are cut off.
+func cnameChain(msg *dns.Msg) (int, string) {
+	if len(msg.Question) == 0 {
+		return 0, ""
+	}
+	var cnames map[string]string
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if cnames == nil {
+				cnames = make(map[string]string)
+			}
+			cnames[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+		}
+	}
+	if cnames == nil {
+		return 0, ""
+	}
+
+	length := 0
+	target := strings.ToLower(msg.Question[0].Name)
+	for length < len(cnames) {
+		next, exists := cnames[target]
+		if !exists {
+			break
+		}
+		target = next
+		length++
+	}
+	return length, target
+}
+
+// nsid returns the name server identifier (RFC 5001) of a response, which tells the
+// instances of an anycast server apart. It is returned as text when it is printable
+// and in hex otherwise.
+func nsid(msg *dns.Msg) string {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if option, ok := option.(*dns.EDNS0_NSID); ok && len(option.Nsid) > 0 {
+			decoded, err := hex.DecodeString(option.Nsid)
+			if err != nil {
+				return option.Nsid
+			}
+			for _, c := range decoded {
+				if c < 0x20 || c > 0x7e {
+					return option.Nsid
+				}
+			}
+			return string(decoded)
+		}
+	}
+	return ""
+}
+
+// addAnswerTypeFields adds a field with the count of each RR type in the answer
+// section, e.g. answer_a=2,answer_cname=1, so unusual mixes such as TXT heavy tunnel
+// traffic can be charted.
+func addAnswerTypeFields(point *write.Point, answer []dns.RR) {
+	if len(answer) == 0 {
+		return
+	}
+	counts := make(map[uint16]int)
+	for _, rr := range answer {
+		counts[rr.Header().Rrtype]++
+	}
+	for rrtype, count := range counts {
+		point.AddField("answer_"+strings.ToLower(dns.Type(rrtype).String()), count)
+	}
+}
+
+// dns64Answer returns whether the AAAA answers are in one of the DNS64 prefixes, and
+// whether there are any AAAA answers at all.
+func dns64Answer(answer []dns.RR, prefixes []*net.IPNet) (bool, bool) {
+	hasAaaa := false
+	for _, rr := range answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			hasAaaa = true
+			for _, prefix := range prefixes {
+				if prefix.Contains(aaaa.AAAA) {
+					return true, true
+				}
+			}
+		}
+	}
+	return false, hasAaaa
+}
+
+// parseDns64Prefixes parses DNS64 prefixes in CIDR notation.
+func parseDns64Prefixes(values []string) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, prefix, err := net.ParseCIDR(value)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid DNS64 prefix \"%s\"", value)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// addPolicyTags tags a response with the policy the server applied to it. A policy
+// that changed the answer also tags it as blocked, with the rule as the list, which
+// is exact where looksBlocked has to guess.
+func addPolicyTags(point *write.Point, policy *dnstapPolicy) {
+	if len(policy.kind) > 0 {
+		point.AddTag("policy_type", policy.kind)
+	}
+	if len(policy.rule) > 0 {
+		point.AddTag("policy_rule", policy.rule)
+	}
+	if len(policy.action) > 0 {
+		point.AddTag("policy_action", policy.action)
+	}
+	if len(policy.match) > 0 {
+		point.AddTag("policy_match", policy.match)
+	}
+	if policy.blocks() {
+		point.AddTag("blocked", "true")
+		if len(policy.rule) > 0 {
+			point.AddTag("block_list", policy.rule)
+		}
+	}
+}
+
+// cookieState returns whether a message carries a DNS cookie (RFC 7873): "client" for
+// a client cookie alone, "server" for a client and server cookie and "malformed" for
+// an option of the wrong length. Cookies the server rejected show up as the BADCOOKIE
+// status of the response.
+func cookieState(msg *dns.Msg) string {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if option, ok := option.(*dns.EDNS0_COOKIE); ok {
+			// the cookie is in hex, with 8 bytes of client cookie and 8 to 32 of server cookie
+			switch length := len(option.Cookie) / 2; {
+			case length == 8:
+				return "client"
+			case length >= 16 && length <= 40:
+				return "server"
+			default:
+				return "malformed"
+			}
+		}
+	}
+	return ""
+}
+
+func addGeoTags(point *write.Point, prefix string, geo GeoInfo) {
+	if len(geo.country) > 0 {
+		point.AddTag(prefix+"country", geo.country)
+	}
+	if len(geo.city) > 0 {
+		point.AddTag(prefix+"city", geo.city)
+	}
+	if len(geo.asn) > 0 {
+		point.AddTag(prefix+"asn", geo.asn)
+	}
+	if len(geo.asOrg) > 0 {
+		point.AddTag(prefix+"as_org", geo.asOrg)
+	}
+}
+
+// Ready checks that InfluxDB is reachable. The result is cached for a few seconds so
+// that frequent readiness probes don't hammer the server.
+func (influx *InfluxProcessor) Ready() error {
+	influx.readyMutex.Lock()
+	defer influx.readyMutex.Unlock()
+	if time.Since(influx.readyTime) < 10*time.Second {
+		return influx.readyErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ready, err := influx.client.Ready(ctx)
+	if err == nil && !ready {
+		err = errors.New("influxdb is not ready")
+	}
+	influx.readyErr = err
+	influx.readyTime = time.Now()
+	return err
+}
+
+func (influx *InfluxProcessor) forwardErrors() {
+	for err := range influx.writeApi.Errors() {
+		influxStats.Add("write_errors", 1)
+		influx.reportError(err)
+	}
 }
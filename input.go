@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	inputFrames    = new(expvar.Int)
+	inputBlockedNs = new(expvar.Int)
+)
+
+func init() {
+	pipelineStats.Set("input_frames", inputFrames)
+	pipelineStats.Set("input_blocked_ns", inputBlockedNs)
+}
+
+// inputReady reports whether the input has been opened and hasn't finished yet.
+func inputReady(opened *int32) func() error {
+	return func() error {
+		if atomic.LoadInt32(opened) == 0 {
+			return errors.New("the dnstap input isn't open")
+		}
+		return nil
+	}
+}
+
+// readInput copies frames from input to output until the input is finished or ctx is
+// cancelled. Frames are passed through an unbuffered channel so that nothing is
+// written to output after readInput returns.
+func readInput(ctx context.Context, input dnstap.Input, output chan []byte) {
+	frames := make(chan []byte)
+	done := make(chan bool)
+	go input.ReadInto(frames)
+	go func() {
+		input.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case frame := <-frames:
+			inputFrames.Add(1)
+			select {
+			case output <- frame:
+				continue
+			default:
+			}
+			start := time.Now()
+			select {
+			case output <- frame:
+				inputBlockedNs.Add(int64(time.Since(start)))
+			case <-ctx.Done():
+				return
+			}
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KnotResolver pushes learned blocks into Knot Resolver by sending Lua policy rules to
+// a kresd control socket. The rules are kept in global Lua tables keyed by domain so
+// that they can be deleted again.
+type KnotResolver struct {
+	messages     chan *EnforcerCommandMessage
+	socket       string
+	blockAction  BlockAction
+	blockTarget  string
+	conn         net.Conn
+	disconnected bool
+}
+
+func NewKnotResolver(socket string, blockAction BlockAction, blockTarget string) (*KnotResolver, error) {
+	if blockAction == BlockCname {
+		return nil, fmt.Errorf("the knot enforcer doesn't support the cname block action")
+	}
+	return &KnotResolver{
+		messages:    make(chan *EnforcerCommandMessage, 1000),
+		socket:      socket,
+		blockAction: blockAction,
+		blockTarget: blockTarget,
+	}, nil
+}
+
+func (knot *KnotResolver) GetChannel() chan *EnforcerCommandMessage {
+	return knot.messages
+}
+
+func (knot *KnotResolver) Probe() error {
+	conn, err := net.DialTimeout("unix", knot.socket, time.Second*5)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (knot *KnotResolver) Run(wg *sync.WaitGroup) {
+	for message := range knot.messages {
+		var command string
+		switch message.cmd {
+		case ZoneAdd:
+			command = knot.zoneAddCommand(message.domain)
+		case ZoneRemove:
+			command = knotRemoveCommand("learned_blocks", message.domain)
+		case DataAdd:
+			var err error
+			command, err = knotDataAddCommand(message.domain, message.data)
+			if err != nil {
+				log.WithError(err).Warnf("Can't add local data for \"%s\"", message.domain)
+				continue
+			}
+		case DataRemove:
+			command = knotRemoveCommand("learned_data", message.domain)
+		default:
+			log.Warnf("Got invalid command: %d", message.cmd)
+			continue
+		}
+		if err := knot.send(command); err != nil {
+			if errorLog.Allow("knot enforcer") {
+				log.WithError(err).Errorf("command \"%s\" failed", command)
+			}
+		}
+	}
+	if knot.conn != nil {
+		_ = knot.conn.Close()
+	}
+	wg.Done()
+}
+
+func (knot *KnotResolver) policyAction() string {
+	switch knot.blockAction {
+	case BlockNodata:
+		return "policy.ANSWER({}, true)"
+	case BlockSinkhole:
+		rrType := "A"
+		if net.ParseIP(knot.blockTarget).To4() == nil {
+			rrType = "AAAA"
+		}
+		return fmt.Sprintf("policy.ANSWER({[kres.type.%s]={rdata=kres.str2ip(%s), ttl=60}})", rrType, strconv.Quote(knot.blockTarget))
+	default:
+		return "policy.DENY"
+	}
+}
+
+func (knot *KnotResolver) zoneAddCommand(domain string) string {
+	name := strconv.Quote(domain)
+	return fmt.Sprintf("learned_blocks = learned_blocks or {}; if learned_blocks[%s] == nil then "+
+		"learned_blocks[%s] = {policy.add(policy.suffix(%s, policy.todnames({%s})))} end",
+		name, name, knot.policyAction(), name)
+}
+
+// knotDataAddCommand only handles A and AAAA records since those are the only types
+// kresd can build rdata for from a string.
+func knotDataAddCommand(domain, data string) (string, error) {
+	rr, err := dns.NewRR(data)
+	if err != nil {
+		return "", err
+	}
+	var rrType, ip string
+	switch record := rr.(type) {
+	case *dns.A:
+		rrType, ip = "A", record.A.String()
+	case *dns.AAAA:
+		rrType, ip = "AAAA", record.AAAA.String()
+	default:
+		return "", fmt.Errorf("unsupported record type %s", dns.Type(rr.Header().Rrtype))
+	}
+	name := strconv.Quote(domain)
+	return fmt.Sprintf("learned_data = learned_data or {}; learned_data[%s] = learned_data[%s] or {}; "+
+		"table.insert(learned_data[%s], policy.add(policy.domains(policy.ANSWER({[kres.type.%s]={rdata=kres.str2ip(%s), ttl=%d}}), policy.todnames({%s}))))",
+		name, name, name, rrType, strconv.Quote(ip), rr.Header().Ttl, name), nil
+}
+
+func knotRemoveCommand(table, domain string) string {
+	name := strconv.Quote(domain)
+	return fmt.Sprintf("if %s and %s[%s] then for _, rule in ipairs(%s[%s]) do policy.del(rule.id) end; %s[%s] = nil end",
+		table, table, name, table, name, table, name)
+}
+
+// send writes a command to the control socket, reconnecting once if the connection
+// was lost since the last command.
+func (knot *KnotResolver) send(command string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if knot.conn == nil {
+			knot.conn, err = net.DialTimeout("unix", knot.socket, time.Second*5)
+			if err != nil {
+				knot.conn = nil
+				knot.disconnected = true
+				return err
+			}
+			if knot.disconnected {
+				knot.disconnected = false
+				annotations.Annotate("enforcer_reconnect", "Reconnected to kresd at %s", knot.socket)
+			}
+			// kresd echoes the result of every command; it is only drained so the socket
+			// doesn't fill up.
+			go func(conn io.Reader) {
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}(knot.conn)
+		}
+		_ = knot.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		if _, err = knot.conn.Write([]byte(command + "\n")); err == nil {
+			return nil
+		}
+		_ = knot.conn.Close()
+		knot.conn = nil
+		knot.disconnected = true
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKnotZoneAddCommand(t *testing.T) {
+	tests := []struct {
+		action BlockAction
+		target string
+		policy string
+	}{
+		{BlockNxdomain, "", "policy.DENY"},
+		{BlockNodata, "", "policy.ANSWER({}, true)"},
+		{BlockSinkhole, "0.0.0.0", `policy.ANSWER({[kres.type.A]={rdata=kres.str2ip("0.0.0.0"), ttl=60}})`},
+		{BlockSinkhole, "::", `policy.ANSWER({[kres.type.AAAA]={rdata=kres.str2ip("::"), ttl=60}})`},
+	}
+	for _, test := range tests {
+		knot, err := NewKnotResolver("/run/kresd.sock", test.action, test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `learned_blocks = learned_blocks or {}; if learned_blocks["ads.example."] == nil then ` +
+			`learned_blocks["ads.example."] = {policy.add(policy.suffix(` + test.policy + `, policy.todnames({"ads.example."})))} end`
+		if command := knot.zoneAddCommand("ads.example."); command != want {
+			t.Errorf("zoneAddCommand() with %v =\n%s\nwant\n%s", test.action, command, want)
+		}
+	}
+
+	if _, err := NewKnotResolver("/run/kresd.sock", BlockCname, "sinkhole.lan."); err == nil {
+		t.Errorf("NewKnotResolver() accepted the cname block action")
+	}
+}
+
+func TestKnotDataAddCommand(t *testing.T) {
+	tests := []struct {
+		data    string
+		command string
+	}{
+		{"host.lan. 300 IN A 192.0.2.1", `learned_data = learned_data or {}; learned_data["host.lan."] = learned_data["host.lan."] or {}; ` +
+			`table.insert(learned_data["host.lan."], policy.add(policy.domains(policy.ANSWER({[kres.type.A]={rdata=kres.str2ip("192.0.2.1"), ttl=300}}), policy.todnames({"host.lan."}))))`},
+		{"host.lan. 60 IN AAAA 2001:db8::1", `learned_data = learned_data or {}; learned_data["host.lan."] = learned_data["host.lan."] or {}; ` +
+			`table.insert(learned_data["host.lan."], policy.add(policy.domains(policy.ANSWER({[kres.type.AAAA]={rdata=kres.str2ip("2001:db8::1"), ttl=60}}), policy.todnames({"host.lan."}))))`},
+		{"host.lan. 60 IN TXT \"hello\"", ""},
+		{"not a record", ""},
+	}
+	for _, test := range tests {
+		command, err := knotDataAddCommand("host.lan.", test.data)
+		if len(test.command) == 0 {
+			if err == nil {
+				t.Errorf("knotDataAddCommand(%q) didn't fail", test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("knotDataAddCommand(%q) failed: %s", test.data, err)
+		} else if command != test.command {
+			t.Errorf("knotDataAddCommand(%q) =\n%s\nwant\n%s", test.data, command, test.command)
+		}
+	}
+}
+
+func TestKnotRemoveCommand(t *testing.T) {
+	want := `if learned_blocks and learned_blocks["ads.example."] then for _, rule in ipairs(learned_blocks["ads.example."]) do ` +
+		`policy.del(rule.id) end; learned_blocks["ads.example."] = nil end`
+	if command := knotRemoveCommand("learned_blocks", "ads.example."); command != want {
+		t.Errorf("knotRemoveCommand() =\n%s\nwant\n%s", command, want)
+	}
+}
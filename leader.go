@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// LeaderElection lets one of several collectors reading mirrored dnstap streams
+// write and enforce, while the others stand by. The leader holds an exclusive lock on
+// a file that all of them can reach; the lock is released by the kernel when the
+// leader exits or crashes, so a standby takes over on its next attempt.
+type LeaderElection struct {
+	path     string
+	interval time.Duration
+	leader   int32
+}
+
+// leaderStat is 1 while this collector is the leader.
+var leaderStat = new(expvar.Int)
+
+func NewLeaderElection(path string, interval time.Duration) *LeaderElection {
+	expvar.Publish("leader", leaderStat)
+	return &LeaderElection{path: path, interval: interval}
+}
+
+// IsLeader returns whether the collector should process messages. It is safe to
+// call on a nil election, which always leads.
+func (election *LeaderElection) IsLeader() bool {
+	return election == nil || atomic.LoadInt32(&election.leader) == 1
+}
+
+// Run tries to take the lock every interval until it gets it, then holds it until the
+// context is done.
+func (election *LeaderElection) Run(ctx context.Context) {
+	file, err := os.OpenFile(election.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open the leader lock %s", election.path)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	log.Infof("Standing by until the leader lock %s is free", election.path)
+	ticker := time.NewTicker(election.interval)
+	defer ticker.Stop()
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			log.WithError(err).Warnf("Failed to lock %s", election.path)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	_ = file.Truncate(0)
+	_, _ = file.WriteAt([]byte(hostname+"\n"), 0)
+	atomic.StoreInt32(&election.leader, 1)
+	leaderStat.Set(1)
+	log.Info("Became the leader")
+	annotations.Annotate("leader", "%s became the leader", hostname)
+
+	<-ctx.Done()
+	atomic.StoreInt32(&election.leader, 0)
+	leaderStat.Set(0)
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDiffDomains is the number of added and removed domains kept per list.
+const maxDiffDomains = 100
+
+// ListChange is what an update changed in one list. The domains are sorted and capped
+// at maxDiffDomains, the counts are complete.
+type ListChange struct {
+	Added          int      `json:"added"`
+	Removed        int      `json:"removed"`
+	AddedDomains   []string `json:"added_domains,omitempty"`
+	RemovedDomains []string `json:"removed_domains,omitempty"`
+}
+
+// ListDiff is what a list update changed, by list. A domain that moved from one list
+// to another is removed from the first and added to the second. Learned blocks are
+// not part of the diff.
+type ListDiff struct {
+	Time  time.Time              `json:"time"`
+	Lists map[string]*ListChange `json:"lists"`
+}
+
+func diffLists(old, updated *SuffixSet) *ListDiff {
+	diff := &ListDiff{Time: time.Now(), Lists: make(map[string]*ListChange)}
+	change := func(list string) *ListChange {
+		if diff.Lists[list] == nil {
+			diff.Lists[list] = &ListChange{}
+		}
+		return diff.Lists[list]
+	}
+	updated.Range(func(domain, list string) {
+		if list != "learned" && old.Get(domain) != list {
+			c := change(list)
+			c.Added++
+			c.AddedDomains = append(c.AddedDomains, domain)
+		}
+	})
+	old.Range(func(domain, list string) {
+		if list != "learned" && updated.Get(domain) != list {
+			c := change(list)
+			c.Removed++
+			c.RemovedDomains = append(c.RemovedDomains, domain)
+		}
+	})
+	for _, c := range diff.Lists {
+		c.AddedDomains = sortedPrefix(c.AddedDomains, maxDiffDomains)
+		c.RemovedDomains = sortedPrefix(c.RemovedDomains, maxDiffDomains)
+	}
+	return diff
+}
+
+func sortedPrefix(values []string, n int) []string {
+	sort.Strings(values)
+	if len(values) > n {
+		return values[:n]
+	}
+	return values
+}
+
+// String summarizes the diff, e.g. "block +120 -35, black +1".
+func (diff *ListDiff) String() string {
+	if len(diff.Lists) == 0 {
+		return "no changes"
+	}
+	names := make([]string, 0, len(diff.Lists))
+	for name := range diff.Lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		c := diff.Lists[name]
+		part := name
+		if c.Added > 0 {
+			part += fmt.Sprintf(" +%d", c.Added)
+		}
+		if c.Removed > 0 {
+			part += fmt.Sprintf(" -%d", c.Removed)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// listDiffHandler serves the diff of the last list update.
+//noinspection GoUnusedParameter
+func (proc *CnameProcessor) listDiffHandler(w http.ResponseWriter, req *http.Request) {
+	proc.recentMutex.Lock()
+	diff := proc.lastDiff
+	proc.recentMutex.Unlock()
+	if diff == nil {
+		http.Error(w, "the lists haven't been updated yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+)
+
+// LogOptions holds how and where logs are written.
+type LogOptions struct {
+	Format     string
+	File       string
+	MaxSizeMb  uint
+	MaxAgeDays uint
+	MaxBackups uint
+}
+
+// configureLogging switches the logrus formatter and output based on the log
+// options. Logs go to stdout unless a file is given, in which case the file is
+// rotated once it reaches MaxSizeMb.
+func configureLogging(options LogOptions) error {
+	switch options.Format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format \"%s\"", options.Format)
+	}
+
+	var output io.Writer = os.Stdout
+	if len(options.File) > 0 {
+		output = &lumberjack.Logger{
+			Filename:   options.File,
+			MaxSize:    int(options.MaxSizeMb),
+			MaxAge:     int(options.MaxAgeDays),
+			MaxBackups: int(options.MaxBackups),
+		}
+	}
+	log.SetOutput(output)
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	dnstap "github.com/dnstap/golang-dnstap"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
+	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +21,7 @@ var (
 	flagFile               bool
 	flagQueriesMeasurement string
 	flagCnamesMeasurement  string
+	flagMalformedMeasure   string
 	flagBucket             string
 	flagAuthToken          string
 	flagOrg                string
@@ -25,90 +31,890 @@ var (
 	flagBlockFile          string
 	flagWhitelistFile      string
 	flagBlacklistFile      string
+	flagGravityDb          string
+	flagDisabledLists      []string
 	flagUpdatePort         uint
 	flagDontExit           bool
 	flagResolver           string
+	flagBlockAction        string
+	flagBlockTarget        string
+	flagEnforcer           string
+	flagRpzFile            string
+	flagKnotSocket         string
+	flagEnforcerProbe      time.Duration
+	flagInfluxBufferSize   uint
+	flagCnameBufferSize    uint
+	flagInfluxOverflow     string
+	flagCnameOverflow      string
+	flagHostCacheSize      uint
+	flagHostCacheTtl       time.Duration
+	flagMaxLookups         uint
+	flagNegativeTtl        time.Duration
+	flagNegativeTtlMax     time.Duration
+	flagHostSources        []string
+	flagHostSourceInterval time.Duration
+	flagNeighbors          bool
+	flagOuiFile            string
+	flagNeighborInterval   time.Duration
+	flagNeighborTtl        time.Duration
+	flagGeoIPFile          string
+	flagAsnFile            string
+	flagClientGroups       []string
+	flagClientGroupsFile   string
+	flagInfluxFilter       string
+	flagCnameFilter        string
+	flagDedupWindow        time.Duration
+	flagDedupDrop          bool
+	flagLowercase          bool
+	flagUnicode            bool
+	flagMaxRestarts        uint
+	flagRestartWindow      time.Duration
+	flagTelemetryMeasure   string
+	flagTelemetryInterval  time.Duration
+	flagPprof              string
+	flagLogFormat          string
+	flagLogFile            string
+	flagLogMaxSize         uint
+	flagLogMaxAge          uint
+	flagLogMaxBackups      uint
+	flagVersion            bool
+	flagConfig             string
+	flagCheckConfig        bool
+	flagStatsInterval      time.Duration
+	flagErrorLogBurst      uint
+	flagErrorLogWindow     time.Duration
+	flagOtlpEndpoint       string
+	flagTraceSampleRatio   float64
+	flagDedupMaxEntries    uint
+	flagMaxLearned         uint
+	flagMemoryTarget       uint
+	flagTopN               uint
+	flagTopInterval        time.Duration
+	flagTopMeasurement     string
+	flagTopFilter          string
+	flagNod                bool
+	flagNodFile            string
+	flagNodCapacity        uint
+	flagNodLearning        time.Duration
+	flagNodMeasurement     string
+	flagRdap               bool
+	flagRdapUrl            string
+	flagRdapInterval       time.Duration
+	flagDga                bool
+	flagDgaThreshold       float64
+	flagDgaMinSuspicious   uint
+	flagDgaInterval        time.Duration
+	flagDgaMeasurement     string
+	flagWebhook            string
+	flagSpikes             bool
+	flagSpikeInterval      time.Duration
+	flagSpikeDeviations    float64
+	flagSpikeMinResponses  uint
+	flagSpikeMeasurement   string
+	flagCardinality        bool
+	flagCardinalityPeriod  time.Duration
+	flagCardinalityMeasure string
+	flagRetransmits        bool
+	flagRetransmitWindow   time.Duration
+	flagRetransmitPeriod   time.Duration
+	flagRetransmitMeasure  string
+	flagUpstreams          bool
+	flagUpstreamTimeout    time.Duration
+	flagUpstreamInterval   time.Duration
+	flagUpstreamMeasure    string
+	flagAmplification      bool
+	flagAmpEdnsSize        uint16
+	flagAmpResponseSize    int
+	flagAmpInterval        time.Duration
+	flagAmpMeasurement     string
+	flagPtrScans           bool
+	flagPtrScanWindow      time.Duration
+	flagPtrScanThreshold   uint
+	flagPtrScanMeasure     string
+	flagFingerprints       bool
+	flagCategoriesFile     string
+	flagFingerprintPeriod  time.Duration
+	flagFingerprintMeasure string
+	flagTalkers            bool
+	flagTalkersCapacity    uint
+	flagStream             bool
+	flagStreamClients      uint
+	flagRecent             uint
+	flagRecentFilter       string
+	flagDashboard          bool
+	flagAnnotations        bool
+	flagAnnotationMeasure  string
+	flagGrafanaUrl         string
+	flagGrafanaToken       string
+	flagWhoQueriedInflux   bool
+	flagTenantsFile        string
+	flagAnonymize          string
+	flagAnonymizeRotation  time.Duration
+	flagRedactQnames       []string
+	flagRedactKey          string
+	flagCreateBucket       bool
+	flagBucketRetention    time.Duration
+	flagCheckWrite         bool
+	flagMirrorUrl          string
+	flagMirrorToken        string
+	flagMirrorOrg          string
+	flagMirrorBucket       string
+	flagLeaderLock         string
+	flagLeaderInterval     time.Duration
+	flagCaptureFilter      string
+	flagCaptureFile        string
+	flagCaptureMeasure     string
+	flagCaptureFormat      string
+	flagQnameRates         []string
+	flagQnameRateMeasure   string
+	flagCounters           bool
+	flagCountersOnly       bool
+	flagCountersInterval   time.Duration
+	flagCountersMeasure    string
+	flagTcRetryWindow      time.Duration
+	flagLatencySlos        []string
+	flagSloMeasurement     string
+	flagZoneOps            bool
+	flagZoneOpsMeasure     string
+	flagDailyUsage         bool
+	flagDailyUsageAt       string
+	flagDailyUsageMeasure  string
+	flagHostFormat         string
+	flagRhost              bool
+	flagRecentFile         string
+	flagInfluxGzip         bool
+	flagHttpTimeout        time.Duration
+	flagWildcardThreshold  uint
+	flagBlockedCounters    bool
+	flagBlockedMeasure     string
+	flagDns64Prefixes      []string
+	flagDns64              bool
+	flagAuthoritative      bool
+	flagAuthMeasurement    string
 )
 
 func main() {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
+	runCommand(os.Args[1:])
+}
+
+// addPipelineFlags registers the flags of the commands that run the pipeline.
+func addPipelineFlags(flags *flag.FlagSet) {
+	flags.UintVarP(&flagLogLevel, "loglevel", "l", 1, "turn on verbose logging")
+	flags.BoolVarP(&flagFile, "file", "f", false, "input is a file rather than a unix socket")
+	flags.StringVar(&flagQueriesMeasurement, "queries-measurement", "queries", "the influxdb queries measurement name")
+	flags.StringVar(&flagCnamesMeasurement, "cnames-measurement", "cnames", "the influxdb cnames measurement name")
+	flags.StringVar(&flagMalformedMeasure, "malformed-measurement", "malformed", "the influxdb measurement for DNS payloads that couldn't be unpacked")
+	flags.StringVarP(&flagBucket, "bucket", "b", "dns", "the influxdb bucket name")
+	flags.StringVarP(&flagAuthToken, "token", "t", "", "the influxdb auth token")
+	flags.StringVarP(&flagOrg, "org", "o", "", "the influxdb org")
+	flags.UintVarP(&flagBatchSize, "batch", "c", 1000, "the write batch size")
+	flags.UintVarP(&flagBufferSize, "buffer", "r", 1000, "the write buffer size")
+	flags.UintVarP(&flagFlushIntervalMs, "flush", "u", 1000, "the write flush interval in ms")
+	flags.StringVar(&flagBlockFile, "block", "/web/hblock.rpz", "the hblock rpz file")
+	flags.StringVar(&flagWhitelistFile, "white", "/web/whitelist.rpz", "the whitelist rpz file")
+	flags.StringVar(&flagBlacklistFile, "black", "/web/blacklist.rpz", "the blacklist rpz file")
+	flags.StringArrayVar(&flagDisabledLists, "disable-list", nil, "leave a list (block, white, black or gravity) out without deleting its file")
+	flags.StringVar(&flagGravityDb, "gravity-db", "", "also use the lists of this Pi-hole gravity.db, read with the sqlite3 command")
+	flags.UintVarP(&flagUpdatePort, "port", "p", 12760, "the port that listens for update commands")
+	flags.BoolVar(&flagDontExit, "dont-exit", false, "don't exit when finished (for testing)")
+	flags.StringVar(&flagResolver, "resolver", "127.0.0.1:5053", "the resolver to use for reverse lookups, as host:port, tls://host[:port] for DNS-over-TLS or an https:// DNS-over-HTTPS URL")
+	flags.StringVar(&flagBlockAction, "block-action", "nxdomain", "how learned blocks are answered (nxdomain, nodata, sinkhole, cname)")
+	flags.StringVar(&flagBlockTarget, "block-target", "", "the sinkhole IP or cname host for the sinkhole and cname block actions")
+	flags.StringVar(&flagEnforcer, "enforcer", defaultEnforcer, "the backend learned blocks are pushed into (unbound, knot, rpz, none)")
+	flags.StringVar(&flagRpzFile, "rpz-file", "/web/learned.rpz", "the rpz file written by the rpz enforcer")
+	flags.StringVar(&flagKnotSocket, "knot-socket", "/run/knot-resolver/control/1", "the kresd control socket used by the knot enforcer")
+	flags.DurationVar(&flagEnforcerProbe, "enforcer-probe-interval", 30*time.Second, "how often the enforcer is probed for /readyz (0 disables)")
+	flags.UintVar(&flagInfluxBufferSize, "influx-buffer", 0, "the influx processor buffer size (defaults to --buffer)")
+	flags.UintVar(&flagCnameBufferSize, "cname-buffer", 0, "the cname processor buffer size (defaults to --buffer)")
+	flags.StringVar(&flagInfluxOverflow, "influx-overflow", "block", "what to do when the influx processor buffer is full (block, drop-oldest, drop-newest)")
+	flags.StringVar(&flagCnameOverflow, "cname-overflow", "block", "what to do when the cname processor buffer is full (block, drop-oldest, drop-newest)")
+	flags.UintVar(&flagHostCacheSize, "host-cache-size", 10000, "the maximum number of reverse lookup results to cache")
+	flags.DurationVar(&flagHostCacheTtl, "host-cache-ttl", time.Hour, "how long reverse lookup results are cached")
+	flags.UintVar(&flagMaxLookups, "max-lookups", 16, "the maximum number of concurrent reverse lookups (0 disables them)")
+	flags.DurationVar(&flagNegativeTtl, "negative-ttl", time.Minute, "how long a failed reverse lookup is cached")
+	flags.DurationVar(&flagNegativeTtlMax, "negative-ttl-max", 24*time.Hour, "the maximum failed reverse lookup cache time after backing off")
+	flags.StringArrayVar(&flagHostSources, "host-source", nil, "a lease file or host map checked before reverse lookups, as kind:path (dnsmasq, isc, kea, csv, yaml, hosts)")
+	flags.DurationVar(&flagHostSourceInterval, "host-source-interval", time.Minute, "how often host sources are reloaded (0 disables)")
+	flags.BoolVar(&flagNeighbors, "neighbors", false, "tag clients with their MAC address from the kernel neighbor table")
+	flags.StringVar(&flagOuiFile, "oui-file", "", "an IEEE oui.txt or Wireshark manuf file used to tag the MAC vendor")
+	flags.DurationVar(&flagNeighborInterval, "neighbor-interval", 30*time.Second, "how often the neighbor table is read")
+	flags.DurationVar(&flagNeighborTtl, "neighbor-ttl", 24*time.Hour, "how long a MAC address is kept after it left the neighbor table (0 keeps it forever)")
+	flags.StringVar(&flagGeoIPFile, "geoip-db", "", "a MaxMind country or city database used to tag query and response addresses")
+	flags.StringVar(&flagAsnFile, "asn-db", "", "a MaxMind ASN database used to tag query and response addresses")
+	flags.StringArrayVar(&flagClientGroups, "client-group", nil, "tag clients in a network with a group label, as cidr=label")
+	flags.StringVar(&flagClientGroupsFile, "client-groups-file", "", "a file of \"cidr label\" lines used to tag client groups")
+	flags.StringVar(&flagInfluxFilter, "influx-filter", "", "only send matching messages to the influx processor (e.g. \"qtype!=PTR\")")
+	flags.StringVar(&flagCnameFilter, "cname-filter", "", "only send matching messages to the cname processor (e.g. \"type=CLIENT_RESPONSE,answers\")")
+	flags.DurationVar(&flagDedupWindow, "dedup-window", 0, "detect duplicate messages for the same transaction within this window (0 disables)")
+	flags.BoolVar(&flagDedupDrop, "dedup-drop", false, "drop duplicate messages instead of tagging them with duplicate=true")
+	flags.BoolVar(&flagLowercase, "lowercase", true, "lowercase query and answer names")
+	flags.BoolVar(&flagUnicode, "qname-unicode", false, "add a qname_unicode tag with the decoded punycode name")
+	flags.UintVar(&flagMaxRestarts, "max-restarts", 5, "the number of times a crashed processor is restarted within --restart-window before it is disabled")
+	flags.DurationVar(&flagRestartWindow, "restart-window", time.Minute, "the window for --max-restarts")
+	flags.StringVar(&flagTelemetryMeasure, "telemetry-measurement", "internal", "the influxdb measurement for the collector's own stats")
+	flags.DurationVar(&flagTelemetryInterval, "telemetry-interval", time.Minute, "how often the collector's own stats are written (0 disables)")
+	flags.StringVar(&flagPprof, "pprof", "", "serve net/http/pprof on this address (e.g. :6060)")
+	flags.StringVar(&flagLogFormat, "log-format", "text", "the log format (text, json)")
+	flags.StringVar(&flagLogFile, "log-file", "", "write logs to this file instead of stdout")
+	flags.UintVar(&flagLogMaxSize, "log-max-size", 100, "the size in MB at which --log-file is rotated")
+	flags.UintVar(&flagLogMaxAge, "log-max-age", 0, "the number of days rotated log files are kept (0 keeps them forever)")
+	flags.UintVar(&flagLogMaxBackups, "log-max-backups", 0, "the number of rotated log files kept (0 keeps them all)")
+	flags.BoolVar(&flagVersion, "version", false, "print the version and exit")
+	flags.StringVar(&flagConfig, "config", "", "a YAML config file; flags take precedence over "+envPrefix+"* environment variables, which take precedence over the file")
+	flags.DurationVar(&flagStatsInterval, "stats-interval", time.Minute, "how often a stats summary is logged (0 disables)")
+	flags.UintVar(&flagErrorLogBurst, "error-log-burst", 5, "the number of errors of each kind logged per --error-log-window before they are only counted")
+	flags.DurationVar(&flagErrorLogWindow, "error-log-window", time.Minute, "the window for --error-log-burst, after which a summary of the errors is logged (0 logs every error)")
+	flags.StringVar(&flagOtlpEndpoint, "otlp-endpoint", "", "export pipeline traces to this OTLP/HTTP endpoint, e.g. localhost:4318 (needs the otel build tag)")
+	flags.Float64Var(&flagTraceSampleRatio, "trace-sample-ratio", 0.01, "the fraction of frames traced when --otlp-endpoint is set")
+	flags.UintVar(&flagDedupMaxEntries, "dedup-max-entries", 100000, "the maximum number of transactions tracked for --dedup-window (0 for no limit)")
+	flags.UintVar(&flagMaxLearned, "max-learned", 100000, "the maximum number of learned cname blocks (0 for no limit)")
+	flags.UintVar(&flagMemoryTarget, "memory-target", 0, "a soft heap limit in MB; caches are shrunk when it is exceeded (0 disables)")
+	flags.UintVar(&flagTopN, "top-n", 0, "write the N most queried domains and busiest clients every --top-interval (0 disables)")
+	flags.DurationVar(&flagTopInterval, "top-interval", time.Minute, "the interval of the --top-n summaries")
+	flags.StringVar(&flagTopMeasurement, "top-measurement", "top", "the influxdb measurement for the --top-n summaries")
+	flags.StringVar(&flagTopFilter, "top-filter", "type=CLIENT_QUERY", "the messages counted for the --top-n summaries")
+	flags.BoolVar(&flagNod, "nod", false, "write an event the first time a registered domain is ever queried (newly observed domains)")
+	flags.StringVar(&flagNodFile, "nod-file", "/data/nod.bloom", "the file the domains seen before are saved to")
+	flags.UintVar(&flagNodCapacity, "nod-capacity", 1000000, "the number of registered domains the seen set is sized for")
+	flags.DurationVar(&flagNodLearning, "nod-learning", 24*time.Hour, "how long domains are learned before newly observed domain events are written")
+	flags.StringVar(&flagNodMeasurement, "nod-measurement", "nod", "the influxdb measurement for newly observed domain events")
+	flags.BoolVar(&flagRdap, "rdap", false, "look up the age of newly observed domains over RDAP")
+	flags.StringVar(&flagRdapUrl, "rdap-url", "https://rdap.org", "the RDAP service domains are looked up with")
+	flags.DurationVar(&flagRdapInterval, "rdap-interval", time.Second, "the minimum time between RDAP lookups")
+	flags.BoolVar(&flagDga, "dga", false, "score NXDOMAIN names for how machine generated they look and write per-client summaries")
+	flags.Float64Var(&flagDgaThreshold, "dga-threshold", 0.6, "the score (0-1) at which a name counts as suspicious")
+	flags.UintVar(&flagDgaMinSuspicious, "dga-min-suspicious", 10, "the number of suspicious names per --dga-interval at which a client is flagged")
+	flags.DurationVar(&flagDgaInterval, "dga-interval", 5*time.Minute, "the interval of the per-client dga summaries")
+	flags.StringVar(&flagDgaMeasurement, "dga-measurement", "dga", "the influxdb measurement for the per-client dga summaries")
+	flags.StringVar(&flagWebhook, "webhook", "", "a URL that alerts are posted to as JSON")
+	flags.BoolVar(&flagSpikes, "spikes", false, "alert when a client's NXDOMAIN or SERVFAIL rate spikes above its baseline")
+	flags.DurationVar(&flagSpikeInterval, "spike-interval", time.Minute, "the interval the --spikes error rates are measured over")
+	flags.Float64Var(&flagSpikeDeviations, "spike-deviations", 4, "the number of standard deviations above the baseline that is a spike")
+	flags.UintVar(&flagSpikeMinResponses, "spike-min-responses", 20, "the number of responses a client needs in an interval to alert")
+	flags.StringVar(&flagSpikeMeasurement, "spike-measurement", "error_spikes", "the influxdb measurement for error rate spike alerts")
+	flags.BoolVar(&flagCardinality, "cardinality", false, "write estimates of the distinct qnames and registered domains, overall and per client")
+	flags.DurationVar(&flagCardinalityPeriod, "cardinality-interval", 5*time.Minute, "the interval of the --cardinality estimates")
+	flags.StringVar(&flagCardinalityMeasure, "cardinality-measurement", "cardinality", "the influxdb measurement for the --cardinality estimates")
+	flags.BoolVar(&flagRetransmits, "retransmissions", false, "write per-client and per-upstream rates of questions asked again within --retransmit-window")
+	flags.DurationVar(&flagRetransmitWindow, "retransmit-window", 2*time.Second, "how soon the same question must be asked again to count as a retransmission")
+	flags.DurationVar(&flagRetransmitPeriod, "retransmit-interval", time.Minute, "the interval of the retransmission rates")
+	flags.StringVar(&flagRetransmitMeasure, "retransmit-measurement", "retransmissions", "the influxdb measurement for the retransmission rates")
+	flags.BoolVar(&flagUpstreams, "upstreams", false, "write the latency, timeout rate and SERVFAIL rate of every forwarding upstream")
+	flags.DurationVar(&flagUpstreamTimeout, "upstream-timeout", 5*time.Second, "how long a forwarder query may wait for a response before it counts as a timeout")
+	flags.DurationVar(&flagUpstreamInterval, "upstream-interval", time.Minute, "the interval of the upstream stats")
+	flags.StringVar(&flagUpstreamMeasure, "upstream-measurement", "upstreams", "the influxdb measurement for the upstream stats")
+	flags.BoolVar(&flagAmplification, "amplification", false, "count ANY queries, large EDNS buffer sizes and large responses per client")
+	flags.Uint16Var(&flagAmpEdnsSize, "amplification-edns-size", 4096, "EDNS buffer sizes above this are flagged")
+	flags.IntVar(&flagAmpResponseSize, "amplification-response-size", 1232, "responses larger than this many bytes are flagged")
+	flags.DurationVar(&flagAmpInterval, "amplification-interval", time.Minute, "the interval of the amplification counts")
+	flags.StringVar(&flagAmpMeasurement, "amplification-measurement", "amplification", "the influxdb measurement for the amplification counts")
+	flags.BoolVar(&flagPtrScans, "ptr-scans", false, "detect clients sweeping a subnet with reverse lookups")
+	flags.DurationVar(&flagPtrScanWindow, "ptr-scan-window", 5*time.Minute, "the window in which the reverse lookups of a scan must happen")
+	flags.UintVar(&flagPtrScanThreshold, "ptr-scan-threshold", 32, "the number of distinct addresses of a /24 or /64 a client must look up to be reported")
+	flags.StringVar(&flagPtrScanMeasure, "ptr-scan-measurement", "ptr_scans", "the influxdb measurement for detected scans")
+	flags.BoolVar(&flagFingerprints, "fingerprints", false, "write a per-client profile of query types, distinct domains and categories")
+	flags.StringVar(&flagCategoriesFile, "categories-file", "", "a file with \"domain category\" lines used for the top category of a client profile or daily usage")
+	flags.DurationVar(&flagFingerprintPeriod, "fingerprint-interval", 15*time.Minute, "the interval of the client profiles")
+	flags.StringVar(&flagFingerprintMeasure, "fingerprint-measurement", "fingerprints", "the influxdb measurement for the client profiles")
+	flags.BoolVar(&flagTalkers, "talkers", false, "serve the top clients and domains of the last 5 to 60 minutes on /top")
+	flags.UintVar(&flagTalkersCapacity, "talkers-capacity", 1000, "the number of clients and domains counted per minute for /top")
+	flags.BoolVar(&flagStream, "stream", false, "stream client queries and responses as server-sent events on /stream")
+	flags.UintVar(&flagStreamClients, "stream-clients", 10, "the maximum number of clients connected to /stream")
+	flags.UintVar(&flagRecent, "recent", 0, "keep this many recent messages and serve them on /queries (0 disables)")
+	flags.StringVar(&flagRecentFilter, "recent-filter", "type=CLIENT_RESPONSE", "only keep the messages matching this filter for /queries")
+	flags.BoolVar(&flagDashboard, "dashboard", false, "serve a web dashboard, which can edit the lists, on /dashboard of the management port")
+	flags.BoolVar(&flagAnnotations, "annotations", false, "write list updates, config reloads and enforcer reconnects as annotation points")
+	flags.StringVar(&flagAnnotationMeasure, "annotation-measurement", "annotations", "the influxdb measurement for annotations")
+	flags.StringVar(&flagGrafanaUrl, "grafana-url", "", "also post annotations to the annotations API of this Grafana")
+	flags.StringVar(&flagGrafanaToken, "grafana-token", "", "the Grafana API token for annotations")
+	flags.BoolVar(&flagWhoQueriedInflux, "whoqueried-influx", false, "answer /whoqueried from influxdb when the recent messages don't cover the window")
+	flags.StringVar(&flagTenantsFile, "tenants-file", "", "a YAML file of tenants, each with its own influxdb org/bucket and block lists, selected by dnstap identity or query zone")
+	flags.StringVar(&flagAnonymize, "anonymize-clients", "", "anonymize client addresses before enrichment: truncate (to the /24 or /64), hash (HMAC with a rotating key) or drop")
+	flags.DurationVar(&flagAnonymizeRotation, "anonymize-rotation", 24*time.Hour, "how often the key of --anonymize-clients=hash is replaced")
+	flags.StringArrayVar(&flagRedactQnames, "redact-qname", nil, "redact the names under a suffix before they are written, as suffix=truncate or suffix=hash")
+	flags.StringVar(&flagRedactKey, "redact-key", "", "key of the HMAC used by --redact-qname=suffix=hash, random for each run if not set")
+	flags.BoolVar(&flagCreateBucket, "create-bucket", false, "create the bucket on startup if it doesn't exist")
+	flags.DurationVar(&flagBucketRetention, "bucket-retention", 0, "the retention period of a bucket created by --create-bucket, 0 to keep data forever")
+	flags.BoolVar(&flagCheckWrite, "check-write", true, "check on startup that the token may write to the bucket")
+	flags.StringVar(&flagMirrorUrl, "mirror-url", "", "also write every point to this influxdb, e.g. the old server while migrating")
+	flags.StringVar(&flagMirrorToken, "mirror-token", "", "the auth token of --mirror-url, username:password for influxdb 1.8")
+	flags.StringVar(&flagMirrorOrg, "mirror-org", "", "the org of --mirror-url, unused by influxdb 1.8")
+	flags.StringVar(&flagMirrorBucket, "mirror-bucket", "dns", "the bucket of --mirror-url, database/retention-policy for influxdb 1.8")
+	flags.StringVar(&flagLeaderLock, "leader-lock", "", "stand by until this lock file is free, so that only one of several collectors writes and enforces")
+	flags.DurationVar(&flagLeaderInterval, "leader-interval", 2*time.Second, "how often a standby tries to take the --leader-lock")
+	flags.StringVar(&flagCaptureFilter, "capture-filter", "", "keep the raw messages matching this filter, e.g. \"malformed\", \"dga=0.8\" or \"qname=example.com\"")
+	flags.StringVar(&flagCaptureFile, "capture-file", "", "write the captured messages to this dnstap file instead of to influxdb")
+	flags.StringVar(&flagCaptureFormat, "capture-format", "dnstap", "the format of the --capture-file: dnstap, json (one object per line) or line (influxdb line protocol)")
+	flags.StringVar(&flagCaptureMeasure, "capture-measurement", "captures", "the influxdb measurement for the captured messages and the line protocol of /stream")
+	flags.StringArrayVar(&flagQnameRates, "qname-rate", nil, "alert when a client queries the same name more than limit times within a window, as limit/window, e.g. 100/1m")
+	flags.StringVar(&flagQnameRateMeasure, "qname-rate-measurement", "qname_rate_alerts", "the influxdb measurement for the --qname-rate alerts")
+	flags.BoolVar(&flagCounters, "counters", false, "count the client responses by rcode, qtype and client group")
+	flags.BoolVar(&flagCountersOnly, "counters-only", false, "write only the --counters and the other summaries, no per query points")
+	flags.DurationVar(&flagCountersInterval, "counters-interval", time.Minute, "the interval of the --counters and --blocked-counters")
+	flags.StringVar(&flagCountersMeasure, "counters-measurement", "counters", "the influxdb measurement for the --counters")
+	flags.DurationVar(&flagTcRetryWindow, "tc-retry-window", 0, "link truncated UDP responses to the TCP retries of the client within this window (0 to disable)")
+	flags.StringArrayVar(&flagLatencySlos, "latency-slo", nil, "write a breach when fewer responses than the target are faster than the threshold in a window, as [type:]percent%<threshold/window, e.g. 99%<50ms/5m")
+	flags.StringVar(&flagSloMeasurement, "slo-measurement", "slo_breaches", "the influxdb measurement for the --latency-slo breaches")
+	flags.BoolVar(&flagZoneOps, "zone-ops", false, "write every NOTIFY, UPDATE, AXFR and IXFR and alert when one is refused")
+	flags.StringVar(&flagZoneOpsMeasure, "zone-ops-measurement", "zone_ops", "the influxdb measurement for --zone-ops")
+	flags.BoolVar(&flagDailyUsage, "daily-usage", false, "write one point per client per day with its queries, blocked queries, distinct domains and top category")
+	flags.StringVar(&flagDailyUsageAt, "daily-usage-at", "00:00", "the local time of day, as hh:mm, at which the daily usage is written")
+	flags.StringVar(&flagDailyUsageMeasure, "daily-usage-measurement", "daily_usage", "the influxdb measurement for --daily-usage")
+	flags.StringVar(&flagHostFormat, "qhost-format", "raw", "how host names are rendered: raw, fqdn, short or combined (\"host (ip)\"), optionally with lower, e.g. short,lower")
+	flags.BoolVar(&flagRhost, "rhost", false, "tag resolver and forwarder messages with the host name of the server they were sent to")
+	flags.StringVar(&flagRecentFile, "recent-file", "", "save the --recent messages to this file on shutdown and load them on start")
+	flags.BoolVar(&flagInfluxGzip, "gzip", false, "gzip the writes to influxdb, which saves a lot of bandwidth at high rates")
+	flags.DurationVar(&flagHttpTimeout, "http-timeout", 20*time.Second, "the timeout of influxdb requests, at least 1s and rounded up to whole seconds")
+	flags.UintVar(&flagWildcardThreshold, "wildcard-threshold", 0, "block a whole registered domain once this many of its subdomains were blocked through the same cname (0 disables)")
+	flags.BoolVar(&flagBlockedCounters, "blocked-counters", false, "count the blocked client responses by list and category every --counters-interval")
+	flags.StringVar(&flagBlockedMeasure, "blocked-counters-measurement", "blocked_counts", "the influxdb measurement for the --blocked-counters")
+	flags.BoolVar(&flagDns64, "dns64", false, "tag responses with AAAA answers with whether they were synthesized by DNS64")
+	flags.StringArrayVar(&flagDns64Prefixes, "dns64-prefix", []string{"64:ff9b::/96"}, "a DNS64 prefix that synthesized AAAA answers are in, for --dns64")
+	flags.BoolVar(&flagAuthoritative, "authoritative", false, "write the latency, timeout rate and SERVFAIL rate of every authoritative server and zone the resolver queries, using the --upstream-timeout and --upstream-interval")
+	flags.StringVar(&flagAuthMeasurement, "authoritative-measurement", "authoritative", "the influxdb measurement for --authoritative")
+	flags.BoolVar(&flagCheckConfig, "check-config", false, "validate the config, list files, influxdb and enforcer, then exit (non-zero on any problem)")
+}
+
+// parsePipelineFlags parses the flags, config file and environment of a command that
+// runs the pipeline, returning the influxdb url and input along with the names of the
+// flags given on the command line. The input may be empty if it is optional.
+func parsePipelineFlags(flags *flag.FlagSet, args []string, optionalInput bool) (string, string, map[string]bool) {
+	_ = flags.Parse(args)
+
+	if flagVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	config, err := LoadConfig(flagConfig, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	commandLine := CommandLineFlags(flags)
+	if err := config.Apply(flags, commandLine); err != nil {
+		log.Fatal(err)
+	}
 
-	flag.Usage = func() {
-		//noinspection GoUnhandledErrorResult
-		fmt.Fprintf(os.Stderr, "%s <influxdb_url> <sock_or_file>\n", os.Args[0])
-		flag.PrintDefaults()
-	}
-
-	flag.UintVarP(&flagLogLevel, "loglevel", "l", 1, "turn on verbose logging")
-	flag.BoolVarP(&flagFile, "file", "f", false, "input is a file rather than a unix socket")
-	flag.StringVar(&flagQueriesMeasurement, "queries-measurement", "queries", "the influxdb queries measurement name")
-	flag.StringVar(&flagCnamesMeasurement, "cnames-measurement", "cnames", "the influxdb cnames measurement name")
-	flag.StringVarP(&flagBucket, "bucket", "b", "dns", "the influxdb bucket name")
-	flag.StringVarP(&flagAuthToken, "token", "t", "", "the influxdb auth token")
-	flag.StringVarP(&flagOrg, "org", "o", "", "the influxdb org")
-	flag.UintVarP(&flagBatchSize, "batch", "c", 1000, "the write batch size")
-	flag.UintVarP(&flagBufferSize, "buffer", "r", 1000, "the write buffer size")
-	flag.UintVarP(&flagFlushIntervalMs, "flush", "u", 1000, "the write flush interval in ms")
-	flag.StringVar(&flagBlockFile, "block", "/web/hblock.rpz", "the hblock rpz file")
-	flag.StringVar(&flagWhitelistFile, "white", "/web/whitelist.rpz", "the whitelist rpz file")
-	flag.StringVar(&flagBlacklistFile, "black", "/web/blacklist.rpz", "the blacklist rpz file")
-	flag.UintVarP(&flagUpdatePort, "port", "p", 12760, "the port that listens for update commands")
-	flag.BoolVar(&flagDontExit, "dont-exit", false, "don't exit when finished (for testing)")
-	flag.StringVar(&flagResolver, "resolver", "127.0.0.1:5053", "the resolver to use for reverse lookups")
-	flag.Parse()
-
-	args := flag.Args()
-	if len(args) != 2 {
-		flag.Usage()
+	args = flags.Args()
+	if len(args) == 0 {
+		args = []string{config.Get(configInfluxdb), config.Get(configInput)}
+	}
+	if optionalInput && len(args) == 1 {
+		args = append(args, "")
+	}
+	if len(args) != 2 || len(args[0]) == 0 || (len(args[1]) == 0 && !optionalInput) {
+		flags.Usage()
 		os.Exit(0)
 	}
 
-	influxdb := args[0]
-	name := args[1]
+	if err := configureLogging(logOptions()); err != nil {
+		log.Fatal(err)
+	}
+	return args[0], args[1], commandLine
+}
+
+func logOptions() LogOptions {
+	return LogOptions{
+		Format:     flagLogFormat,
+		File:       flagLogFile,
+		MaxSizeMb:  flagLogMaxSize,
+		MaxAgeDays: flagLogMaxAge,
+		MaxBackups: flagLogMaxBackups,
+	}
+}
+
+// openInput opens the dnstap file or unix socket given by --file.
+func openInput(name string) (dnstap.Input, error) {
+	if flagFile {
+		return dnstap.NewFrameStreamInputFromFilename(name)
+	}
+	return dnstap.NewFrameStreamSockInputFromPath(name)
+}
+
+// runPipeline runs the collector until the input is finished (unless --dont-exit is
+// set) or it is signalled, then drains the pipeline.
+func runPipeline(flags *flag.FlagSet, influxdb string, commandLine map[string]bool, open func() (dnstap.Input, error)) {
+	log.Infof("Starting %s", versionString())
+
+	SetRestartPolicy(flagMaxRestarts, flagRestartWindow)
+	SetErrorLogLimit(flagErrorLogBurst, flagErrorLogWindow)
+	if len(flagOtlpEndpoint) > 0 {
+		shutdownTracing, err := initTracing(flagOtlpEndpoint, flagTraceSampleRatio)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to enable tracing")
+		}
+		defer shutdownTracing()
+	}
+	if len(flagPprof) > 0 {
+		go servePprof(flagPprof)
+	}
 
-	decoder := NewDnsTapDecoder(flagResolver, flagBufferSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Got %s, shutting down", sig)
+		cancel()
+	}()
 
+	hostCache := NewHostCache(flagHostCacheSize, flagHostCacheTtl)
+	reverse := NewReverseResolver(flagResolver, hostCache, flagMaxLookups, flagNegativeTtl, flagNegativeTtlMax)
+	hosts, err := NewHostSources(flagHostSources, flagHostSourceInterval)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid host source")
+	}
+	go hosts.Run(ctx)
+	var neighbors *NeighborTable
+	if flagNeighbors {
+		neighbors = NewNeighborTable(flagOuiFile, flagNeighborInterval, flagNeighborTtl)
+		go neighbors.Run(ctx)
+	}
+	var geoIP *GeoIP
+	if len(flagGeoIPFile) > 0 || len(flagAsnFile) > 0 {
+		geoIP = NewGeoIP(flagGeoIPFile, flagAsnFile, time.Minute)
+		go geoIP.Run(ctx)
+	}
+	groups, err := NewClientGroups(flagClientGroups, flagClientGroupsFile)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid client groups")
+	}
+	var dedup *Deduplicator
+	if flagDedupWindow > 0 {
+		dedup = NewDeduplicator(flagDedupWindow, flagDedupDrop, flagDedupMaxEntries)
+	}
+	enricher := NewEnricher(reverse, hosts, neighbors, geoIP, groups, flagUnicode)
+	hostFormat, err := ParseHostFormat(flagHostFormat)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid host format")
+	}
+	enricher.SetHostFormat(hostFormat)
+	enricher.ResolveResponders(flagRhost)
+	var anonymizer *Anonymizer
+	if len(flagAnonymize) > 0 {
+		mode, err := ParseAnonymizeMode(flagAnonymize)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid anonymize mode")
+		}
+		anonymizer = NewAnonymizer(mode, flagAnonymizeRotation)
+	}
+	var election *LeaderElection
+	if len(flagLeaderLock) > 0 {
+		election = NewLeaderElection(flagLeaderLock, flagLeaderInterval)
+	}
+	decoder := NewDnsTapDecoder(enricher, dedup, anonymizer, election, flagLowercase, flagBufferSize)
+
+	if flagMemoryTarget > 0 {
+		budget := NewMemoryBudget(flagMemoryTarget, 10*time.Second)
+		budget.Add("host cache", func() {
+			hostCache.Shrink(0.5)
+		})
+		if dedup != nil {
+			budget.Add("dedup", dedup.Clear)
+		}
+		go budget.Run(ctx)
+	}
+
+	// The client takes the timeout in whole seconds, where 0 means no timeout at all. It
+	// builds its own http.Transport, so there are no idle connection limits to tune.
+	if flagHttpTimeout < time.Second {
+		log.Fatalf("Invalid http timeout %s, it must be at least 1s", flagHttpTimeout)
+	}
 	options := influxdb2.DefaultOptions().
 		SetLogLevel(flagLogLevel).
 		SetBatchSize(flagBatchSize).
 		SetFlushInterval(flagFlushIntervalMs).
+		SetUseGZip(flagInfluxGzip).
+		SetHttpRequestTimeout(uint((flagHttpTimeout + time.Second - 1) / time.Second)).
 		SetPrecision(time.Millisecond)
-	influx := NewInfluxProcessor(influxdb, flagAuthToken, flagOrg, flagBucket, flagQueriesMeasurement, flagBufferSize, options)
-	influx.LogErrors()
+	if flagInfluxBufferSize == 0 {
+		flagInfluxBufferSize = flagBufferSize
+	}
+	if flagCnameBufferSize == 0 {
+		flagCnameBufferSize = flagBufferSize
+	}
+	influxOverflow, err := ParseOverflowPolicy(flagInfluxOverflow)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid influx overflow policy")
+	}
+	cnameOverflow, err := ParseOverflowPolicy(flagCnameOverflow)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid cname overflow policy")
+	}
 
-	cnames := NewCnameProcessor(influx.GetWriteApi(), flagCnamesMeasurement, flagBlockFile, flagWhitelistFile, flagBlacklistFile, flagBufferSize, flagUpdatePort)
+	redactor, err := NewRedactor(flagRedactQnames, flagRedactKey)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid qname redaction")
+	}
+	var dns64Prefixes []*net.IPNet
+	if flagDns64 {
+		dns64Prefixes, err = parseDns64Prefixes(flagDns64Prefixes)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid DNS64 prefix")
+		}
+	}
 
-	decoder.AddProcessor(influx)
-	decoder.AddProcessor(cnames)
+	influx := NewInfluxProcessor(influxdb, flagAuthToken, flagOrg, flagBucket, flagQueriesMeasurement, flagMalformedMeasure, flagInfluxBufferSize, options)
+	if flagCreateBucket || flagCheckWrite {
+		setupBucket(influx, flagCreateBucket, flagBucketRetention)
+	}
+	if len(flagMirrorUrl) > 0 {
+		influx.MirrorTo(flagMirrorUrl, flagMirrorToken, flagMirrorOrg, flagMirrorBucket, options)
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(3)
+	blockAction, blockTarget, err := ParseBlockAction(flagBlockAction, flagBlockTarget)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid block action")
+	}
+	enforcer, err := NewEnforcer(flagEnforcer, blockAction, blockTarget, flagRpzFile, flagKnotSocket)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create enforcer")
+	}
 
-	go influx.Run(&wg)
-	go cnames.Run(&wg)
-	go decoder.Run(&wg)
+	if flagAnnotations {
+		annotations = NewAnnotator(influx.GetWriteApi(), flagAnnotationMeasure, flagGrafanaUrl, flagGrafanaToken)
+	}
 
-	if flagFile {
-		input, err := dnstap.NewFrameStreamInputFromFilename(name)
+	cnames := NewCnameProcessor(influx.GetWriteApi(), enforcer, flagCnamesMeasurement, flagBlockFile, flagWhitelistFile, flagBlacklistFile, flagGravityDb, flagCnameBufferSize, flagMaxLearned)
+	if len(flagDisabledLists) > 0 {
+		if err := cnames.SetDisabledLists(flagDisabledLists); err != nil {
+			log.WithError(err).Fatal("Invalid disabled list")
+		}
+		if err := cnames.ReloadLists(); err != nil {
+			log.WithError(err).Fatal("Failed to load the lists")
+		}
+	}
+	cnames.SetWildcardThreshold(flagWildcardThreshold)
+	influx.SetBlockedLookup(cnames.BlockedList)
+	influx.SetRedactor(redactor)
+	influx.SetDns64Prefixes(dns64Prefixes)
+
+	management := NewManagementServer(flagUpdatePort)
+	readiness := NewReadinessChecks()
+	readiness.RegisterHandlers(management)
+	readiness.Add("influxdb", influx.Ready)
+	if flagEnforcerProbe > 0 {
+		enforcerHealth := NewEnforcerHealth(enforcer, flagEnforcerProbe)
+		go enforcerHealth.Run(ctx)
+		readiness.Add("enforcer", enforcerHealth.Ready)
+	}
+	cnames.RegisterHandlers(management)
+	if flagDashboard {
+		management.HandleFunc("/dashboard", dashboardHandler)
+	}
+	RegisterEnforcerHandlers(enforcer, management)
+
+	influxFilter, err := ParseFilter(flagInfluxFilter)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid influx filter")
+	}
+	cnameFilter, err := ParseFilter(flagCnameFilter)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid cname filter")
+	}
+
+	var webhook *Webhook
+	if len(flagWebhook) > 0 {
+		webhook = NewWebhook(flagWebhook)
+	}
+
+	var tenants []*Tenant
+	if len(flagTenantsFile) > 0 {
+		tenants, err = LoadTenants(flagTenantsFile)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to load the tenants from %s", flagTenantsFile)
+		}
+	}
+
+	pipeline := NewPipeline(decoder)
+	if flagCountersOnly {
+		influx.DisableQueries()
+	}
+	if flagTcRetryWindow > 0 {
+		influx.TrackTruncation(flagTcRetryWindow)
+	}
+	pipeline.AddProcessor("influx", influx, influxOverflow, influxFilter.And(excludeTenants(tenants)))
+	pipeline.AddProcessor("cnames", cnames, cnameOverflow, cnameFilter.And(excludeTenants(tenants)))
+	tenantCnames := make(map[*Tenant]*CnameProcessor)
+	for _, tenant := range tenants {
+		tenantInflux := NewInfluxProcessor(influxdb, flagAuthToken, tenant.Org, tenant.Bucket, flagQueriesMeasurement, flagMalformedMeasure, flagInfluxBufferSize, options)
+		if flagCreateBucket || flagCheckWrite {
+			setupBucket(tenantInflux, flagCreateBucket, flagBucketRetention)
+		}
+		var tenantEnforcer Enforcer = NewNoopEnforcer()
+		if len(tenant.RpzFile) > 0 {
+			tenantEnforcer, err = NewEnforcer("rpz", blockAction, blockTarget, tenant.RpzFile, "")
+			if err != nil {
+				log.WithError(err).Fatalf("Failed to create the enforcer of tenant %s", tenant.Name)
+			}
+		}
+		tenantCnames[tenant] = NewCnameProcessor(tenantInflux.GetWriteApi(), tenantEnforcer, flagCnamesMeasurement, tenant.BlockFile, tenant.WhiteFile, tenant.BlackFile, tenant.GravityDb, flagCnameBufferSize, flagMaxLearned)
+		tenantCnames[tenant].SetWildcardThreshold(flagWildcardThreshold)
+		tenantInflux.SetBlockedLookup(tenantCnames[tenant].BlockedList)
+		tenantInflux.SetRedactor(redactor)
+		tenantInflux.SetDns64Prefixes(dns64Prefixes)
+		if flagCountersOnly {
+			tenantInflux.DisableQueries()
+		}
+		readiness.Add("influxdb "+tenant.Name, tenantInflux.Ready)
+		pipeline.AddProcessor("influx."+tenant.Name, tenantInflux, influxOverflow, influxFilter.And(tenant.Filter()))
+		pipeline.AddProcessor("cnames."+tenant.Name, tenantCnames[tenant], cnameOverflow, cnameFilter.And(tenant.Filter()))
+	}
+	if flagTopN > 0 {
+		topFilter, err := ParseFilter(flagTopFilter)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid top filter")
+		}
+		top := NewTopNProcessor(influx.GetWriteApi(), flagTopMeasurement, flagTopN, flagTopInterval, flagBufferSize)
+		pipeline.AddProcessor("top", top, OverflowDropNewest, topFilter)
+	}
+	if flagNod {
+		nodFilter, _ := ParseFilter("type=CLIENT_QUERY")
+		var rdap *RdapClient
+		if flagRdap {
+			rdap = NewRdapClient(flagRdapUrl, flagRdapInterval)
+		}
+		nod := NewNodProcessor(influx.GetWriteApi(), flagNodMeasurement, flagNodFile, flagNodCapacity, flagNodLearning, time.Minute, rdap, flagBufferSize)
+		pipeline.AddProcessor("nod", nod, OverflowBlock, nodFilter)
+	}
+	if flagDga {
+		dgaFilter, _ := ParseFilter("type=CLIENT_RESPONSE,rcode=NXDOMAIN")
+		dga := NewDgaProcessor(influx.GetWriteApi(), flagDgaMeasurement, flagDgaThreshold, flagDgaMinSuspicious, flagDgaInterval, flagBufferSize)
+		pipeline.AddProcessor("dga", dga, OverflowDropNewest, dgaFilter)
+	}
+	if flagSpikes {
+		spikeFilter, _ := ParseFilter("type=CLIENT_RESPONSE")
+		spikes := NewSpikeProcessor(influx.GetWriteApi(), flagSpikeMeasurement, webhook, flagSpikeInterval, flagSpikeDeviations, flagSpikeMinResponses, flagBufferSize)
+		pipeline.AddProcessor("spikes", spikes, OverflowDropNewest, spikeFilter)
+	}
+	if flagCardinality {
+		cardinalityFilter, _ := ParseFilter("type=CLIENT_QUERY")
+		cardinality := NewCardinalityProcessor(influx.GetWriteApi(), flagCardinalityMeasure, flagCardinalityPeriod, flagBufferSize)
+		pipeline.AddProcessor("cardinality", cardinality, OverflowDropNewest, cardinalityFilter)
+	}
+	if flagRetransmits {
+		retransmitFilter, _ := ParseFilter("type=CLIENT_QUERY|RESOLVER_QUERY|FORWARDER_QUERY")
+		retransmits := NewRetransmitProcessor(influx.GetWriteApi(), flagRetransmitMeasure, flagRetransmitWindow, flagRetransmitPeriod, flagBufferSize)
+		pipeline.AddProcessor("retransmissions", retransmits, OverflowDropNewest, retransmitFilter)
+	}
+	if flagUpstreams {
+		upstreamFilter, _ := ParseFilter("type=FORWARDER_QUERY|FORWARDER_RESPONSE")
+		upstreams := NewUpstreamProcessor("upstreams", influx.GetWriteApi(), flagUpstreamMeasure, false, flagUpstreamTimeout, flagUpstreamInterval, flagBufferSize)
+		pipeline.AddProcessor("upstreams", upstreams, OverflowDropNewest, upstreamFilter)
+	}
+	if flagAuthoritative {
+		authoritativeFilter, _ := ParseFilter("type=RESOLVER_QUERY|RESOLVER_RESPONSE")
+		authoritative := NewUpstreamProcessor("authoritative", influx.GetWriteApi(), flagAuthMeasurement, true, flagUpstreamTimeout, flagUpstreamInterval, flagBufferSize)
+		pipeline.AddProcessor("authoritative", authoritative, OverflowDropNewest, authoritativeFilter)
+	}
+	if len(flagCaptureFilter) > 0 {
+		captureFilter, err := ParseFilter(flagCaptureFilter)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid capture filter")
+		}
+		captureFormat, err := ParseCaptureFormat(flagCaptureFormat)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid capture format")
+		}
+		capture, err := NewCaptureProcessor(influx.GetWriteApi(), flagCaptureMeasure, flagCaptureFile, captureFormat, flagBufferSize)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to open the capture file %s", flagCaptureFile)
+		}
+		pipeline.AddProcessor("capture", capture, OverflowDropNewest, captureFilter)
+	}
+	if flagAmplification {
+		ampFilter, _ := ParseFilter("type=CLIENT_QUERY|CLIENT_RESPONSE")
+		amplification := NewAmplificationProcessor(influx.GetWriteApi(), flagAmpMeasurement, flagAmpEdnsSize, flagAmpResponseSize, flagAmpInterval, flagBufferSize)
+		pipeline.AddProcessor("amplification", amplification, OverflowDropNewest, ampFilter)
+	}
+	if flagPtrScans {
+		ptrScanFilter, _ := ParseFilter("type=CLIENT_QUERY,qtype=PTR")
+		ptrScans := NewPtrScanProcessor(influx.GetWriteApi(), flagPtrScanMeasure, webhook, flagPtrScanWindow, flagPtrScanThreshold, flagBufferSize)
+		pipeline.AddProcessor("ptr_scans", ptrScans, OverflowDropNewest, ptrScanFilter)
+	}
+	if flagCounters || flagCountersOnly {
+		countersFilter, _ := ParseFilter("type=CLIENT_RESPONSE")
+		counters := NewCountersProcessor(influx.GetWriteApi(), flagCountersMeasure, flagCountersInterval, flagBufferSize)
+		pipeline.AddProcessor("counters", counters, OverflowDropNewest, countersFilter)
+	}
+	if len(flagQnameRates) > 0 {
+		qnameRateFilter, _ := ParseFilter("type=CLIENT_QUERY")
+		qnameRates, err := NewQnameRateProcessor(influx.GetWriteApi(), flagQnameRateMeasure, webhook, flagQnameRates, flagBufferSize)
 		if err != nil {
-			log.Fatalf("dnstap: Failed to open input file %s: %v", name, err)
+			log.WithError(err).Fatal("Invalid qname rate rule")
 		}
-		go input.ReadInto(decoder.GetChannel())
-		input.Wait()
-	} else {
-		input, err := dnstap.NewFrameStreamSockInputFromPath(name)
+		pipeline.AddProcessor("qname_rates", qnameRates, OverflowDropNewest, qnameRateFilter)
+	}
+	if flagZoneOps {
+		zoneOpsFilter, _ := ParseFilter("type=CLIENT_QUERY|CLIENT_RESPONSE|AUTH_QUERY|AUTH_RESPONSE")
+		zoneOps := NewZoneOpsProcessor(influx.GetWriteApi(), flagZoneOpsMeasure, webhook, flagBufferSize)
+		pipeline.AddProcessor("zone_ops", zoneOps, OverflowDropNewest, zoneOpsFilter)
+	}
+	if len(flagLatencySlos) > 0 {
+		slos, err := NewSloProcessor(influx.GetWriteApi(), flagSloMeasurement, webhook, flagLatencySlos, flagBufferSize)
 		if err != nil {
-			//noinspection GoUnhandledErrorResult
-			log.Fatalf("dnstap: Failed to open unix socket %s: %v", name, err)
+			log.WithError(err).Fatal("Invalid latency SLO")
 		}
-		go input.ReadInto(decoder.GetChannel())
-		input.Wait()
+		pipeline.AddProcessor("slos", slos, OverflowDropNewest, slos.Filter())
+	}
+	var categories map[string]string
+	if len(flagCategoriesFile) > 0 {
+		categories, err = loadCategories(flagCategoriesFile)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to load categories from %s", flagCategoriesFile)
+		}
+	}
+	if flagFingerprints {
+		fingerprintFilter, _ := ParseFilter("type=CLIENT_QUERY")
+		fingerprints := NewFingerprintProcessor(influx.GetWriteApi(), flagFingerprintMeasure, categories, flagFingerprintPeriod, flagBufferSize)
+		pipeline.AddProcessor("fingerprints", fingerprints, OverflowDropNewest, fingerprintFilter)
+	}
+	if flagDailyUsage {
+		dailyUsageAt, err := parseTimeOfDay(flagDailyUsageAt)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid daily usage time")
+		}
+		dailyUsageFilter, _ := ParseFilter("type=CLIENT_QUERY|CLIENT_RESPONSE")
+		dailyUsage := NewDailyUsageProcessor(influx.GetWriteApi(), flagDailyUsageMeasure, categories, dailyUsageAt, flagBufferSize)
+		dailyUsage.SetBlockedLookup(cnames.BlockedList)
+		pipeline.AddProcessor("daily_usage", dailyUsage, OverflowDropNewest, dailyUsageFilter)
+	}
+	if flagBlockedCounters {
+		blockedCountersFilter, _ := ParseFilter("type=CLIENT_RESPONSE")
+		blockedCounters := NewBlockedCountersProcessor(influx.GetWriteApi(), flagBlockedMeasure, categories, cnames.BlockedList, flagCountersInterval, flagBufferSize)
+		pipeline.AddProcessor("blocked_counters", blockedCounters, OverflowDropNewest, blockedCountersFilter)
+	}
+	if flagTalkers {
+		talkersFilter, _ := ParseFilter("type=CLIENT_QUERY")
+		talkers := NewTalkersProcessor(flagTalkersCapacity, flagBufferSize)
+		talkers.RegisterHandlers(management)
+		pipeline.AddProcessor("talkers", talkers, OverflowDropNewest, talkersFilter)
+	}
+	if flagStream {
+		streamFilter, _ := ParseFilter("type=CLIENT_QUERY|CLIENT_RESPONSE")
+		stream := NewStreamProcessor(flagCaptureMeasure, flagStreamClients, flagBufferSize)
+		stream.RegisterHandlers(management)
+		pipeline.AddProcessor("stream", stream, OverflowDropNewest, streamFilter)
+	}
+	var recent *RecentProcessor
+	if flagRecent > 0 {
+		recentFilter, err := ParseFilter(flagRecentFilter)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid recent filter")
+		}
+		recent = NewRecentProcessor(flagRecent, flagRecentFile, flagBufferSize)
+		recent.RegisterHandlers(management)
+		pipeline.AddProcessor("recent", recent, OverflowDropNewest, recentFilter)
+	}
+	if recent != nil || flagWhoQueriedInflux {
+		NewWhoQueried(recent, influx, flagBucket, flagQueriesMeasurement, flagWhoQueriedInflux).RegisterHandlers(management)
+	}
+	if err := pipeline.Start(ctx); err != nil {
+		log.WithError(err).Fatal("Failed to start the pipeline")
 	}
 
+	// the settings that can be changed without a restart
+	reloader := NewReloader(flagConfig, flags, commandLine)
+	reloader.Add("logging", func() error {
+		return configureLogging(logOptions())
+	})
+	reloader.Add("lists", func() error {
+		if err := cnames.SetDisabledLists(flagDisabledLists); err != nil {
+			return err
+		}
+		return cnames.SetLists(flagBlockFile, flagWhitelistFile, flagBlacklistFile, flagGravityDb)
+	})
+	for _, tenant := range tenants {
+		reloader.Add("lists of tenant "+tenant.Name, tenantCnames[tenant].ReloadLists)
+	}
+	reloader.Add("filters", func() error {
+		influxFilter, err := ParseFilter(flagInfluxFilter)
+		if err != nil {
+			return err
+		}
+		cnameFilter, err := ParseFilter(flagCnameFilter)
+		if err != nil {
+			return err
+		}
+		_ = pipeline.SetFilter("influx", influxFilter.And(excludeTenants(tenants)))
+		for _, tenant := range tenants {
+			_ = pipeline.SetFilter("influx."+tenant.Name, influxFilter.And(tenant.Filter()))
+			_ = pipeline.SetFilter("cnames."+tenant.Name, cnameFilter.And(tenant.Filter()))
+		}
+		return pipeline.SetFilter("cnames", cnameFilter.And(excludeTenants(tenants)))
+	})
+	reloader.Add("reverse lookups", func() error {
+		reverse.Reconfigure(flagResolver, flagNegativeTtl, flagNegativeTtlMax)
+		hostCache.SetTtl(flagHostCacheTtl)
+		return nil
+	})
+	reloader.Add("host sources", func() error {
+		newHosts, err := NewHostSources(flagHostSources, flagHostSourceInterval)
+		if err != nil {
+			return err
+		}
+		hosts.Replace(newHosts)
+		return nil
+	})
+	reloader.Add("client groups", func() error {
+		newGroups, err := NewClientGroups(flagClientGroups, flagClientGroupsFile)
+		if err != nil {
+			return err
+		}
+		groups.Replace(newGroups)
+		return nil
+	})
+	reloader.RegisterHandlers(management)
+	go reloader.Run(ctx)
+
+	readiness.Add("processors", func() error {
+		for name, err := range pipeline.Health(time.Minute) {
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	})
+
+	if flagTelemetryInterval > 0 {
+		go NewTelemetry(influx.GetWriteApi(), flagTelemetryMeasure, flagTelemetryInterval).Run(ctx)
+	}
+
+	go errorLog.Run(ctx)
+	if election != nil {
+		go election.Run(ctx)
+	}
+	if flagStatsInterval > 0 {
+		go NewStatsLogger(flagStatsInterval).Run(ctx)
+	}
+
+	var inputOpened int32
+	readiness.Add("input", inputReady(&inputOpened))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go management.Run(ctx, &wg)
+	go notifyReady(ctx, readiness)
+	go runWatchdog(ctx, pipeline.GetChannel())
+
+	input, err := open()
+	if err != nil {
+		log.Fatalf("dnstap: Failed to open input: %v", err)
+	}
+	atomic.StoreInt32(&inputOpened, 1)
+	readInput(ctx, input, pipeline.GetChannel())
+	atomic.StoreInt32(&inputOpened, 0)
+
 	if !flagDontExit {
-		close(decoder.GetChannel())
+		cancel()
 	}
+	<-ctx.Done()
+	_ = sdNotify("STOPPING=1")
+
+	// the management server is stopped first so that no more commands are queued
+	// while the pipeline drains
 	wg.Wait()
-	os.Exit(0)
+	pipeline.Close()
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ManagementServer is the HTTP server that listens for update commands. Components
+// register their handlers with it before it is started.
+type ManagementServer struct {
+	httpServer *http.Server
+	mux        *http.ServeMux
+}
+
+func NewManagementServer(port uint) *ManagementServer {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/version", versionHandler)
+	return &ManagementServer{
+		httpServer: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux},
+		mux:        mux,
+	}
+}
+
+func (server *ManagementServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	server.mux.HandleFunc(pattern, handler)
+}
+
+func (server *ManagementServer) Handle(pattern string, handler http.Handler) {
+	server.mux.Handle(pattern, handler)
+}
+
+// Run serves requests until ctx is cancelled, then gives outstanding requests a few
+// seconds to finish.
+func (server *ManagementServer) Run(ctx context.Context, wg *sync.WaitGroup) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.httpServer.Shutdown(shutdownCtx)
+	}()
+	if err := server.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.WithError(err).Fatal("ListenAndServe() failed")
+	}
+	wg.Done()
+}
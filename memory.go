@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	log "github.com/sirupsen/logrus"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// memoryStats counts the times the soft memory target was exceeded.
+var memoryStats = expvar.NewMap("memory")
+
+type evictor struct {
+	name  string
+	evict func()
+}
+
+// MemoryBudget keeps the heap under a soft target by asking the caches to evict
+// entries whenever the target is exceeded, so that the collector stays stable on
+// devices with little memory.
+type MemoryBudget struct {
+	target   uint64
+	interval time.Duration
+	evictors []evictor
+}
+
+func NewMemoryBudget(targetMb uint, interval time.Duration) *MemoryBudget {
+	return &MemoryBudget{target: uint64(targetMb) << 20, interval: interval}
+}
+
+// Add registers a cache. evict is called from the budget's goroutine, so it must be
+// safe to call concurrently with the cache's users.
+func (budget *MemoryBudget) Add(name string, evict func()) {
+	budget.evictors = append(budget.evictors, evictor{name, evict})
+}
+
+func (budget *MemoryBudget) Run(ctx context.Context) {
+	ticker := time.NewTicker(budget.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			budget.check()
+		}
+	}
+}
+
+func (budget *MemoryBudget) check() {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	if memStats.HeapAlloc <= budget.target {
+		return
+	}
+
+	memoryStats.Add("over_target", 1)
+	log.Warnf("Heap of %d MB is over the %d MB memory target, evicting cache entries", memStats.HeapAlloc>>20, budget.target>>20)
+	for _, evictor := range budget.evictors {
+		log.Debugf("Evicting %s entries", evictor.name)
+		evictor.evict()
+	}
+	debug.FreeOSMemory()
+}
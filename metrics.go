@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var metricNameRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// forEachMetric calls fn for every numeric expvar. Maps produce one call per numeric
+// entry, with the entry's key; other vars have an empty key. Values are int64 or
+// float64.
+func forEachMetric(fn func(name, key string, value interface{})) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			m.Do(func(entry expvar.KeyValue) {
+				if value, ok := metricValue(entry.Value); ok {
+					fn(kv.Key, entry.Key, value)
+				}
+			})
+		} else if value, ok := metricValue(kv.Value); ok {
+			fn(kv.Key, "", value)
+		}
+	})
+}
+
+// metricsHandler exports every numeric expvar in the Prometheus text format. Maps are
+// exported as one series per key, with the key as the "key" label.
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer := bufio.NewWriter(w)
+	lastName := ""
+	forEachMetric(func(name, key string, value interface{}) {
+		name = "dnstap_" + metricNameRe.ReplaceAllString(name, "_")
+		if name != lastName {
+			_, _ = fmt.Fprintf(writer, "# TYPE %s untyped\n", name)
+			lastName = name
+		}
+		if len(key) > 0 {
+			_, _ = fmt.Fprintf(writer, "%s{key=%s} %v\n", name, strconv.Quote(key), value)
+		} else {
+			_, _ = fmt.Fprintf(writer, "%s %v\n", name, value)
+		}
+	})
+	_ = writer.Flush()
+}
+
+func metricValue(v expvar.Var) (interface{}, bool) {
+	switch value := v.(type) {
+	case *expvar.Int:
+		return value.Value(), true
+	case *expvar.Float:
+		return value.Value(), true
+	case expvar.Func:
+		switch n := value.Value().(type) {
+		case int:
+			return int64(n), true
+		case int64:
+			return n, true
+		case uint64:
+			return int64(n), true
+		case float64:
+			return n, true
+		}
+	}
+	return nil, false
+}
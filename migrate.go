@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+// schemaVersion is written as the schema_version tag of the queries points. It is
+// raised whenever a change of their tags or fields would break existing queries, and
+// migrate brings older points up to it. Points written before the tag existed are
+// version 0.
+const schemaVersion = "1"
+
+// migrationFlux returns the Flux that copies the points of the measurement written
+// with an older schema into the target bucket with the current one. Each retag
+// rewrites a tag value, as tag:old=new.
+func migrationFlux(bucket, target, org, measurement string, start, stop time.Time, retags []string) (string, error) {
+	var mappings []string
+	for _, retag := range retags {
+		parts := strings.SplitN(retag, ":", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid retag \"%s\", expected tag:old=new", retag)
+		}
+		values := strings.SplitN(parts[1], "=", 2)
+		if len(values) != 2 || len(parts[0]) == 0 {
+			return "", fmt.Errorf("invalid retag \"%s\", expected tag:old=new", retag)
+		}
+		mappings = append(mappings, fmt.Sprintf("%s: if exists r[%q] and r[%q] == %q then %q else r[%q]",
+			parts[0], parts[0], parts[0], values[0], values[1], parts[0]))
+	}
+	mappings = append(mappings, fmt.Sprintf("schema_version: %q", schemaVersion))
+
+	return fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %q and (not exists r.schema_version or r.schema_version != %q))
+  |> map(fn: (r) => ({r with %s}))
+  |> to(bucket: %q, org: %q)
+`, bucket, start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339), measurement, schemaVersion,
+		strings.Join(mappings, ", "), target, org), nil
+}
+
+func migrateCmd(name string, args []string) {
+	var target string
+	var since time.Duration
+	var retags []string
+	var printOnly bool
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	flags.StringVar(&target, "to-bucket", "", "the bucket the migrated points are written to (default the bucket itself)")
+	flags.DurationVar(&since, "since", 30*24*time.Hour, "migrate the points of this long ago until now")
+	flags.StringArrayVar(&retags, "retag", nil, "rewrite a tag value while migrating, as tag:old=new")
+	flags.BoolVar(&printOnly, "print", false, "print the Flux instead of running it")
+	influxdb, _, _ := parsePipelineFlags(flags, args, true)
+	if len(target) == 0 {
+		target = flagBucket
+	}
+
+	stop := time.Now()
+	flux, err := migrationFlux(flagBucket, target, flagOrg, flagQueriesMeasurement, stop.Add(-since), stop, retags)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid migration")
+	}
+	if printOnly {
+		fmt.Print(flux)
+		os.Exit(0)
+	}
+	if target == flagBucket {
+		log.Warn("Migrating in place adds the new series next to the old ones, which have to be deleted afterwards")
+	}
+
+	client := influxdb2.NewClient(influxdb, flagAuthToken)
+	defer client.Close()
+	result, err := client.QueryApi(flagOrg).Query(context.Background(), flux)
+	if err != nil {
+		log.WithError(err).Fatal("Migration failed")
+	}
+	//noinspection GoUnhandledErrorResult
+	defer result.Close()
+	points := 0
+	for result.Next() {
+		points++
+	}
+	if result.Err() != nil {
+		log.WithError(result.Err()).Fatalf("Migration failed after %d points", points)
+	}
+	log.Infof("Migrated %d points of %s to schema version %s in bucket %s", points, flagQueriesMeasurement, schemaVersion, target)
+}
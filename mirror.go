@@ -0,0 +1,96 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	"sync"
+)
+
+// mirrorErrors counts the write errors of each server when writes are mirrored.
+var mirrorErrors = expvar.NewMap("influx_mirror_errors")
+
+// mirrorWriteApi writes every point to several write APIs, e.g. an InfluxDB 1.x
+// database and a 2.x bucket while migrating. Each API batches and retries on its own,
+// so one server being down doesn't hold up or fail the writes to the others.
+type mirrorWriteApi struct {
+	names     []string
+	apis      []api.WriteApi
+	errors    chan error
+	errorOnce sync.Once
+}
+
+func newMirrorWriteApi(name string, writeApi api.WriteApi) *mirrorWriteApi {
+	return &mirrorWriteApi{names: []string{name}, apis: []api.WriteApi{writeApi}}
+}
+
+func (mirror *mirrorWriteApi) add(name string, writeApi api.WriteApi) {
+	mirror.names = append(mirror.names, name)
+	mirror.apis = append(mirror.apis, writeApi)
+}
+
+func (mirror *mirrorWriteApi) WriteRecord(line string) {
+	for _, writeApi := range mirror.apis {
+		writeApi.WriteRecord(line)
+	}
+}
+
+func (mirror *mirrorWriteApi) WritePoint(point *write.Point) {
+	for _, writeApi := range mirror.apis {
+		writeApi.WritePoint(point)
+	}
+}
+
+func (mirror *mirrorWriteApi) Flush() {
+	for _, writeApi := range mirror.apis {
+		writeApi.Flush()
+	}
+}
+
+// Close flushes and closes every API. Closing the clients afterwards is harmless.
+func (mirror *mirrorWriteApi) Close() {
+	for _, writeApi := range mirror.apis {
+		writeApi.Close()
+	}
+}
+
+// Errors merges the errors of all the APIs, prefixed with the name of the one that
+// failed. The channel is closed once all of theirs are.
+func (mirror *mirrorWriteApi) Errors() <-chan error {
+	mirror.errorOnce.Do(func() {
+		mirror.errors = make(chan error)
+		var wg sync.WaitGroup
+		for i, writeApi := range mirror.apis {
+			wg.Add(1)
+			go func(name string, errors <-chan error) {
+				for err := range errors {
+					mirrorErrors.Add(name, 1)
+					mirror.errors <- fmt.Errorf("%s: %w", name, err)
+				}
+				wg.Done()
+			}(mirror.names[i], writeApi.Errors())
+		}
+		go func() {
+			wg.Wait()
+			close(mirror.errors)
+		}()
+	})
+	return mirror.errors
+}
+
+// MirrorTo also writes everything written through the processor's write API, including
+// the points of the processors sharing it, to the bucket of another server. For an
+// InfluxDB 1.8 server the token is "username:password" and the bucket is
+// "database/retention-policy".
+func (influx *InfluxProcessor) MirrorTo(serverUrl string, authToken string, org string, bucket string, options *influxdb2.Options) {
+	mirror, ok := influx.writeApi.(*mirrorWriteApi)
+	if !ok {
+		mirror = newMirrorWriteApi(influx.client.ServerUrl(), influx.writeApi)
+		influx.writeApi = mirror
+	}
+	client := influxdb2.NewClientWithOptions(serverUrl, authToken, options)
+	influx.mirrors = append(influx.mirrors, client)
+	mirror.add(serverUrl, client.WriteApi(org, bucket))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NeighborTable maps client IPs to MAC addresses using the kernel neighbor (ARP/NDP)
+// table, and MAC addresses to vendors using an OUI database. Entries are kept after
+// they disappear from the kernel table so a client keeps its MAC between refreshes,
+// until they haven't been seen for the TTL.
+type NeighborTable struct {
+	interval time.Duration
+	ttl      time.Duration
+	mutex    sync.RWMutex
+	macs     map[string]neighbor
+	vendors  map[string]string
+}
+
+// neighbor is a MAC address and when it was last in the kernel table.
+type neighbor struct {
+	mac  string
+	seen time.Time
+}
+
+// NewNeighborTable reads the neighbor table every interval. A ttl of 0 keeps the
+// entries forever.
+func NewNeighborTable(ouiFile string, interval, ttl time.Duration) *NeighborTable {
+	neighbors := &NeighborTable{
+		interval: interval,
+		ttl:      ttl,
+		macs:     make(map[string]neighbor),
+		vendors:  make(map[string]string),
+	}
+	if len(ouiFile) > 0 {
+		vendors, err := loadOuiFile(ouiFile)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to load OUI file %s", ouiFile)
+		} else {
+			neighbors.vendors = vendors
+		}
+	}
+	neighbors.refresh()
+	return neighbors
+}
+
+// Lookup returns the MAC address and vendor for ip, if known.
+func (neighbors *NeighborTable) Lookup(ip string) (string, string) {
+	neighbors.mutex.RLock()
+	defer neighbors.mutex.RUnlock()
+	mac := neighbors.macs[ip].mac
+	if len(mac) < 8 {
+		return mac, ""
+	}
+	return mac, neighbors.vendors[strings.ToUpper(mac[:8])]
+}
+
+func (neighbors *NeighborTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(neighbors.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			neighbors.refresh()
+		}
+	}
+}
+
+func (neighbors *NeighborTable) refresh() {
+	macs := make(map[string]string)
+	output, err := exec.Command("ip", "neigh", "show").Output()
+	if err == nil {
+		parseIpNeigh(bytes.NewReader(output), macs)
+	} else {
+		file, err := os.Open("/proc/net/arp")
+		if err != nil {
+			log.WithError(err).Warn("Failed to read the neighbor table")
+			return
+		}
+		parseProcArp(file, macs)
+		_ = file.Close()
+	}
+
+	neighbors.update(macs, time.Now())
+}
+
+// update adds the neighbors read at now and drops those not seen for the TTL.
+func (neighbors *NeighborTable) update(macs map[string]string, now time.Time) {
+	neighbors.mutex.Lock()
+	defer neighbors.mutex.Unlock()
+	for ip, mac := range macs {
+		neighbors.macs[ip] = neighbor{mac: mac, seen: now}
+	}
+	if neighbors.ttl <= 0 {
+		return
+	}
+	for ip, entry := range neighbors.macs {
+		if now.Sub(entry.seen) > neighbors.ttl {
+			delete(neighbors.macs, ip)
+		}
+	}
+}
+
+func addNeighbor(macs map[string]string, ip, mac string) {
+	parsedIp := net.ParseIP(ip)
+	parsedMac, err := net.ParseMAC(mac)
+	if parsedIp == nil || err != nil || bytes.Equal(parsedMac, make([]byte, len(parsedMac))) {
+		return
+	}
+	macs[parsedIp.String()] = parsedMac.String()
+}
+
+// parseIpNeigh reads "ip dev eth0 lladdr aa:bb:cc:dd:ee:ff STATE" lines.
+func parseIpNeigh(reader io.Reader, macs map[string]string) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] == "lladdr" {
+				addNeighbor(macs, fields[0], fields[i+1])
+				break
+			}
+		}
+	}
+}
+
+// parseProcArp reads the IPv4 only /proc/net/arp table.
+func parseProcArp(reader io.Reader, macs map[string]string) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 {
+			addNeighbor(macs, fields[0], fields[3])
+		}
+	}
+}
+
+// loadOuiFile reads either the IEEE oui.txt or the Wireshark manuf format, returning
+// vendors keyed by the first three octets of the MAC (e.g. "00:1A:2B").
+func loadOuiFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	re := regexp.MustCompile(`^([0-9A-Fa-f]{2})[-:]([0-9A-Fa-f]{2})[-:]([0-9A-Fa-f]{2})\s+(\(hex\)\s+)?(.+)$`)
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := re.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		fields := strings.Split(match[5], "\t")
+		vendor := strings.TrimSpace(fields[len(fields)-1])
+		if len(vendor) > 0 {
+			vendors[strings.ToUpper(match[1]+":"+match[2]+":"+match[3])] = vendor
+		}
+	}
+	return vendors, scanner.Err()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeighborTableTtl(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		age  time.Duration
+		kept bool
+	}{
+		{"seen recently", time.Hour, 30 * time.Minute, true},
+		{"expired", time.Hour, 2 * time.Hour, false},
+		{"kept forever", 0, 1000 * time.Hour, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			neighbors := &NeighborTable{ttl: test.ttl, macs: make(map[string]neighbor)}
+			now := time.Now()
+			neighbors.update(map[string]string{
+				"192.168.1.20": "aa:bb:cc:dd:ee:01",
+				"192.168.1.21": "aa:bb:cc:dd:ee:02",
+			}, now.Add(-test.age))
+			// only .21 is still in the kernel table
+			neighbors.update(map[string]string{"192.168.1.21": "aa:bb:cc:dd:ee:02"}, now)
+
+			mac, _ := neighbors.Lookup("192.168.1.20")
+			if kept := len(mac) > 0; kept != test.kept {
+				t.Errorf("192.168.1.20 kept = %t, want %t", kept, test.kept)
+			}
+			if mac, _ := neighbors.Lookup("192.168.1.21"); mac != "aa:bb:cc:dd:ee:02" {
+				t.Errorf("Lookup(192.168.1.21) = %q, want aa:bb:cc:dd:ee:02", mac)
+			}
+		})
+	}
+}
+
+func TestParseNeighbors(t *testing.T) {
+	ipNeigh := `192.168.1.20 dev eth0 lladdr AA:BB:CC:DD:EE:01 REACHABLE
+192.168.1.21 dev eth0  FAILED
+fe80::1 dev eth0 lladdr aa:bb:cc:dd:ee:03 router STALE
+192.168.1.22 dev eth0 lladdr 00:00:00:00:00:00 STALE
+`
+	procArp := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.20     0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0
+192.168.1.23     0x1         0x0         00:00:00:00:00:00     *        eth0
+bogus            0x1         0x2         aa:bb:cc:dd:ee:04     *        eth0
+`
+	tests := []struct {
+		name  string
+		parse func(macs map[string]string)
+		want  map[string]string
+	}{
+		{"ip neigh", func(macs map[string]string) {
+			parseIpNeigh(strings.NewReader(ipNeigh), macs)
+		}, map[string]string{"192.168.1.20": "aa:bb:cc:dd:ee:01", "fe80::1": "aa:bb:cc:dd:ee:03"}},
+		{"/proc/net/arp", func(macs map[string]string) {
+			parseProcArp(strings.NewReader(procArp), macs)
+		}, map[string]string{"192.168.1.20": "aa:bb:cc:dd:ee:01"}},
+	}
+	for _, test := range tests {
+		macs := make(map[string]string)
+		test.parse(macs)
+		if len(macs) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, macs, test.want)
+			continue
+		}
+		for ip, mac := range test.want {
+			if macs[ip] != mac {
+				t.Errorf("%s: got %v, want %v", test.name, macs, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodStats counts the registered domains checked and the newly observed ones.
+var nodStats = expvar.NewMap("nod")
+
+// NodProcessor detects newly observed domains: the first time a registered domain
+// (e.g. example.co.uk for www.example.co.uk) is ever queried on the network, an event
+// point is written. The domains seen before are kept in a bloom filter that is saved
+// to a file, so they survive restarts. No events are written until the filter has
+// been learning for the learning period, so that a new install doesn't report every
+// domain. With an RDAP client, the age of the domain is looked up before the event is
+// written.
+type NodProcessor struct {
+	baseProcessor
+	writeApi     *api.WriteApi
+	measurement  string
+	path         string
+	saveInterval time.Duration
+	learning     time.Duration
+	mutex        sync.Mutex
+	seen         *BloomFilter
+	started      time.Time
+	dirty        bool
+	rdap         *RdapClient
+	rdapQueue    chan nodEvent
+	rdapDone     chan struct{}
+}
+
+type nodEvent struct {
+	point  *write.Point
+	domain string
+}
+
+func NewNodProcessor(writeApi *api.WriteApi, measurement, path string, capacity uint, learning, saveInterval time.Duration, rdap *RdapClient, bufferSize uint) *NodProcessor {
+	proc := &NodProcessor{
+		baseProcessor: newBaseProcessor("nod", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		path:          path,
+		saveInterval:  saveInterval,
+		learning:      learning,
+		rdap:          rdap,
+	}
+	if rdap != nil {
+		proc.rdapQueue = make(chan nodEvent, 1000)
+		proc.rdapDone = make(chan struct{})
+	}
+
+	if len(path) > 0 {
+		seen, started, err := LoadBloomFilter(path)
+		if err == nil {
+			proc.seen = seen
+			proc.started = time.Unix(int64(started), 0)
+			log.Infof("Loaded the seen domains from %s, learning since %s", path, proc.started)
+		} else if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("Failed to load %s, starting over", path)
+		}
+	}
+	if proc.seen == nil {
+		proc.seen = NewBloomFilter(capacity, 0.001)
+		proc.started = time.Now()
+	}
+	return proc
+}
+
+func (proc *NodProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.saveLoop(ctx)
+	if proc.rdap != nil {
+		go proc.rdapLoop(ctx)
+	}
+	return nil
+}
+
+func (proc *NodProcessor) run() {
+	proc.consume(proc.check)
+	if proc.rdap != nil {
+		close(proc.rdapQueue)
+		<-proc.rdapDone
+	}
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *NodProcessor) saveLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+// rdapLoop adds the domain age to the queued events and writes them. Once the context
+// is done, the remaining events are written without it.
+func (proc *NodProcessor) rdapLoop(ctx context.Context) {
+	for event := range proc.rdapQueue {
+		if ctx.Err() == nil {
+			created, err := proc.rdap.Created(ctx, event.domain)
+			if err == nil {
+				event.point.AddField("created", created.Format(time.RFC3339)).
+					AddField("domain_age_days", time.Since(created).Hours()/24)
+			} else if errorLog.Allow("rdap") {
+				log.WithError(err).Warnf("Failed to look up the age of %s", event.domain)
+			}
+		}
+		(*proc.writeApi).WritePoint(event.point)
+	}
+	close(proc.rdapDone)
+}
+
+// Flush saves the seen domains if they changed.
+func (proc *NodProcessor) Flush() {
+	if len(proc.path) == 0 {
+		return
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	if !proc.dirty {
+		return
+	}
+	if err := proc.seen.Save(proc.path, uint64(proc.started.Unix())); err != nil {
+		proc.reportError(err)
+		return
+	}
+	proc.dirty = false
+}
+
+// registeredDomain returns the public suffix plus one label of a query name, or an
+// empty string for names that don't have one, such as names under a TLD that isn't
+// in the public suffix list (e.g. .lan).
+func registeredDomain(qname string) string {
+	name := strings.TrimSuffix(qname, ".")
+	if suffix, icann := publicsuffix.PublicSuffix(name); !icann && !strings.Contains(suffix, ".") {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+func (proc *NodProcessor) check(message *Message) {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return
+	}
+	qname := message.dnsMessage.Question[0].Name
+	domain := registeredDomain(qname)
+	if len(domain) == 0 {
+		return
+	}
+	nodStats.Add("checked", 1)
+
+	proc.mutex.Lock()
+	seen := proc.seen.Add(domain)
+	if !seen {
+		proc.dirty = true
+	}
+	learning := time.Since(proc.started) < proc.learning
+	proc.mutex.Unlock()
+	if seen || learning {
+		return
+	}
+
+	nodStats.Add("new_domains", 1)
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("domain", domain).
+		AddTag("qname", qname).
+		AddField("new", true).
+		SetTime(message.timestamp)
+	if message.dnstapMessage.QueryAddress != nil {
+		point.AddTag("qaddress", net.IP(message.dnstapMessage.QueryAddress).String())
+	}
+	if len(message.host) > 0 {
+		point.AddTag("qhost", message.host)
+	}
+	if proc.rdap != nil {
+		select {
+		case proc.rdapQueue <- nodEvent{point: point, domain: domain}:
+			return
+		default:
+			nodStats.Add("rdap_dropped", 1)
+		}
+	}
+	(*proc.writeApi).WritePoint(point)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+// normalizeNames lowercases the question and answer names of msg, since resolvers using
+// 0x20 randomization send mixed case names that would otherwise be counted separately.
+func normalizeNames(msg *dns.Msg) {
+	for i := range msg.Question {
+		msg.Question[i].Name = strings.ToLower(msg.Question[i].Name)
+	}
+	for _, rr := range msg.Answer {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if cname, ok := rr.(*dns.CNAME); ok {
+			cname.Target = strings.ToLower(cname.Target)
+		}
+	}
+}
+
+// unicodeName decodes the punycode labels of name, returning false if name has none.
+func unicodeName(name string) (string, bool) {
+	if !strings.Contains(name, "xn--") {
+		return "", false
+	}
+	unicode, err := idna.ToUnicode(name)
+	if err != nil || unicode == name {
+		return "", false
+	}
+	return unicode, true
+}
@@ -0,0 +1,18 @@
+//go:build nounbound
+// +build nounbound
+
+package main
+
+import (
+	"errors"
+)
+
+const defaultEnforcer = "none"
+
+type Unbound struct {
+	NoopEnforcer
+}
+
+func NewUnbound(blockAction BlockAction, blockTarget string) (*Unbound, error) {
+	return nil, errors.New("built without unbound support (nounbound tag)")
+}
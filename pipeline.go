@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// processorErrors records the last error reported by each processor.
+var processorErrors = expvar.NewMap("processor_errors")
+
+type pipelineProcessor struct {
+	name      string
+	processor Processor
+	mutex     sync.Mutex
+	lastError error
+	errorTime time.Time
+}
+
+// Pipeline owns the decoder and its processors. Processors are started before the
+// decoder and closed after it, in the reverse order they were added, so a processor may
+// depend on any processor added before it.
+type Pipeline struct {
+	decoder    *DnsTapDecoder
+	processors []*pipelineProcessor
+	wg         sync.WaitGroup
+}
+
+func NewPipeline(decoder *DnsTapDecoder) *Pipeline {
+	return &Pipeline{decoder: decoder}
+}
+
+func (pipeline *Pipeline) AddProcessor(name string, proc Processor, overflow OverflowPolicy, filter *Filter) {
+	pipeline.decoder.AddProcessor(name, proc, overflow, filter)
+	pipeline.processors = append(pipeline.processors, &pipelineProcessor{name: name, processor: proc})
+}
+
+// SetFilter replaces the filter of the named processor without interrupting the
+// decoder.
+func (pipeline *Pipeline) SetFilter(name string, filter *Filter) error {
+	for _, output := range pipeline.decoder.processors {
+		if output.name == name {
+			output.setFilter(filter)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown processor \"%s\"", name)
+}
+
+func (pipeline *Pipeline) Start(ctx context.Context) error {
+	for _, entry := range pipeline.processors {
+		if err := entry.processor.Start(ctx); err != nil {
+			return err
+		}
+		go entry.watchErrors()
+	}
+	pipeline.wg.Add(1)
+	go pipeline.decoder.Run(&pipeline.wg)
+	return nil
+}
+
+func (pipeline *Pipeline) GetChannel() chan []byte {
+	return pipeline.decoder.GetChannel()
+}
+
+// Close stops the decoder once its input has been drained, then closes the processors.
+func (pipeline *Pipeline) Close() {
+	close(pipeline.decoder.GetChannel())
+	pipeline.wg.Wait()
+	for i := len(pipeline.processors) - 1; i >= 0; i-- {
+		entry := pipeline.processors[i]
+		if err := entry.processor.Close(); err != nil {
+			log.WithError(err).Errorf("Failed to close processor %s", entry.name)
+		}
+	}
+}
+
+func (pipeline *Pipeline) Flush() {
+	for _, entry := range pipeline.processors {
+		entry.processor.Flush()
+	}
+}
+
+// Health returns the last error reported by each processor within the given window, or
+// nil for processors that have been healthy.
+func (pipeline *Pipeline) Health(window time.Duration) map[string]error {
+	health := make(map[string]error)
+	for _, entry := range pipeline.processors {
+		entry.mutex.Lock()
+		if entry.lastError != nil && time.Since(entry.errorTime) < window {
+			health[entry.name] = entry.lastError
+		} else {
+			health[entry.name] = nil
+		}
+		entry.mutex.Unlock()
+	}
+	return health
+}
+
+func (entry *pipelineProcessor) watchErrors() {
+	for err := range entry.processor.Errors() {
+		if errorLog.Allow(entry.name + " processor") {
+			log.WithError(err).Errorf("%s processor error", entry.name)
+		}
+		entry.mutex.Lock()
+		entry.lastError = err
+		entry.errorTime = time.Now()
+		entry.mutex.Unlock()
+		processorErrors.Set(entry.name, expvarString(err.Error()))
+	}
+}
+
+func expvarString(value string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(value)
+	return v
+}
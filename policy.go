@@ -0,0 +1,138 @@
+package main
+
+import (
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/encoding/protowire"
+	"strconv"
+)
+
+// The policy field of newer dnstap schemas, which the vendored schema doesn't know
+// yet, so it is decoded from the unknown fields of the message.
+const (
+	dnstapMessagePolicy protowire.Number = 15
+
+	dnstapPolicyType   protowire.Number = 1
+	dnstapPolicyRule   protowire.Number = 2
+	dnstapPolicyAction protowire.Number = 3
+	dnstapPolicyMatch  protowire.Number = 4
+	dnstapPolicyValue  protowire.Number = 5
+)
+
+var policyActions = map[uint64]string{
+	1: "NXDOMAIN",
+	2: "NODATA",
+	3: "PASS",
+	4: "DROP",
+	5: "TRUNCATE",
+	6: "LOCAL_DATA",
+}
+
+var policyMatches = map[uint64]string{
+	1: "QNAME",
+	2: "CLIENT_IP",
+	3: "RESPONSE_IP",
+	4: "NS_NAME",
+	5: "NS_IP",
+}
+
+// dnstapPolicy is the policy a server applied to a message, e.g. the RPZ rule that
+// rewrote a response.
+type dnstapPolicy struct {
+	kind   string
+	rule   string
+	action string
+	match  string
+	value  string
+}
+
+// blocks returns whether the policy changed the answer.
+func (policy *dnstapPolicy) blocks() bool {
+	return len(policy.action) > 0 && policy.action != "PASS"
+}
+
+// parsePolicy returns the policy of a message, or nil if the server didn't send one.
+func parsePolicy(message *dnstap.Message) *dnstapPolicy {
+	unknown := message.XXX_unrecognized
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return nil
+		}
+		unknown = unknown[n:]
+		if num == dnstapMessagePolicy && typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(unknown)
+			if n < 0 {
+				return nil
+			}
+			return decodePolicy(value)
+		}
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return nil
+		}
+		unknown = unknown[n:]
+	}
+	return nil
+}
+
+func decodePolicy(b []byte) *dnstapPolicy {
+	policy := &dnstapPolicy{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil
+			}
+			switch num {
+			case dnstapPolicyType:
+				policy.kind = string(value)
+			case dnstapPolicyRule:
+				policy.rule = policyName(value)
+			case dnstapPolicyValue:
+				policy.value = policyName(value)
+			}
+			b = b[n:]
+		case typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil
+			}
+			switch num {
+			case dnstapPolicyAction:
+				policy.action = enumName(policyActions, value)
+			case dnstapPolicyMatch:
+				policy.match = enumName(policyMatches, value)
+			}
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil
+			}
+			b = b[n:]
+		}
+	}
+	return policy
+}
+
+// policyName returns a rule or value, which RPZ sends as a domain in wire format.
+func policyName(b []byte) string {
+	if name, n, err := dns.UnpackDomainName(b, 0); err == nil && n == len(b) {
+		return name
+	}
+	return string(b)
+}
+
+func enumName(names map[uint64]string, value uint64) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return strconv.FormatUint(value, 10)
+}
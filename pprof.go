@@ -0,0 +1,22 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the profiling endpoints on their own listener so they are never
+// exposed on the management port by accident.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	log.Infof("Serving pprof on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithError(err).Error("pprof listener failed")
+	}
+}
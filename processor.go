@@ -1,20 +1,146 @@
 package main
 
 import (
+	"context"
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Message is a decoded dnstap message. Messages are pooled: every processor that
+// receives a message must call Release once it is done with it, and must not keep any
+// reference to the message (or its dnstap and dns messages) afterwards.
 type Message struct {
 	timestamp     time.Time
 	dnstapMessage *dnstap.Message
 	dnsMessage    *dns.Msg
 	host          string
+	rhost         string
+	mac           string
+	vendor        string
+	qgeo          GeoInfo
+	rgeo          GeoInfo
+	clientGroup   string
+	duplicate     bool
+	qnameUnicode  string
+	malformed     []byte
+	unpackErr     error
+	dnstap        *dnstap.Dnstap
+	span          Span
+	refs          int32
 }
 
+var (
+	messagePool = sync.Pool{New: func() interface{} { return new(Message) }}
+	dnstapPool  = sync.Pool{New: func() interface{} { return new(dnstap.Dnstap) }}
+	dnsMsgPool  = sync.Pool{New: func() interface{} { return new(dns.Msg) }}
+)
+
+func newMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// Release drops one reference to the message, returning it and the objects it owns to
+// their pools once the last reference is gone.
+func (message *Message) Release() {
+	if atomic.AddInt32(&message.refs, -1) > 0 {
+		return
+	}
+	if message.span != nil {
+		message.span.End()
+	}
+	if message.dnstap != nil {
+		dnstapPool.Put(message.dnstap)
+	}
+	if message.dnsMessage != nil {
+		dnsMsgPool.Put(message.dnsMessage)
+	}
+	*message = Message{}
+	messagePool.Put(message)
+}
+
+// Processor consumes the messages produced by the decoder. Start launches the
+// processor's goroutines, Flush pushes out anything it has buffered, and Close stops
+// accepting messages, drains the channel and waits for the processor to finish.
+// Problems that don't stop the processor are reported on the Errors channel.
 type Processor interface {
 	GetChannel() chan *Message
-	Run(wg *sync.WaitGroup)
+	Start(ctx context.Context) error
+	Flush()
+	Close() error
+	Errors() <-chan error
+}
+
+// baseProcessor implements the channel handling shared by all processors. The
+// processor's run loop must call finish when the message channel has been drained.
+type baseProcessor struct {
+	name     string
+	messages chan *Message
+	errors   chan error
+	done     chan bool
+}
+
+func newBaseProcessor(name string, bufferSize uint) baseProcessor {
+	return baseProcessor{
+		name:     name,
+		messages: make(chan *Message, bufferSize),
+		errors:   make(chan error, 100),
+		done:     make(chan bool),
+	}
+}
+
+func (base *baseProcessor) GetChannel() chan *Message {
+	return base.messages
+}
+
+func (base *baseProcessor) Errors() <-chan error {
+	return base.errors
+}
+
+// reportError queues err for whoever is watching the processor, dropping it if the
+// error channel is full so that a processor never blocks on error reporting.
+func (base *baseProcessor) reportError(err error) {
+	select {
+	case base.errors <- err:
+	default:
+	}
+}
+
+// consume calls process for every message, releasing each message afterwards, and
+// restarts after a panic as allowed by the restart policy. The message is released
+// and its span ended even when process panics.
+func (base *baseProcessor) consume(process func(message *Message)) {
+	base.supervise(func() {
+		for message := range base.messages {
+			base.consumeOne(message, process)
+		}
+	}, base.discard)
+}
+
+func (base *baseProcessor) consumeOne(message *Message, process func(message *Message)) {
+	span := childSpan(message.span, base.name)
+	defer func() {
+		span.End()
+		message.Release()
+	}()
+	process(message)
+}
+
+// discard releases messages without processing them until the channel is closed.
+func (base *baseProcessor) discard() {
+	for message := range base.messages {
+		message.Release()
+	}
+}
+
+func (base *baseProcessor) finish() {
+	close(base.done)
+}
+
+func (base *baseProcessor) Close() error {
+	close(base.messages)
+	<-base.done
+	return nil
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchmarkOutputs is the number of processors every message is fanned out to.
+const benchmarkOutputs = 4
+
+type benchmarkProcessor struct {
+	baseProcessor
+}
+
+func (proc *benchmarkProcessor) Start(ctx context.Context) error {
+	return nil
+}
+
+func (proc *benchmarkProcessor) Flush() {
+}
+
+func (proc *benchmarkProcessor) Close() error {
+	return nil
+}
+
+// benchmarkFrame returns a client response frame like the ones unbound sends.
+func benchmarkFrame(b *testing.B) []byte {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Response = true
+	msg.RecursionAvailable = true
+	for _, answer := range []string{
+		"www.example.com. 300 IN CNAME web.example.net.",
+		"web.example.net. 60 IN A 192.0.2.1",
+		"web.example.net. 60 IN A 192.0.2.2",
+	} {
+		rr, err := dns.NewRR(answer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	msg.SetEdns0(1232, false)
+	payload, err := msg.Pack()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	now := time.Now()
+	sec, nsec := uint64(now.Unix()), uint32(now.Nanosecond())
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Identity: []byte("resolver"),
+		Version:  []byte("unbound 1.13.1"),
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Message: &dnstap.Message{
+			Type:             dnstap.Message_CLIENT_RESPONSE.Enum(),
+			SocketFamily:     dnstap.SocketFamily_INET.Enum(),
+			SocketProtocol:   dnstap.SocketProtocol_UDP.Enum(),
+			QueryAddress:     net.ParseIP("192.168.1.10").To4(),
+			QueryPort:        proto.Uint32(53124),
+			QueryTimeSec:     proto.Uint64(sec),
+			QueryTimeNsec:    proto.Uint32(nsec),
+			ResponseTimeSec:  proto.Uint64(sec),
+			ResponseTimeNsec: proto.Uint32(nsec),
+			ResponseMessage:  payload,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return frame
+}
+
+func benchmarkOutputList() []*processorOutput {
+	outputs := make([]*processorOutput, benchmarkOutputs)
+	for i := range outputs {
+		proc := &benchmarkProcessor{newBaseProcessor("benchmark", 1)}
+		outputs[i] = newProcessorOutput("benchmark", proc, OverflowBlock, nil)
+	}
+	return outputs
+}
+
+// decodePooled decodes a frame the way the decoder does, with the pooled objects.
+func decodePooled(frame []byte) *Message {
+	dt := dnstapPool.Get().(*dnstap.Dnstap)
+	if err := proto.Unmarshal(frame, dt); err != nil {
+		panic(err)
+	}
+	dnsMsg, err := getDnsMsg(dt.Message.ResponseMessage)
+	if err != nil {
+		panic(err)
+	}
+	message := newMessage()
+	message.timestamp = getTime(dt.Message.ResponseTimeSec, dt.Message.ResponseTimeNsec)
+	message.dnstapMessage = dt.Message
+	message.dnsMessage = dnsMsg
+	message.dnstap = dt
+	return message
+}
+
+// decodeUnpooled decodes a frame into newly allocated objects, as before the pools.
+func decodeUnpooled(frame []byte) *Message {
+	dt := new(dnstap.Dnstap)
+	if err := proto.Unmarshal(frame, dt); err != nil {
+		panic(err)
+	}
+	dnsMsg := new(dns.Msg)
+	if err := dnsMsg.Unpack(dt.Message.ResponseMessage); err != nil {
+		panic(err)
+	}
+	return &Message{
+		timestamp:     getTime(dt.Message.ResponseTimeSec, dt.Message.ResponseTimeNsec),
+		dnstapMessage: dt.Message,
+		dnsMessage:    dnsMsg,
+	}
+}
+
+// fanOut sends the message to every output and has each processor finish with it.
+func fanOut(outputs []*processorOutput, message *Message, release bool) {
+	message.refs = int32(len(outputs))
+	for _, output := range outputs {
+		output.send(message)
+		received := <-output.processor.GetChannel()
+		if release {
+			received.Release()
+		}
+	}
+}
+
+func benchmarkPipeline(b *testing.B, decode func(frame []byte) *Message, release bool) {
+	frame := benchmarkFrame(b)
+	outputs := benchmarkOutputList()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fanOut(outputs, decode(frame), release)
+	}
+}
+
+func BenchmarkPipelinePooled(b *testing.B) {
+	benchmarkPipeline(b, decodePooled, true)
+}
+
+func BenchmarkPipelineUnpooled(b *testing.B) {
+	benchmarkPipeline(b, decodeUnpooled, false)
+}
+
+func BenchmarkPipelinePooledParallel(b *testing.B) {
+	frame := benchmarkFrame(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		outputs := benchmarkOutputList()
+		for pb.Next() {
+			fanOut(outputs, decodePooled(frame), true)
+		}
+	})
+}
+
+func BenchmarkPipelineUnpooledParallel(b *testing.B) {
+	frame := benchmarkFrame(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		outputs := benchmarkOutputList()
+		for pb.Next() {
+			fanOut(outputs, decodeUnpooled(frame), false)
+		}
+	})
+}
+
+// countingSpan counts how many of it and its children have been ended.
+type countingSpan struct {
+	ended *int32
+}
+
+func (span countingSpan) Child(string) Span {
+	return span
+}
+
+func (span countingSpan) End() {
+	atomic.AddInt32(span.ended, 1)
+}
+
+func TestConsumeReleasesAfterPanic(t *testing.T) {
+	proc := &benchmarkProcessor{newBaseProcessor("panicking", 2)}
+	var ended int32
+	for i := 0; i < 2; i++ {
+		message := newMessage()
+		message.refs = 1
+		message.span = countingSpan{&ended}
+		proc.messages <- message
+	}
+	close(proc.messages)
+
+	proc.consume(func(message *Message) {
+		panic("process failed")
+	})
+
+	// every message ends its consume span and, once released, its own span
+	if ended != 4 {
+		t.Errorf("%d spans ended, want 4", ended)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ptrScanStats counts the scans detected.
+var ptrScanStats = expvar.NewMap("ptr_scans")
+
+// ptrAddress returns the address of a reverse lookup name, or nil if the name isn't a
+// complete in-addr.arpa or ip6.arpa name.
+func ptrAddress(qname string) net.IP {
+	qname = strings.ToLower(dns.Fqdn(qname))
+	if strings.HasSuffix(qname, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(qname, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+		return ip
+	}
+	if strings.HasSuffix(qname, ".ip6.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(qname, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			pos := 2*net.IPv6len - 1 - i
+			ip[pos/2] |= byte(nibble) << (4 * uint(1-pos%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+type ptrScanKey struct {
+	client string
+	subnet string
+}
+
+type ptrScan struct {
+	host      string
+	firstSeen time.Time
+	targets   map[string]bool
+	low       net.IP
+	high      net.IP
+	alerted   bool
+}
+
+// PtrScanAlert is written as a point and sent to the webhook when a client looks up
+// the names of many addresses of a subnet.
+type PtrScanAlert struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Host    string    `json:"host,omitempty"`
+	Subnet  string    `json:"subnet"`
+	First   string    `json:"first"`
+	Last    string    `json:"last"`
+	Lookups int       `json:"lookups"`
+}
+
+// PtrScanProcessor detects clients sweeping a subnet with reverse lookups, which is
+// often the first sign of reconnaissance inside a network. A scan is reported once
+// a client has looked up the given number of distinct addresses of the same /24 or
+// /64 within the window.
+type PtrScanProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	webhook     *Webhook
+	window      time.Duration
+	threshold   int
+	mutex       sync.Mutex
+	scans       map[ptrScanKey]*ptrScan
+}
+
+func NewPtrScanProcessor(writeApi *api.WriteApi, measurement string, webhook *Webhook, window time.Duration, threshold uint, bufferSize uint) *PtrScanProcessor {
+	return &PtrScanProcessor{
+		baseProcessor: newBaseProcessor("ptr_scans", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		webhook:       webhook,
+		window:        window,
+		threshold:     int(threshold),
+		scans:         make(map[ptrScanKey]*ptrScan),
+	}
+}
+
+func (proc *PtrScanProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.pruneLoop(ctx)
+	return nil
+}
+
+func (proc *PtrScanProcessor) run() {
+	proc.consume(proc.check)
+	proc.finish()
+}
+
+func (proc *PtrScanProcessor) pruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			proc.mutex.Lock()
+			for key, scan := range proc.scans {
+				if now.Sub(scan.firstSeen) > proc.window {
+					delete(proc.scans, key)
+				}
+			}
+			proc.mutex.Unlock()
+		}
+	}
+}
+
+// Flush does nothing, scans are reported as soon as they are detected.
+func (proc *PtrScanProcessor) Flush() {
+}
+
+func (proc *PtrScanProcessor) check(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		message.dnsMessage.Question[0].Qtype != dns.TypePTR || message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	target := ptrAddress(message.dnsMessage.Question[0].Name)
+	if target == nil {
+		return
+	}
+	var subnet net.IPNet
+	if target.To4() != nil {
+		subnet = net.IPNet{IP: target.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	} else {
+		subnet = net.IPNet{IP: target.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	}
+	key := ptrScanKey{
+		client: net.IP(message.dnstapMessage.QueryAddress).String(),
+		subnet: subnet.String(),
+	}
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	scan := proc.scans[key]
+	if scan == nil || message.timestamp.Sub(scan.firstSeen) > proc.window {
+		scan = &ptrScan{
+			firstSeen: message.timestamp,
+			targets:   make(map[string]bool),
+			low:       target,
+			high:      target,
+		}
+		proc.scans[key] = scan
+	}
+	if len(message.host) > 0 {
+		scan.host = message.host
+	}
+	scan.targets[target.String()] = true
+	if bytes.Compare(target, scan.low) < 0 {
+		scan.low = target
+	}
+	if bytes.Compare(target, scan.high) > 0 {
+		scan.high = target
+	}
+	if !scan.alerted && len(scan.targets) >= proc.threshold {
+		scan.alerted = true
+		proc.alert(PtrScanAlert{
+			Time:    message.timestamp,
+			Client:  key.client,
+			Host:    scan.host,
+			Subnet:  key.subnet,
+			First:   scan.low.String(),
+			Last:    scan.high.String(),
+			Lookups: len(scan.targets),
+		})
+	}
+}
+
+func (proc *PtrScanProcessor) alert(alert PtrScanAlert) {
+	ptrScanStats.Add("detected", 1)
+	log.Warnf("%s looked up %d addresses of %s (%s - %s) within %s", alert.Client, alert.Lookups, alert.Subnet, alert.First, alert.Last, proc.window)
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("qaddress", alert.Client).
+		AddTag("subnet", alert.Subnet).
+		AddField("first", alert.First).
+		AddField("last", alert.Last).
+		AddField("lookups", alert.Lookups).
+		SetTime(alert.Time)
+	if len(alert.Host) > 0 {
+		point.AddTag("qhost", alert.Host)
+	}
+	(*proc.writeApi).WritePoint(point)
+	proc.webhook.Notify(alert)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qnameRateStats counts the rate limit alerts raised.
+var qnameRateStats = expvar.NewMap("qname_rates")
+
+type qnameRateKey struct {
+	client string
+	qname  string
+}
+
+// qnameRateRule alerts when a client queries the same name more than limit times
+// within a window. Windows are fixed, starting with the first message after the last
+// one ended, so a client is reported at most once per name and window.
+type qnameRateRule struct {
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[qnameRateKey]int
+}
+
+// parseQnameRateRule parses a rule of the form "limit/window", e.g. "100/1m".
+func parseQnameRateRule(rule string) (*qnameRateRule, error) {
+	parts := strings.SplitN(rule, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid qname rate rule \"%s\", expected limit/window", rule)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("invalid limit in qname rate rule \"%s\"", rule)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window in qname rate rule \"%s\"", rule)
+	}
+	return &qnameRateRule{limit: limit, window: window, counts: make(map[qnameRateKey]int)}, nil
+}
+
+// QnameRateAlert is written as a point and sent to the webhook when a client exceeds
+// a rule.
+type QnameRateAlert struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Host   string    `json:"host,omitempty"`
+	Qname  string    `json:"qname"`
+	Limit  int       `json:"limit"`
+	Window string    `json:"window"`
+}
+
+// QnameRateProcessor catches clients hammering a single name, like stuck IoT devices
+// and beaconing malware.
+type QnameRateProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	webhook     *Webhook
+	mutex       sync.Mutex
+	rules       []*qnameRateRule
+}
+
+func NewQnameRateProcessor(writeApi *api.WriteApi, measurement string, webhook *Webhook, rules []string, bufferSize uint) (*QnameRateProcessor, error) {
+	proc := &QnameRateProcessor{
+		baseProcessor: newBaseProcessor("qname_rates", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		webhook:       webhook,
+	}
+	for _, rule := range rules {
+		parsed, err := parseQnameRateRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		proc.rules = append(proc.rules, parsed)
+	}
+	return proc, nil
+}
+
+func (proc *QnameRateProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *QnameRateProcessor) run() {
+	proc.consume(proc.check)
+	proc.finish()
+}
+
+// Flush does nothing, alerts are raised as soon as a limit is exceeded.
+func (proc *QnameRateProcessor) Flush() {
+}
+
+func (proc *QnameRateProcessor) check(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	key := qnameRateKey{
+		client: net.IP(message.dnstapMessage.QueryAddress).String(),
+		qname:  strings.ToLower(message.dnsMessage.Question[0].Name),
+	}
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	for _, rule := range proc.rules {
+		if message.timestamp.Sub(rule.start) >= rule.window {
+			rule.start = message.timestamp
+			rule.counts = make(map[qnameRateKey]int)
+		}
+		rule.counts[key]++
+		if rule.counts[key] == rule.limit+1 {
+			proc.alert(QnameRateAlert{
+				Time:   message.timestamp,
+				Client: key.client,
+				Host:   message.host,
+				Qname:  key.qname,
+				Limit:  rule.limit,
+				Window: rule.window.String(),
+			})
+		}
+	}
+}
+
+func (proc *QnameRateProcessor) alert(alert QnameRateAlert) {
+	qnameRateStats.Add("alerts", 1)
+	log.Warnf("%s queried %s more than %d times within %s", alert.Client, alert.Qname, alert.Limit, alert.Window)
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("qaddress", alert.Client).
+		AddTag("qname", alert.Qname).
+		AddTag("window", alert.Window).
+		AddField("limit", alert.Limit).
+		SetTime(alert.Time)
+	if len(alert.Host) > 0 {
+		point.AddTag("qhost", alert.Host)
+	}
+	(*proc.writeApi).WritePoint(point)
+	proc.webhook.Notify(alert)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rdapStats counts the RDAP lookups, cache hits and failures.
+var rdapStats = expvar.NewMap("rdap")
+
+type rdapEntry struct {
+	created time.Time
+	err     error
+	expires time.Time
+}
+
+// RdapClient looks up the registration date of domains over RDAP. Results, including
+// failures, are cached and lookups are spaced at least interval apart so that the
+// public RDAP servers don't rate limit us.
+type RdapClient struct {
+	baseUrl    string
+	client     *http.Client
+	interval   time.Duration
+	maxEntries int
+	mutex      sync.Mutex
+	cache      map[string]rdapEntry
+	lastLookup time.Time
+}
+
+func NewRdapClient(baseUrl string, interval time.Duration) *RdapClient {
+	return &RdapClient{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		interval:   interval,
+		maxEntries: 10000,
+		cache:      make(map[string]rdapEntry),
+	}
+}
+
+// Created returns the registration date of a registered domain. It blocks while
+// waiting for its turn to do a lookup, unless the context is done.
+func (rdap *RdapClient) Created(ctx context.Context, domain string) (time.Time, error) {
+	rdap.mutex.Lock()
+	defer rdap.mutex.Unlock()
+
+	now := time.Now()
+	if entry, exists := rdap.cache[domain]; exists && now.Before(entry.expires) {
+		rdapStats.Add("cached", 1)
+		return entry.created, entry.err
+	}
+
+	if wait := rdap.interval - now.Sub(rdap.lastLookup); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	rdap.lastLookup = time.Now()
+	rdapStats.Add("lookups", 1)
+	created, err := rdap.lookup(ctx, domain)
+
+	entry := rdapEntry{created: created, err: err, expires: time.Now().Add(7 * 24 * time.Hour)}
+	if err != nil {
+		rdapStats.Add("failed", 1)
+		entry.expires = time.Now().Add(time.Hour)
+	}
+	if len(rdap.cache) >= rdap.maxEntries {
+		for cached, cachedEntry := range rdap.cache {
+			if now.After(cachedEntry.expires) || len(rdap.cache) >= rdap.maxEntries {
+				delete(rdap.cache, cached)
+			}
+		}
+	}
+	rdap.cache[domain] = entry
+	return created, err
+}
+
+type rdapDomain struct {
+	Events []struct {
+		Action string    `json:"eventAction"`
+		Date   time.Time `json:"eventDate"`
+	} `json:"events"`
+}
+
+func (rdap *RdapClient) lookup(ctx context.Context, domain string) (time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, rdap.baseUrl+"/domain/"+domain, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := rdap.client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("got status %s for %s", resp.Status, domain)
+	}
+
+	var result rdapDomain
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return time.Time{}, err
+	}
+	for _, event := range result.Events {
+		if event.Action == "registration" {
+			return event.Date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no registration date for %s", domain)
+}
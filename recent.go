@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentProcessor keeps the last records it received in a ring buffer and serves them
+// on /queries, newest first, e.g. /queries?client=192.168.1.20&since=10m. This shows
+// what a device just looked up without waiting for InfluxDB. With a path, the records
+// are saved on shutdown and loaded on start, so they survive restarts.
+type RecentProcessor struct {
+	baseProcessor
+	path    string
+	mutex   sync.RWMutex
+	records []QueryRecord
+	next    int
+	full    bool
+}
+
+func NewRecentProcessor(size uint, path string, bufferSize uint) *RecentProcessor {
+	proc := &RecentProcessor{
+		baseProcessor: newBaseProcessor("recent", bufferSize),
+		path:          path,
+		records:       make([]QueryRecord, size),
+	}
+	if len(path) > 0 {
+		count, err := proc.load()
+		if err == nil {
+			log.Infof("Loaded %d recent records from %s", count, path)
+		} else if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("Failed to load %s, starting empty", path)
+		}
+	}
+	return proc
+}
+
+func (proc *RecentProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *RecentProcessor) run() {
+	proc.consume(proc.add)
+	if len(proc.path) > 0 {
+		if err := proc.save(); err != nil {
+			log.WithError(err).Errorf("Failed to save the recent records to %s", proc.path)
+		}
+	}
+	proc.finish()
+}
+
+// load adds the records saved to the path, oldest first. Only the newest records are
+// kept if there are more than fit.
+func (proc *RecentProcessor) load() (int, error) {
+	file, err := os.Open(proc.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	count := 0
+	for {
+		var record QueryRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		proc.addRecord(record)
+		count++
+	}
+}
+
+// save writes the records to the path atomically, oldest first, one JSON object per
+// line.
+func (proc *RecentProcessor) save() error {
+	proc.mutex.RLock()
+	defer proc.mutex.RUnlock()
+	file, err := os.Create(proc.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	start, count := 0, proc.next
+	if proc.full {
+		start, count = proc.next, len(proc.records)
+	}
+	for i := 0; i < count && err == nil; i++ {
+		err = encoder.Encode(&proc.records[(start+i)%len(proc.records)])
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), proc.path)
+}
+
+// Flush does nothing, the records are only served over HTTP.
+func (proc *RecentProcessor) Flush() {
+}
+
+func (proc *RecentProcessor) add(message *Message) {
+	proc.addRecord(newQueryRecord(message))
+}
+
+func (proc *RecentProcessor) addRecord(record QueryRecord) {
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	proc.records[proc.next] = record
+	proc.next++
+	if proc.next == len(proc.records) {
+		proc.next = 0
+		proc.full = true
+	}
+}
+
+// Oldest returns the time of the oldest record kept, or the zero time if there are
+// none.
+func (proc *RecentProcessor) Oldest() time.Time {
+	proc.mutex.RLock()
+	defer proc.mutex.RUnlock()
+	if proc.full {
+		return proc.records[proc.next].Time
+	}
+	if proc.next > 0 {
+		return proc.records[0].Time
+	}
+	return time.Time{}
+}
+
+// recordQuery selects records by client address or network, domain (including its
+// subdomains), rcode, qtype, age and a filter in the syntax of --influx-filter.
+type recordQuery struct {
+	client *net.IPNet
+	domain string
+	rcode  string
+	qtype  string
+	since  time.Time
+	filter *Filter
+	limit  int
+}
+
+// parseRecordQuery parses the parameters of a search. The limit defaults to 100 and is
+// capped at the number of records kept.
+func (proc *RecentProcessor) parseRecordQuery(req *http.Request) (*recordQuery, error) {
+	params := req.URL.Query()
+	query := &recordQuery{
+		rcode: strings.ToUpper(params.Get("rcode")),
+		qtype: strings.ToUpper(params.Get("qtype")),
+		limit: 100,
+	}
+	if client := params.Get("client"); len(client) > 0 {
+		if !strings.Contains(client, "/") {
+			if strings.Contains(client, ":") {
+				client += "/128"
+			} else {
+				client += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, err
+		}
+		query.client = network
+	}
+	if domain := params.Get("domain"); len(domain) > 0 {
+		query.domain = dns.Fqdn(strings.ToLower(domain))
+	}
+	if since := params.Get("since"); len(since) > 0 {
+		if age, err := time.ParseDuration(since); err == nil {
+			query.since = time.Now().Add(-age)
+		} else if query.since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, err
+		}
+	}
+	if filter := params.Get("filter"); len(filter) > 0 {
+		var err error
+		if query.filter, err = ParseRecordFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	if limit := params.Get("limit"); len(limit) > 0 {
+		var err error
+		if query.limit, err = strconv.Atoi(limit); err != nil {
+			return nil, err
+		}
+		if query.limit < 1 {
+			return nil, fmt.Errorf("invalid limit %d, it must be at least 1", query.limit)
+		}
+	}
+	if query.limit > len(proc.records) {
+		query.limit = len(proc.records)
+	}
+	return query, nil
+}
+
+func (query *recordQuery) match(record *QueryRecord) bool {
+	if record.Time.Before(query.since) {
+		return false
+	}
+	if query.client != nil && !query.client.Contains(net.ParseIP(record.Client)) {
+		return false
+	}
+	if len(query.domain) > 0 && !dns.IsSubDomain(query.domain, strings.ToLower(record.Qname)) {
+		return false
+	}
+	if len(query.rcode) > 0 && query.rcode != record.Rcode {
+		return false
+	}
+	if len(query.qtype) > 0 && query.qtype != record.Qtype {
+		return false
+	}
+	return query.filter.MatchRecord(record)
+}
+
+// Search returns the records matching the query, newest first.
+func (proc *RecentProcessor) Search(query *recordQuery) []QueryRecord {
+	matches := make([]QueryRecord, 0)
+	proc.mutex.RLock()
+	defer proc.mutex.RUnlock()
+	count := proc.next
+	if proc.full {
+		count = len(proc.records)
+	}
+	for i := 1; i <= count && len(matches) < query.limit; i++ {
+		record := &proc.records[(proc.next-i+len(proc.records))%len(proc.records)]
+		if query.match(record) {
+			matches = append(matches, *record)
+		}
+	}
+	return matches
+}
+
+func (proc *RecentProcessor) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/queries", proc.queriesHandler)
+	server.HandleFunc("/export", proc.exportHandler)
+}
+
+func (proc *RecentProcessor) queriesHandler(w http.ResponseWriter, req *http.Request) {
+	query, err := proc.parseRecordQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(proc.Search(query))
+}
+
+// exportHandler downloads the recent records as CSV or JSON, oldest first. It takes the
+// parameters of /queries, plus format (csv or json) and window as a shorthand for
+// since, e.g. /export?format=csv&window=15m&filter=rcode=NXDOMAIN|SERVFAIL. All
+// matching records are exported unless a limit is given.
+func (proc *RecentProcessor) exportHandler(w http.ResponseWriter, req *http.Request) {
+	query, err := proc.parseRecordQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := req.URL.Query()
+	if window := params.Get("window"); len(window) > 0 {
+		age, err := time.ParseDuration(window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.since = time.Now().Add(-age)
+	}
+	if len(params.Get("limit")) == 0 {
+		query.limit = len(proc.records)
+	}
+	format := params.Get("format")
+	if len(format) == 0 {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	records := proc.Search(query)
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	filename := fmt.Sprintf("dnstap-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"time", "type", "client", "host", "group", "upstream", "qname", "qtype", "rcode", "answers"})
+	for _, record := range records {
+		_ = writer.Write([]string{
+			record.Time.Format(time.RFC3339Nano),
+			record.Type,
+			record.Client,
+			record.Host,
+			record.Group,
+			record.Upstream,
+			record.Qname,
+			record.Qtype,
+			record.Rcode,
+			strings.Join(record.Answers, "; "),
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordQueryMatch(t *testing.T) {
+	now := time.Now()
+	record := &QueryRecord{
+		Time:   now.Add(-time.Minute),
+		Client: "192.168.1.20",
+		Qname:  "WWW.Example.com.",
+		Qtype:  "AAAA",
+		Rcode:  "NOERROR",
+	}
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, host, _ := net.ParseCIDR("192.168.1.21/32")
+	tests := []struct {
+		name  string
+		query recordQuery
+		match bool
+	}{
+		{"empty", recordQuery{}, true},
+		{"client network", recordQuery{client: lan}, true},
+		{"other client", recordQuery{client: host}, false},
+		{"domain", recordQuery{domain: "example.com."}, true},
+		{"exact domain", recordQuery{domain: "www.example.com."}, true},
+		{"other domain", recordQuery{domain: "example.net."}, false},
+		{"subdomain", recordQuery{domain: "a.www.example.com."}, false},
+		{"rcode", recordQuery{rcode: "NOERROR"}, true},
+		{"other rcode", recordQuery{rcode: "NXDOMAIN"}, false},
+		{"qtype", recordQuery{qtype: "AAAA"}, true},
+		{"other qtype", recordQuery{qtype: "A"}, false},
+		{"since", recordQuery{since: now.Add(-time.Hour)}, true},
+		{"too old", recordQuery{since: now}, false},
+		{"all", recordQuery{client: lan, domain: "example.com.", rcode: "NOERROR", qtype: "AAAA", since: now.Add(-time.Hour)}, true},
+	}
+	for _, test := range tests {
+		if match := test.query.match(record); match != test.match {
+			t.Errorf("%s: match() = %t, want %t", test.name, match, test.match)
+		}
+	}
+}
+
+func TestParseRecordQueryLimit(t *testing.T) {
+	proc := NewRecentProcessor(50, "", 1)
+	tests := []struct {
+		params string
+		limit  int
+		valid  bool
+	}{
+		{"", 50, true},
+		{"limit=10", 10, true},
+		{"limit=50", 50, true},
+		{"limit=1000000", 50, true},
+		{"limit=0", 0, false},
+		{"limit=-1", 0, false},
+		{"limit=ten", 0, false},
+	}
+	for _, test := range tests {
+		query, err := proc.parseRecordQuery(httptest.NewRequest(http.MethodGet, "/queries?"+test.params, nil))
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v, want valid %t", test.params, err, test.valid)
+			continue
+		}
+		if err == nil && query.limit != test.limit {
+			t.Errorf("%q: limit = %d, want %d", test.params, query.limit, test.limit)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	proc.queriesHandler(recorder, httptest.NewRequest(http.MethodGet, "/queries?limit=0", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("/queries?limit=0 returned %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRecentSearch(t *testing.T) {
+	proc := NewRecentProcessor(3, "", 1)
+	start := time.Now()
+	for i, qname := range []string{"a.example.", "b.example.", "c.example.", "d.example."} {
+		proc.addRecord(QueryRecord{Time: start.Add(time.Duration(i) * time.Second), Qname: qname})
+	}
+	tests := []struct {
+		limit  int
+		qnames []string
+	}{
+		{3, []string{"d.example.", "c.example.", "b.example."}},
+		{2, []string{"d.example.", "c.example."}},
+	}
+	for _, test := range tests {
+		records := proc.Search(&recordQuery{limit: test.limit})
+		var qnames []string
+		for _, record := range records {
+			qnames = append(qnames, record.Qname)
+		}
+		if len(qnames) != len(test.qnames) {
+			t.Errorf("limit %d: got %v, want %v", test.limit, qnames, test.qnames)
+			continue
+		}
+		for i := range qnames {
+			if qnames[i] != test.qnames[i] {
+				t.Errorf("limit %d: got %v, want %v", test.limit, qnames, test.qnames)
+				break
+			}
+		}
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	proc := NewRecentProcessor(10, "", 1)
+	now := time.Now()
+	proc.addRecord(QueryRecord{Time: now, Type: "CLIENT_RESPONSE", Client: "192.168.1.20", Qname: "a.example.", Qtype: "A", Rcode: "NOERROR"})
+	proc.addRecord(QueryRecord{Time: now, Type: "CLIENT_RESPONSE", Client: "192.168.1.21", Qname: "b.example.", Qtype: "A", Rcode: "NXDOMAIN"})
+	proc.addRecord(QueryRecord{Time: now, Type: "CLIENT_RESPONSE", Client: "192.168.1.20", Qname: "c.example.", Qtype: "PTR", Rcode: "SERVFAIL"})
+	tests := []struct {
+		filter string
+		code   int
+		body   string
+	}{
+		{"", http.StatusOK, "a.example.,b.example.,c.example."},
+		{"rcode=NXDOMAIN|SERVFAIL", http.StatusOK, "b.example.,c.example."},
+		{"qtype!=PTR,client=192.168.1.0/24", http.StatusOK, "a.example.,b.example."},
+		{"qname=b.example", http.StatusOK, "b.example."},
+		{"identity=resolver", http.StatusBadRequest, ""},
+		{"bogus=1", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		target := "/export?format=json&filter=" + url.QueryEscape(test.filter)
+		proc.exportHandler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != test.code {
+			t.Errorf("%q: returned %d, want %d", test.filter, recorder.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var records []QueryRecord
+		if err := json.NewDecoder(recorder.Body).Decode(&records); err != nil {
+			t.Fatal(err)
+		}
+		qnames := make([]string, 0, len(records))
+		for _, record := range records {
+			qnames = append(qnames, record.Qname)
+		}
+		if body := strings.Join(qnames, ","); body != test.body {
+			t.Errorf("%q: exported %s, want %s", test.filter, body, test.body)
+		}
+	}
+}
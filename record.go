@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// QueryRecord is the JSON form of a message served by the HTTP endpoints. Unlike a
+// Message it owns its data, so it can be kept after the message is released.
+type QueryRecord struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"`
+	Client       string    `json:"client,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	Group        string    `json:"group,omitempty"`
+	Upstream     string    `json:"upstream,omitempty"`
+	UpstreamHost string    `json:"upstream_host,omitempty"`
+	Qname        string    `json:"qname,omitempty"`
+	Qtype        string    `json:"qtype,omitempty"`
+	Rcode        string    `json:"rcode,omitempty"`
+	Answers      []string  `json:"answers,omitempty"`
+}
+
+func newQueryRecord(message *Message) QueryRecord {
+	record := QueryRecord{
+		Time:         message.timestamp,
+		Type:         message.dnstapMessage.Type.String(),
+		Host:         message.host,
+		Group:        message.clientGroup,
+		UpstreamHost: message.rhost,
+	}
+	if message.dnstapMessage.QueryAddress != nil {
+		record.Client = net.IP(message.dnstapMessage.QueryAddress).String()
+	}
+	if message.dnstapMessage.ResponseAddress != nil {
+		record.Upstream = net.IP(message.dnstapMessage.ResponseAddress).String()
+	}
+	if message.dnsMessage != nil {
+		if len(message.dnsMessage.Question) > 0 {
+			record.Qname = message.dnsMessage.Question[0].Name
+			record.Qtype = dns.Type(message.dnsMessage.Question[0].Qtype).String()
+		}
+		if message.dnsMessage.Response {
+			record.Rcode = dns.RcodeToString[message.dnsMessage.Rcode]
+			for _, rr := range message.dnsMessage.Answer {
+				record.Answers = append(record.Answers, rr.String())
+			}
+		}
+	}
+	return record
+}
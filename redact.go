@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+type redactRule struct {
+	suffix string
+	hash   bool
+}
+
+// Redactor rewrites the names under configured suffixes before they are written, so
+// that internal names aren't recorded. Truncated names are written as
+// "<redacted>.suffix" and hashed names as an HMAC of the full name in place of the
+// labels under the suffix, which keeps them distinguishable without revealing them.
+// Processors that work in memory, like the CNAME processor, still see the real names.
+type Redactor struct {
+	rules []redactRule
+	key   []byte
+}
+
+// NewRedactor parses "suffix=truncate" or "suffix=hash" rules. Without a mode, names
+// are truncated. Without a key, a random one is used, so hashed names only stay the
+// same until the next restart.
+func NewRedactor(rules []string, key string) (*Redactor, error) {
+	redactor := &Redactor{key: []byte(key)}
+	if len(key) == 0 {
+		redactor.key = make([]byte, 32)
+		if _, err := rand.Read(redactor.key); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		suffix := dns.Fqdn(strings.ToLower(strings.TrimSpace(parts[0])))
+		if _, ok := dns.IsDomainName(suffix); !ok || suffix == "." {
+			return nil, fmt.Errorf("invalid redaction suffix \"%s\"", parts[0])
+		}
+		mode := "truncate"
+		if len(parts) == 2 {
+			mode = parts[1]
+		}
+		switch mode {
+		case "truncate":
+			redactor.rules = append(redactor.rules, redactRule{suffix: suffix})
+		case "hash":
+			redactor.rules = append(redactor.rules, redactRule{suffix: suffix, hash: true})
+		default:
+			return nil, fmt.Errorf("invalid redaction mode \"%s\" for %s", mode, suffix)
+		}
+	}
+	return redactor, nil
+}
+
+// Redact returns the name as it should be written and whether it was changed. The
+// suffix itself is not redacted.
+func (redactor *Redactor) Redact(name string) (string, bool) {
+	if redactor == nil || len(name) == 0 {
+		return name, false
+	}
+	lower := strings.ToLower(dns.Fqdn(name))
+	for _, rule := range redactor.rules {
+		if lower == rule.suffix || !dns.IsSubDomain(rule.suffix, lower) {
+			continue
+		}
+		if !rule.hash {
+			return "<redacted>." + rule.suffix, true
+		}
+		mac := hmac.New(sha256.New, redactor.key)
+		_, _ = mac.Write([]byte(lower))
+		return hex.EncodeToString(mac.Sum(nil)[:8]) + "." + rule.suffix, true
+	}
+	return name, false
+}
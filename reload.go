@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type reloadStep struct {
+	name   string
+	reload func() error
+}
+
+// Reloader re-reads the config file on SIGHUP or a POST to /reload and then runs the
+// registered reload steps, which apply the new settings to the running components.
+// Settings without a reload step only take effect after a restart.
+type Reloader struct {
+	mutex       sync.Mutex
+	configFile  string
+	flags       *flag.FlagSet
+	commandLine map[string]bool
+	steps       []reloadStep
+}
+
+func NewReloader(configFile string, flags *flag.FlagSet, commandLine map[string]bool) *Reloader {
+	return &Reloader{configFile: configFile, flags: flags, commandLine: commandLine}
+}
+
+func (reloader *Reloader) Add(name string, reload func() error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.steps = append(reloader.steps, reloadStep{name, reload})
+}
+
+// Reload re-reads the config and runs every reload step, even if an earlier one
+// failed.
+func (reloader *Reloader) Reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	config, err := LoadConfig(reloader.configFile, reloader.flags)
+	if err != nil {
+		return err
+	}
+	if err := config.Apply(reloader.flags, reloader.commandLine); err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, step := range reloader.steps {
+		if err := step.reload(); err != nil {
+			log.WithError(err).Errorf("Failed to reload %s", step.name)
+			errs = append(errs, fmt.Sprintf("%s: %s", step.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reload failed: %s", strings.Join(errs, "; "))
+	}
+	log.Info("Reloaded the config")
+	annotations.Annotate("config_reload", "Config reloaded")
+	return nil
+}
+
+func (reloader *Reloader) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloader.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Run reloads on every SIGHUP until ctx is cancelled.
+func (reloader *Reloader) Run(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info("Got SIGHUP, reloading the config")
+			_ = reloader.Reload()
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"net"
+	"sync"
+	"time"
+)
+
+type retransmitKey struct {
+	upstream bool
+	address  string
+	qname    string
+	qtype    uint16
+}
+
+type retransmitCounts struct {
+	host            string
+	queries         int
+	retransmissions int
+}
+
+type retransmitPeer struct {
+	upstream bool
+	address  string
+}
+
+// RetransmitProcessor detects the same question being asked again of or by the same
+// address within a short window, which points at timeouts or packet loss. Client
+// queries are counted per client and resolver/forwarder queries per upstream, and the
+// retransmission rates are written every interval.
+type RetransmitProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	window      time.Duration
+	interval    time.Duration
+	mutex       sync.Mutex
+	lastAsked   map[retransmitKey]time.Time
+	counts      map[retransmitPeer]*retransmitCounts
+}
+
+func NewRetransmitProcessor(writeApi *api.WriteApi, measurement string, window, interval time.Duration, bufferSize uint) *RetransmitProcessor {
+	return &RetransmitProcessor{
+		baseProcessor: newBaseProcessor("retransmissions", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		window:        window,
+		interval:      interval,
+		lastAsked:     make(map[retransmitKey]time.Time),
+		counts:        make(map[retransmitPeer]*retransmitCounts),
+	}
+}
+
+func (proc *RetransmitProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *RetransmitProcessor) run() {
+	proc.consume(proc.check)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *RetransmitProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *RetransmitProcessor) check(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return
+	}
+	peer := retransmitPeer{}
+	host := ""
+	switch *message.dnstapMessage.Type {
+	case dnstap.Message_CLIENT_QUERY:
+		if message.dnstapMessage.QueryAddress == nil {
+			return
+		}
+		peer.address = net.IP(message.dnstapMessage.QueryAddress).String()
+		host = message.host
+	case dnstap.Message_RESOLVER_QUERY, dnstap.Message_FORWARDER_QUERY:
+		if message.dnstapMessage.ResponseAddress == nil {
+			return
+		}
+		peer.upstream = true
+		peer.address = net.IP(message.dnstapMessage.ResponseAddress).String()
+	default:
+		return
+	}
+	question := message.dnsMessage.Question[0]
+	key := retransmitKey{
+		upstream: peer.upstream,
+		address:  peer.address,
+		qname:    question.Name,
+		qtype:    question.Qtype,
+	}
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	counts := proc.counts[peer]
+	if counts == nil {
+		counts = &retransmitCounts{}
+		proc.counts[peer] = counts
+	}
+	if len(host) > 0 {
+		counts.host = host
+	}
+	counts.queries++
+	if last, exists := proc.lastAsked[key]; exists && message.timestamp.Sub(last) <= proc.window {
+		counts.retransmissions++
+	}
+	proc.lastAsked[key] = message.timestamp
+}
+
+// Flush writes the rates since the last flush and forgets questions that are older
+// than the window.
+func (proc *RetransmitProcessor) Flush() {
+	now := time.Now()
+	proc.mutex.Lock()
+	counts := proc.counts
+	proc.counts = make(map[retransmitPeer]*retransmitCounts)
+	for key, last := range proc.lastAsked {
+		if now.Sub(last) > proc.window {
+			delete(proc.lastAsked, key)
+		}
+	}
+	proc.mutex.Unlock()
+
+	for peer, peerCounts := range counts {
+		kind := "client"
+		addressTag := "qaddress"
+		if peer.upstream {
+			kind = "upstream"
+			addressTag = "raddress"
+		}
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("kind", kind).
+			AddTag(addressTag, peer.address).
+			AddField("queries", peerCounts.queries).
+			AddField("retransmissions", peerCounts.retransmissions).
+			AddField("rate", float64(peerCounts.retransmissions)/float64(peerCounts.queries)).
+			SetTime(now)
+		if len(peerCounts.host) > 0 {
+			point.AddTag("qhost", peerCounts.host)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reverseLookupStats = expvar.NewMap("reverse_lookups")
+
+// ReverseResolver resolves client addresses to host names without blocking the caller.
+// A cache miss returns the IP and starts a background lookup, so the host name is used
+// for subsequent messages. Concurrent misses for the same IP share one lookup.
+type ReverseResolver struct {
+	resolver       addrResolver
+	cache          *HostCache
+	negativeTtl    time.Duration
+	negativeTtlMax time.Duration
+	mutex          sync.Mutex
+	inflight       map[string]bool
+	semaphore      chan bool
+}
+
+type addrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// NewReverseResolver looks up the host names with the resolver, which is either a
+// plain DNS server as host:port, a DNS-over-TLS server as tls://host[:port] or a
+// DNS-over-HTTPS URL, so that the lookups of client addresses can be kept private. A
+// maxLookups of 0 disables the lookups.
+func NewReverseResolver(resolver string, cache *HostCache, maxLookups uint, negativeTtl, negativeTtlMax time.Duration) *ReverseResolver {
+	return &ReverseResolver{
+		resolver:       newAddrResolver(resolver),
+		cache:          cache,
+		negativeTtl:    negativeTtl,
+		negativeTtlMax: negativeTtlMax,
+		inflight:       make(map[string]bool),
+		semaphore:      make(chan bool, maxLookups),
+	}
+}
+
+func newAddrResolver(resolver string) addrResolver {
+	if strings.HasPrefix(resolver, "https://") {
+		return newDohClient(resolver)
+	}
+
+	network, dial := "udp", resolver
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(resolver, "tls://") {
+		dial = strings.TrimPrefix(resolver, "tls://")
+		if _, _, err := net.SplitHostPort(dial); err != nil {
+			dial = net.JoinHostPort(dial, "853")
+		}
+		host, _, _ := net.SplitHostPort(dial)
+		network, tlsConfig = "tcp", &tls.Config{ServerName: host}
+	}
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: false,
+		Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Millisecond * 1000,
+			}
+			conn, err := d.DialContext(ctx, network, dial)
+			if err != nil || tlsConfig == nil {
+				return conn, err
+			}
+			// a connection that isn't a net.PacketConn is spoken to with TCP framing
+			return tls.Client(conn, tlsConfig), nil
+		},
+	}
+}
+
+// Reconfigure switches to another resolver and negative TTLs, e.g. after the local
+// resolver moved. Lookups already in flight finish with the old resolver.
+func (rev *ReverseResolver) Reconfigure(resolver string, negativeTtl, negativeTtlMax time.Duration) {
+	rev.mutex.Lock()
+	defer rev.mutex.Unlock()
+	rev.resolver = newAddrResolver(resolver)
+	rev.negativeTtl = negativeTtl
+	rev.negativeTtlMax = negativeTtlMax
+}
+
+func (rev *ReverseResolver) GetHost(ip string) string {
+	host, exists, expired := rev.cache.Get(ip)
+	if !exists || expired {
+		rev.lookup(ip)
+	}
+	if !exists {
+		return ip
+	}
+	return host
+}
+
+func (rev *ReverseResolver) lookup(ip string) {
+	if cap(rev.semaphore) == 0 {
+		return
+	}
+	rev.mutex.Lock()
+	defer rev.mutex.Unlock()
+	if rev.inflight[ip] {
+		reverseLookupStats.Add("deduplicated", 1)
+		return
+	}
+
+	select {
+	case rev.semaphore <- true:
+	default:
+		// too many lookups outstanding, try again on a later message
+		reverseLookupStats.Add("skipped", 1)
+		return
+	}
+
+	rev.inflight[ip] = true
+	go func() {
+		rev.resolve(ip)
+		<-rev.semaphore
+		rev.mutex.Lock()
+		delete(rev.inflight, ip)
+		rev.mutex.Unlock()
+	}()
+}
+
+func (rev *ReverseResolver) resolve(ip string) {
+	reverseLookupStats.Add("lookups", 1)
+	rev.mutex.Lock()
+	resolver, negativeTtl, negativeTtlMax := rev.resolver, rev.negativeTtl, rev.negativeTtlMax
+	rev.mutex.Unlock()
+	hosts, err := resolver.LookupAddr(context.Background(), ip)
+	if err == nil && len(hosts) > 0 && hosts[0] != "" {
+		rev.cache.Put(ip, hosts[0])
+		return
+	}
+	reverseLookupStats.Add("failures", 1)
+	rev.cache.PutFailure(ip, ip, negativeTtl, negativeTtlMax)
+}
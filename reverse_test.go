@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingResolver answers every lookup with host once release is closed.
+type blockingResolver struct {
+	release chan bool
+	lookups int32
+}
+
+func (resolver *blockingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	atomic.AddInt32(&resolver.lookups, 1)
+	<-resolver.release
+	return []string{"host.lan."}, nil
+}
+
+func TestReverseResolverLookups(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxLookups uint
+		ips        []string
+		lookups    int32
+	}{
+		{"disabled", 0, []string{"192.0.2.1", "192.0.2.2"}, 0},
+		{"deduplicated", 4, []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, 1},
+		{"limited", 2, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &blockingResolver{release: make(chan bool)}
+			rev := NewReverseResolver("127.0.0.1:53", NewHostCache(10, time.Hour), test.maxLookups, time.Minute, time.Hour)
+			rev.resolver = resolver
+			for _, ip := range test.ips {
+				if host := rev.GetHost(ip); host != ip {
+					t.Errorf("GetHost(%s) = %s before the lookup finished, want the ip", ip, host)
+				}
+			}
+			close(resolver.release)
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&resolver.lookups) < test.lookups && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if lookups := atomic.LoadInt32(&resolver.lookups); lookups != test.lookups {
+				t.Errorf("%d lookups, want %d", lookups, test.lookups)
+			}
+		})
+	}
+}
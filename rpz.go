@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RpzEnforcer writes learned blocks and local data to an RPZ zone file that the
+// resolver loads, rather than pushing them into the resolver directly. The whole
+// file is rewritten, sorted by domain, once all the queued changes are applied.
+type RpzEnforcer struct {
+	messages    chan *EnforcerCommandMessage
+	path        string
+	blockAction BlockAction
+	blockTarget string
+	blocked     map[string]bool
+	data        map[string][]string
+}
+
+func NewRpzEnforcer(path string, blockAction BlockAction, blockTarget string) (*RpzEnforcer, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("the rpz enforcer needs a file")
+	}
+	return &RpzEnforcer{
+		messages:    make(chan *EnforcerCommandMessage, 1000),
+		path:        path,
+		blockAction: blockAction,
+		blockTarget: blockTarget,
+		blocked:     make(map[string]bool),
+		data:        make(map[string][]string),
+	}, nil
+}
+
+func (rpz *RpzEnforcer) GetChannel() chan *EnforcerCommandMessage {
+	return rpz.messages
+}
+
+// Probe checks that the rpz file's directory is writable.
+func (rpz *RpzEnforcer) Probe() error {
+	file, err := ioutil.TempFile(filepath.Dir(rpz.path), ".probe")
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+func (rpz *RpzEnforcer) Run(wg *sync.WaitGroup) {
+	if err := rpz.write(); err != nil {
+		log.WithError(err).Errorf("Failed to write %s", rpz.path)
+	}
+	for message := range rpz.messages {
+		changed := rpz.apply(message)
+		// a burst of learned blocks, e.g. after a list update, is a single rewrite
+	drain:
+		for {
+			select {
+			case next, ok := <-rpz.messages:
+				if !ok {
+					break drain
+				}
+				changed = rpz.apply(next) || changed
+			default:
+				break drain
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := rpz.write(); err != nil {
+			log.WithError(err).Errorf("Failed to write %s", rpz.path)
+		}
+	}
+	wg.Done()
+}
+
+// apply applies a command to the blocks and data, returning false for invalid ones.
+func (rpz *RpzEnforcer) apply(message *EnforcerCommandMessage) bool {
+	switch message.cmd {
+	case ZoneAdd:
+		rpz.blocked[message.domain] = true
+	case ZoneRemove:
+		delete(rpz.blocked, message.domain)
+	case DataAdd:
+		rpz.data[message.domain] = append(rpz.data[message.domain], message.data)
+	case DataRemove:
+		delete(rpz.data, message.domain)
+	default:
+		log.Warnf("Got invalid command: %d", message.cmd)
+		return false
+	}
+	return true
+}
+
+// relativeName converts an absolute domain into an RPZ trigger name, which is relative
+// to the policy zone origin.
+func relativeName(domain string) string {
+	return strings.TrimSuffix(domain, ".")
+}
+
+func (rpz *RpzEnforcer) blockRecord(domain string) string {
+	name := relativeName(domain)
+	switch rpz.blockAction {
+	case BlockNodata:
+		return fmt.Sprintf("%s CNAME *.", name)
+	case BlockSinkhole:
+		if strings.Contains(rpz.blockTarget, ":") {
+			return fmt.Sprintf("%s AAAA %s", name, rpz.blockTarget)
+		}
+		return fmt.Sprintf("%s A %s", name, rpz.blockTarget)
+	case BlockCname:
+		return fmt.Sprintf("%s CNAME %s", name, rpz.blockTarget)
+	default:
+		return fmt.Sprintf("%s CNAME .", name)
+	}
+}
+
+func (rpz *RpzEnforcer) write() error {
+	tmpPath := rpz.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := rpz.writeZone(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, rpz.path)
+}
+
+// writeZone writes the zone with the blocks and then the local data, both sorted by
+// domain, so that the file only changes where the blocks do.
+func (rpz *RpzEnforcer) writeZone(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	_, _ = fmt.Fprintln(writer, "$TTL 60")
+	_, _ = fmt.Fprintln(writer, "@ SOA localhost. root.localhost. 1 3600 600 86400 60")
+	_, _ = fmt.Fprintln(writer, "@ NS localhost.")
+
+	domains := make([]string, 0, len(rpz.blocked))
+	for domain := range rpz.blocked {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		_, _ = fmt.Fprintln(writer, rpz.blockRecord(domain))
+	}
+
+	domains = domains[:0]
+	for domain := range rpz.data {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		for _, record := range rpz.data[domain] {
+			rr, err := dns.NewRR(record)
+			if err != nil || rr == nil {
+				continue
+			}
+			rr.Header().Name = relativeName(domain)
+			_, _ = fmt.Fprintln(writer, rr.String())
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRpzBlockRecord(t *testing.T) {
+	tests := []struct {
+		action BlockAction
+		target string
+		record string
+	}{
+		{BlockNxdomain, "", "ads.example CNAME ."},
+		{BlockNodata, "", "ads.example CNAME *."},
+		{BlockSinkhole, "0.0.0.0", "ads.example A 0.0.0.0"},
+		{BlockSinkhole, "::", "ads.example AAAA ::"},
+		{BlockCname, "sinkhole.lan.", "ads.example CNAME sinkhole.lan."},
+	}
+	for _, test := range tests {
+		rpz, _ := NewRpzEnforcer("learned.rpz", test.action, test.target)
+		if record := rpz.blockRecord("ads.example."); record != test.record {
+			t.Errorf("blockRecord() with %v = %q, want %q", test.action, record, test.record)
+		}
+	}
+}
+
+func TestRpzWriteZone(t *testing.T) {
+	rpz, _ := NewRpzEnforcer("learned.rpz", BlockNxdomain, "")
+	for _, message := range []*EnforcerCommandMessage{
+		{cmd: ZoneAdd, domain: "c.example."},
+		{cmd: ZoneAdd, domain: "a.example."},
+		{cmd: ZoneAdd, domain: "b.example."},
+		{cmd: ZoneRemove, domain: "b.example."},
+		{cmd: DataAdd, domain: "z.lan.", data: "z.lan. 60 IN A 192.0.2.26"},
+		{cmd: DataAdd, domain: "y.lan.", data: "y.lan. 60 IN A 192.0.2.25"},
+		{cmd: DataAdd, domain: "x.lan.", data: "x.lan. 60 IN A 192.0.2.24"},
+		{cmd: DataRemove, domain: "x.lan."},
+	} {
+		if !rpz.apply(message) {
+			t.Fatalf("apply(%v) failed", message.cmd)
+		}
+	}
+	if rpz.apply(&EnforcerCommandMessage{cmd: 0}) {
+		t.Errorf("apply() of an invalid command succeeded")
+	}
+
+	want := "$TTL 60\n" +
+		"@ SOA localhost. root.localhost. 1 3600 600 86400 60\n" +
+		"@ NS localhost.\n" +
+		"a.example CNAME .\n" +
+		"c.example CNAME .\n" +
+		"y.lan\t60\tIN\tA\t192.0.2.25\n" +
+		"z.lan\t60\tIN\tA\t192.0.2.26\n"
+	// the zone is the same no matter the order of the maps
+	for i := 0; i < 10; i++ {
+		var zone bytes.Buffer
+		if err := rpz.writeZone(&zone); err != nil {
+			t.Fatal(err)
+		}
+		if zone.String() != want {
+			t.Fatalf("writeZone() =\n%s\nwant\n%s", zone.String(), want)
+		}
+	}
+}
+
+func TestRpzRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "learned.rpz")
+	rpz, _ := NewRpzEnforcer(path, BlockNxdomain, "")
+	for _, domain := range []string{"b.example.", "a.example.", "c.example."} {
+		rpz.GetChannel() <- &EnforcerCommandMessage{cmd: ZoneAdd, domain: domain}
+	}
+	close(rpz.GetChannel())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	rpz.Run(&wg)
+	wg.Wait()
+
+	zone, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(zone), "a.example CNAME .\nb.example CNAME .\nc.example CNAME .\n") {
+		t.Errorf("%s doesn't end with the blocks:\n%s", path, zone)
+	}
+}
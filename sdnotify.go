@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends a state change such as "READY=1" to systemd. It does nothing when not
+// run by systemd under Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if strings.HasPrefix(socket, "@") {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the systemd watchdog timeout, or 0 if the watchdog isn't
+// enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd the collector is ready once every readiness check passes.
+func notifyReady(ctx context.Context, readiness *ReadinessChecks) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if len(readiness.Check()) == 0 {
+				if err := sdNotify("READY=1"); err != nil {
+					log.WithError(err).Warn("Failed to notify systemd")
+				}
+				return
+			}
+		}
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half its timeout for as long as the
+// decoder is alive. The decoder is considered hung when frames are queued for it but
+// none were decoded since the last ping, in which case the ping is skipped so that
+// systemd restarts the collector.
+func runWatchdog(ctx context.Context, decoderChannel chan []byte) {
+	timeout := watchdogInterval()
+	if timeout == 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	lastFrames := decodedFrames.Value()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			frames := decodedFrames.Value()
+			if frames == lastFrames && len(decoderChannel) > 0 {
+				log.Warn("The decoder hasn't made progress, skipping the watchdog ping")
+				continue
+			}
+			lastFrames = frames
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.WithError(err).Warn("Failed to ping the systemd watchdog")
+			}
+		}
+	}
+}
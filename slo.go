@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sloStats counts the SLO breaches raised.
+var sloStats = expvar.NewMap("slos")
+
+// sloOffenders is the number of the worst upstreams and zones written with a breach.
+const sloOffenders = 5
+
+type sloCounts struct {
+	responses int
+	slow      int
+}
+
+// sloRule requires that target percent of the responses of a message type are faster
+// than threshold in every window. Windows are fixed, starting with the first response
+// after the last one ended, and are evaluated when they end.
+type sloRule struct {
+	spec         string
+	responseType dnstap.Message_Type
+	target       float64
+	threshold    time.Duration
+	window       time.Duration
+	start        time.Time
+	total        sloCounts
+	upstreams    map[string]*sloCounts
+	zones        map[string]*sloCounts
+}
+
+// parseSloRule parses a rule of the form "[type:]percent%<threshold/window", e.g.
+// "99%<50ms/5m" or "forwarder:95%<200ms/1m". The type defaults to client.
+func parseSloRule(spec string) (*sloRule, error) {
+	rule := &sloRule{spec: spec, responseType: dnstap.Message_CLIENT_RESPONSE}
+	rest := spec
+	if i := strings.Index(rest, ":"); i >= 0 {
+		value, exists := dnstap.Message_Type_value[strings.ToUpper(rest[:i])+"_RESPONSE"]
+		if !exists {
+			return nil, fmt.Errorf("invalid message type in latency SLO \"%s\"", spec)
+		}
+		rule.responseType = dnstap.Message_Type(value)
+		rest = rest[i+1:]
+	}
+	percent := strings.SplitN(rest, "%<", 2)
+	if len(percent) != 2 {
+		return nil, fmt.Errorf("invalid latency SLO \"%s\", expected percent%%<threshold/window", spec)
+	}
+	target, err := strconv.ParseFloat(percent[0], 64)
+	if err != nil || target <= 0 || target > 100 {
+		return nil, fmt.Errorf("invalid percent in latency SLO \"%s\"", spec)
+	}
+	rule.target = target / 100
+	parts := strings.SplitN(percent[1], "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid latency SLO \"%s\", expected percent%%<threshold/window", spec)
+	}
+	if rule.threshold, err = time.ParseDuration(parts[0]); err != nil || rule.threshold <= 0 {
+		return nil, fmt.Errorf("invalid threshold in latency SLO \"%s\"", spec)
+	}
+	if rule.window, err = time.ParseDuration(parts[1]); err != nil || rule.window <= 0 {
+		return nil, fmt.Errorf("invalid window in latency SLO \"%s\"", spec)
+	}
+	rule.reset(time.Time{})
+	return rule, nil
+}
+
+func (rule *sloRule) reset(start time.Time) {
+	rule.start = start
+	rule.total = sloCounts{}
+	rule.upstreams = make(map[string]*sloCounts)
+	rule.zones = make(map[string]*sloCounts)
+}
+
+func addSloCount(counts map[string]*sloCounts, key string, slow bool) {
+	if len(key) == 0 {
+		return
+	}
+	count := counts[key]
+	if count == nil {
+		count = &sloCounts{}
+		counts[key] = count
+	}
+	count.responses++
+	if slow {
+		count.slow++
+	}
+}
+
+// SloOffender is an upstream or zone with slow responses in a breached window.
+type SloOffender struct {
+	Upstream  string `json:"upstream,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Responses int    `json:"responses"`
+	Slow      int    `json:"slow"`
+}
+
+// SloBreach is written as points and sent to the webhook when a window of a rule
+// misses its target.
+type SloBreach struct {
+	Time       time.Time     `json:"time"`
+	Slo        string        `json:"slo"`
+	Type       string        `json:"type"`
+	Target     float64       `json:"target"`
+	Compliance float64       `json:"compliance"`
+	Responses  int           `json:"responses"`
+	Slow       int           `json:"slow"`
+	Offenders  []SloOffender `json:"offenders,omitempty"`
+}
+
+// worstOffenders returns the keys with the most slow responses, worst first.
+func worstOffenders(counts map[string]*sloCounts) []string {
+	keys := make([]string, 0, len(counts))
+	for key, count := range counts {
+		if count.slow > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]].slow != counts[keys[j]].slow {
+			return counts[keys[i]].slow > counts[keys[j]].slow
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > sloOffenders {
+		keys = keys[:sloOffenders]
+	}
+	return keys
+}
+
+// SloProcessor tracks the share of responses faster than the latency threshold of
+// each rule and writes a breach, with the upstreams and zones that were slowest, for
+// every window that misses its target. The latency is the time between the query and
+// response times of a response message, so responses without a query time are not
+// counted.
+type SloProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	webhook     *Webhook
+	mutex       sync.Mutex
+	rules       []*sloRule
+}
+
+func NewSloProcessor(writeApi *api.WriteApi, measurement string, webhook *Webhook, rules []string, bufferSize uint) (*SloProcessor, error) {
+	proc := &SloProcessor{
+		baseProcessor: newBaseProcessor("slos", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		webhook:       webhook,
+	}
+	for _, rule := range rules {
+		parsed, err := parseSloRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		proc.rules = append(proc.rules, parsed)
+	}
+	return proc, nil
+}
+
+// Filter returns a filter of the response types of the rules.
+func (proc *SloProcessor) Filter() *Filter {
+	types := make([]string, 0, len(proc.rules))
+	for _, rule := range proc.rules {
+		if !containsString(types, rule.responseType.String()) {
+			types = append(types, rule.responseType.String())
+		}
+	}
+	filter, _ := ParseFilter("type=" + strings.Join(types, "|"))
+	return filter
+}
+
+func (proc *SloProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *SloProcessor) run() {
+	proc.consume(proc.track)
+	proc.finish()
+}
+
+// Flush does nothing, windows are evaluated when the first response after them
+// arrives.
+func (proc *SloProcessor) Flush() {
+}
+
+func (proc *SloProcessor) track(message *Message) {
+	dnstapMessage := message.dnstapMessage
+	if message.duplicate || dnstapMessage.QueryTimeSec == nil || dnstapMessage.QueryTimeNsec == nil {
+		return
+	}
+	latency := message.timestamp.Sub(getTime(dnstapMessage.QueryTimeSec, dnstapMessage.QueryTimeNsec))
+	if latency < 0 {
+		return
+	}
+	var upstream string
+	if *dnstapMessage.Type != dnstap.Message_CLIENT_RESPONSE && dnstapMessage.ResponseAddress != nil {
+		upstream = net.IP(dnstapMessage.ResponseAddress).String()
+	}
+	zone := queryZone(message)
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	for _, rule := range proc.rules {
+		if rule.responseType != *dnstapMessage.Type {
+			continue
+		}
+		if message.timestamp.Sub(rule.start) >= rule.window {
+			proc.evaluate(rule)
+			rule.reset(message.timestamp)
+		}
+		slow := latency >= rule.threshold
+		rule.total.responses++
+		if slow {
+			rule.total.slow++
+		}
+		addSloCount(rule.upstreams, upstream, slow)
+		addSloCount(rule.zones, zone, slow)
+	}
+}
+
+// evaluate raises a breach if the window of rule that just ended missed its target.
+func (proc *SloProcessor) evaluate(rule *sloRule) {
+	if rule.total.responses == 0 {
+		return
+	}
+	compliance := 1 - float64(rule.total.slow)/float64(rule.total.responses)
+	if compliance >= rule.target {
+		return
+	}
+	breach := SloBreach{
+		Time:       rule.start.Add(rule.window),
+		Slo:        rule.spec,
+		Type:       rule.responseType.String(),
+		Target:     rule.target,
+		Compliance: compliance,
+		Responses:  rule.total.responses,
+		Slow:       rule.total.slow,
+	}
+	for _, upstream := range worstOffenders(rule.upstreams) {
+		counts := rule.upstreams[upstream]
+		breach.Offenders = append(breach.Offenders, SloOffender{Upstream: upstream, Responses: counts.responses, Slow: counts.slow})
+	}
+	for _, zone := range worstOffenders(rule.zones) {
+		counts := rule.zones[zone]
+		breach.Offenders = append(breach.Offenders, SloOffender{Zone: zone, Responses: counts.responses, Slow: counts.slow})
+	}
+	proc.breach(breach)
+}
+
+func (proc *SloProcessor) breach(breach SloBreach) {
+	sloStats.Add("breaches", 1)
+	log.Warnf("Latency SLO %s breached: %.2f%% of %d responses were fast enough", breach.Slo, 100*breach.Compliance, breach.Responses)
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("slo", breach.Slo).
+		AddTag("type", breach.Type).
+		AddField("target", breach.Target).
+		AddField("compliance", breach.Compliance).
+		AddField("responses", breach.Responses).
+		AddField("slow", breach.Slow).
+		SetTime(breach.Time)
+	(*proc.writeApi).WritePoint(point)
+	for _, offender := range breach.Offenders {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("slo", breach.Slo).
+			AddTag("type", breach.Type).
+			AddField("responses", offender.Responses).
+			AddField("slow", offender.Slow).
+			AddField("compliance", 1-float64(offender.Slow)/float64(offender.Responses)).
+			SetTime(breach.Time)
+		if len(offender.Upstream) > 0 {
+			point.AddTag("upstream", offender.Upstream)
+		} else {
+			point.AddTag("query_zone", offender.Zone)
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+	annotations.Annotate("slo_breach", "Latency SLO %s breached: %.2f%% compliance", breach.Slo, 100*breach.Compliance)
+	proc.webhook.Notify(breach)
+}
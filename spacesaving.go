@@ -0,0 +1,94 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type heavyHitter struct {
+	key   string
+	count uint64
+	error uint64
+	index int
+}
+
+type hitterHeap []*heavyHitter
+
+func (h hitterHeap) Len() int           { return len(h) }
+func (h hitterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hitterHeap) Push(x interface{}) {
+	hitter := x.(*heavyHitter)
+	hitter.index = len(*h)
+	*h = append(*h, hitter)
+}
+
+func (h *hitterHeap) Pop() interface{} {
+	old := *h
+	hitter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return hitter
+}
+
+// SpaceSaving approximates the most frequent keys of a stream using a fixed number of
+// counters (the space-saving algorithm). When every counter is in use, the least
+// frequent key is replaced and its count is inherited as the new key's error bound.
+type SpaceSaving struct {
+	capacity int
+	keys     map[string]*heavyHitter
+	heap     hitterHeap
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{
+		capacity: capacity,
+		keys:     make(map[string]*heavyHitter, capacity),
+		heap:     make(hitterHeap, 0, capacity),
+	}
+}
+
+func (ss *SpaceSaving) Add(key string) {
+	if hitter, exists := ss.keys[key]; exists {
+		hitter.count++
+		heap.Fix(&ss.heap, hitter.index)
+		return
+	}
+	if len(ss.heap) < ss.capacity {
+		hitter := &heavyHitter{key: key, count: 1}
+		ss.keys[key] = hitter
+		heap.Push(&ss.heap, hitter)
+		return
+	}
+	min := ss.heap[0]
+	delete(ss.keys, min.key)
+	min.key = key
+	min.error = min.count
+	min.count++
+	ss.keys[key] = min
+	heap.Fix(&ss.heap, 0)
+}
+
+// Top returns the n most frequent keys, most frequent first.
+func (ss *SpaceSaving) Top(n int) []heavyHitter {
+	top := make([]heavyHitter, 0, len(ss.heap))
+	for _, hitter := range ss.heap {
+		top = append(top, *hitter)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].count > top[j].count
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (ss *SpaceSaving) Reset() {
+	ss.keys = make(map[string]*heavyHitter, ss.capacity)
+	ss.heap = ss.heap[:0]
+}
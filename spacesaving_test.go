@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSpaceSavingError(t *testing.T) {
+	const capacity = 50
+	const total = 100000
+	ss := NewSpaceSaving(capacity)
+	counts := make(map[string]uint64)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, 10000)
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("domain%d.example.", zipf.Uint64())
+		counts[key]++
+		ss.Add(key)
+	}
+
+	top := ss.Top(capacity)
+	if len(top) != capacity {
+		t.Fatalf("Top() returned %d keys, want %d", len(top), capacity)
+	}
+	found := make(map[string]bool)
+	for i, hitter := range top {
+		found[hitter.key] = true
+		if i > 0 && hitter.count > top[i-1].count {
+			t.Errorf("Top() isn't sorted: %d after %d", hitter.count, top[i-1].count)
+		}
+		// the true count is between count - error and count
+		if actual := counts[hitter.key]; actual > hitter.count || actual < hitter.count-hitter.error {
+			t.Errorf("%s: count %d with error %d, but it was added %d times", hitter.key, hitter.count, hitter.error, actual)
+		}
+		// and the error is at most total / capacity
+		if hitter.error > total/capacity {
+			t.Errorf("%s: error %d, want at most %d", hitter.key, hitter.error, total/capacity)
+		}
+	}
+	// every key added more than total / capacity times is kept
+	for key, count := range counts {
+		if count > total/capacity && !found[key] {
+			t.Errorf("%s was added %d times but isn't in Top()", key, count)
+		}
+	}
+
+	if top := ss.Top(3); len(top) != 3 {
+		t.Errorf("Top(3) returned %d keys", len(top))
+	}
+	ss.Reset()
+	if top := ss.Top(capacity); len(top) != 0 {
+		t.Errorf("Top() after Reset() = %v, want none", top)
+	}
+}
+
+func TestSpaceSavingExact(t *testing.T) {
+	// with fewer keys than counters the counts are exact
+	ss := NewSpaceSaving(10)
+	for i, key := range []string{"a", "b", "c"} {
+		for j := 0; j <= i; j++ {
+			ss.Add(key)
+		}
+	}
+	for i, want := range []struct {
+		key   string
+		count uint64
+	}{{"c", 3}, {"b", 2}, {"a", 1}} {
+		hitter := ss.Top(10)[i]
+		if hitter.key != want.key || hitter.count != want.count || hitter.error != 0 {
+			t.Errorf("Top()[%d] = %s %d (error %d), want %s %d (error 0)", i, hitter.key, hitter.count, hitter.error, want.key, want.count)
+		}
+	}
+}
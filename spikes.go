@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// spikeStats counts the alerts raised per response code.
+var spikeStats = expvar.NewMap("error_spikes")
+
+// ewma is an exponentially weighted moving average of a rate along with its variance.
+type ewma struct {
+	mean     float64
+	variance float64
+	samples  int
+}
+
+func (avg *ewma) update(value, alpha float64) {
+	if avg.samples == 0 {
+		avg.mean = value
+	} else {
+		diff := value - avg.mean
+		incr := alpha * diff
+		avg.mean += incr
+		avg.variance = (1 - alpha) * (avg.variance + diff*incr)
+	}
+	avg.samples++
+}
+
+type spikeCounts struct {
+	host      string
+	responses int
+	errors    map[int]int
+}
+
+type spikeBaseline struct {
+	rates    map[int]*ewma
+	lastSeen time.Time
+}
+
+// spikeRcodes are the response codes whose rates are tracked.
+var spikeRcodes = []int{dns.RcodeNameError, dns.RcodeServerFailure}
+
+// SpikeAlert is written as a point and sent to the webhook when a client's error rate
+// jumps above its baseline.
+type SpikeAlert struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Host      string    `json:"host,omitempty"`
+	Rcode     string    `json:"rcode"`
+	Rate      float64   `json:"rate"`
+	Baseline  float64   `json:"baseline"`
+	Responses int       `json:"responses"`
+}
+
+// SpikeProcessor keeps a per-client baseline of the NXDOMAIN and SERVFAIL rates of
+// client responses and raises an alert when a client's rate in an interval is more
+// than the given number of standard deviations above its baseline. Baselines need a
+// few intervals of warm up before they alert, and are forgotten after a day without
+// queries from the client.
+type SpikeProcessor struct {
+	baseProcessor
+	writeApi     *api.WriteApi
+	measurement  string
+	webhook      *Webhook
+	interval     time.Duration
+	deviations   float64
+	minResponses int
+	alpha        float64
+	warmup       int
+	mutex        sync.Mutex
+	counts       map[string]*spikeCounts
+	baselines    map[string]*spikeBaseline
+}
+
+func NewSpikeProcessor(writeApi *api.WriteApi, measurement string, webhook *Webhook, interval time.Duration, deviations float64, minResponses uint, bufferSize uint) *SpikeProcessor {
+	return &SpikeProcessor{
+		baseProcessor: newBaseProcessor("spikes", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		webhook:       webhook,
+		interval:      interval,
+		deviations:    deviations,
+		minResponses:  int(minResponses),
+		alpha:         0.1,
+		warmup:        5,
+		counts:        make(map[string]*spikeCounts),
+		baselines:     make(map[string]*spikeBaseline),
+	}
+}
+
+func (proc *SpikeProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.checkLoop(ctx)
+	return nil
+}
+
+func (proc *SpikeProcessor) run() {
+	proc.consume(proc.count)
+	proc.finish()
+}
+
+func (proc *SpikeProcessor) checkLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.check(time.Now())
+		}
+	}
+}
+
+// Flush does nothing, since a partial interval would skew the baselines.
+func (proc *SpikeProcessor) Flush() {
+}
+
+func (proc *SpikeProcessor) count(message *Message) {
+	if message.dnsMessage == nil || message.dnstapMessage.QueryAddress == nil {
+		return
+	}
+	client := net.IP(message.dnstapMessage.QueryAddress).String()
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	counts := proc.counts[client]
+	if counts == nil {
+		counts = &spikeCounts{errors: make(map[int]int)}
+		proc.counts[client] = counts
+	}
+	counts.host = message.host
+	counts.responses++
+	counts.errors[message.dnsMessage.Rcode]++
+}
+
+func (proc *SpikeProcessor) check(now time.Time) {
+	proc.mutex.Lock()
+	counts := proc.counts
+	proc.counts = make(map[string]*spikeCounts)
+	proc.mutex.Unlock()
+
+	for client, clientCounts := range counts {
+		baseline := proc.baselines[client]
+		if baseline == nil {
+			baseline = &spikeBaseline{rates: make(map[int]*ewma)}
+			proc.baselines[client] = baseline
+		}
+		baseline.lastSeen = now
+		for _, rcode := range spikeRcodes {
+			avg := baseline.rates[rcode]
+			if avg == nil {
+				avg = &ewma{}
+				baseline.rates[rcode] = avg
+			}
+			rate := float64(clientCounts.errors[rcode]) / float64(clientCounts.responses)
+			if avg.samples >= proc.warmup && clientCounts.responses >= proc.minResponses &&
+				rate > avg.mean+proc.deviations*math.Max(math.Sqrt(avg.variance), 0.01) {
+				proc.alert(SpikeAlert{
+					Time:      now,
+					Client:    client,
+					Host:      clientCounts.host,
+					Rcode:     dns.RcodeToString[rcode],
+					Rate:      rate,
+					Baseline:  avg.mean,
+					Responses: clientCounts.responses,
+				})
+			}
+			avg.update(rate, proc.alpha)
+		}
+	}
+
+	for client, baseline := range proc.baselines {
+		if now.Sub(baseline.lastSeen) > 24*time.Hour {
+			delete(proc.baselines, client)
+		}
+	}
+}
+
+func (proc *SpikeProcessor) alert(alert SpikeAlert) {
+	spikeStats.Add(alert.Rcode, 1)
+	log.Warnf("%s rate of %s is %.1f%%, its baseline is %.1f%%", alert.Rcode, alert.Client, 100*alert.Rate, 100*alert.Baseline)
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("qaddress", alert.Client).
+		AddTag("rcode", alert.Rcode).
+		AddField("rate", alert.Rate).
+		AddField("baseline", alert.Baseline).
+		AddField("responses", alert.Responses).
+		SetTime(alert.Time)
+	if len(alert.Host) > 0 {
+		point.AddTag("qhost", alert.Host)
+	}
+	(*proc.writeApi).WritePoint(point)
+	proc.webhook.Notify(alert)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// StatsLogger periodically logs a one-line summary of the collector's stats, so that
+// simple deployments can check on it from the journal without a dashboard.
+type StatsLogger struct {
+	interval   time.Duration
+	lastFrames int64
+	lastTime   time.Time
+}
+
+func NewStatsLogger(interval time.Duration) *StatsLogger {
+	return &StatsLogger{interval: interval, lastTime: time.Now()}
+}
+
+func (stats *StatsLogger) Run(ctx context.Context) {
+	ticker := time.NewTicker(stats.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats.log()
+		}
+	}
+}
+
+func (stats *StatsLogger) log() {
+	now := time.Now()
+	frames := decodedFrames.Value()
+	qps := 0.0
+	if elapsed := now.Sub(stats.lastTime).Seconds(); elapsed > 0 {
+		qps = float64(frames-stats.lastFrames) / elapsed
+	}
+	stats.lastFrames = frames
+	stats.lastTime = now
+
+	log.Infof("Stats: %d frames (%.1f/s), %d points written, %d write errors, %d blocks learned, %d blocked domains, %d cached hosts",
+		frames, qps,
+		mapInt(influxStats, "points"),
+		mapInt(influxStats, "write_errors"),
+		mapInt(cnameStats, "learned_blocks"),
+		mapInt(cnameStats, "blocked_domains"),
+		mapInt(hostCacheStats, "size"))
+}
+
+// mapInt returns the integer value of a map entry, or 0 if it isn't set yet.
+func mapInt(m *expvar.Map, key string) int64 {
+	if value, ok := metricValue(m.Get(key)); ok {
+		if n, ok := value.(int64); ok {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// streamStats counts the stream subscribers and the records dropped for slow ones.
+var streamStats = expvar.NewMap("stream")
+
+type streamSubscriber struct {
+	filter  *Filter
+	format  CaptureFormat
+	records chan []byte
+}
+
+// StreamProcessor pushes the messages it receives to the clients connected to /stream
+// as server-sent events, one record per event. Each client can narrow the stream with
+// the client, domain, rcode, qtype and type parameters, e.g.
+// /stream?client=192.168.1.0/24&rcode=NXDOMAIN, and choose the format of the records
+// like --capture-format: json (the default), line (InfluxDB line protocol into the
+// measurement) or dnstap (a base64 dnstap frame). Records are dropped for clients that
+// don't keep up rather than slowing down the pipeline.
+type StreamProcessor struct {
+	baseProcessor
+	measurement    string
+	maxSubscribers int
+	mutex          sync.RWMutex
+	subscribers    map[*streamSubscriber]bool
+}
+
+func NewStreamProcessor(measurement string, maxSubscribers uint, bufferSize uint) *StreamProcessor {
+	proc := &StreamProcessor{
+		baseProcessor:  newBaseProcessor("stream", bufferSize),
+		measurement:    measurement,
+		maxSubscribers: int(maxSubscribers),
+		subscribers:    make(map[*streamSubscriber]bool),
+	}
+	streamStats.Set("subscribers", expvar.Func(func() interface{} {
+		proc.mutex.RLock()
+		defer proc.mutex.RUnlock()
+		return len(proc.subscribers)
+	}))
+	return proc
+}
+
+func (proc *StreamProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *StreamProcessor) run() {
+	proc.consume(proc.publish)
+	proc.mutex.Lock()
+	for subscriber := range proc.subscribers {
+		close(subscriber.records)
+		delete(proc.subscribers, subscriber)
+	}
+	proc.mutex.Unlock()
+	proc.finish()
+}
+
+// Flush does nothing, records are pushed as they arrive.
+func (proc *StreamProcessor) Flush() {
+}
+
+func (proc *StreamProcessor) publish(message *Message) {
+	proc.mutex.RLock()
+	defer proc.mutex.RUnlock()
+	// every format is encoded at most once
+	var records [CaptureLine + 1][]byte
+	for subscriber := range proc.subscribers {
+		if !subscriber.filter.Match(message) {
+			continue
+		}
+		record := records[subscriber.format]
+		if record == nil {
+			var err error
+			if record, err = proc.encode(message, subscriber.format); err != nil {
+				streamStats.Add("errors", 1)
+				continue
+			}
+			records[subscriber.format] = record
+		}
+		select {
+		case subscriber.records <- record:
+		default:
+			streamStats.Add("dropped", 1)
+		}
+	}
+}
+
+func (proc *StreamProcessor) encode(message *Message, format CaptureFormat) ([]byte, error) {
+	switch format {
+	case CaptureDnstap:
+		frame, err := proto.Marshal(message.dnstap)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(base64.StdEncoding.EncodeToString(frame)), nil
+	case CaptureLine:
+		payload := capturePayload(message)
+		return []byte(lineProtocol(proc.measurement, newCaptureRecord(message, payload), len(payload))), nil
+	default:
+		return json.Marshal(newQueryRecord(message))
+	}
+}
+
+func (proc *StreamProcessor) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/stream", proc.streamHandler)
+}
+
+// recordFilter builds a filter from the client, domain, rcode, qtype and type query
+// parameters.
+func recordFilter(req *http.Request) (*Filter, error) {
+	keys := []struct {
+		param string
+		term  string
+	}{{"client", "client"}, {"domain", "qname"}, {"rcode", "rcode"}, {"qtype", "qtype"}, {"type", "type"}}
+	var terms []string
+	for _, key := range keys {
+		if value := req.URL.Query().Get(key.param); len(value) > 0 {
+			if key.param == "client" && !strings.Contains(value, "/") {
+				if strings.Contains(value, ":") {
+					value += "/128"
+				} else {
+					value += "/32"
+				}
+			}
+			terms = append(terms, key.term+"="+value)
+		}
+	}
+	return ParseFilter(strings.Join(terms, ","))
+}
+
+func (proc *StreamProcessor) streamHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := recordFilter(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := CaptureJson
+	if value := req.URL.Query().Get("format"); len(value) > 0 {
+		if format, err = ParseCaptureFormat(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	subscriber := &streamSubscriber{filter: filter, format: format, records: make(chan []byte, 1000)}
+	proc.mutex.Lock()
+	if len(proc.subscribers) >= proc.maxSubscribers {
+		proc.mutex.Unlock()
+		http.Error(w, "too many stream clients", http.StatusServiceUnavailable)
+		return
+	}
+	proc.subscribers[subscriber] = true
+	proc.mutex.Unlock()
+	log.Infof("Streaming to %s", req.RemoteAddr)
+	defer func() {
+		proc.mutex.Lock()
+		delete(proc.subscribers, subscriber)
+		proc.mutex.Unlock()
+		log.Infof("Stopped streaming to %s", req.RemoteAddr)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case record, ok := <-subscriber.records:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", record); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureMessage returns a client query for "odd name.example" from "my laptop" with
+// its dnstap frame.
+func captureMessage(t *testing.T) *Message {
+	msg := new(dns.Msg)
+	msg.SetQuestion("odd\\032name.example.", dns.TypeTXT)
+	payload, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnstapMessage := &dnstap.Message{
+		Type:         dnstap.Message_CLIENT_QUERY.Enum(),
+		QueryAddress: net.ParseIP("192.168.1.20").To4(),
+		QueryMessage: payload,
+	}
+	return &Message{
+		timestamp:     time.Unix(1600000000, 0),
+		host:          "my laptop",
+		dnstapMessage: dnstapMessage,
+		dnsMessage:    msg,
+		dnstap:        &dnstap.Dnstap{Type: dnstap.Dnstap_MESSAGE.Enum(), Message: dnstapMessage},
+	}
+}
+
+func TestStreamEncode(t *testing.T) {
+	message := captureMessage(t)
+	proc := NewStreamProcessor("captures", 1, 1)
+	wire := base64.StdEncoding.EncodeToString(message.dnstapMessage.QueryMessage)
+
+	record, err := proc.encode(message, CaptureJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded QueryRecord
+	if err := json.Unmarshal(record, &decoded); err != nil || decoded.Qtype != "TXT" || decoded.Client != "192.168.1.20" {
+		t.Errorf("json record %s didn't decode to the query: %v", record, err)
+	}
+
+	record, err = proc.encode(message, CaptureLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `captures,qaddress=192.168.1.20,qhost=my\ laptop,qname=odd\032name.example.,qtype=TXT,tap_type=CLIENT_QUERY size=` +
+		`34i,wire="` + wire + `" 1600000000000000000`
+	if string(record) != want {
+		t.Errorf("line record = %s, want %s", record, want)
+	}
+
+	record, err = proc.encode(message, CaptureDnstap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := base64.StdEncoding.DecodeString(string(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dt dnstap.Dnstap
+	if err := proto.Unmarshal(frame, &dt); err != nil || !strings.Contains(string(dt.Message.QueryMessage), "odd name") {
+		t.Errorf("dnstap record didn't decode to the query: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"strings"
+)
+
+// SuffixSet maps domains to the name of the list that blocks them. It is a trie of the
+// labels from the top level domain down, so the parents shared by many domains (com.,
+// doubleclick.net.) are stored once. Every distinct label is interned once in a byte
+// arena, the nodes are kept in a single slice indexed by an open addressing table of
+// (parent, label), and the list of a node is an index into the list names. For
+// millions of domains that is a fraction of the memory of a map of domain strings.
+// Domains are compared as is, with or without the trailing dot, and a lookup only
+// matches the domain itself, not its subdomains. Lookups are safe to run concurrently,
+// changes are not.
+type SuffixSet struct {
+	nodes      []suffixNode
+	slots      []uint32
+	labels     []byte
+	labelEnds  []uint32
+	labelSlots []uint32
+	lists      []string
+	count      int
+}
+
+// suffixNode is a domain, with the list that blocks it or 0 if it isn't in the set.
+// Nodes are never removed, a deleted domain keeps its node for its subdomains.
+type suffixNode struct {
+	parent uint32
+	label  uint32
+	list   uint16
+}
+
+// NewSuffixSet returns an empty set with room for about size domains.
+func NewSuffixSet(size int) *SuffixSet {
+	// node 0 is the root and label 0 is its empty label, so that 0 marks an empty slot
+	return &SuffixSet{
+		nodes:      make([]suffixNode, 1, size+1),
+		slots:      make([]uint32, tableSize(size)),
+		labelEnds:  make([]uint32, 1, size/2+1),
+		labelSlots: make([]uint32, tableSize(size/2)),
+		lists:      []string{""},
+	}
+}
+
+// tableSize returns the power of two size of a table that holds n ids at most 3/4 full.
+func tableSize(n int) int {
+	size := 8
+	for size*3 < n*4 {
+		size *= 2
+	}
+	return size
+}
+
+// growTable doubles the size of a table and adds the ids from 1 to n-1 back.
+func growTable(table []uint32, n int, hash func(id uint32) uint64) []uint32 {
+	grown := make([]uint32, 2*len(table))
+	mask := len(grown) - 1
+	for id := uint32(1); id < uint32(n); id++ {
+		i := int(hash(id)) & mask
+		for grown[i] != 0 {
+			i = (i + 1) & mask
+		}
+		grown[i] = id
+	}
+	return grown
+}
+
+// hashLabel is the FNV-1a hash of label.
+func hashLabel(label string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(label); i++ {
+		h ^= uint64(label[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func hashNode(parent, label uint32) uint64 {
+	h := (uint64(parent)<<32 | uint64(label)) * 0x9e3779b97f4a7c15
+	return h ^ h>>32
+}
+
+// lastLabel splits the last label off name, e.g. "www.example" into "www" and "example".
+func lastLabel(name string) (string, string) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+func (set *SuffixSet) label(id uint32) []byte {
+	return set.labels[set.labelEnds[id-1]:set.labelEnds[id]]
+}
+
+// labelSlot returns the slot of label and its id, or the empty slot where it belongs
+// and 0 if it isn't interned.
+func (set *SuffixSet) labelSlot(label string) (int, uint32) {
+	mask := len(set.labelSlots) - 1
+	for i := int(hashLabel(label)) & mask; ; i = (i + 1) & mask {
+		id := set.labelSlots[i]
+		if id == 0 || string(set.label(id)) == label {
+			return i, id
+		}
+	}
+}
+
+func (set *SuffixSet) internLabel(label string) uint32 {
+	slot, id := set.labelSlot(label)
+	if id != 0 {
+		return id
+	}
+	set.labels = append(set.labels, label...)
+	set.labelEnds = append(set.labelEnds, uint32(len(set.labels)))
+	id = uint32(len(set.labelEnds) - 1)
+	set.labelSlots[slot] = id
+	if len(set.labelEnds)*4 > len(set.labelSlots)*3 {
+		set.labelSlots = growTable(set.labelSlots, len(set.labelEnds), func(id uint32) uint64 {
+			return hashLabel(string(set.label(id)))
+		})
+	}
+	return id
+}
+
+// nodeSlot returns the slot of the child of parent with label and its id, or the
+// empty slot where it belongs and 0 if there is no such child.
+func (set *SuffixSet) nodeSlot(parent, label uint32) (int, uint32) {
+	mask := len(set.slots) - 1
+	for i := int(hashNode(parent, label)) & mask; ; i = (i + 1) & mask {
+		id := set.slots[i]
+		if id == 0 || (set.nodes[id].parent == parent && set.nodes[id].label == label) {
+			return i, id
+		}
+	}
+}
+
+// child returns the child of parent with label, or 0 if there is none.
+func (set *SuffixSet) child(parent uint32, label string) uint32 {
+	_, id := set.labelSlot(label)
+	if id == 0 {
+		return 0
+	}
+	_, node := set.nodeSlot(parent, id)
+	return node
+}
+
+func (set *SuffixSet) addChild(parent uint32, label string) uint32 {
+	labelId := set.internLabel(label)
+	slot, id := set.nodeSlot(parent, labelId)
+	if id != 0 {
+		return id
+	}
+	set.nodes = append(set.nodes, suffixNode{parent: parent, label: labelId})
+	id = uint32(len(set.nodes) - 1)
+	set.slots[slot] = id
+	if len(set.nodes)*4 > len(set.slots)*3 {
+		set.slots = growTable(set.slots, len(set.nodes), func(id uint32) uint64 {
+			return hashNode(set.nodes[id].parent, set.nodes[id].label)
+		})
+	}
+	return id
+}
+
+// find returns the node of domain and whether it exists.
+func (set *SuffixSet) find(domain string) (uint32, bool) {
+	node := uint32(0)
+	for name := strings.TrimSuffix(domain, "."); len(name) > 0; {
+		var label string
+		name, label = lastLabel(name)
+		if node = set.child(node, label); node == 0 {
+			return 0, false
+		}
+	}
+	return node, true
+}
+
+func (set *SuffixSet) listIndex(list string) uint16 {
+	for i, name := range set.lists {
+		if name == list {
+			return uint16(i)
+		}
+	}
+	set.lists = append(set.lists, list)
+	return uint16(len(set.lists) - 1)
+}
+
+// Len returns the number of domains in the set.
+func (set *SuffixSet) Len() int {
+	return set.count
+}
+
+// Get returns the list of domain, or an empty string if it isn't in the set. Parent
+// domains are not considered.
+func (set *SuffixSet) Get(domain string) string {
+	node, ok := set.find(domain)
+	if !ok {
+		return ""
+	}
+	return set.lists[set.nodes[node].list]
+}
+
+// Set adds domain to the set, or moves it to list if it is already in it. An empty
+// list deletes the domain.
+func (set *SuffixSet) Set(domain, list string) {
+	if len(list) == 0 {
+		set.Delete(domain)
+		return
+	}
+	node := uint32(0)
+	for name := strings.TrimSuffix(domain, "."); len(name) > 0; {
+		var label string
+		name, label = lastLabel(name)
+		node = set.addChild(node, label)
+	}
+	if set.nodes[node].list == 0 {
+		set.count++
+	}
+	set.nodes[node].list = set.listIndex(list)
+}
+
+// Delete removes domain from the set. Its subdomains stay in it.
+func (set *SuffixSet) Delete(domain string) {
+	if node, ok := set.find(domain); ok && set.nodes[node].list != 0 {
+		set.nodes[node].list = 0
+		set.count--
+	}
+}
+
+// Range calls fn with every domain in the set, with the trailing dot, and its list.
+// The domains come in the order their nodes were created in, so a parent domain
+// always comes before its subdomains.
+func (set *SuffixSet) Range(fn func(domain, list string)) {
+	var name []byte
+	for id := range set.nodes {
+		if set.nodes[id].list == 0 {
+			continue
+		}
+		name = name[:0]
+		for node := uint32(id); node != 0; node = set.nodes[node].parent {
+			name = append(name, set.label(set.nodes[node].label)...)
+			name = append(name, '.')
+		}
+		if len(name) == 0 {
+			name = append(name, '.')
+		}
+		fn(string(name), set.lists[set.nodes[id].list])
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSuffixSet(t *testing.T) {
+	set := NewSuffixSet(4)
+	set.Set("example.com.", "block")
+	set.Set("ads.example.com.", "black")
+	set.Set("tracker.net", "gravity")
+	set.Set("example.com.", "learned")
+	set.Set("empty.org.", "")
+
+	tests := []struct {
+		domain string
+		list   string
+	}{
+		{"example.com.", "learned"},
+		{"example.com", "learned"},
+		{"ads.example.com.", "black"},
+		{"www.example.com.", ""},
+		{"www.ads.example.com.", ""},
+		{"com.", ""},
+		{"tracker.net.", "gravity"},
+		{"empty.org.", ""},
+		{"missing.", ""},
+		{".", ""},
+	}
+	for _, test := range tests {
+		if list := set.Get(test.domain); list != test.list {
+			t.Errorf("Get(%q) = %q, want %q", test.domain, list, test.list)
+		}
+	}
+	if set.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", set.Len())
+	}
+}
+
+func TestSuffixSetDelete(t *testing.T) {
+	tests := []struct {
+		name    string
+		delete  string
+		remains map[string]string
+	}{
+		{"leaf", "ads.example.com.", map[string]string{"example.com.": "block"}},
+		{"parent keeps subdomains", "example.com.", map[string]string{"ads.example.com.": "black"}},
+		{"missing", "www.example.com.", map[string]string{"example.com.": "block", "ads.example.com.": "black"}},
+		{"intermediate node", "com.", map[string]string{"example.com.": "block", "ads.example.com.": "black"}},
+		{"empty list", "", map[string]string{"example.com.": "block", "ads.example.com.": "black"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewSuffixSet(0)
+			set.Set("example.com.", "block")
+			set.Set("ads.example.com.", "black")
+			set.Delete(test.delete)
+
+			ranged := make(map[string]string)
+			set.Range(func(domain, list string) {
+				ranged[domain] = list
+			})
+			if fmt.Sprint(ranged) != fmt.Sprint(test.remains) {
+				t.Errorf("Range() = %v, want %v", ranged, test.remains)
+			}
+			if set.Len() != len(test.remains) {
+				t.Errorf("Len() = %d, want %d", set.Len(), len(test.remains))
+			}
+		})
+	}
+}
+
+func TestSuffixSetRangeOrder(t *testing.T) {
+	set := NewSuffixSet(0)
+	for _, domain := range []string{"b.example.", "a.example.", "example."} {
+		set.Set(domain, "block")
+	}
+	var domains []string
+	set.Range(func(domain, list string) {
+		domains = append(domains, domain)
+	})
+	// parents are created before their subdomains, even when added after them
+	want := []string{"example.", "b.example.", "a.example."}
+	if fmt.Sprint(domains) != fmt.Sprint(want) {
+		t.Errorf("Range() order = %v, want %v", domains, want)
+	}
+}
+
+func TestSuffixSetGrow(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		domains int
+	}{
+		{"no growth", 1000, 500},
+		{"past 3/4 load", 0, 100},
+		{"many times", 8, 20000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set := NewSuffixSet(test.size)
+			slots, labelSlots := len(set.slots), len(set.labelSlots)
+			for i := 0; i < test.domains; i++ {
+				set.Set(fmt.Sprintf("host%d.zone%d.example.", i, i%7), fmt.Sprintf("list%d", i%3))
+			}
+			if len(set.nodes)*4 > len(set.slots)*3 || len(set.labelEnds)*4 > len(set.labelSlots)*3 {
+				t.Errorf("tables more than 3/4 full: %d nodes in %d slots, %d labels in %d slots",
+					len(set.nodes), len(set.slots), len(set.labelEnds), len(set.labelSlots))
+			}
+			if test.size == 0 && (len(set.slots) == slots || len(set.labelSlots) == labelSlots) {
+				t.Errorf("tables didn't grow")
+			}
+			for i := 0; i < test.domains; i++ {
+				domain := fmt.Sprintf("host%d.zone%d.example.", i, i%7)
+				if list := set.Get(domain); list != fmt.Sprintf("list%d", i%3) {
+					t.Fatalf("Get(%q) = %q after growing, want list%d", domain, list, i%3)
+				}
+			}
+			if set.Len() != test.domains {
+				t.Errorf("Len() = %d, want %d", set.Len(), test.domains)
+			}
+		})
+	}
+}
+
+func TestTableSize(t *testing.T) {
+	tests := []struct {
+		n    int
+		size int
+	}{
+		{0, 8},
+		{6, 8},
+		{7, 16},
+		{12, 16},
+		{13, 32},
+	}
+	for _, test := range tests {
+		if size := tableSize(test.n); size != test.size {
+			t.Errorf("tableSize(%d) = %d, want %d", test.n, size, test.size)
+		}
+	}
+}
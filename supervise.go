@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"runtime/debug"
+	"time"
+)
+
+// processorCrashes counts the panics recovered in each processor.
+var processorCrashes = expvar.NewMap("processor_crashes")
+
+// RestartPolicy limits how often a crashed processor loop is restarted.
+type RestartPolicy struct {
+	MaxRestarts uint
+	Window      time.Duration
+}
+
+var restartPolicy = RestartPolicy{MaxRestarts: 5, Window: time.Minute}
+
+func SetRestartPolicy(maxRestarts uint, window time.Duration) {
+	restartPolicy = RestartPolicy{MaxRestarts: maxRestarts, Window: window}
+}
+
+// supervise runs loop, which is expected to return when its input channel is closed.
+// If loop panics, the panic is logged and counted and loop is started again. When the
+// restart policy is exceeded, the processor is given up on and drain is run instead,
+// which must discard the rest of the input so that senders don't block.
+func (base *baseProcessor) supervise(loop func(), drain func()) {
+	var restarts []time.Time
+	for {
+		if runRecovered(base.name, base.reportError, loop) {
+			return
+		}
+
+		now := time.Now()
+		recent := restarts[:0]
+		for _, restart := range restarts {
+			if now.Sub(restart) < restartPolicy.Window {
+				recent = append(recent, restart)
+			}
+		}
+		restarts = append(recent, now)
+
+		if uint(len(restarts)) > restartPolicy.MaxRestarts {
+			log.Errorf("%s processor crashed %d times in %s, disabling it", base.name, len(restarts), restartPolicy.Window)
+			base.reportError(fmt.Errorf("disabled after %d crashes", len(restarts)))
+			drain()
+			return
+		}
+		log.Warnf("Restarting %s processor", base.name)
+	}
+}
+
+// runRecovered returns true if loop returned normally, or false if it panicked.
+func runRecovered(name string, reportError func(error), loop func()) (finished bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			processorCrashes.Add(name, 1)
+			log.Errorf("%s processor panic: %v\n%s", name, r, debug.Stack())
+			reportError(fmt.Errorf("panic: %v", r))
+			finished = false
+		}
+	}()
+	loop()
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/miekg/dns"
+)
+
+// The SVCB and HTTPS record types and the SvcParamKeys we look at (RFC 9460). The
+// dns package we use predates them, so their records are unpacked as RFC3597 and
+// parsed here.
+const (
+	typeSVCB  uint16 = 64
+	typeHTTPS uint16 = 65
+
+	svcParamAlpn uint16 = 1
+	svcParamEch  uint16 = 5
+)
+
+var errShortSvcb = errors.New("short SVCB rdata")
+
+// svcbInfo is what we record of the SVCB and HTTPS answers of a response.
+type svcbInfo struct {
+	alpn []string
+	ech  bool
+}
+
+func (info *svcbInfo) hasAlpn(protocol string) bool {
+	return containsString(info.alpn, protocol)
+}
+
+// parseSvcbAnswers collects the ALPN protocols and ECH presence of the SVCB and HTTPS
+// answers. It returns nil if there are none.
+func parseSvcbAnswers(answers []dns.RR) *svcbInfo {
+	var info *svcbInfo
+	for _, rr := range answers {
+		rrtype := rr.Header().Rrtype
+		if rrtype != typeSVCB && rrtype != typeHTTPS {
+			continue
+		}
+		unknown, ok := rr.(*dns.RFC3597)
+		if !ok {
+			continue
+		}
+		rdata, err := hex.DecodeString(unknown.Rdata)
+		if err != nil {
+			continue
+		}
+		if info == nil {
+			info = &svcbInfo{}
+		}
+		_ = parseSvcbRdata(rdata, info)
+	}
+	return info
+}
+
+// parseSvcbRdata adds the SvcParams of the rdata of one record to info.
+func parseSvcbRdata(rdata []byte, info *svcbInfo) error {
+	if len(rdata) < 2 {
+		return errShortSvcb
+	}
+	// skip the priority and the target name, which is never compressed
+	_, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return err
+	}
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return errShortSvcb
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return errShortSvcb
+		}
+		value := rdata[off : off+length]
+		off += length
+
+		switch key {
+		case svcParamAlpn:
+			for i := 0; i < len(value); {
+				n := int(value[i])
+				if i+1+n > len(value) {
+					return errShortSvcb
+				}
+				protocol := string(value[i+1 : i+1+n])
+				if !info.hasAlpn(protocol) {
+					info.alpn = append(info.alpn, protocol)
+				}
+				i += 1 + n
+			}
+		case svcParamEch:
+			info.ech = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// talkerMinutes is the longest window the top talkers can be asked for.
+const talkerMinutes = 60
+
+type talkerBucket struct {
+	minute  int64
+	clients *SpaceSaving
+	domains *SpaceSaving
+}
+
+type talkerCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// TalkersProcessor keeps per-minute counts of the busiest clients and the most queried
+// domains of the last hour and serves the top talkers of a sliding window as JSON on
+// /top, e.g. /top?window=15m&n=20. Each minute keeps a fixed number of counters, so
+// the counts of keys outside the top few hundred are approximate.
+type TalkersProcessor struct {
+	baseProcessor
+	capacity int
+	mutex    sync.Mutex
+	buckets  [talkerMinutes]talkerBucket
+}
+
+func NewTalkersProcessor(capacity uint, bufferSize uint) *TalkersProcessor {
+	proc := &TalkersProcessor{
+		baseProcessor: newBaseProcessor("talkers", bufferSize),
+		capacity:      int(capacity),
+	}
+	for i := range proc.buckets {
+		proc.buckets[i] = talkerBucket{
+			minute:  -1,
+			clients: NewSpaceSaving(int(capacity)),
+			domains: NewSpaceSaving(int(capacity)),
+		}
+	}
+	return proc
+}
+
+func (proc *TalkersProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *TalkersProcessor) run() {
+	proc.consume(proc.count)
+	proc.finish()
+}
+
+// Flush does nothing, the counts are only served over HTTP.
+func (proc *TalkersProcessor) Flush() {
+}
+
+func (proc *TalkersProcessor) count(message *Message) {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return
+	}
+	minute := message.timestamp.Unix() / 60
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	bucket := &proc.buckets[minute%talkerMinutes]
+	if bucket.minute != minute {
+		bucket.minute = minute
+		bucket.clients.Reset()
+		bucket.domains.Reset()
+	}
+	bucket.domains.Add(message.dnsMessage.Question[0].Name)
+	if message.dnstapMessage.QueryAddress != nil {
+		bucket.clients.Add(net.IP(message.dnstapMessage.QueryAddress).String())
+	}
+}
+
+// Top returns the n busiest clients and most queried domains of the last window.
+func (proc *TalkersProcessor) Top(window time.Duration, n int, now time.Time) ([]talkerCount, []talkerCount) {
+	last := now.Unix() / 60
+	first := last - int64(window/time.Minute) + 1
+	clients := make(map[string]uint64)
+	domains := make(map[string]uint64)
+
+	proc.mutex.Lock()
+	for i := range proc.buckets {
+		bucket := &proc.buckets[i]
+		if bucket.minute < first || bucket.minute > last {
+			continue
+		}
+		for _, hitter := range bucket.clients.Top(proc.capacity) {
+			clients[hitter.key] += hitter.count
+		}
+		for _, hitter := range bucket.domains.Top(proc.capacity) {
+			domains[hitter.key] += hitter.count
+		}
+	}
+	proc.mutex.Unlock()
+
+	return topCounts(clients, n), topCounts(domains, n)
+}
+
+func topCounts(counts map[string]uint64, n int) []talkerCount {
+	top := make([]talkerCount, 0, len(counts))
+	for key, count := range counts {
+		top = append(top, talkerCount{Key: key, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (proc *TalkersProcessor) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/top", proc.topHandler)
+}
+
+func (proc *TalkersProcessor) topHandler(w http.ResponseWriter, req *http.Request) {
+	window := 5 * time.Minute
+	if value := req.URL.Query().Get("window"); len(value) > 0 {
+		var err error
+		window, err = time.ParseDuration(value)
+		if err != nil || window < time.Minute || window > talkerMinutes*time.Minute {
+			http.Error(w, fmt.Sprintf("window must be between 1m and %dm", talkerMinutes), http.StatusBadRequest)
+			return
+		}
+	}
+	n := 10
+	if value := req.URL.Query().Get("n"); len(value) > 0 {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	clients, domains := proc.Top(window, n, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Window  string        `json:"window"`
+		Clients []talkerCount `json:"clients"`
+		Domains []talkerCount `json:"domains"`
+	}{window.String(), clients, domains})
+}
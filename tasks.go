@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// rollupTags are the tags kept by the rollups. They match the tags the influx
+// processor writes for the dashboards, leaving out the per-point ones like the geo
+// tags.
+var rollupTags = []string{"tap_type", "qaddress", "qhost", "qname", "qtype", "status", "blocked"}
+
+type rollup struct {
+	name   string
+	every  string
+	from   string
+	field  string
+	sum    bool
+	offset string
+}
+
+// rollups returns the hourly rollup of the queries measurement and the daily rollup
+// of the hourly one.
+func rollups(measurement string) []rollup {
+	return []rollup{
+		{name: measurement + "_1h", every: "1h", from: measurement, field: "id", offset: "5m"},
+		{name: measurement + "_1d", every: "1d", from: measurement + "_1h", field: "count", sum: true, offset: "15m"},
+	}
+}
+
+// fluxTask returns the Flux task that writes a rollup from the bucket to the rollup
+// bucket.
+func fluxTask(r rollup, org, bucket, rollupBucket string) string {
+	source, fn := bucket, "count"
+	if r.sum {
+		source, fn = rollupBucket, "sum"
+	}
+	return fmt.Sprintf(`option task = {name: "dnstap %s", every: %s, offset: %s}
+
+from(bucket: %q)
+  |> range(start: -task.every)
+  |> filter(fn: (r) => r._measurement == %q and r._field == %q)
+  |> group(columns: [%s])
+  |> aggregateWindow(every: task.every, fn: %s, createEmpty: false)
+  |> set(key: "_measurement", value: %q)
+  |> set(key: "_field", value: "count")
+  |> to(bucket: %q, org: %q)
+`, r.name, r.every, r.offset, source, r.from, r.field, quotedList(rollupTags), fn, r.name, rollupBucket, org)
+}
+
+// continuousQuery returns the InfluxDB 1.x continuous query that writes a rollup into
+// the retention policy.
+func continuousQuery(r rollup, database, policy string) string {
+	source, fn := fmt.Sprintf("%q", r.from), fmt.Sprintf("count(%q)", r.field)
+	if r.sum {
+		source, fn = fmt.Sprintf("%q.%q.%q", database, policy, r.from), fmt.Sprintf("sum(%q)", r.field)
+	}
+	return fmt.Sprintf(`CREATE CONTINUOUS QUERY %q ON %q BEGIN SELECT %s AS "count" INTO %q.%q.%q FROM %s GROUP BY time(%s), %s END`,
+		r.name, database, fn, database, policy, r.name, source, r.every, quotedList(rollupTags))
+}
+
+func quotedList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func tasksCmd(name string, args []string) {
+	var rollupBucket string
+	var v1 bool
+	var printOnly bool
+	flags := newFlagSet(name)
+	addPipelineFlags(flags)
+	flags.StringVar(&rollupBucket, "rollup-bucket", "", "the existing bucket (or 1.x retention policy) the rollups are written to (default the bucket name with _rollups appended)")
+	flags.BoolVar(&v1, "v1", false, "install InfluxDB 1.x continuous queries in the database named by --bucket instead of Flux tasks")
+	flags.BoolVar(&printOnly, "print", false, "print the tasks or continuous queries instead of installing them")
+	influxdb, _, _ := parsePipelineFlags(flags, args, true)
+	if len(rollupBucket) == 0 {
+		rollupBucket = flagBucket + "_rollups"
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	failed := false
+	for _, r := range rollups(flagQueriesMeasurement) {
+		var err error
+		if v1 {
+			query := continuousQuery(r, flagBucket, rollupBucket)
+			if printOnly {
+				fmt.Println(query + "\n")
+				continue
+			}
+			err = installContinuousQuery(client, influxdb, query)
+		} else {
+			task := fluxTask(r, flagOrg, flagBucket, rollupBucket)
+			if printOnly {
+				fmt.Println(task)
+				continue
+			}
+			err = installTask(client, influxdb, task)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to install the %s rollup", r.name)
+			failed = true
+		} else {
+			log.Infof("Installed the %s rollup", r.name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func installTask(client *http.Client, influxdb, task string) error {
+	body, err := json.Marshal(map[string]string{
+		"org":    flagOrg,
+		"flux":   task,
+		"status": "active",
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(influxdb, "/")+"/api/v2/tasks", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+flagAuthToken)
+	return doInfluxRequest(client, req)
+}
+
+// installContinuousQuery runs the query on the 1.x /query endpoint. The token is
+// expected to be "username:password", like the 1.8 compatibility API expects it.
+func installContinuousQuery(client *http.Client, influxdb, query string) error {
+	values := url.Values{}
+	values.Set("q", query)
+	if parts := strings.SplitN(flagAuthToken, ":", 2); len(parts) == 2 {
+		values.Set("u", parts[0])
+		values.Set("p", parts[1])
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(influxdb, "/")+"/query", strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doInfluxRequest(client, req)
+}
+
+func doInfluxRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	// 1.x reports errors of a query in the body
+	var result struct {
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil {
+		for _, r := range result.Results {
+			if len(r.Error) > 0 {
+				return fmt.Errorf("%s", r.Error)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Telemetry periodically writes the collector's own stats to InfluxDB so that its
+// health can be monitored without a Prometheus server.
+type Telemetry struct {
+	writeApi    *api.WriteApi
+	measurement string
+	interval    time.Duration
+	hostname    string
+	lastFrames  int64
+	lastTime    time.Time
+}
+
+func NewTelemetry(writeApi *api.WriteApi, measurement string, interval time.Duration) *Telemetry {
+	hostname, _ := os.Hostname()
+	return &Telemetry{
+		writeApi:    writeApi,
+		measurement: measurement,
+		interval:    interval,
+		hostname:    hostname,
+		lastTime:    time.Now(),
+	}
+}
+
+func (telemetry *Telemetry) Run(ctx context.Context) {
+	ticker := time.NewTicker(telemetry.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			telemetry.write()
+		}
+	}
+}
+
+func (telemetry *Telemetry) write() {
+	now := time.Now()
+	point := influxdb2.NewPointWithMeasurement(telemetry.measurement).
+		AddTag("host", telemetry.hostname).
+		AddTag("version", version).
+		SetTime(now)
+
+	forEachMetric(func(name, key string, value interface{}) {
+		if len(key) > 0 {
+			name += "_" + key
+		}
+		point.AddField(name, value)
+	})
+
+	frames := decodedFrames.Value()
+	if elapsed := now.Sub(telemetry.lastTime).Seconds(); elapsed > 0 {
+		point.AddField("frames_per_second", float64(frames-telemetry.lastFrames)/elapsed)
+	}
+	telemetry.lastFrames = frames
+	telemetry.lastTime = now
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	point.AddField("goroutines", runtime.NumGoroutine()).
+		AddField("heap_alloc_bytes", int64(memStats.HeapAlloc)).
+		AddField("sys_bytes", int64(memStats.Sys)).
+		AddField("gc_count", int64(memStats.NumGC))
+
+	(*telemetry.writeApi).WritePoint(point)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+)
+
+// Tenant is a customer view on a shared resolver. Messages are routed to a tenant by
+// the dnstap identity of the resolver or by the query zone (e.g. the unbound view)
+// they were answered from, and each tenant gets its own InfluxDB org and bucket and
+// its own block lists. Learned blocks are only enforced for tenants with their own RPZ
+// file, since the resolver's other enforcers are shared by all views.
+type Tenant struct {
+	Name       string   `yaml:"name"`
+	Identities []string `yaml:"identities"`
+	QueryZones []string `yaml:"query_zones"`
+	Org        string   `yaml:"org"`
+	Bucket     string   `yaml:"bucket"`
+	BlockFile  string   `yaml:"block"`
+	WhiteFile  string   `yaml:"white"`
+	BlackFile  string   `yaml:"black"`
+	GravityDb  string   `yaml:"gravity_db"`
+	RpzFile    string   `yaml:"rpz_file"`
+}
+
+// LoadTenants reads the tenants from a YAML file with a top-level tenants list. Org,
+// bucket and the lists default to the collector's own settings.
+func LoadTenants(path string) ([]*Tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tenants []*Tenant `yaml:"tenants"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, tenant := range file.Tenants {
+		if len(tenant.Name) == 0 {
+			return nil, fmt.Errorf("a tenant in %s has no name", path)
+		}
+		if names[tenant.Name] {
+			return nil, fmt.Errorf("tenant %s is defined twice in %s", tenant.Name, path)
+		}
+		names[tenant.Name] = true
+		if len(tenant.Identities) == 0 && len(tenant.QueryZones) == 0 {
+			return nil, fmt.Errorf("tenant %s has no identities or query zones", tenant.Name)
+		}
+		for i := range tenant.QueryZones {
+			tenant.QueryZones[i] = dns.Fqdn(strings.ToLower(tenant.QueryZones[i]))
+		}
+		tenant.Org = defaultString(tenant.Org, flagOrg)
+		tenant.Bucket = defaultString(tenant.Bucket, flagBucket)
+		tenant.BlockFile = defaultString(tenant.BlockFile, flagBlockFile)
+		tenant.WhiteFile = defaultString(tenant.WhiteFile, flagWhitelistFile)
+		tenant.BlackFile = defaultString(tenant.BlackFile, flagBlacklistFile)
+		tenant.GravityDb = defaultString(tenant.GravityDb, flagGravityDb)
+	}
+	return file.Tenants, nil
+}
+
+func defaultString(value, defaultValue string) string {
+	if len(value) == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Match returns true if the message was sent by one of the tenant's identities or
+// answered from one of its query zones.
+func (tenant *Tenant) Match(message *Message) bool {
+	if len(tenant.Identities) > 0 && containsString(tenant.Identities, string(message.dnstap.Identity)) {
+		return true
+	}
+	return len(tenant.QueryZones) > 0 && containsString(tenant.QueryZones, queryZone(message))
+}
+
+// Filter returns a filter that matches the tenant's messages.
+func (tenant *Tenant) Filter() *Filter {
+	return &Filter{terms: []filterTerm{{match: tenant.Match}}}
+}
+
+// excludeTenants returns a filter that matches the messages of no tenant, or nil if
+// there are no tenants.
+func excludeTenants(tenants []*Tenant) *Filter {
+	if len(tenants) == 0 {
+		return nil
+	}
+	return &Filter{terms: []filterTerm{{negate: true, match: func(message *Message) bool {
+		for _, tenant := range tenants {
+			if tenant.Match(message) {
+				return true
+			}
+		}
+		return false
+	}}}}
+}
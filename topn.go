@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TopNProcessor tracks the most queried domains and the busiest clients and writes
+// them as summary points every interval, so that "top talkers" panels don't need to
+// group by over the raw queries.
+type TopNProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	n           int
+	interval    time.Duration
+	mutex       sync.Mutex
+	domains     *SpaceSaving
+	clients     *SpaceSaving
+}
+
+// NewTopNProcessor keeps ten times as many counters as it reports, which keeps the
+// reported counts accurate for all but very flat distributions.
+func NewTopNProcessor(writeApi *api.WriteApi, measurement string, n uint, interval time.Duration, bufferSize uint) *TopNProcessor {
+	return &TopNProcessor{
+		baseProcessor: newBaseProcessor("top", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		n:             int(n),
+		interval:      interval,
+		domains:       NewSpaceSaving(int(n) * 10),
+		clients:       NewSpaceSaving(int(n) * 10),
+	}
+}
+
+func (proc *TopNProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *TopNProcessor) run() {
+	proc.consume(proc.count)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *TopNProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *TopNProcessor) count(message *Message) {
+	if message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 {
+		return
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	proc.domains.Add(message.dnsMessage.Question[0].Name)
+	if message.dnstapMessage.QueryAddress != nil {
+		proc.clients.Add(net.IP(message.dnstapMessage.QueryAddress).String())
+	}
+}
+
+// Flush writes the top domains and clients seen since the last flush.
+func (proc *TopNProcessor) Flush() {
+	proc.mutex.Lock()
+	domains := proc.domains.Top(proc.n)
+	clients := proc.clients.Top(proc.n)
+	proc.domains.Reset()
+	proc.clients.Reset()
+	proc.mutex.Unlock()
+
+	now := time.Now()
+	proc.writeTop("domain", domains, now)
+	proc.writeTop("client", clients, now)
+}
+
+func (proc *TopNProcessor) writeTop(kind string, top []heavyHitter, now time.Time) {
+	for rank, hitter := range top {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("kind", kind).
+			AddTag("rank", strconv.Itoa(rank+1)).
+			AddTag("key", hitter.key).
+			AddField("count", int64(hitter.count)).
+			AddField("error", int64(hitter.error)).
+			SetTime(now)
+		(*proc.writeApi).WritePoint(point)
+	}
+}
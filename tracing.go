@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// Span is a traced stage of the pipeline. Building with the otel tag exports spans
+// over OTLP; otherwise, and for frames that aren't sampled, spans do nothing.
+type Span interface {
+	Child(name string) Span
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) Child(string) Span {
+	return noopSpan{}
+}
+
+func (noopSpan) End() {
+}
+
+// newRootSpan starts a trace. It is set by initTracing when tracing is enabled.
+var newRootSpan func(name string) Span
+
+var traceSampleRatio float64
+
+// startTrace starts a trace for a sampled fraction of calls.
+func startTrace(name string) Span {
+	if newRootSpan == nil || rand.Float64() >= traceSampleRatio {
+		return noopSpan{}
+	}
+	return newRootSpan(name)
+}
+
+// childSpan starts a child of span, which may be nil.
+func childSpan(span Span, name string) Span {
+	if span == nil {
+		return noopSpan{}
+	}
+	return span.Child(name)
+}
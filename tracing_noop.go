@@ -0,0 +1,13 @@
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"errors"
+)
+
+// initTracing enables tracing. Without the otel tag, there is no exporter.
+func initTracing(endpoint string, sampleRatio float64) (func(), error) {
+	return nil, errors.New("built without tracing support (otel tag)")
+}
@@ -0,0 +1,59 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+type otelSpan struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	span   trace.Span
+}
+
+func (span *otelSpan) Child(name string) Span {
+	ctx, child := span.tracer.Start(span.ctx, name)
+	return &otelSpan{ctx: ctx, tracer: span.tracer, span: child}
+}
+
+func (span *otelSpan) End() {
+	span.span.End()
+}
+
+// initTracing exports spans to the OTLP/HTTP endpoint (host:port). Frames are sampled
+// by startTrace, so every span that is started is exported. The returned function
+// flushes the spans that haven't been exported yet.
+func initTracing(endpoint string, sampleRatio float64) (func(), error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(resource.NewWithAttributes("",
+			attribute.String("service.name", "dnstap-to-influxdb"),
+			attribute.String("service.version", version))))
+	tracer := provider.Tracer("github.com/fhriley/dnstap-to-influxdb")
+
+	traceSampleRatio = sampleRatio
+	newRootSpan = func(name string) Span {
+		ctx, span := tracer.Start(context.Background(), name)
+		return &otelSpan{ctx: ctx, tracer: tracer, span: span}
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = provider.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"expvar"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// truncationStats counts the truncated responses and the TCP retries matched to them.
+var truncationStats = expvar.NewMap("truncation")
+
+type truncationKey struct {
+	client string
+	qname  string
+	qtype  uint16
+}
+
+type truncatedResponse struct {
+	id   string
+	time time.Time
+}
+
+// truncationTracker links a truncated UDP response to the TCP query the client
+// retries it with, so the cost of truncation can be measured. Both points get the same
+// tc_id, and the retry also gets the delay since the truncated response.
+type truncationTracker struct {
+	window  time.Duration
+	nextId  uint64
+	pending map[truncationKey]truncatedResponse
+	pruned  time.Time
+}
+
+func newTruncationTracker(window time.Duration) *truncationTracker {
+	return &truncationTracker{window: window, pending: make(map[truncationKey]truncatedResponse)}
+}
+
+// track returns the correlation id of the message and, for a retry, the delay since
+// the truncated response. The id is empty for messages that are neither.
+func (tracker *truncationTracker) track(msg *Message) (string, time.Duration) {
+	if msg.dnsMessage == nil || len(msg.dnsMessage.Question) == 0 || msg.dnstapMessage.QueryAddress == nil ||
+		msg.dnstapMessage.SocketProtocol == nil {
+		return "", 0
+	}
+	key := truncationKey{
+		client: net.IP(msg.dnstapMessage.QueryAddress).String(),
+		qname:  strings.ToLower(msg.dnsMessage.Question[0].Name),
+		qtype:  msg.dnsMessage.Question[0].Qtype,
+	}
+	tcp := *msg.dnstapMessage.SocketProtocol == dnstap.SocketProtocol_TCP
+
+	switch *msg.dnstapMessage.Type {
+	case dnstap.Message_CLIENT_RESPONSE:
+		if tcp || !msg.dnsMessage.Truncated {
+			return "", 0
+		}
+		tracker.prune(msg.timestamp)
+		tracker.nextId++
+		id := strconv.FormatUint(tracker.nextId, 36)
+		tracker.pending[key] = truncatedResponse{id: id, time: msg.timestamp}
+		truncationStats.Add("truncated", 1)
+		return id, 0
+	case dnstap.Message_CLIENT_QUERY:
+		if !tcp {
+			return "", 0
+		}
+		response, exists := tracker.pending[key]
+		if !exists || msg.timestamp.Sub(response.time) > tracker.window {
+			return "", 0
+		}
+		delete(tracker.pending, key)
+		truncationStats.Add("retries", 1)
+		return response.id, msg.timestamp.Sub(response.time)
+	}
+	return "", 0
+}
+
+// prune drops the responses that weren't retried within the window, at most once per
+// window.
+func (tracker *truncationTracker) prune(now time.Time) {
+	if now.Sub(tracker.pruned) < tracker.window {
+		return
+	}
+	for key, response := range tracker.pending {
+		if now.Sub(response.time) > tracker.window {
+			delete(tracker.pending, key)
+		}
+	}
+	tracker.pruned = now
+}
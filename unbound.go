@@ -1,53 +1,191 @@
+//go:build !nounbound
+// +build !nounbound
+
 package main
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os/exec"
+	"strings"
 	"sync"
 )
 
-type UnboundCommand int
+const defaultEnforcer = "unbound"
 
-const (
-	ZoneAdd    UnboundCommand = 1
-	ZoneRemove                = 2
-)
+type Unbound struct {
+	messages    chan *EnforcerCommandMessage
+	blockAction BlockAction
+	blockTarget string
+	failing     bool
+}
 
-type UnboundCommandMessage struct {
-	cmd    UnboundCommand
-	domain string
+func NewUnbound(blockAction BlockAction, blockTarget string) (*Unbound, error) {
+	return &Unbound{
+		messages:    make(chan *EnforcerCommandMessage, 1000),
+		blockAction: blockAction,
+		blockTarget: blockTarget,
+	}, nil
 }
 
-type Unbound struct {
-	messages chan *UnboundCommandMessage
+func (unbound *Unbound) GetChannel() chan *EnforcerCommandMessage {
+	return unbound.messages
 }
 
-func NewUnbound() *Unbound {
-	return &Unbound{
-		messages: make(chan *UnboundCommandMessage, 1000),
+// zoneAddCommands returns the unbound-control invocations that block domain using the
+// configured block action.
+func (unbound *Unbound) zoneAddCommands(domain string) [][]string {
+	switch unbound.blockAction {
+	case BlockNodata:
+		return [][]string{{"local_zone", domain, "always_nodata"}}
+	case BlockSinkhole:
+		rrType := "A"
+		if net.ParseIP(unbound.blockTarget).To4() == nil {
+			rrType = "AAAA"
+		}
+		return [][]string{
+			{"local_zone", domain, "redirect"},
+			{"local_data", fmt.Sprintf("%s %s %s", domain, rrType, unbound.blockTarget)},
+		}
+	case BlockCname:
+		return [][]string{
+			{"local_zone", domain, "redirect"},
+			{"local_data", fmt.Sprintf("%s CNAME %s", domain, unbound.blockTarget)},
+		}
+	default:
+		return [][]string{{"local_zone", domain, "always_nxdomain"}}
 	}
 }
 
-func (unbound *Unbound) GetChannel() chan *UnboundCommandMessage {
-	return unbound.messages
+// zoneRemoveCommands returns the unbound-control invocations that lift the block of
+// domain. Removing a redirect zone leaves its local data behind, so the sinkhole and
+// cname block actions remove the data as well.
+func (unbound *Unbound) zoneRemoveCommands(domain string) [][]string {
+	switch unbound.blockAction {
+	case BlockSinkhole, BlockCname:
+		return [][]string{
+			{"local_zone_remove", domain},
+			{"local_data_remove", domain},
+		}
+	default:
+		return [][]string{{"local_zone_remove", domain}}
+	}
 }
 
+func (unbound *Unbound) Probe() error {
+	output, err := exec.Command("/opt/unbound/sbin/unbound-control", "status").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unbound-control status failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// maxUnboundBatch is the most commands sent in a single unbound-control call.
+const maxUnboundBatch = 1000
+
+// bulkCommands are the unbound-control commands that read any number of arguments
+// from stdin, one per line, by the single command they batch.
+var bulkCommands = map[string]string{
+	"local_zone":        "local_zones",
+	"local_zone_remove": "local_zones_remove",
+	"local_data":        "local_datas",
+	"local_data_remove": "local_datas_remove",
+}
+
+// unboundBatch is a bulk command and the lines it reads.
+type unboundBatch struct {
+	command string
+	lines   []string
+}
+
+func (unbound *Unbound) commands(message *EnforcerCommandMessage) [][]string {
+	switch message.cmd {
+	case ZoneAdd:
+		return unbound.zoneAddCommands(message.domain)
+	case ZoneRemove:
+		return unbound.zoneRemoveCommands(message.domain)
+	case DataAdd:
+		return [][]string{{"local_data", message.data}}
+	case DataRemove:
+		return [][]string{{"local_data_remove", message.domain}}
+	default:
+		log.Warnf("Got invalid command: %d", message.cmd)
+		return nil
+	}
+}
+
+// batches groups the commands of consecutive messages of the same kind into bulk
+// commands. Within a run of zone adds all zones are added before their data, which
+// keeps every redirect zone ahead of its data; runs of different kinds keep their
+// order.
+func (unbound *Unbound) batches(messages []*EnforcerCommandMessage) []unboundBatch {
+	var batches []unboundBatch
+	for start := 0; start < len(messages); {
+		end := start
+		for end < len(messages) && messages[end].cmd == messages[start].cmd {
+			end++
+		}
+		var run []unboundBatch
+		for _, message := range messages[start:end] {
+			for _, args := range unbound.commands(message) {
+				command := bulkCommands[args[0]]
+				i := 0
+				for i < len(run) && run[i].command != command {
+					i++
+				}
+				if i == len(run) {
+					run = append(run, unboundBatch{command: command})
+				}
+				run[i].lines = append(run[i].lines, strings.Join(args[1:], " "))
+			}
+		}
+		batches = append(batches, run...)
+		start = end
+	}
+	return batches
+}
+
+// Run sends the commands to unbound. unbound-control makes a new TLS connection for
+// every call and unbound closes it after a single command, so the commands queued
+// up, e.g. by a burst of learned blocks after a list update, are sent as bulk commands
+// instead of one call each.
 func (unbound *Unbound) Run(wg *sync.WaitGroup) {
 	for message := range unbound.messages {
-		var cmd *exec.Cmd
-		switch message.cmd {
-		case ZoneAdd:
-			cmd = exec.Command("/opt/unbound/sbin/unbound-control", "local_zone", message.domain, "always_nxdomain")
-		case ZoneRemove:
-			cmd = exec.Command("/opt/unbound/sbin/unbound-control", "local_zone_remove", message.domain)
-		default:
-			log.Warnf("Got invalid command: %s", message.cmd)
-			continue
+		messages := []*EnforcerCommandMessage{message}
+	drain:
+		for len(messages) < maxUnboundBatch {
+			select {
+			case next, ok := <-unbound.messages:
+				if !ok {
+					break drain
+				}
+				messages = append(messages, next)
+			default:
+				break drain
+			}
 		}
-		err := cmd.Run()
-		if err != nil {
-			log.WithError(err).Errorf("command \"%s\" failed", cmd)
+		for _, batch := range unbound.batches(messages) {
+			unbound.run(batch)
 		}
 	}
 	wg.Done()
 }
+
+func (unbound *Unbound) run(batch unboundBatch) {
+	cmd := exec.Command("/opt/unbound/sbin/unbound-control", batch.command)
+	cmd.Stdin = strings.NewReader(strings.Join(batch.lines, "\n") + "\n")
+	output, err := cmd.CombinedOutput()
+	if err == nil && (strings.HasPrefix(string(output), "error") || strings.Contains(string(output), "\nerror")) {
+		err = fmt.Errorf("unbound reported errors")
+	}
+	if err != nil {
+		unbound.failing = true
+		if errorLog.Allow("unbound enforcer") {
+			log.WithError(err).Errorf("command \"%s\" with %d lines failed: %s", batch.command, len(batch.lines), strings.TrimSpace(string(output)))
+		}
+	} else if unbound.failing {
+		unbound.failing = false
+		annotations.Annotate("enforcer_reconnect", "unbound-control works again")
+	}
+}
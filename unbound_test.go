@@ -0,0 +1,74 @@
+//go:build !nounbound
+// +build !nounbound
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUnboundCommands(t *testing.T) {
+	tests := []struct {
+		action BlockAction
+		target string
+		cmd    EnforcerCommand
+		want   [][]string
+	}{
+		{BlockNxdomain, "", ZoneAdd, [][]string{{"local_zone", "ads.example.", "always_nxdomain"}}},
+		{BlockNodata, "", ZoneAdd, [][]string{{"local_zone", "ads.example.", "always_nodata"}}},
+		{BlockSinkhole, "0.0.0.0", ZoneAdd, [][]string{
+			{"local_zone", "ads.example.", "redirect"},
+			{"local_data", "ads.example. A 0.0.0.0"},
+		}},
+		{BlockSinkhole, "::", ZoneAdd, [][]string{
+			{"local_zone", "ads.example.", "redirect"},
+			{"local_data", "ads.example. AAAA ::"},
+		}},
+		{BlockCname, "sinkhole.lan.", ZoneAdd, [][]string{
+			{"local_zone", "ads.example.", "redirect"},
+			{"local_data", "ads.example. CNAME sinkhole.lan."},
+		}},
+		{BlockNxdomain, "", ZoneRemove, [][]string{{"local_zone_remove", "ads.example."}}},
+		{BlockNodata, "", ZoneRemove, [][]string{{"local_zone_remove", "ads.example."}}},
+		{BlockSinkhole, "0.0.0.0", ZoneRemove, [][]string{
+			{"local_zone_remove", "ads.example."},
+			{"local_data_remove", "ads.example."},
+		}},
+		{BlockCname, "sinkhole.lan.", ZoneRemove, [][]string{
+			{"local_zone_remove", "ads.example."},
+			{"local_data_remove", "ads.example."},
+		}},
+		{BlockNxdomain, "", DataRemove, [][]string{{"local_data_remove", "ads.example."}}},
+	}
+	for _, test := range tests {
+		unbound, _ := NewUnbound(test.action, test.target)
+		message := &EnforcerCommandMessage{cmd: test.cmd, domain: "ads.example."}
+		if commands := unbound.commands(message); fmt.Sprint(commands) != fmt.Sprint(test.want) {
+			t.Errorf("%v %s with %v: got %v, want %v", test.cmd, message.domain, test.action, commands, test.want)
+		}
+	}
+}
+
+func TestUnboundBatches(t *testing.T) {
+	unbound, _ := NewUnbound(BlockSinkhole, "0.0.0.0")
+	messages := []*EnforcerCommandMessage{
+		{cmd: ZoneAdd, domain: "a.example."},
+		{cmd: ZoneAdd, domain: "b.example."},
+		{cmd: ZoneRemove, domain: "c.example."},
+		{cmd: ZoneAdd, domain: "d.example."},
+		{cmd: DataAdd, data: "host.lan. A 192.0.2.1"},
+	}
+	want := []unboundBatch{
+		{"local_zones", []string{"a.example. redirect", "b.example. redirect"}},
+		{"local_datas", []string{"a.example. A 0.0.0.0", "b.example. A 0.0.0.0"}},
+		{"local_zones_remove", []string{"c.example."}},
+		{"local_datas_remove", []string{"c.example."}},
+		{"local_zones", []string{"d.example. redirect"}},
+		{"local_datas", []string{"d.example. A 0.0.0.0"}},
+		{"local_datas", []string{"host.lan. A 192.0.2.1"}},
+	}
+	if batches := unbound.batches(messages); fmt.Sprint(batches) != fmt.Sprint(want) {
+		t.Errorf("batches() = %v, want %v", batches, want)
+	}
+}
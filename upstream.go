@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	dnstap "github.com/dnstap/golang-dnstap"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// upstreamStats counts the forwarder and resolver queries that are waiting for a
+// response.
+var upstreamStats = expvar.NewMap("upstreams")
+
+type upstreamKey struct {
+	upstream string
+	id       uint16
+	qname    string
+	qtype    uint16
+}
+
+// upstreamCountsKey is the upstream, and the zone if the stats are kept by zone, that
+// stats are kept for.
+type upstreamCountsKey struct {
+	upstream string
+	zone     string
+}
+
+type pendingQuery struct {
+	time time.Time
+	zone string
+}
+
+type upstreamCounts struct {
+	host      string
+	queries   int
+	responses int
+	timeouts  int
+	servfails int
+	latencies []float64
+}
+
+// UpstreamProcessor pairs forwarder or resolver queries with their responses and
+// writes the latency, timeout rate and SERVFAIL rate of every upstream each interval.
+// A query that hasn't been answered within the timeout counts as a timeout. Kept by
+// zone as well, the stats of the resolver queries show how reachable each
+// authoritative server of each zone is.
+type UpstreamProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	byZone      bool
+	timeout     time.Duration
+	interval    time.Duration
+	mutex       sync.Mutex
+	pending     map[upstreamKey]pendingQuery
+	counts      map[upstreamCountsKey]*upstreamCounts
+}
+
+// NewUpstreamProcessor returns a processor named name. With byZone the stats are kept
+// per dnstap query zone of every upstream.
+func NewUpstreamProcessor(name string, writeApi *api.WriteApi, measurement string, byZone bool, timeout, interval time.Duration, bufferSize uint) *UpstreamProcessor {
+	proc := &UpstreamProcessor{
+		baseProcessor: newBaseProcessor(name, bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		byZone:        byZone,
+		timeout:       timeout,
+		interval:      interval,
+		pending:       make(map[upstreamKey]pendingQuery),
+		counts:        make(map[upstreamCountsKey]*upstreamCounts),
+	}
+	pendingStat := "pending"
+	if name != "upstreams" {
+		pendingStat = name + "_pending"
+	}
+	upstreamStats.Set(pendingStat, expvar.Func(func() interface{} {
+		proc.mutex.Lock()
+		defer proc.mutex.Unlock()
+		return len(proc.pending)
+	}))
+	return proc
+}
+
+func (proc *UpstreamProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	go proc.writeLoop(ctx)
+	return nil
+}
+
+func (proc *UpstreamProcessor) run() {
+	proc.consume(proc.track)
+	proc.Flush()
+	proc.finish()
+}
+
+func (proc *UpstreamProcessor) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(proc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proc.Flush()
+		}
+	}
+}
+
+func (proc *UpstreamProcessor) upstreamCounts(upstream, zone string) *upstreamCounts {
+	key := upstreamCountsKey{upstream: upstream}
+	if proc.byZone {
+		key.zone = zone
+	}
+	counts := proc.counts[key]
+	if counts == nil {
+		counts = &upstreamCounts{}
+		proc.counts[key] = counts
+	}
+	return counts
+}
+
+func (proc *UpstreamProcessor) track(message *Message) {
+	if message.duplicate || message.dnsMessage == nil || len(message.dnsMessage.Question) == 0 ||
+		message.dnstapMessage.ResponseAddress == nil {
+		return
+	}
+	key := upstreamKey{
+		upstream: net.IP(message.dnstapMessage.ResponseAddress).String(),
+		id:       message.dnsMessage.Id,
+		qname:    message.dnsMessage.Question[0].Name,
+		qtype:    message.dnsMessage.Question[0].Qtype,
+	}
+
+	zone := queryZone(message)
+
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	counts := proc.upstreamCounts(key.upstream, zone)
+	if len(message.rhost) > 0 {
+		counts.host = message.rhost
+	}
+	switch *message.dnstapMessage.Type {
+	case dnstap.Message_FORWARDER_QUERY, dnstap.Message_RESOLVER_QUERY:
+		counts.queries++
+		proc.pending[key] = pendingQuery{time: message.timestamp, zone: zone}
+	case dnstap.Message_FORWARDER_RESPONSE, dnstap.Message_RESOLVER_RESPONSE:
+		counts.responses++
+		if message.dnsMessage.Rcode == dns.RcodeServerFailure {
+			counts.servfails++
+		}
+		// the response usually carries the query time as well, which also covers
+		// queries that were sent before we started
+		query, exists := proc.pending[key]
+		delete(proc.pending, key)
+		queryTime := query.time
+		if message.dnstapMessage.QueryTimeSec != nil && message.dnstapMessage.QueryTimeNsec != nil {
+			queryTime, exists = getTime(message.dnstapMessage.QueryTimeSec, message.dnstapMessage.QueryTimeNsec), true
+		}
+		if exists && !message.timestamp.Before(queryTime) {
+			counts.latencies = append(counts.latencies, float64(message.timestamp.Sub(queryTime))/float64(time.Millisecond))
+		}
+	}
+}
+
+// Flush counts the queries that timed out and writes the stats of every upstream seen
+// since the last flush.
+func (proc *UpstreamProcessor) Flush() {
+	now := time.Now()
+	proc.mutex.Lock()
+	for key, query := range proc.pending {
+		if now.Sub(query.time) > proc.timeout {
+			proc.upstreamCounts(key.upstream, query.zone).timeouts++
+			delete(proc.pending, key)
+		}
+	}
+	counts := proc.counts
+	proc.counts = make(map[upstreamCountsKey]*upstreamCounts)
+	proc.mutex.Unlock()
+
+	for key, upstreamCounts := range counts {
+		point := influxdb2.NewPointWithMeasurement(proc.measurement).
+			AddTag("raddress", key.upstream).
+			AddField("queries", upstreamCounts.queries).
+			AddField("responses", upstreamCounts.responses).
+			AddField("timeouts", upstreamCounts.timeouts).
+			AddField("servfails", upstreamCounts.servfails).
+			SetTime(now)
+		if len(upstreamCounts.host) > 0 {
+			point.AddTag("rhost", upstreamCounts.host)
+		}
+		if len(key.zone) > 0 {
+			point.AddTag("query_zone", key.zone)
+		}
+		if upstreamCounts.queries > 0 {
+			point.AddField("timeout_rate", float64(upstreamCounts.timeouts)/float64(upstreamCounts.queries))
+		}
+		if upstreamCounts.responses > 0 {
+			point.AddField("servfail_rate", float64(upstreamCounts.servfails)/float64(upstreamCounts.responses))
+		}
+		if latencies := upstreamCounts.latencies; len(latencies) > 0 {
+			sort.Float64s(latencies)
+			sum := 0.0
+			for _, latency := range latencies {
+				sum += latency
+			}
+			point.AddField("latency_avg_ms", sum/float64(len(latencies))).
+				AddField("latency_p50_ms", latencies[len(latencies)/2]).
+				AddField("latency_p95_ms", latencies[len(latencies)*95/100]).
+				AddField("latency_max_ms", latencies[len(latencies)-1])
+		}
+		(*proc.writeApi).WritePoint(point)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// webhookStats counts the notifications sent, failed and dropped.
+var webhookStats = expvar.NewMap("webhook")
+
+// Webhook posts alerts as JSON to a URL. Alerts are queued and sent by a single
+// goroutine; when the queue is full they are dropped rather than blocking the
+// pipeline.
+type Webhook struct {
+	url    string
+	client *http.Client
+	queue  chan interface{}
+}
+
+func NewWebhook(url string) *Webhook {
+	webhook := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan interface{}, 100),
+	}
+	go webhook.run()
+	return webhook
+}
+
+// Notify queues an alert. It is safe to call on a nil webhook, which does nothing.
+func (webhook *Webhook) Notify(alert interface{}) {
+	if webhook == nil {
+		return
+	}
+	select {
+	case webhook.queue <- alert:
+	default:
+		webhookStats.Add("dropped", 1)
+	}
+}
+
+func (webhook *Webhook) run() {
+	for alert := range webhook.queue {
+		if err := webhook.send(alert); err != nil {
+			webhookStats.Add("failed", 1)
+			if errorLog.Allow("webhook") {
+				log.WithError(err).Errorf("Failed to notify %s", webhook.url)
+			}
+			continue
+		}
+		webhookStats.Add("sent", 1)
+	}
+}
+
+func (webhook *Webhook) send(alert interface{}) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
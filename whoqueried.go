@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type whoQueriedClient struct {
+	Client   string    `json:"client"`
+	Host     string    `json:"host,omitempty"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+type whoQueriedResult struct {
+	Domain  string             `json:"domain"`
+	Window  string             `json:"window"`
+	Source  string             `json:"source"`
+	Clients []whoQueriedClient `json:"clients"`
+}
+
+// WhoQueried answers which clients queried a domain or its subdomains on
+// /whoqueried/<domain>?window=1h. It answers from the recent messages when they cover
+// the whole window, and otherwise falls back to querying InfluxDB if that is enabled.
+type WhoQueried struct {
+	recent      *RecentProcessor
+	influx      *InfluxProcessor
+	bucket      string
+	measurement string
+	fallback    bool
+}
+
+func NewWhoQueried(recent *RecentProcessor, influx *InfluxProcessor, bucket, measurement string, fallback bool) *WhoQueried {
+	return &WhoQueried{
+		recent:      recent,
+		influx:      influx,
+		bucket:      bucket,
+		measurement: measurement,
+		fallback:    fallback,
+	}
+}
+
+func (who *WhoQueried) RegisterHandlers(server *ManagementServer) {
+	server.HandleFunc("/whoqueried/", who.handler)
+}
+
+func (who *WhoQueried) handler(w http.ResponseWriter, req *http.Request) {
+	domain := dns.Fqdn(strings.ToLower(strings.TrimPrefix(req.URL.Path, "/whoqueried/")))
+	if !domainRegex.MatchString(domain) {
+		http.Error(w, "invalid domain", http.StatusBadRequest)
+		return
+	}
+	window := time.Hour
+	if value := req.URL.Query().Get("window"); len(value) > 0 {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := who.Lookup(req.Context(), domain, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// Lookup returns the clients that queried the domain within the window, busiest first.
+func (who *WhoQueried) Lookup(ctx context.Context, domain string, window time.Duration) (*whoQueriedResult, error) {
+	since := time.Now().Add(-window)
+	result := &whoQueriedResult{Domain: domain, Window: window.String()}
+	if who.recent != nil && (!who.fallback || !who.recent.Oldest().After(since)) {
+		result.Source = "memory"
+		result.Clients = who.fromRecent(domain, since)
+	} else if who.fallback {
+		result.Source = "influxdb"
+		clients, err := who.fromInflux(ctx, domain, window)
+		if err != nil {
+			return nil, err
+		}
+		result.Clients = clients
+	} else {
+		return nil, fmt.Errorf("neither recent messages (--recent) nor the influxdb fallback are enabled")
+	}
+	sort.Slice(result.Clients, func(i, j int) bool {
+		if result.Clients[i].Count != result.Clients[j].Count {
+			return result.Clients[i].Count > result.Clients[j].Count
+		}
+		return result.Clients[i].Client < result.Clients[j].Client
+	})
+	return result, nil
+}
+
+func (who *WhoQueried) fromRecent(domain string, since time.Time) []whoQueriedClient {
+	records := who.recent.Search(&recordQuery{domain: domain, since: since, limit: len(who.recent.records)})
+	byClient := make(map[string]*whoQueriedClient)
+	for _, record := range records {
+		if len(record.Client) == 0 {
+			continue
+		}
+		client := byClient[record.Client]
+		if client == nil {
+			// records are newest first
+			client = &whoQueriedClient{Client: record.Client, Host: record.Host, LastSeen: record.Time}
+			byClient[record.Client] = client
+		}
+		client.Count++
+	}
+	clients := make([]whoQueriedClient, 0, len(byClient))
+	for _, client := range byClient {
+		clients = append(clients, *client)
+	}
+	return clients
+}
+
+func (who *WhoQueried) fromInflux(ctx context.Context, domain string, window time.Duration) ([]whoQueriedClient, error) {
+	// the domain was validated, so it can't break out of the string literals
+	flux := fmt.Sprintf(`import "strings"
+from(bucket: %q)
+  |> range(start: -%ds)
+  |> filter(fn: (r) => r._measurement == %q and r._field == "id" and r.tap_type == "CLIENT_QUERY")
+  |> filter(fn: (r) => r.qname == %q or strings.hasSuffix(v: r.qname, suffix: %q))
+  |> group(columns: ["qaddress", "qhost"])
+  |> count()`, who.bucket, int64(window.Seconds()), who.measurement, domain, "."+domain)
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	result, err := who.influx.QueryApi().Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer result.Close()
+	byClient := make(map[string]*whoQueriedClient)
+	for result.Next() {
+		record := result.Record()
+		address, _ := record.ValueByKey("qaddress").(string)
+		if len(address) == 0 {
+			continue
+		}
+		client := byClient[address]
+		if client == nil {
+			client = &whoQueriedClient{Client: address}
+			byClient[address] = client
+		}
+		if host, ok := record.ValueByKey("qhost").(string); ok {
+			client.Host = host
+		}
+		if count, ok := record.ValueByKey("_value").(int64); ok {
+			client.Count += count
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	clients := make([]whoQueriedClient, 0, len(byClient))
+	for _, client := range byClient {
+		clients = append(clients, *client)
+	}
+	return clients, nil
+}
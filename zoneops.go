@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// zoneOpStats counts the zone operations seen, by operation.
+var zoneOpStats = expvar.NewMap("zone_ops")
+
+// zoneOp returns the zone operation of a message: NOTIFY, UPDATE, AXFR or IXFR, or an
+// empty string for anything else.
+func zoneOp(msg *dns.Msg) string {
+	switch msg.Opcode {
+	case dns.OpcodeNotify:
+		return "NOTIFY"
+	case dns.OpcodeUpdate:
+		return "UPDATE"
+	case dns.OpcodeQuery:
+		if len(msg.Question) > 0 && (msg.Question[0].Qtype == dns.TypeAXFR || msg.Question[0].Qtype == dns.TypeIXFR) {
+			return dns.Type(msg.Question[0].Qtype).String()
+		}
+	}
+	return ""
+}
+
+// ZoneOpAlert is sent to the webhook when a zone operation is refused, which on most
+// networks means someone is probing for transfers or updates they shouldn't get.
+type ZoneOpAlert struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Host   string    `json:"host,omitempty"`
+	Op     string    `json:"op"`
+	Zone   string    `json:"zone"`
+	Status string    `json:"status"`
+}
+
+// ZoneOpsProcessor writes a point for every NOTIFY, UPDATE, AXFR and IXFR message,
+// with whether the server refused it, since those are rare and security relevant
+// compared to standard queries.
+type ZoneOpsProcessor struct {
+	baseProcessor
+	writeApi    *api.WriteApi
+	measurement string
+	webhook     *Webhook
+}
+
+func NewZoneOpsProcessor(writeApi *api.WriteApi, measurement string, webhook *Webhook, bufferSize uint) *ZoneOpsProcessor {
+	return &ZoneOpsProcessor{
+		baseProcessor: newBaseProcessor("zone_ops", bufferSize),
+		writeApi:      writeApi,
+		measurement:   measurement,
+		webhook:       webhook,
+	}
+}
+
+func (proc *ZoneOpsProcessor) Start(ctx context.Context) error {
+	go proc.run()
+	return nil
+}
+
+func (proc *ZoneOpsProcessor) run() {
+	proc.consume(proc.record)
+	proc.finish()
+}
+
+// Flush does nothing, every operation is written as soon as it is seen.
+func (proc *ZoneOpsProcessor) Flush() {
+}
+
+func (proc *ZoneOpsProcessor) record(message *Message) {
+	if message.duplicate || message.dnsMessage == nil {
+		return
+	}
+	op := zoneOp(message.dnsMessage)
+	if len(op) == 0 {
+		return
+	}
+	zoneOpStats.Add(op, 1)
+
+	point := influxdb2.NewPointWithMeasurement(proc.measurement).
+		AddTag("tap_type", message.dnstapMessage.Type.String()).
+		AddTag("op", op).
+		SetTime(message.timestamp)
+	var zone string
+	if len(message.dnsMessage.Question) > 0 {
+		zone = strings.ToLower(message.dnsMessage.Question[0].Name)
+		point.AddTag("zone", zone)
+	}
+	var client string
+	if message.dnstapMessage.QueryAddress != nil {
+		client = net.IP(message.dnstapMessage.QueryAddress).String()
+		point.AddTag("qaddress", client)
+	}
+	if len(message.host) > 0 {
+		point.AddTag("qhost", message.host)
+	}
+
+	if message.dnsMessage.Response {
+		status := dns.RcodeToString[message.dnsMessage.Rcode]
+		refused := message.dnsMessage.Rcode == dns.RcodeRefused || message.dnsMessage.Rcode == dns.RcodeNotAuth
+		point.AddTag("status", status).
+			AddField("refused", refused).
+			AddField("answers", len(message.dnsMessage.Answer))
+		if refused {
+			zoneOpStats.Add("refused", 1)
+			log.Warnf("%s %s of %s from %s", status, op, zone, client)
+			proc.webhook.Notify(ZoneOpAlert{
+				Time:   message.timestamp,
+				Client: client,
+				Host:   message.host,
+				Op:     op,
+				Zone:   zone,
+				Status: status,
+			})
+		}
+	} else {
+		point.AddField("updates", len(message.dnsMessage.Ns))
+	}
+	(*proc.writeApi).WritePoint(point)
+}